@@ -0,0 +1,132 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+	"github.com/tetratelabs/istio-registry-sync/pkg/consul"
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+	"github.com/tetratelabs/istio-registry-sync/pkg/vault"
+)
+
+// cloudMapCredentialOptions returns the option reading Cloud Map credentials from the given files, reloaded whenever
+// they're rotated, or no option if no files are given
+func cloudMapCredentialOptions(ctx context.Context, idFile, keyFile, tokenFile string) ([]cloudmap.Option, error) {
+	if idFile == "" && keyFile == "" && tokenFile == "" {
+		return nil, nil
+	}
+	if idFile == "" || keyFile == "" {
+		return nil, errors.New("both the AWS access key ID and secret access key files must be provided")
+	}
+	id, err := secret.Watch(ctx, idFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "AWS access key ID")
+	}
+	key, err := secret.Watch(ctx, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "AWS secret access key")
+	}
+	var token *secret.File
+	if tokenFile != "" {
+		if token, err = secret.Watch(ctx, tokenFile); err != nil {
+			return nil, errors.Wrap(err, "AWS session token")
+		}
+	}
+	return []cloudmap.Option{cloudmap.WithCredentials(cloudmap.FileCredentials(id, key, token))}, nil
+}
+
+// cloudMapVaultOptions returns the option reading Cloud Map credentials generated by Vault's AWS secrets engine,
+// authenticating to Vault with the token in tokenFile unless c logs in with Kubernetes auth, or no option if c
+// names no role
+func cloudMapVaultOptions(ctx context.Context, c vault.Config, tokenFile string) ([]cloudmap.Option, error) {
+	if c.AWSRole == "" {
+		return nil, nil
+	}
+	if tokenFile != "" && c.KubernetesRole == "" {
+		token, err := secret.Watch(ctx, tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Vault token")
+		}
+		c.Token = token
+	}
+	creds, err := vault.NewAWSCredentials(c)
+	if err != nil {
+		return nil, err
+	}
+	return []cloudmap.Option{cloudmap.WithCredentials(creds)}, nil
+}
+
+// cloudMapOptions returns the option reading Cloud Map credentials from files or Vault, if either is configured
+func cloudMapOptions(ctx context.Context, idFile, keyFile, tokenFile string, c vault.Config, vaultTokenFile string) (
+	[]cloudmap.Option, error) {
+	if c.AWSRole != "" {
+		if idFile != "" || keyFile != "" || tokenFile != "" {
+			return nil, errors.New("AWS credential files and Vault cannot be combined")
+		}
+		return cloudMapVaultOptions(ctx, c, vaultTokenFile)
+	}
+	return cloudMapCredentialOptions(ctx, idFile, keyFile, tokenFile)
+}
+
+// cloudMapRoleOptions returns the option assuming role to read Cloud Map, or no option if it names no role
+func cloudMapRoleOptions(role cloudmap.AssumeRole) ([]cloudmap.Option, error) {
+	if role.ARN == "" {
+		if role.ExternalID != "" || role.SessionName != "" {
+			return nil, errors.New("an AWS role external ID or session name requires a role ARN")
+		}
+		return nil, nil
+	}
+	if !strings.HasPrefix(role.ARN, "arn:") {
+		return nil, errors.Errorf("invalid AWS role ARN %q", role.ARN)
+	}
+	return []cloudmap.Option{cloudmap.WithAssumeRole(role)}, nil
+}
+
+// cloudMapWebIdentityOptions returns the option reading Cloud Map as a role assumed with a web identity token, as
+// IAM Roles for Service Accounts mounts them, or no option if neither the token file nor the role is given
+func cloudMapWebIdentityOptions(id cloudmap.WebIdentity) ([]cloudmap.Option, error) {
+	if id.TokenFile == "" && id.RoleARN == "" {
+		return nil, nil
+	}
+	if id.TokenFile == "" || id.RoleARN == "" {
+		return nil, errors.New("both the AWS web identity token file and role ARN must be provided")
+	}
+	if !strings.HasPrefix(id.RoleARN, "arn:") {
+		return nil, errors.Errorf("invalid AWS web identity role ARN %q", id.RoleARN)
+	}
+	return []cloudmap.Option{cloudmap.WithWebIdentity(id)}, nil
+}
+
+// consulTokenOptions returns the options authenticating to Consul with the static ACL token, if not empty, and the
+// one in tokenFile, reloaded whenever it's rotated, which takes precedence
+func consulTokenOptions(ctx context.Context, token, tokenFile string) ([]consul.Option, error) {
+	var opts []consul.Option
+	if token != "" {
+		opts = append(opts, consul.WithToken(token))
+	}
+	if tokenFile == "" {
+		return opts, nil
+	}
+	f, err := secret.Watch(ctx, tokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Consul ACL token")
+	}
+	return append(opts, consul.WithTokenFile(f)), nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/bundle"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+)
+
+func dump() (dump *cobra.Command) {
+	var output string
+	dump = &cobra.Command{
+		Use:     "dump",
+		Aliases: []string{"dry-run"},
+		Short:   "Reads the registry once and prints the ServiceEntries its hosts translate to",
+		Long: `Reads the registry once and prints the ServiceEntries its hosts translate to, WorkloadEntries included.
+
+Its alias dry-run only discovers: it neither reads nor writes the cluster, so it doesn't tell which ServiceEntries a
+sync would create, update or delete. plan does.`,
+		Example: "istio-registry-sync dump --aws-region us-east-2 -o json",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return logging.LogToStderr()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "yaml" && output != "json" {
+				return errors.Errorf("unknown output format %q, must be yaml or json", output)
+			}
+			ctx := context.Background()
+			watcher, err := getWatcher(ctx)
+			if err != nil {
+				return err
+			}
+			if err := watcher.Refresh(ctx); err != nil {
+				return errors.Wrap(err, "failed to read the registry")
+			}
+
+			list := bundle.ServiceEntries(watcher.Prefix(), watcher.Store().Hosts())
+			out, err := json.MarshalIndent(list, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal ServiceEntries")
+			}
+			if output == "yaml" {
+				if out, err = yaml.JSONToYAML(out); err != nil {
+					return errors.Wrap(err, "failed to convert ServiceEntries to YAML")
+				}
+			} else {
+				out = append(out, '\n')
+			}
+			_, err = os.Stdout.Write(out)
+			return err
+		},
+	}
+	dump.Flags().StringVarP(&output, "output", "o", "yaml", "Output format, yaml or json")
+	_ = dump.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{"yaml", "json"}, cobra.ShellCompDirectiveNoFileComp))
+	addProviderFlags(dump)
+	return dump
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/bundle"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+)
+
+func export() (export *cobra.Command) {
+	var output string
+	export = &cobra.Command{
+		Use:   "export",
+		Short: "Reads the registry once and writes a support bundle of the providers' state",
+		Long: "Reads the registry once and writes a support bundle: a gzipped tarball with, per provider, its status, " +
+			"its hosts as JSON and the ServiceEntries they translate to, with addresses and hostnames redacted according " +
+			"to --log-redaction. A running instance serves the same bundle, including its recent ServiceEntry writes, " +
+			"at /debug/bundle on the admin address.",
+		Example: "istio-registry-sync export --aws-region us-east-2 --log-redaction hash -o bundle.tar.gz",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return logging.LogToStderr()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			pipelines, err := getPipelines(ctx)
+			if err != nil {
+				return err
+			}
+			bundled := make([]bundle.Pipeline, 0, len(pipelines))
+			for _, p := range pipelines {
+				// a provider that can't be read is what the bundle is meant to help with, so it's included regardless
+				if err := p.watcher.Refresh(ctx); err != nil {
+					log.Errorf("failed to read %q: %v", p.prefix, err)
+				}
+				bundled = append(bundled, bundle.Pipeline{Prefix: p.prefix, Store: p.watcher.Store()})
+			}
+
+			if output == "" {
+				output = bundle.FileName(time.Now())
+			}
+			if output == "-" {
+				return bundle.Write(os.Stdout, buildVersion, bundled)
+			}
+			f, err := os.Create(output)
+			if err != nil {
+				return errors.Wrap(err, "failed to create the bundle")
+			}
+			if err := bundle.Write(f, buildVersion, bundled); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return errors.Wrap(err, "failed to write the bundle")
+			}
+			log.Infof("Wrote support bundle to %s", output)
+			return nil
+		},
+	}
+	export.Flags().StringVarP(&output, "output", "o", "",
+		"File to write the bundle to, or - for stdout; defaults to a timestamped file in the working directory")
+	export.Flags().StringVar(&tenantsConfig, "tenants-config", "",
+		"If provided, a YAML file listing tenants, each with its own providers, to include instead of the provider flags")
+	_ = export.MarkFlagFilename("tenants-config", "yaml", "yml")
+	addProviderFlags(export)
+	return export
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+	"github.com/tetratelabs/istio-registry-sync/pkg/consul"
+	"github.com/tetratelabs/istio-registry-sync/pkg/fault"
+	"github.com/tetratelabs/istio-registry-sync/pkg/synthetic"
+)
+
+var faults fault.Config
+
+// addFaultFlags adds the flags injecting faults into the providers
+func addFaultFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().Float64Var(&faults.ErrorRate, "fault-error-rate", 0,
+		"For resilience testing only: probability, between 0 and 1, that a provider API call fails")
+	cmd.PersistentFlags().DurationVar(&faults.Latency, "fault-latency", 0,
+		"For resilience testing only: maximum random delay added to every provider API call")
+	cmd.PersistentFlags().Float64Var(&faults.PartialRate, "fault-partial-rate", 0,
+		"For resilience testing only: probability, between 0 and 1, that a provider listing returns only part of its page")
+	cmd.PersistentFlags().Int64Var(&faults.Seed, "fault-seed", 0,
+		"Seed making the injected faults reproducible; 0 seeds from the clock")
+}
+
+// faultInjector returns the injector for the provider with the given prefix, or nil if no faults are configured
+func faultInjector(prefix string) (*fault.Injector, error) {
+	if !faults.Enabled() {
+		return nil, nil
+	}
+	return fault.New(faults, prefix)
+}
+
+// cloudMapFaultOptions returns the option injecting the configured faults into Cloud Map API calls, if any
+func cloudMapFaultOptions(prefix string) ([]cloudmap.Option, error) {
+	i, err := faultInjector(prefix)
+	if err != nil || i == nil {
+		return nil, err
+	}
+	return []cloudmap.Option{cloudmap.WithClientWrapper(func(c cloudmap.ServiceDiscoveryClient) cloudmap.ServiceDiscoveryClient {
+		return fault.CloudMapClient(c, i)
+	})}, nil
+}
+
+// consulFaultOptions returns the option injecting the configured faults into Consul API calls, if any
+func consulFaultOptions(prefix string) ([]consul.Option, error) {
+	i, err := faultInjector(prefix)
+	if err != nil || i == nil {
+		return nil, err
+	}
+	return []consul.Option{consul.WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper {
+		return fault.Transport(rt, i)
+	})}, nil
+}
+
+// syntheticFaultOptions returns the option injecting the configured faults into synthetic refreshes, if any
+func syntheticFaultOptions(prefix string) ([]synthetic.Option, error) {
+	i, err := faultInjector(prefix)
+	if err != nil || i == nil {
+		return nil, err
+	}
+	return []synthetic.Option{synthetic.WithFaults(i)}, nil
+}
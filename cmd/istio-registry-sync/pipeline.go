@@ -0,0 +1,409 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+	"github.com/tetratelabs/istio-registry-sync/pkg/consul"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/servicedirectory"
+	"github.com/tetratelabs/istio-registry-sync/pkg/synthetic"
+	"github.com/tetratelabs/istio-registry-sync/pkg/tenant"
+	"github.com/tetratelabs/istio-registry-sync/pkg/vault"
+	"github.com/tetratelabs/istio-registry-sync/pkg/zookeeper"
+)
+
+// pipeline is a provider whose hosts are published as ServiceEntries with the given prefix and owner into namespace
+type pipeline struct {
+	watcher   provider.Watcher
+	owner     v1.OwnerReference
+	prefix    string
+	namespace string
+}
+
+// getPipelines returns one pipeline per provider of every tenant in --tenants-config, or outside of multi-tenant mode
+// the pipelines configured by the provider flags: one per region of --aws-regions, or else a single one
+func getPipelines(ctx context.Context) ([]pipeline, error) {
+	if tenantsConfig == "" {
+		watchers, err := getWatchers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// a distinct owner per region, as per tenant, keeps each one's ServiceEntries out of the others' reach
+		pipelines := make([]pipeline, 0, len(watchers))
+		for _, w := range watchers {
+			pipelines = append(pipelines, pipeline{
+				watcher:   w,
+				owner:     ownerReference(uuid.NewUUID()),
+				prefix:    w.Prefix(),
+				namespace: publishNamespace(),
+			})
+		}
+		return pipelines, nil
+	}
+
+	if providerPrefix != "" {
+		return nil, errors.New("--prefix doesn't apply to --tenants-config, set the tenants' prefixes instead")
+	}
+	if maxEndpoints > 0 {
+		return nil, errors.New("--max-endpoints doesn't apply to --tenants-config, set the tenants' maxEndpoints instead")
+	}
+	config, err := tenant.Load(tenantsConfig)
+	if err != nil {
+		return nil, err
+	}
+	var pipelines []pipeline
+	for _, t := range config.Tenants {
+		watchers, err := tenantWatchers(ctx, t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %q", t.Name)
+		}
+		for _, w := range watchers {
+			// a distinct owner keeps each tenant's and provider's ServiceEntries out of the others' reach
+			owner := ownerReference(uuid.NewUUID())
+			owner.Name = id + "-" + t.Name
+			pipelines = append(pipelines, pipeline{
+				watcher:   w,
+				owner:     owner,
+				prefix:    t.Prefix + w.Prefix(),
+				namespace: t.Namespace,
+			})
+			log.Infof("Tenant %q publishes %s hosts into %q", t.Name, w.Prefix(), t.Namespace)
+		}
+	}
+	return pipelines, nil
+}
+
+// tenantWatchers returns a watcher for each of the tenant's providers, sharing the tenant's endpoint budget
+func tenantWatchers(ctx context.Context, t tenant.Tenant) ([]provider.Watcher, error) {
+	var opts []provider.StoreOption
+	if t.MaxEndpoints > 0 {
+		opts = append(opts, provider.WithBudget(provider.NewBudget(t.Name, t.MaxEndpoints)))
+	}
+	var watchers []provider.Watcher
+	if c := t.CloudMap; c != nil {
+		cmWatchers, err := cloudMapWatchers(ctx, t.Prefix, "cloudmap-", c, opts)
+		if err != nil {
+			return nil, err
+		}
+		watchers = append(watchers, cmWatchers...)
+	}
+	if c := t.Consul; c != nil {
+		consulOpts, err := consulTokenOptions(ctx, c.Token, c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if c.CallTimeout.Duration > 0 {
+			consulOpts = append(consulOpts, consul.WithCallTimeout(c.CallTimeout.Duration))
+		}
+		if c.Concurrency > 0 {
+			consulOpts = append(consulOpts, consul.WithConcurrency(c.Concurrency))
+		}
+		if c.MaxBackoff.Duration > 0 {
+			consulOpts = append(consulOpts, consul.WithMaxBackoff(c.MaxBackoff.Duration))
+		}
+		consulOpts = append(consulOpts, consul.WithHealthStatus(c.HealthStatus),
+			consul.WithConsistency(c.Consistency, c.MaxStale.Duration))
+		if c.Filter != "" {
+			consulOpts = append(consulOpts, consul.WithFilter(c.Filter))
+		}
+		if c.ExcludeServices != "" || len(c.ExcludeTags) > 0 {
+			exclusions, err := consulExclusions(c.ExcludeServices, c.ExcludeTags)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid consul.excludeServices")
+			}
+			consulOpts = append(consulOpts, exclusions)
+		}
+		if c.Connect {
+			consulOpts = append(consulOpts, consul.WithConnect())
+		}
+		if c.AgentServices {
+			consulOpts = append(consulOpts, consul.WithAgentServices())
+		}
+		if c.ServiceAnnotations {
+			consulOpts = append(consulOpts, consul.WithServiceAnnotations())
+		}
+		if c.OverridesPrefix != "" {
+			consulOpts = append(consulOpts, consul.WithOverrides(c.OverridesPrefix))
+		}
+		if c.HostTemplate != "" {
+			t, err := consul.ParseHostTemplate(c.HostTemplate)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid consul.hostTemplate")
+			}
+			consulOpts = append(consulOpts, consul.WithHostTemplate(t))
+		}
+		if c.TaggedAddress != "" {
+			consulOpts = append(consulOpts, consul.WithTaggedAddress(c.TaggedAddress))
+		}
+		if c.PortTags != "" {
+			re, err := regexp.Compile(c.PortTags)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid consul.portTags")
+			}
+			consulOpts = append(consulOpts, consul.WithPortTags(re))
+		}
+		if c.ServiceWatches {
+			consulOpts = append(consulOpts, consul.WithServiceWatches())
+		}
+		if c.HealthWatch {
+			consulOpts = append(consulOpts, consul.WithHealthWatch())
+		}
+		if c.AllNamespaces {
+			consulOpts = append(consulOpts, consul.WithAllNamespaces())
+		}
+		if c.Peers {
+			consulOpts = append(consulOpts, consul.WithPeers())
+		}
+		if c.Partition != "" {
+			consulOpts = append(consulOpts, consul.WithPartition(c.Partition))
+		}
+		if c.AuthMethod != "" {
+			consulOpts = append(consulOpts, consul.WithLogin(consul.Login{AuthMethod: c.AuthMethod,
+				BearerTokenPath: c.AuthBearerTokenFile}))
+		}
+		faultOpts, err := consulFaultOptions(t.Prefix + "consul-")
+		if err != nil {
+			return nil, err
+		}
+		consulOpts = append(consulOpts, faultOpts...)
+		consulOpts = append(consulOpts, consul.WithDrops(provider.NewDrops(t.Prefix+"consul-")))
+		w, err := consul.NewWatcher(provider.NewStore(opts...), c.Endpoint, c.Namespace, consulOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "error setting up consul")
+		}
+		watchers = append(watchers, w)
+	}
+	if c := t.ServiceDirectory; c != nil {
+		sdOpts := serviceDirectoryOptions("servicedirectory-", c.CredentialsFile, c.Namespaces)
+		if c.SyncInterval.Duration > 0 {
+			sdOpts = append(sdOpts, servicedirectory.WithInterval(c.SyncInterval.Duration))
+		}
+		if c.CallTimeout.Duration > 0 {
+			sdOpts = append(sdOpts, servicedirectory.WithCallTimeout(c.CallTimeout.Duration))
+		}
+		w, err := servicedirectory.NewWatcher(ctx, provider.NewStore(opts...), c.Project, c.Region, sdOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "error setting up Service Directory")
+		}
+		watchers = append(watchers, w)
+	}
+	if c := t.Synthetic; c != nil {
+		faultOpts, err := syntheticFaultOptions(t.Prefix + "synthetic-")
+		if err != nil {
+			return nil, err
+		}
+		w, err := synthetic.NewWatcher(provider.NewStore(opts...), c.Hosts, c.Endpoints, c.Mutations, c.Interval.Duration,
+			faultOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "error setting up synthetic provider")
+		}
+		watchers = append(watchers, w)
+	}
+	if c := t.ZooKeeper; c != nil {
+		zkOpts := []zookeeper.Option{zookeeper.WithPrefix("zookeeper-"), zookeeper.WithRoot(c.Root)}
+		if c.Layout != "" {
+			zkOpts = append(zkOpts, zookeeper.WithLayout(c.Layout))
+		}
+		if c.SessionTimeout.Duration > 0 {
+			zkOpts = append(zkOpts, zookeeper.WithSessionTimeout(c.SessionTimeout.Duration))
+		}
+		w, err := zookeeper.NewWatcher(provider.NewStore(opts...), c.Servers, zkOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "error setting up ZooKeeper")
+		}
+		watchers = append(watchers, w)
+	}
+	return watchers, nil
+}
+
+// cloudMapWatchers returns a watcher of the Cloud Map registry of c, or one of each of its accounts, each with a store of
+// its own. Their ServiceEntries are prefixed with prefix, followed by the account's name and a dash for accounts.
+func cloudMapWatchers(ctx context.Context, tenantPrefix, prefix string, c *tenant.CloudMap,
+	opts []provider.StoreOption) ([]provider.Watcher, error) {
+	if len(c.Accounts) == 0 {
+		w, err := tenantCloudMapWatcher(ctx, tenantPrefix, prefix, c, c.AWS, provider.NewStore(opts...))
+		if err != nil {
+			return nil, err
+		}
+		return []provider.Watcher{w}, nil
+	}
+	watchers := make([]provider.Watcher, 0, len(c.Accounts))
+	for _, a := range c.Accounts {
+		if a.Region == "" {
+			a.Region = c.Region
+		}
+		w, err := tenantCloudMapWatcher(ctx, tenantPrefix, prefix+a.Name+"-", c, a.AWS, provider.NewStore(opts...))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cloudmap account %q", a.Name)
+		}
+		watchers = append(watchers, w)
+	}
+	return watchers, nil
+}
+
+// configWatchers returns the watchers of every Cloud Map registry in --cloudmap-config, sharing the endpoint budget of
+// opts. Each watcher's ServiceEntries are prefixed with "cloudmap-" followed by its name and a dash.
+func configWatchers(ctx context.Context, opts []provider.StoreOption) ([]provider.Watcher, error) {
+	if providerPrefix != "" {
+		return nil, errors.New("--prefix doesn't apply to --cloudmap-config, where watchers are prefixed by name")
+	}
+	config, err := tenant.LoadCloudMap(cloudMapConfig)
+	if err != nil {
+		return nil, err
+	}
+	var watchers []provider.Watcher
+	for i := range config.Watchers {
+		c := &config.Watchers[i]
+		cmWatchers, err := cloudMapWatchers(ctx, "", "cloudmap-"+c.Name+"-", &c.CloudMap, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cloudmap watcher %q", c.Name)
+		}
+		log.Infof("Cloud Map Watcher %q initialized", c.Name)
+		watchers = append(watchers, cmWatchers...)
+	}
+	return watchers, nil
+}
+
+// tenantCloudMapWatcher returns a watcher of the Cloud Map registry of c, or of one of its accounts, read in the region
+// and with the credentials of a. Its ServiceEntries are prefixed with prefix, after the tenant's.
+func tenantCloudMapWatcher(ctx context.Context, tenantPrefix, prefix string, c *tenant.CloudMap, a tenant.AWS,
+	store provider.Store) (provider.Watcher, error) {
+	var vc vault.Config
+	var vaultTokenFile string
+	if v := a.Vault; v != nil {
+		vc = vault.Config{Address: v.Address, CAFile: v.CAFile, KubernetesRole: v.KubernetesRole,
+			KubernetesMount: v.KubernetesMount, AWSMount: v.AWSMount, AWSRole: v.AWSRole}
+		vaultTokenFile = v.TokenFile
+	}
+	cmOpts, err := cloudMapOptions(ctx, a.AccessKeyIDFile, a.SecretAccessKeyFile, a.SessionTokenFile, vc, vaultTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	roleOpts, err := cloudMapRoleOptions(cloudmap.AssumeRole{ARN: a.RoleARN, ExternalID: a.ExternalID, SessionName: a.RoleSessionName})
+	if err != nil {
+		return nil, err
+	}
+	cmOpts = append(cmOpts, roleOpts...)
+	webIdentityOpts, err := cloudMapWebIdentityOptions(cloudmap.WebIdentity{RoleARN: a.WebIdentityRoleARN, TokenFile: a.WebIdentityTokenFile})
+	if err != nil {
+		return nil, err
+	}
+	cmOpts = append(cmOpts, webIdentityOpts...)
+	if c.CallTimeout.Duration > 0 {
+		cmOpts = append(cmOpts, cloudmap.WithCallTimeout(c.CallTimeout.Duration))
+	}
+	breakerFailures := c.BreakerFailures
+	if breakerFailures == 0 {
+		breakerFailures = cloudmap.DefaultBreakerFailures
+	}
+	cmOpts = append(cmOpts, cloudmap.WithRateLimit(c.RequestsPerSecond, c.RequestBurst),
+		cloudmap.WithInterval(c.SyncInterval.Duration), cloudmap.WithConcurrency(c.Concurrency),
+		cloudmap.WithCircuitBreaker(breakerFailures, c.BreakerProbeInterval.Duration),
+		cloudmap.WithIncremental(c.FullSyncInterval.Duration), cloudmap.WithInstancesTTL(c.InstancesTTL.Duration))
+	retries := cloudmap.Retries{Mode: aws.RetryMode(c.RetryMode), MaxAttempts: c.RetryMaxAttempts, MaxBackoff: c.RetryMaxBackoff.Duration}
+	if retries != (cloudmap.Retries{}) {
+		cmOpts = append(cmOpts, cloudmap.WithRetries(retries))
+	}
+	if c.EventsQueueURL != "" {
+		cmOpts = append(cmOpts, cloudmap.WithSQSEvents(c.EventsQueueURL, c.ResyncInterval.Duration))
+	}
+	if c.HealthStatus != "" {
+		health, err := cloudmap.ParseHealthStatus(c.HealthStatus)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid cloudmap.healthStatus")
+		}
+		cmOpts = append(cmOpts, cloudmap.WithHealthStatus(health))
+	}
+	if c.NamespaceLookup {
+		cmOpts = append(cmOpts, cloudmap.WithNamespaceLookup())
+	}
+	if c.PartialRefresh {
+		cmOpts = append(cmOpts, cloudmap.WithPartialRefresh())
+	}
+	if c.ServiceAnnotations {
+		cmOpts = append(cmOpts, cloudmap.WithServiceAnnotations())
+	}
+	if c.ResolveDNSNamespaces {
+		cmOpts = append(cmOpts, cloudmap.WithDNSResolution())
+	}
+	if len(c.PortAttributes) > 0 {
+		cmOpts = append(cmOpts, cloudmap.WithPortAttributes(c.PortAttributes))
+	}
+	cmOpts = append(cmOpts, cloudmap.WithWeightAttribute(c.WeightAttribute))
+	if len(c.LabelAttributes) > 0 {
+		cmOpts = append(cmOpts, cloudmap.WithLabelAttributes(c.LabelAttributes))
+	}
+	if c.EndpointURL != "" {
+		cmOpts = append(cmOpts, cloudmap.WithEndpoint(c.EndpointURL))
+	}
+	if c.FIPS {
+		cmOpts = append(cmOpts, cloudmap.WithFIPS())
+	}
+	if c.CABundleFile != "" {
+		cmOpts = append(cmOpts, cloudmap.WithCABundle(c.CABundleFile))
+	}
+	transport := cloudmap.Transport{Proxy: c.ProxyURL, DialTimeout: c.DialTimeout.Duration,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout.Duration}
+	if transport != (cloudmap.Transport{}) {
+		cmOpts = append(cmOpts, cloudmap.WithTransport(transport))
+	}
+	if c.HealthAttribute != "" {
+		unhealthy := c.UnhealthyValues
+		if len(unhealthy) == 0 {
+			unhealthy = []string{"UNHEALTHY"}
+		}
+		cmOpts = append(cmOpts, cloudmap.WithUnhealthyAttribute(c.HealthAttribute, unhealthy))
+	}
+	names, err := serviceNames(c.IncludeServices, c.ExcludeServices)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cloudmap.includeServices or cloudmap.excludeServices")
+	}
+	cmOpts = append(cmOpts, names)
+	if len(c.QueryParameters) > 0 {
+		queries := make(map[string]cloudmap.QueryParameters, len(c.QueryParameters))
+		for host, q := range c.QueryParameters {
+			queries[host] = cloudmap.QueryParameters{Query: q.Query, Optional: q.Optional}
+		}
+		cmOpts = append(cmOpts, cloudmap.WithQueryParameters(queries))
+	}
+	if c.Tag != "" {
+		tag, err := cloudmap.ParseTag(c.Tag)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid cloudmap.tag")
+		}
+		cmOpts = append(cmOpts, cloudmap.WithTag(tag))
+	}
+	faultOpts, err := cloudMapFaultOptions(tenantPrefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	cmOpts = append(cmOpts, faultOpts...)
+	cmOpts = append(cmOpts, cloudmap.WithPrefix(prefix), cloudmap.WithDrops(provider.NewDrops(tenantPrefix+prefix)),
+		cloudmap.WithNamespaces(c.Namespaces, c.ExcludeNamespaces), cloudmap.WithHostSuffixes(c.HostSuffixes))
+	w, err := cloudmap.NewWatcher(ctx, store, a.Region, a.AccessKeyID, a.SecretAccessKey, cmOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting up aws")
+	}
+	return w, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/clientset/versioned"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+func plan() (plan *cobra.Command) {
+	plan = &cobra.Command{
+		Use:     "plan",
+		Short:   "Prints the ServiceEntry changes a sync would make without applying them",
+		Example: "istio-registry-sync plan --kube-config ~/.kube/config --aws-region us-east-2",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return logging.LogToStderr()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			ic, err := istioClient()
+			if err != nil {
+				return err
+			}
+
+			watcher, err := getWatcher(ctx)
+			if err != nil {
+				return err
+			}
+			if err := watcher.Refresh(ctx); err != nil {
+				return errors.Wrap(err, "failed to read the registry")
+			}
+
+			istio, err := loadServiceEntries(ctx, ic, watcher.Prefix(), "")
+			if err != nil {
+				return err
+			}
+
+			changes := control.Plan(istio.OwnerReference(), watcher.Prefix(), watcher.Store().Hosts(), istio.Ours(), istio.Theirs())
+			var out strings.Builder
+			if err := control.WritePlan(&out, changes); err != nil {
+				return err
+			}
+			_, err = io.WriteString(os.Stdout, logging.Redact(out.String()))
+			return err
+		},
+	}
+	addKubeFlags(plan)
+	addProviderFlags(plan)
+	return plan
+}
+
+// loadServiceEntries lists the ServiceEntries in the cluster and classifies them the way the running instance with
+// our ID and prefix would. If there is no running instance, the entries are classified as owned by an instance with fallbackUID.
+func loadServiceEntries(ctx context.Context, client ic.Interface, prefix string, fallbackUID types.UID) (serviceentry.Store, error) {
+	existing, err := client.NetworkingV1alpha3().ServiceEntries(allNamespaces).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list ServiceEntries")
+	}
+	uid := runningInstanceUID(existing.Items, prefix)
+	if uid == "" {
+		uid = fallbackUID
+	}
+	istio := serviceentry.New(ownerReference(uid), serviceentry.WithPrefix(prefix))
+	for _, se := range existing.Items {
+		if err := istio.Insert(se); err != nil {
+			return nil, err
+		}
+	}
+	return istio, nil
+}
+
+// runningInstanceUID returns the owner UID of the most recently created ServiceEntry with prefix owned by an
+// instance with our ID, or an empty UID if there is none.
+func runningInstanceUID(entries []*v1alpha3.ServiceEntry, prefix string) types.UID {
+	var uid types.UID
+	var newest v1.Time
+	for _, se := range entries {
+		if !serviceentry.Named(se, prefix) {
+			continue
+		}
+		for _, ref := range se.OwnerReferences {
+			if ref.APIVersion != ownerAPIVersion || ref.Kind != ownerKind || ref.Name != id {
+				continue
+			}
+			if uid == "" || newest.Before(&se.CreationTimestamp) {
+				uid, newest = ref.UID, se.CreationTimestamp
+			}
+		}
+	}
+	return uid
+}
@@ -0,0 +1,341 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	icversioned "istio.io/client-go/pkg/clientset/versioned"
+	icinformer "istio.io/client-go/pkg/informers/externalversions/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/admin"
+	"github.com/tetratelabs/istio-registry-sync/pkg/authz"
+	"github.com/tetratelabs/istio-registry-sync/pkg/bundle"
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/destinationrule"
+	"github.com/tetratelabs/istio-registry-sync/pkg/externaldns"
+	"github.com/tetratelabs/istio-registry-sync/pkg/kubeservice"
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+	"github.com/tetratelabs/istio-registry-sync/pkg/sidecar"
+)
+
+const (
+	publishServiceEntries = "serviceentries"
+	publishServices       = "services"
+)
+
+func serve() (serve *cobra.Command) {
+
+	serve = &cobra.Command{
+		Use:     "serve",
+		Aliases: []string{"serve"},
+		Short:   "Starts the Istio Cloud Map Operator server",
+		Example: "istio-registry-sync serve --id 123",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if publishAs != publishServiceEntries && publishAs != publishServices {
+				return errors.Errorf("invalid --publish-as %q: must be %s or %s", publishAs, publishServiceEntries, publishServices)
+			}
+			egress, err := sidecar.ParseEgress(sidecarEgress)
+			if err != nil {
+				return errors.Wrap(err, "invalid --sidecar-egress")
+			}
+			if len(egress) > 0 && publishAs != publishServiceEntries {
+				return errors.New("--sidecar-egress scopes ServiceEntries, it requires --publish-as=serviceentries")
+			}
+			if tlsRules && publishAs != publishServiceEntries {
+				return errors.New("--tls-destination-rules configures ServiceEntry hosts, it requires --publish-as=serviceentries")
+			}
+			if debounce > 0 && publishAs != publishServiceEntries {
+				return errors.New("--debounce-window holds back ServiceEntry syncs, it requires --publish-as=serviceentries")
+			}
+			var policies *authz.Template
+			if policyTemplate != "" {
+				if publishAs != publishServiceEntries {
+					return errors.New("--authorization-policy-template guards ServiceEntries, it requires --publish-as=serviceentries")
+				}
+				if policies, err = authz.LoadTemplate(policyTemplate); err != nil {
+					return err
+				}
+			}
+			var (
+				ic       icversioned.Interface
+				kc       kubernetes.Interface
+				informer cache.SharedIndexInformer
+			)
+			if publishAs == publishServices || cloudMapExport {
+				if kc, err = kubeClient(); err != nil {
+					return err
+				}
+			}
+			if publishAs != publishServices {
+				if ic, err = istioClient(); err != nil {
+					return err
+				}
+				informer = icinformer.NewServiceEntryInformer(ic, allNamespaces, time.Duration(resyncPeriod)*time.Second,
+					// taken from https://github.com/istio/istio/blob/release-1.5/pilot/pkg/bootstrap/namespacecontroller.go
+					cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			}
+
+			// TODO: move over to run groups, get a context there to use to handle shutdown gracefully.
+			ctx := context.Background() // common context for cancellation across all loops/routines
+
+			pipelines, err := getPipelines(ctx)
+			if err != nil {
+				return err
+			}
+			var dnsClient dynamic.Interface
+			if externalDNS {
+				if dnsClient, err = dynamicClient(); err != nil {
+					return err
+				}
+			}
+
+			adminServer := admin.New(adminAddress)
+			if adminTLS.CertFile != "" || adminTLS.KeyFile != "" {
+				if err := adminServer.EnableTLS(ctx, adminTLS); err != nil {
+					return err
+				}
+			}
+			sources := make([]sidecar.Source, 0, len(pipelines))
+			refreshes := make([]func(context.Context) error, 0, len(pipelines))
+			bundled := make([]bundle.Pipeline, 0, len(pipelines))
+			watchers := make(map[string]provider.Watcher, len(pipelines))
+			for _, p := range pipelines {
+				p, watcher := p, p.watcher
+				go watcher.Run(ctx)
+				pipeline := bundle.Pipeline{Prefix: p.prefix, Store: watcher.Store()}
+				var sync func(context.Context) error
+				if publishAs == publishServices {
+					log.Infof("Starting Service publisher for %q", p.prefix)
+					services := kubeservice.NewPublisher(p.owner, watcher.Store(), p.prefix, kc, p.namespace,
+						kubeservice.WithStalenessThreshold(staleAfter))
+					go services.Run(ctx)
+					pipeline.Ready = services.Ready
+					sync = func(ctx context.Context) error {
+						return errors.Wrapf(services.Sync(ctx), "failed to publish Services for %q", p.prefix)
+					}
+				} else {
+					istio := serviceentry.New(p.owner, serviceentry.WithPrefix(p.prefix))
+					if debug {
+						istio = serviceentry.NewLoggingStore(istio, log.Infof)
+					}
+					serviceentry.AttachHandler(istio, informer)
+					log.Infof("Starting Synchronizer control loop for %q", p.prefix)
+
+					// we get the service entry for the pipeline's namespace for the synchronizer to publish service
+					// entries in to (if we use an `allNamespaces` client here we can't publish). Listening for
+					// ServiceEntries is done with the informer, which uses allNamespace.
+					write := ic.NetworkingV1alpha3().ServiceEntries(p.namespace)
+					synchronizer := control.NewSynchronizer(p.owner, istio, watcher.Store(), p.prefix, write,
+						control.WithFlapDamping(dampingCycles), control.WithStalenessThreshold(staleAfter),
+						control.WithDebounce(debounce, debounceMax))
+					go synchronizer.Run(ctx)
+					pipeline.Ready, pipeline.Audit = synchronizer.Ready, synchronizer.Audit
+					sync = func(ctx context.Context) error {
+						synchronizer.Sync(ctx)
+						return nil
+					}
+				}
+				if tlsRules {
+					destinationRules := destinationrule.NewPublisher(p.owner, watcher.Store(), p.prefix,
+						ic.NetworkingV1alpha3().DestinationRules(p.namespace),
+						destinationrule.WithStalenessThreshold(staleAfter))
+					go destinationRules.Run(ctx)
+				}
+				if policies != nil {
+					authorization := authz.NewPublisher(p.owner, watcher.Store(), p.prefix, p.namespace, policies,
+						ic.SecurityV1beta1(), authz.WithStalenessThreshold(staleAfter))
+					go authorization.Run(ctx)
+				}
+				if dnsClient != nil {
+					dns := externaldns.NewPublisher(p.owner, watcher.Store(), p.prefix,
+						dnsClient.Resource(externaldns.Resource).Namespace(p.namespace),
+						externaldns.WithTTL(int64(externalDNSTTL/time.Second)),
+						externaldns.WithStalenessThreshold(staleAfter))
+					go dns.Run(ctx)
+				}
+
+				sources = append(sources, sidecar.Source{Namespace: p.namespace, Store: watcher.Store()})
+				metrics.RegisterStaleness(p.prefix, watcher.Store().LastSync)
+				adminServer.AddReadinessCheck(p.prefix, pipeline.Ready)
+				if r, ok := watcher.(provider.Readier); ok {
+					adminServer.AddReadinessCheck(p.prefix+"registry", r.Ready)
+				}
+				bundled = append(bundled, pipeline)
+				watchers[p.prefix] = watcher
+				refreshes = append(refreshes, func(ctx context.Context) error {
+					if err := watcher.Refresh(ctx); err != nil {
+						return errors.Wrapf(err, "failed to refresh %q", p.prefix)
+					}
+					return sync(ctx)
+				})
+			}
+			if len(egress) > 0 {
+				// a single Sidecar per namespace grants the hosts of every pipeline
+				owner := ownerReference(uuid.NewUUID())
+				sidecars := sidecar.NewPublisher(owner, sources, egress, ic.NetworkingV1alpha3(),
+					sidecar.WithBaseHosts(sidecarBaseHosts))
+				go sidecars.Run(ctx)
+			}
+			refresh := func(ctx context.Context) error {
+				var failures []string
+				for _, r := range refreshes {
+					if err := r(ctx); err != nil {
+						failures = append(failures, err.Error())
+					}
+				}
+				if len(failures) > 0 {
+					return errors.New(strings.Join(failures, "; "))
+				}
+				return nil
+			}
+			adminServer.HandleRefresh(refresh)
+			adminServer.Handle("/debug/bundle", bundle.Handler(buildVersion, bundled))
+			adminServer.Handle("/debug/dropped", provider.DroppedHandler(watchers))
+			go refreshOnSignal(ctx, refresh)
+			if cloudMapExport {
+				client, err := cloudMapRegistrationClient(ctx)
+				if err != nil {
+					return errors.Wrap(err, "failed to set up the Cloud Map exporter")
+				}
+				log.Info("Exporting annotated Services to Cloud Map")
+				go cloudmap.NewExporter(client, kc, id, cloudmap.WithExportInterval(exportInterval)).Run(ctx)
+			}
+			go reloadOnSignal(ctx)
+			go func() {
+				if err := adminServer.Run(ctx); err != nil {
+					log.Errorf("%v", err)
+				}
+			}()
+
+			if informer == nil {
+				log.Infof("Publishing Services with id %q", id)
+				<-ctx.Done()
+				return nil
+			}
+			log.Infof("Watching %s.%s across all namespaces with resync period %d and id %q", apiType, kind, resyncPeriod, id)
+			informer.Run(ctx.Done())
+			return nil
+		},
+	}
+
+	addKubeFlags(serve)
+	addPublishFlags(serve)
+	addProviderFlags(serve)
+	serve.PersistentFlags().IntVar(&resyncPeriod, "resync-period", 5, "Time in seconds between resyncs")
+	serve.PersistentFlags().StringVar(&adminAddress, "admin-address", ":9090",
+		"Address to serve the metrics (/metrics) and admin endpoints on")
+	serve.PersistentFlags().StringVar(&adminTLS.CertFile, "admin-tls-cert-file", "",
+		"If provided with --admin-tls-key-file, serve the admin endpoints over TLS with the PEM certificate chain in this file; reloaded when it changes")
+	serve.PersistentFlags().StringVar(&adminTLS.KeyFile, "admin-tls-key-file", "",
+		"PEM key of --admin-tls-cert-file; reloaded when it changes")
+	serve.PersistentFlags().StringVar(&adminTLS.ClientCAFile, "admin-tls-client-ca-file", "",
+		"If provided, require a client certificate signed by one of the CAs in this PEM file for every admin endpoint but /healthz and /readyz; reloaded when it changes")
+	serve.PersistentFlags().StringSliceVar(&adminTLS.SPIFFEIDs, "admin-tls-spiffe-ids", nil,
+		"If provided, only admit client certificates carrying one of these SPIFFE IDs, or any ID of a trust domain given as spiffe://<trust domain>")
+	serve.PersistentFlags().IntVar(&dampingCycles, "flap-damping-cycles", 0,
+		"If greater than 1, a change to a host's endpoints is only published once it has been observed for this many consecutive sync cycles; hosts flapping back to their previous state keep it")
+	serve.PersistentFlags().DurationVar(&debounce, "debounce-window", 0,
+		"If set, hold back publishing changes to ServiceEntries while the provider keeps changing, until it has been quiet for this long (e.g. 15s), so bursts such as rolling deploys are published at once")
+	serve.PersistentFlags().DurationVar(&debounceMax, "debounce-max-delay", 2*time.Minute,
+		"The longest --debounce-window holds back a change while the provider keeps changing; zero for no limit")
+	serve.PersistentFlags().StringVar(&policyTemplate, "authorization-policy-template", "",
+		"If provided, a Go template of the YAML of an AuthorizationPolicy to keep for every host, named and owned like its ServiceEntry; it can refer to {{ .Host }}, {{ .Name }} and {{ .Namespace }}")
+	_ = serve.MarkPersistentFlagFilename("authorization-policy-template", "yaml", "yml")
+	serve.PersistentFlags().BoolVar(&externalDNS, "external-dns", false,
+		"If true, also publish an ExternalDNS DNSEndpoint per host, named and owned like its ServiceEntry, so ExternalDNS can make registry hosts resolvable outside the mesh")
+	serve.PersistentFlags().DurationVar(&externalDNSTTL, "external-dns-ttl", 0,
+		"TTL of the records published with --external-dns, e.g. 5m; the DNS provider's default if unset")
+	serve.PersistentFlags().StringVar(&publishAs, "publish-as", publishServiceEntries,
+		"What to publish registry hosts as: serviceentries for Istio ServiceEntries, or services for headless Kubernetes Services and EndpointSlices, for clients outside the mesh")
+	_ = serve.RegisterFlagCompletionFunc("publish-as", cobra.FixedCompletions(
+		[]string{publishServiceEntries, publishServices}, cobra.ShellCompDirectiveNoFileComp))
+	serve.PersistentFlags().StringSliceVar(&sidecarEgress, "sidecar-egress", nil,
+		"If provided, keep a namespace-wide Sidecar in each namespace listed as <namespace>=<host pattern>, whose egress only allows the registry hosts matching the namespace's patterns, e.g. payments=*.billing.svc")
+	serve.PersistentFlags().StringSliceVar(&sidecarBaseHosts, "sidecar-egress-base-hosts", sidecar.DefaultBaseHosts,
+		"Egress hosts the Sidecars of --sidecar-egress allow besides registry hosts")
+	serve.PersistentFlags().BoolVar(&tlsRules, "tls-destination-rules", false,
+		"If true, publish a DestinationRule, named and owned like its ServiceEntry, with the TLS settings of every host whose provider metadata says it speaks TLS")
+	serve.PersistentFlags().StringVar(&tenantsConfig, "tenants-config", "",
+		"If provided, a YAML file listing tenants, each with its own providers, ServiceEntry prefix and namespace, to serve instead of the provider flags")
+	_ = serve.MarkPersistentFlagFilename("tenants-config", "yaml", "yml")
+	serve.PersistentFlags().BoolVar(&cloudMapExport, "cloudmap-export", false,
+		"If true, also register the ready endpoints of the Kubernetes Services annotated with "+cloudmap.ExportAnnotation+
+			" as instances of the Cloud Map service it names, e.g. web.apps.local, in --aws-region")
+	serve.PersistentFlags().DurationVar(&exportInterval, "cloudmap-export-interval", 30*time.Second,
+		"How often --cloudmap-export registers and deregisters instances")
+	serve.PersistentFlags().DurationVar(&staleAfter, "staleness-threshold", 0,
+		"If set, readiness fails and garbage collection of Service Entries and the other published resources is suspended while the provider hasn't synced successfully for longer than this (e.g. 5m)")
+	return serve
+}
+
+// refreshOnSignal calls refresh every time the process receives SIGUSR1, until the context is cancelled
+func refreshOnSignal(ctx context.Context, refresh func(context.Context) error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			log.Info("Received SIGUSR1, refreshing providers")
+			if err := refresh(ctx); err != nil {
+				log.Errorf("error refreshing providers: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadOnSignal re-reads every watched credential file every time the process receives SIGHUP, until the context is
+// cancelled
+func reloadOnSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			log.Info("Received SIGHUP, reloading credential files")
+			secret.ReloadAll()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cloudMapRegistrationClient returns the Cloud Map client of --aws-region the AWS flags configure, for the exporter
+func cloudMapRegistrationClient(ctx context.Context) (cloudmap.RegistrationClient, error) {
+	opts, err := cloudMapClientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cloudmap.NewRegistrationClient(ctx, awsRegion, awsID, awsSecret, opts...)
+}
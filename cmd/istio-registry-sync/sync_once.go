@@ -0,0 +1,187 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+// exitChanged is sync-once's exit code with --detailed-exitcode when changes were applied
+const exitChanged = 2
+
+// exitCodeError makes main exit with the given code without logging an error
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit code %d", int(e))
+}
+
+// exitCode returns the code main exits with after err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var code exitCodeError
+	if errors.As(err, &code) {
+		return int(code)
+	}
+	return 1
+}
+
+// syncSummary is the machine readable outcome of sync-once
+type syncSummary struct {
+	Changed         bool     `json:"changed"`
+	Created         []string `json:"created"`
+	Updated         []string `json:"updated"`
+	Deleted         []string `json:"deleted"`
+	Errors          []string `json:"errors"`
+	DurationSeconds float64  `json:"durationSeconds"`
+}
+
+func syncOnce() (syncOnce *cobra.Command) {
+	var (
+		timeout          time.Duration
+		detailedExitCode bool
+		summary          bool
+	)
+	syncOnce = &cobra.Command{
+		Use:   "sync-once",
+		Short: "Reads the registry once, reconciles the ServiceEntries with it and exits",
+		Long: `Reads the registry once, reconciles the ServiceEntries with it and exits; suited to running as a Kubernetes CronJob.
+
+Exits with 1 if the registry couldn't be read or any ServiceEntry failed to change. With --detailed-exitcode, exits
+with 0 if nothing changed and 2 if changes were applied.`,
+		Example: "istio-registry-sync sync-once --kube-config ~/.kube/config --aws-region us-east-2 --timeout 2m --summary",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if summary {
+				return logging.LogToStderr()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSyncOnce(cmd, reconcileOnce, timeout, detailedExitCode, summary)
+		},
+	}
+	syncOnce.Flags().DurationVar(&timeout, "timeout", 5*time.Minute,
+		"Maximum total runtime, after which the sync is abandoned and reported as failed; 0 disables the limit")
+	syncOnce.Flags().BoolVar(&detailedExitCode, "detailed-exitcode", false,
+		"Exit with 2 if changes were applied, 0 if there were none, and 1 on errors")
+	syncOnce.Flags().BoolVar(&summary, "summary", false,
+		"Print a JSON summary of the changes and errors to stdout, sending logs to stderr")
+	addKubeFlags(syncOnce)
+	addPublishFlags(syncOnce)
+	addProviderFlags(syncOnce)
+	return syncOnce
+}
+
+// runSyncOnce runs reconcile within timeout, unless it's zero, writes the summary if asked to, and returns the error
+// sync-once exits with
+func runSyncOnce(cmd *cobra.Command, reconcile func(context.Context) (control.Result, error), timeout time.Duration,
+	detailedExitCode, summary bool) error {
+	start := time.Now()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	res, err := reconcile(ctx)
+	if err != nil {
+		res.Errors = append(res.Errors, err)
+	}
+	if summary {
+		if err := writeSyncSummary(cmd, res, time.Since(start)); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(res.Errors) == 1:
+		return res.Errors[0]
+	case len(res.Errors) > 1:
+		return errors.Errorf("%d errors, the first: %v", len(res.Errors), res.Errors[0])
+	case detailedExitCode && res.Changed():
+		return exitCodeError(exitChanged)
+	}
+	log.Infof("sync finished: %d created, %d updated, %d deleted", len(res.Created), len(res.Updated), len(res.Deleted))
+	return nil
+}
+
+// reconcileOnce reads the registry and reconciles the ServiceEntries with it
+func reconcileOnce(ctx context.Context) (control.Result, error) {
+	ic, err := istioClient()
+	if err != nil {
+		return control.Result{}, err
+	}
+
+	watcher, err := getWatcher(ctx)
+	if err != nil {
+		return control.Result{}, err
+	}
+	if err := watcher.Refresh(ctx); err != nil {
+		return control.Result{}, errors.Wrap(err, "failed to read the registry")
+	}
+
+	// adopt the running instance's ownership so we don't fight over its entries
+	istio, err := loadServiceEntries(ctx, ic, watcher.Prefix(), uuid.NewUUID())
+	if err != nil {
+		return control.Result{}, err
+	}
+	if debug {
+		istio = serviceentry.NewLoggingStore(istio, log.Infof)
+	}
+	write := ic.NetworkingV1alpha3().ServiceEntries(publishNamespace())
+	return control.NewSynchronizer(istio.OwnerReference(), istio, watcher.Store(), watcher.Prefix(), write).Sync(ctx), nil
+}
+
+func writeSyncSummary(cmd *cobra.Command, res control.Result, took time.Duration) error {
+	s := syncSummary{
+		Changed:         res.Changed(),
+		Created:         redactAll(res.Created),
+		Updated:         redactAll(res.Updated),
+		Deleted:         redactAll(res.Deleted),
+		Errors:          make([]string, 0, len(res.Errors)),
+		DurationSeconds: took.Seconds(),
+	}
+	for _, err := range res.Errors {
+		s.Errors = append(s.Errors, logging.Redact(err.Error()))
+	}
+	out, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the summary")
+	}
+	_, err = fmt.Fprintln(cmd.OutOrStdout(), string(out))
+	return err
+}
+
+// redactAll returns a copy of names, redacted as configured by --log-redaction
+func redactAll(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		out = append(out, logging.Redact(name))
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+)
+
+func TestRunSyncOnce(t *testing.T) {
+	result := func(res control.Result, err error) func(context.Context) (control.Result, error) {
+		return func(context.Context) (control.Result, error) { return res, err }
+	}
+	created := control.Result{Created: []string{"cloudmap-a.tetrate.io"}}
+	failed := control.Result{Updated: []string{"cloudmap-a.tetrate.io"}, Errors: []error{errors.New("conflict")}}
+	tests := []struct {
+		name             string
+		reconcile        func(context.Context) (control.Result, error)
+		timeout          time.Duration
+		detailedExitCode bool
+		wantCode         int
+		want             map[string]interface{} // summary, but for its duration
+	}{
+		{
+			name:      "no change",
+			reconcile: result(control.Result{}, nil),
+			wantCode:  0,
+			want: map[string]interface{}{"changed": false, "created": []interface{}{}, "updated": []interface{}{},
+				"deleted": []interface{}{}, "errors": []interface{}{}},
+		},
+		{
+			name:      "changes",
+			reconcile: result(created, nil),
+			wantCode:  0,
+			want: map[string]interface{}{"changed": true, "created": []interface{}{"cloudmap-a.tetrate.io"},
+				"updated": []interface{}{}, "deleted": []interface{}{}, "errors": []interface{}{}},
+		},
+		{
+			name:             "no change with a detailed exit code",
+			reconcile:        result(control.Result{}, nil),
+			detailedExitCode: true,
+			wantCode:         0,
+			want: map[string]interface{}{"changed": false, "created": []interface{}{}, "updated": []interface{}{},
+				"deleted": []interface{}{}, "errors": []interface{}{}},
+		},
+		{
+			name:             "changes with a detailed exit code",
+			reconcile:        result(created, nil),
+			detailedExitCode: true,
+			wantCode:         exitChanged,
+			want: map[string]interface{}{"changed": true, "created": []interface{}{"cloudmap-a.tetrate.io"},
+				"updated": []interface{}{}, "deleted": []interface{}{}, "errors": []interface{}{}},
+		},
+		{
+			name:             "errors win over changes",
+			reconcile:        result(failed, nil),
+			detailedExitCode: true,
+			wantCode:         1,
+			want: map[string]interface{}{"changed": true, "created": []interface{}{},
+				"updated": []interface{}{"cloudmap-a.tetrate.io"}, "deleted": []interface{}{},
+				"errors": []interface{}{"conflict"}},
+		},
+		{
+			name:             "registry unreadable",
+			reconcile:        result(control.Result{}, errors.New("failed to read the registry")),
+			detailedExitCode: true,
+			wantCode:         1,
+			want: map[string]interface{}{"changed": false, "created": []interface{}{}, "updated": []interface{}{},
+				"deleted": []interface{}{}, "errors": []interface{}{"failed to read the registry"}},
+		},
+		{
+			name: "timeout",
+			reconcile: func(ctx context.Context) (control.Result, error) {
+				<-ctx.Done()
+				return control.Result{}, ctx.Err()
+			},
+			timeout:  10 * time.Millisecond,
+			wantCode: 1,
+			want: map[string]interface{}{"changed": false, "created": []interface{}{}, "updated": []interface{}{},
+				"deleted": []interface{}{}, "errors": []interface{}{context.DeadlineExceeded.Error()}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cmd := &cobra.Command{}
+			cmd.SetOut(&out)
+			err := runSyncOnce(cmd, tt.reconcile, tt.timeout, tt.detailedExitCode, true)
+			if got := exitCode(err); got != tt.wantCode {
+				t.Errorf("exit code = %d (error %v), want %d", got, err, tt.wantCode)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("invalid summary %q: %v", out.String(), err)
+			}
+			if took, ok := got["durationSeconds"].(float64); !ok || took < tt.timeout.Seconds() {
+				t.Errorf("durationSeconds = %v, want at least %v", got["durationSeconds"], tt.timeout.Seconds())
+			}
+			delete(got, "durationSeconds")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summary = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
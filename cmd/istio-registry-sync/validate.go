@@ -0,0 +1,140 @@
+// Copyright 2018 Tetrate Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	authv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// check is a named preflight check run by validate
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func validate() (validate *cobra.Command) {
+	validate = &cobra.Command{
+		Use:     "validate",
+		Short:   "Checks the registry and cluster are reachable with the required permissions before starting the server",
+		Example: "istio-registry-sync validate --kube-config ~/.kube/config --aws-region us-east-2",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// later checks use what earlier ones set up, and are skipped when it's missing
+			var cfg *rest.Config
+			var watchers []provider.Watcher
+			checks := []check{
+				{name: "kubernetes config", run: func(context.Context) (err error) {
+					cfg, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
+					return errors.Wrapf(err, "failed to load the kube config %q", kubeConfig)
+				}},
+				{name: "kubernetes RBAC", run: func(ctx context.Context) error {
+					if cfg == nil {
+						return errors.New("skipped, the kube config is invalid")
+					}
+					return checkServiceEntryAccess(ctx, cfg, publishNamespace())
+				}},
+				{name: "provider config", run: func(ctx context.Context) (err error) {
+					watchers, err = getWatchers(ctx)
+					return err
+				}},
+				{name: "provider access", run: func(ctx context.Context) error {
+					if watchers == nil {
+						return errors.New("skipped, the provider config is invalid")
+					}
+					for _, w := range watchers {
+						if c, ok := w.(provider.Checker); ok {
+							if err := c.Check(ctx); err != nil && len(watchers) > 1 {
+								return errors.Wrapf(err, "%q", w.Prefix())
+							} else if err != nil {
+								return err
+							}
+						}
+					}
+					return nil
+				}},
+			}
+
+			ctx := context.Background()
+			failed := 0
+			for _, c := range checks {
+				if err := c.run(ctx); err != nil {
+					failed++
+					fmt.Fprintf(cmd.OutOrStdout(), "FAIL %s: %v\n", c.name, err)
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "PASS %s\n", c.name)
+			}
+			if failed > 0 {
+				return errors.Errorf("%d of %d checks failed", failed, len(checks))
+			}
+			return nil
+		},
+	}
+	addKubeFlags(validate)
+	addPublishFlags(validate)
+	addProviderFlags(validate)
+	return validate
+}
+
+// checkServiceEntryAccess asks the API server whether we may watch ServiceEntries across the cluster and manage them
+// in the namespace we publish to, reporting every missing permission
+func checkServiceEntryAccess(ctx context.Context, cfg *rest.Config, publishNamespace string) error {
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to create a kube client from the k8s rest config")
+	}
+	required := []authv1.ResourceAttributes{
+		{Verb: "list"},
+		{Verb: "watch"},
+		{Verb: "get", Namespace: publishNamespace},
+		{Verb: "create", Namespace: publishNamespace},
+		{Verb: "update", Namespace: publishNamespace},
+		{Verb: "delete", Namespace: publishNamespace},
+	}
+	var missing []string
+	for _, attrs := range required {
+		attrs := attrs
+		attrs.Group, attrs.Resource = apiGroup, "serviceentries"
+		review := &authv1.SelfSubjectAccessReview{Spec: authv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attrs}}
+		resp, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, v1.CreateOptions{})
+		if err != nil {
+			return errors.Wrap(err, "failed to review our access to ServiceEntries")
+		}
+		if resp.Status.Allowed {
+			continue
+		}
+		where := "all namespaces"
+		if attrs.Namespace != allNamespaces {
+			where = fmt.Sprintf("namespace %q", attrs.Namespace)
+		}
+		missing = append(missing, fmt.Sprintf("%s in %s", attrs.Verb, where))
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("missing ServiceEntry permissions: %s; bind a role like the one in kubernetes/rbac.yaml",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Server serves the operator's metrics and administrative endpoints over HTTP
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+
+	m      sync.RWMutex
+	checks map[string]func() error // readiness checks by name
+
+	tlsConfig *tls.Config
+	// authenticate, if set, admits requests to all but the unauthenticated paths, or returns the status to reject with
+	authenticate func(*http.Request) (int, error)
+}
+
+// New returns a Server listening on addr with the metrics endpoint registered at /metrics,
+// liveness and readiness endpoints at /healthz and /readyz, and log levels at /logging
+func New(addr string) *Server {
+	s := &Server{addr: addr, mux: http.NewServeMux(), checks: make(map[string]func() error)}
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	s.mux.HandleFunc("/readyz", s.ready)
+	s.mux.HandleFunc("/logging", logLevels)
+	return s
+}
+
+// AddReadinessCheck registers a check that must pass for /readyz to report ready
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.checks[name] = check
+}
+
+// HandleRefresh serves POST /refresh by calling refresh, reporting its error if any
+func (s *Server) HandleRefresh(refresh func(context.Context) error) {
+	s.mux.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "refresh must be requested with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := refresh(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// Handle registers an additional handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run serves until the context is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Wrapf(err, "admin server failed to listen on %s", s.addr)
+	}
+	return s.serve(ctx, l)
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s.handler(), TLSConfig: s.tlsConfig}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("error shutting down admin server: %v", err)
+		}
+	}()
+
+	var err error
+	if s.tlsConfig != nil {
+		log.Infof("Serving admin endpoints over TLS on %s", l.Addr())
+		// the certificate comes from the TLS config
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		log.Infof("Serving admin endpoints on %s", l.Addr())
+		err = srv.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Wrapf(err, "admin server failed on %s", l.Addr())
+	}
+	return nil
+}
+
+// handler serves the endpoints, authenticating clients if required
+func (s *Server) handler() http.Handler {
+	if s.authenticate == nil {
+		return s.mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !unauthenticated[r.URL.Path] {
+			if code, err := s.authenticate(r); err != nil {
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
+		s.mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) ready(w http.ResponseWriter, _ *http.Request) {
+	s.m.RLock()
+	names := make([]string, 0, len(s.checks))
+	checks := make(map[string]func() error, len(s.checks))
+	for name, check := range s.checks {
+		names = append(names, name)
+		checks[name] = check
+	}
+	s.m.RUnlock()
+	sort.Strings(names)
+
+	var failures []string
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, f := range failures {
+			fmt.Fprintln(w, f)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// logLevels lists the level of every log scope on GET, and applies the level specification in the level query
+// parameter (e.g. "info,cloudmap:debug") on PUT
+func logLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if err := logging.Configure(r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		http.Error(w, "log levels must be read with GET or changed with PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	levels := logging.Levels()
+	for _, name := range logging.ScopeNames() {
+		fmt.Fprintf(w, "%s: %s\n", name, levels[name])
+	}
+}
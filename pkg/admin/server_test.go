@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+)
+
+func TestServer_readyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		checks   map[string]func() error
+		wantCode int
+		wantBody string
+	}{
+		{name: "ready without checks", wantCode: http.StatusOK, wantBody: "ok\n"},
+		{
+			name:     "ready when all checks pass",
+			checks:   map[string]func() error{"cloudmap-": func() error { return nil }},
+			wantCode: http.StatusOK,
+			wantBody: "ok\n",
+		},
+		{
+			name: "not ready when a check fails",
+			checks: map[string]func() error{
+				"cloudmap-": func() error { return nil },
+				"consul-":   func() error { return errors.New("stale") },
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "consul-: stale\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(":0")
+			for name, check := range tt.checks {
+				s.AddReadinessCheck(name, check)
+			}
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("/readyz code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("/readyz body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServer_refresh(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		err        error
+		wantCode   int
+		wantCalled bool
+	}{
+		{name: "refreshes on POST", method: http.MethodPost, wantCode: http.StatusOK, wantCalled: true},
+		{name: "reports refresh errors", method: http.MethodPost, err: errors.New("bang"), wantCode: http.StatusInternalServerError, wantCalled: true},
+		{name: "rejects GET", method: http.MethodGet, wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			s := New(":0")
+			s.HandleRefresh(func(context.Context) error {
+				called = true
+				return tt.err
+			})
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, httptest.NewRequest(tt.method, "/refresh", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("/refresh code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("refresh called = %v, want %v", called, tt.wantCalled)
+			}
+			if tt.err != nil && !strings.Contains(rec.Body.String(), tt.err.Error()) {
+				t.Errorf("/refresh body = %q, want it to contain %q", rec.Body.String(), tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestServer_logging(t *testing.T) {
+	logging.RegisterScope("admin-test")
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		wantCode int
+		wantLine string
+	}{
+		{name: "lists levels", method: http.MethodGet, wantCode: http.StatusOK, wantLine: "admin-test: info"},
+		{name: "changes levels", method: http.MethodPut, query: "?level=info,admin-test:debug", wantCode: http.StatusOK, wantLine: "admin-test: debug"},
+		{name: "rejects unknown levels", method: http.MethodPut, query: "?level=loud", wantCode: http.StatusBadRequest},
+		{name: "rejects POST", method: http.MethodPost, wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logging.SetAllLevels(logging.InfoLevel)
+			s := New(":0")
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, httptest.NewRequest(tt.method, "/logging"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("/logging code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantLine != "" && !strings.Contains(rec.Body.String(), tt.wantLine+"\n") {
+				t.Errorf("/logging body = %q, want it to contain %q", rec.Body.String(), tt.wantLine)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+)
+
+// TLS configures serving the admin endpoints over TLS, and optionally authenticating clients by certificate
+type TLS struct {
+	// CertFile and KeyFile hold the server's PEM encoded certificate chain and key; both are reloaded when rotated
+	CertFile, KeyFile string
+	// ClientCAFile, if set, holds the CAs client certificates must be signed by; reloaded when rotated
+	ClientCAFile string
+	// SPIFFEIDs, if set, only admits clients whose certificate carries one of these SPIFFE IDs, or any SPIFFE ID of
+	// a trust domain listed as spiffe://<trust domain>
+	SPIFFEIDs []string
+}
+
+// unauthenticated paths are served to clients without a certificate, so kubelet can probe them
+var unauthenticated = map[string]bool{"/healthz": true, "/readyz": true}
+
+// EnableTLS serves over TLS as configured by c from the next Run. With a client CA, every endpoint but /healthz and
+// /readyz requires a client certificate signed by it. Files are watched until ctx is cancelled.
+func (s *Server) EnableTLS(ctx context.Context, c TLS) error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("both a certificate and a key file are required to serve TLS")
+	}
+	if len(c.SPIFFEIDs) > 0 && c.ClientCAFile == "" {
+		return errors.New("a client CA file is required to verify SPIFFE IDs")
+	}
+	for _, id := range c.SPIFFEIDs {
+		if !strings.HasPrefix(id, "spiffe://") {
+			return errors.Errorf("%q is not a SPIFFE ID", id)
+		}
+	}
+	cert, err := newCertificate(ctx, c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cert.get}
+	if c.ClientCAFile != "" {
+		pool, err := newCertPool(ctx, c.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		// certificates are verified if given, and required by authenticate for all but the probes
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config.Clone()
+			c.ClientCAs = pool.get()
+			return c, nil
+		}
+		s.authenticate = func(r *http.Request) (int, error) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				return http.StatusUnauthorized, errors.New("a client certificate is required")
+			}
+			if len(c.SPIFFEIDs) > 0 && !spiffeIDAllowed(r.TLS.VerifiedChains[0][0], c.SPIFFEIDs) {
+				return http.StatusForbidden, errors.New("the client certificate's SPIFFE ID is not allowed")
+			}
+			return http.StatusOK, nil
+		}
+	}
+	s.tlsConfig = config
+	return nil
+}
+
+// spiffeIDAllowed returns whether cert carries one of the allowed SPIFFE IDs, or an ID in an allowed trust domain
+func spiffeIDAllowed(cert *x509.Certificate, allowed []string) bool {
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		id := uri.String()
+		for _, a := range allowed {
+			if id == a || a == "spiffe://"+uri.Host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certificate holds the latest valid key pair loaded from a certificate and key file
+type certificate struct {
+	cert, key *secret.File
+
+	m    sync.RWMutex
+	pair *tls.Certificate
+}
+
+func newCertificate(ctx context.Context, certFile, keyFile string) (*certificate, error) {
+	cert, err := secret.Watch(ctx, certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "admin TLS certificate")
+	}
+	key, err := secret.Watch(ctx, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "admin TLS key")
+	}
+	c := &certificate{cert: cert, key: key}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	// the certificate and key are replaced one after the other, so a mismatch is expected halfway through
+	reload := func() {
+		if err := c.load(); err != nil {
+			log.Warnf("keeping the previous admin TLS certificate: %v", err)
+		}
+	}
+	cert.OnChange(reload)
+	key.OnChange(reload)
+	return c, nil
+}
+
+func (c *certificate) load() error {
+	pair, err := tls.X509KeyPair([]byte(c.cert.Value()), []byte(c.key.Value()))
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the admin TLS key pair from %q and %q", c.cert.Path(), c.key.Path())
+	}
+	c.m.Lock()
+	c.pair = &pair
+	c.m.Unlock()
+	return nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.pair, nil
+}
+
+// certPool holds the latest CAs loaded from a PEM bundle
+type certPool struct {
+	file *secret.File
+
+	m    sync.RWMutex
+	pool *x509.CertPool
+}
+
+func newCertPool(ctx context.Context, path string) (*certPool, error) {
+	f, err := secret.Watch(ctx, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "admin TLS client CA")
+	}
+	p := &certPool{file: f}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	f.OnChange(func() {
+		if err := p.load(); err != nil {
+			log.Warnf("keeping the previous admin TLS client CAs: %v", err)
+		}
+	})
+	return p, nil
+}
+
+func (p *certPool) load() error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(p.file.Value())) {
+		return errors.Errorf("no certificates found in %q", p.file.Path())
+	}
+	p.m.Lock()
+	p.pool = pool
+	p.m.Unlock()
+	return nil
+}
+
+func (p *certPool) get() *x509.CertPool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.pool
+}
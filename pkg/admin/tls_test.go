@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issuer signs certificates for tests
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newIssuer(t *testing.T) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &issuer{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key for 127.0.0.1, carrying spiffeID if not empty
+func (i *issuer) issue(t *testing.T, spiffeID string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if spiffeID != "" {
+		u, _ := url.Parse(spiffeID)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, i.cert, &key.PublicKey, i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestServer_TLS(t *testing.T) {
+	ca, other := newIssuer(t), newIssuer(t)
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	serverCert, serverKey := ca.issue(t, "")
+	config := TLS{
+		CertFile:     write("tls.crt", serverCert),
+		KeyFile:      write("tls.key", serverKey),
+		ClientCAFile: write("ca.crt", ca.pem),
+		SPIFFEIDs:    []string{"spiffe://cluster.local/ns/monitoring/sa/prometheus", "spiffe://admins.example"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New("")
+	if err := s.EnableTLS(ctx, config); err != nil {
+		t.Fatalf("EnableTLS() error = %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.serve(ctx, l) }()
+
+	tests := []struct {
+		name     string
+		issuer   *issuer
+		spiffeID string
+		path     string
+		wantCode int // zero when the handshake should fail
+	}{
+		{name: "probes need no certificate", path: "/healthz", wantCode: http.StatusOK},
+		{name: "metrics need a certificate", path: "/metrics", wantCode: http.StatusUnauthorized},
+		{name: "allowed SPIFFE ID", issuer: ca, spiffeID: "spiffe://cluster.local/ns/monitoring/sa/prometheus", path: "/metrics", wantCode: http.StatusOK},
+		{name: "allowed trust domain", issuer: ca, spiffeID: "spiffe://admins.example/alice", path: "/logging", wantCode: http.StatusOK},
+		{name: "other SPIFFE ID", issuer: ca, spiffeID: "spiffe://cluster.local/ns/default/sa/app", path: "/metrics", wantCode: http.StatusForbidden},
+		{name: "no SPIFFE ID", issuer: ca, path: "/metrics", wantCode: http.StatusForbidden},
+		{name: "untrusted client CA", issuer: other, spiffeID: "spiffe://admins.example/mallory", path: "/metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			clientConfig := &tls.Config{RootCAs: roots}
+			if tt.issuer != nil {
+				certPEM, keyPEM := tt.issuer.issue(t, tt.spiffeID)
+				pair, err := tls.X509KeyPair(certPEM, keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConfig.Certificates = []tls.Certificate{pair}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			resp, err := client.Get("https://" + l.Addr().String() + tt.path)
+			if tt.wantCode == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("GET %s succeeded with %d, want a handshake failure", tt.path, resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GET %s error = %v", tt.path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("GET %s code = %d, want %d", tt.path, resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServer_EnableTLS_config(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TLS
+	}{
+		{name: "no key", config: TLS{CertFile: "tls.crt"}},
+		{name: "SPIFFE IDs without a client CA", config: TLS{CertFile: "tls.crt", KeyFile: "tls.key", SPIFFEIDs: []string{"spiffe://a"}}},
+		{name: "not a SPIFFE ID", config: TLS{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt", SPIFFEIDs: []string{"cluster.local"}}},
+		{name: "missing files", config: TLS{CertFile: "/nonexistent/tls.crt", KeyFile: "/nonexistent/tls.key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := New("").EnableTLS(context.Background(), tt.config); err == nil {
+				t.Error("EnableTLS() succeeded, want an error")
+			}
+		})
+	}
+}
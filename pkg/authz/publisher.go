@@ -0,0 +1,97 @@
+// Package authz generates an AuthorizationPolicy per registry host from a template, typically allowing only a few
+// principals to reach the host through the egress gateway, so security teams get guardrails as soon as services
+// enter the mesh.
+package authz
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+	secapi "istio.io/client-go/pkg/apis/security/v1beta1"
+	icsecurity "istio.io/client-go/pkg/clientset/versioned/typed/security/v1beta1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+// Option configures optional behaviour of the publisher
+type Option func(*publisher)
+
+// WithStalenessThreshold suspends deleting AuthorizationPolicies while the store hasn't synced successfully for
+// longer than d
+func WithStalenessThreshold(d time.Duration) Option {
+	return func(p *publisher) {
+		p.StalenessThreshold = d
+	}
+}
+
+type publisher struct {
+	*publish.Publisher[*secapi.AuthorizationPolicy]
+}
+
+// NewPublisher returns a publisher keeping an AuthorizationPolicy rendered from template, named and owned like
+// its ServiceEntry, for every host in store. namespace is where the ServiceEntries are published.
+func NewPublisher(owner v1.OwnerReference, store provider.Store, prefix, namespace string, template *Template,
+	client icsecurity.SecurityV1beta1Interface, opts ...Option) *publisher {
+	p := &publisher{&publish.Publisher[*secapi.AuthorizationPolicy]{
+		Resources: publish.Resources[*secapi.AuthorizationPolicy]{
+			Kind:   "AuthorizationPolicy",
+			Plural: "AuthorizationPolicies",
+			// the template may put policies in any namespace
+			List: func(ctx context.Context) ([]*secapi.AuthorizationPolicy, error) {
+				list, err := client.AuthorizationPolicies(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+				if err != nil {
+					return nil, err
+				}
+				return list.Items, nil
+			},
+			Get: func(ctx context.Context, desired *secapi.AuthorizationPolicy) (*secapi.AuthorizationPolicy, error) {
+				return client.AuthorizationPolicies(desired.Namespace).Get(ctx, desired.Name, v1.GetOptions{})
+			},
+			Equal: func(existing, desired *secapi.AuthorizationPolicy) bool {
+				return proto.Equal(&existing.Spec, &desired.Spec) && reflect.DeepEqual(existing.Labels, desired.Labels) &&
+					reflect.DeepEqual(existing.Annotations, desired.Annotations)
+			},
+			Create: func(ctx context.Context, desired *secapi.AuthorizationPolicy) error {
+				_, err := client.AuthorizationPolicies(desired.Namespace).Create(ctx, desired, v1.CreateOptions{})
+				return err
+			},
+			Update: func(ctx context.Context, existing, desired *secapi.AuthorizationPolicy) error {
+				updated := existing.DeepCopy()
+				desired.Spec.DeepCopyInto(&updated.Spec)
+				updated.Labels, updated.Annotations = desired.Labels, desired.Annotations
+				_, err := client.AuthorizationPolicies(updated.Namespace).Update(ctx, updated, v1.UpdateOptions{})
+				return err
+			},
+			Delete: func(ctx context.Context, existing *secapi.AuthorizationPolicy) error {
+				return client.AuthorizationPolicies(existing.Namespace).Delete(ctx, existing.Name, v1.DeleteOptions{})
+			},
+		},
+		Owner:  owner,
+		Store:  store,
+		Prefix: prefix,
+		// a policy that fails to render is kept as last rendered
+		Render: func(host string, _ []*v1alpha3.WorkloadEntry) (*secapi.AuthorizationPolicy, bool, error) {
+			policy, err := template.Render(Values{Host: host, Name: infer.ServiceEntryName(prefix, host), Namespace: namespace})
+			if err != nil {
+				return nil, false, err
+			}
+			policy.OwnerReferences = []v1.OwnerReference{owner}
+			return policy, true, nil
+		},
+		Key: func(policy *secapi.AuthorizationPolicy) string {
+			return policy.Namespace + "/" + policy.Name
+		},
+		Interval: 5 * time.Second,
+		Log:      log,
+	}}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
@@ -0,0 +1,148 @@
+package authz
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+var owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: "us"}
+
+const egressGateway = `
+metadata:
+  namespace: istio-system
+  labels:
+    app: registry
+spec:
+  selector:
+    matchLabels:
+      istio: egressgateway
+  action: ALLOW
+  rules:
+  - from:
+    - source:
+        principals: ["cluster.local/ns/{{ .Namespace }}/sa/billing"]
+    to:
+    - operation:
+        hosts: ["{{ .Host }}"]
+`
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{name: "valid", text: egressGateway},
+		{name: "invalid template", text: "spec: {{ .Host", wantErr: true},
+		{name: "unknown value", text: "spec:\n  action: {{ .Action }}", wantErr: true},
+		{name: "invalid policy", text: "spec: [{{ .Host }}]", wantErr: true},
+		{name: "unknown field", text: "metadata:\n  nmae: {{ .Host }}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseTemplate(tt.text); (err != nil) != tt.wantErr {
+				t.Errorf("ParseTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublisher_Sync(t *testing.T) {
+	template, err := ParseTemplate(egressGateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	security := client.SecurityV1beta1()
+	store := provider.NewStore()
+	p := NewPublisher(owner, store, "cloudmap-", "registry", template, security)
+
+	// fails to render the policy of a.tetrate.io
+	broken, err := ParseTemplate(egressGateway + `{{ if eq .Host "a.tetrate.io" }}{{ .Missing }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		restart *Template // with a new UID, as every run gets
+		hosts   map[string][]*v1alpha3.WorkloadEntry
+		want    map[string][]string // allowed hosts by policy namespace/name
+		wantErr bool
+	}{
+		{
+			name: "creates a policy per host",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.1", 80)},
+				"b.tetrate.io": {infer.WorkloadEntry("10.0.0.2", 80)},
+			},
+			want: map[string][]string{
+				"istio-system/cloudmap-a.tetrate.io": {"a.tetrate.io"},
+				"istio-system/cloudmap-b.tetrate.io": {"b.tetrate.io"},
+			},
+		},
+		{
+			name: "deletes the policies of removed hosts",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.3", 80)},
+			},
+			want: map[string][]string{"istio-system/cloudmap-a.tetrate.io": {"a.tetrate.io"}},
+		},
+		{
+			name:    "takes over the policies of the previous run after a restart, keeping those failing to render",
+			restart: broken,
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.3", 80)},
+				"c.tetrate.io": {infer.WorkloadEntry("10.0.0.4", 80)},
+			},
+			want: map[string][]string{
+				"istio-system/cloudmap-a.tetrate.io": {"a.tetrate.io"},
+				"istio-system/cloudmap-c.tetrate.io": {"c.tetrate.io"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, step := range steps {
+		if step.restart != nil {
+			restarted := owner
+			restarted.UID = "us, restarted"
+			store = provider.NewStore()
+			p = NewPublisher(restarted, store, "cloudmap-", "registry", step.restart, security)
+		}
+		store.Set(step.hosts)
+		if err := p.Sync(context.TODO()); (err != nil) != step.wantErr {
+			t.Fatalf("%s: Sync() error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		list, err := security.AuthorizationPolicies(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string][]string{}
+		for _, policy := range list.Items {
+			if !publish.Owns(owner, policy.OwnerReferences) || policy.Labels["app"] != "registry" {
+				t.Errorf("%s: policy %s/%s not labelled and owned as templated", step.name, policy.Namespace, policy.Name)
+			}
+			rules := policy.Spec.Rules
+			if len(rules) != 1 || !reflect.DeepEqual(rules[0].From[0].Source.Principals, []string{"cluster.local/ns/registry/sa/billing"}) {
+				t.Errorf("%s: policy %s/%s has rules %v", step.name, policy.Namespace, policy.Name, rules)
+				continue
+			}
+			hosts := rules[0].To[0].Operation.Hosts
+			sort.Strings(hosts)
+			got[policy.Namespace+"/"+policy.Name] = hosts
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package authz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"text/template"
+
+	"github.com/pkg/errors"
+	secapi "istio.io/client-go/pkg/apis/security/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// Template renders the AuthorizationPolicy of a host from a Go template of its YAML
+type Template struct {
+	t *template.Template
+}
+
+// Values are what a template can refer to
+type Values struct {
+	// Host is the registry host, e.g. billing.prod.svc
+	Host string
+	// Name of the host's ServiceEntry, which the AuthorizationPolicy is named after too
+	Name string
+	// Namespace the ServiceEntry is published to, where the AuthorizationPolicy goes unless the template says otherwise
+	Namespace string
+}
+
+// LoadTemplate reads and parses the template in the file at path
+func LoadTemplate(path string) (*Template, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read AuthorizationPolicy template %q", path)
+	}
+	t, err := ParseTemplate(string(text))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid AuthorizationPolicy template %q", path)
+	}
+	return t, nil
+}
+
+// ParseTemplate parses text, and checks it renders a valid AuthorizationPolicy
+func ParseTemplate(text string) (*Template, error) {
+	t, err := template.New("AuthorizationPolicy").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	out := &Template{t: t}
+	if _, err := out.Render(Values{Host: "example.com", Name: "example.com", Namespace: "default"}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Render returns the AuthorizationPolicy of v.Host, named after its ServiceEntry whatever the template says
+func (t *Template) Render(v Values) (*secapi.AuthorizationPolicy, error) {
+	var buf bytes.Buffer
+	if err := t.t.Execute(&buf, v); err != nil {
+		return nil, errors.Wrap(err, "failed to render AuthorizationPolicy")
+	}
+	policy := &secapi.AuthorizationPolicy{}
+	if err := yaml.UnmarshalStrict(buf.Bytes(), policy); err != nil {
+		return nil, errors.Wrapf(err, "rendered an invalid AuthorizationPolicy for %q", v.Host)
+	}
+	policy.Name = v.Name
+	if policy.Namespace == "" {
+		policy.Namespace = v.Namespace
+	}
+	return policy, nil
+}
@@ -0,0 +1,155 @@
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+var owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "benchmark", UID: "benchmark"}
+
+func TestMain(m *testing.M) {
+	// per entry logging would dominate the measurements
+	logging.SetAllLevels(logging.NoneLevel)
+	os.Exit(m.Run())
+}
+
+// BenchmarkCloudMapRefresh measures a full Cloud Map refresh: listing namespaces and services, discovering
+// instances and setting the store. Every refresh after the first finds the registry unchanged.
+func BenchmarkCloudMapRefresh(b *testing.B) {
+	for _, size := range Sizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			w := cloudmap.NewWatcherFromClient(NewCloudMap(size), provider.NewStore(), cloudmap.WithCallTimeout(0))
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.Refresh(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if got := len(w.Store().Hosts()); got != size {
+				b.Fatalf("store holds %d hosts, want %d", got, size)
+			}
+		})
+	}
+}
+
+// BenchmarkStoreSet measures setting every host of a provider store to what it already holds, with and without
+// an endpoint budget
+func BenchmarkStoreSet(b *testing.B) {
+	for _, size := range Sizes {
+		hosts := Hosts(size)
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			store := provider.NewStore()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Set(hosts)
+			}
+		})
+		b.Run(fmt.Sprintf("services=%d/budget", size), func(b *testing.B) {
+			store := provider.NewStore(provider.WithBudget(provider.NewBudget("benchmark", size*EndpointsPerService)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Set(hosts)
+			}
+		})
+	}
+}
+
+// BenchmarkReconcile measures the synchronizer creating every Service Entry from scratch, and reconciling a
+// synced registry where 1% of the hosts changed
+func BenchmarkReconcile(b *testing.B) {
+	for _, size := range Sizes {
+		size := size
+		b.Run(fmt.Sprintf("services=%d/initial", size), func(b *testing.B) {
+			store := provider.NewStore()
+			store.Set(Hosts(size))
+			ctx := context.Background()
+			created := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				entries := serviceentry.New(owner)
+				client := NewServiceEntries(entries)
+				s := control.NewSynchronizer(owner, entries, store, "cloudmap", client)
+				b.StartTimer()
+				res := s.Sync(ctx)
+				if len(res.Errors) > 0 || len(res.Created) != size {
+					b.Fatalf("created %d Service Entries with errors %v, want %d", len(res.Created), res.Errors, size)
+				}
+				created += len(res.Created)
+			}
+			// Elapsed leaves out the setup done while the timer was stopped
+			b.ReportMetric(float64(created)/b.Elapsed().Seconds(), "entries/s")
+		})
+		b.Run(fmt.Sprintf("services=%d/churn", size), func(b *testing.B) {
+			hosts := Hosts(size)
+			store := provider.NewStore()
+			store.Set(hosts)
+			entries := serviceentry.New(owner)
+			s := control.NewSynchronizer(owner, entries, store, "cloudmap", NewServiceEntries(entries))
+			ctx := context.Background()
+			s.Sync(ctx)
+			updated := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				Mutate(hosts, 100, i+1)
+				store.Set(hosts)
+				b.StartTimer()
+				res := s.Sync(ctx)
+				if len(res.Errors) > 0 || len(res.Updated) == 0 {
+					b.Fatalf("updated %d Service Entries with errors %v", len(res.Updated), res.Errors)
+				}
+				updated += len(res.Updated)
+			}
+			// only the entries of the hosts that changed are reconciled, not every entry of the registry
+			b.ReportMetric(float64(updated)/b.Elapsed().Seconds(), "entries/s")
+		})
+	}
+}
+
+// BenchmarkSteadyState measures a full poll cycle, a Cloud Map refresh followed by a sync, of a registry that
+// doesn't change. Its allocations are the garbage an idle deployment produces every cycle.
+func BenchmarkSteadyState(b *testing.B) {
+	for _, size := range Sizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			store := provider.NewStore()
+			w := cloudmap.NewWatcherFromClient(NewCloudMap(size), store, cloudmap.WithCallTimeout(0))
+			entries := serviceentry.New(owner)
+			s := control.NewSynchronizer(owner, entries, store, "cloudmap-", NewServiceEntries(entries))
+			ctx := context.Background()
+			// the second cycle sees the Service Entries the first created
+			for i := 0; i < 2; i++ {
+				if err := w.Refresh(ctx); err != nil {
+					b.Fatal(err)
+				}
+				s.Sync(ctx)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.Refresh(ctx); err != nil {
+					b.Fatal(err)
+				}
+				if res := s.Sync(ctx); res.Changed() || len(res.Errors) > 0 {
+					b.Fatalf("steady state sync changed %+v", res)
+				}
+			}
+		})
+	}
+}
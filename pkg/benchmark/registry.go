@@ -0,0 +1,223 @@
+// Package benchmark simulates registries at scale, so the watchers and the synchronizer can be benchmarked
+// without a real Cloud Map or cluster. The benchmarks themselves live in benchmark_test.go; run them with
+// `make bench`.
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"istio.io/api/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+// Sizes are the registry sizes, in services, the benchmarks run at
+var Sizes = []int{1000, 10000, 50000}
+
+const (
+	// ServicesPerNamespace spreads services across namespaces the way a large registry would
+	ServicesPerNamespace = 100
+	// EndpointsPerService is the number of instances registered for each service
+	EndpointsPerService = 3
+)
+
+// Hosts returns a registry of services hosts, each with EndpointsPerService endpoints, named like Cloud Map's
+func Hosts(services int) map[string][]*v1alpha3.WorkloadEntry {
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, services)
+	for i := 0; i < services; i++ {
+		wes := make([]*v1alpha3.WorkloadEntry, EndpointsPerService)
+		for j := range wes {
+			wes[j] = infer.WorkloadEntry(address(i*EndpointsPerService+j), 8080)
+		}
+		hosts[fmt.Sprintf("svc-%d.ns-%d", i, i/ServicesPerNamespace)] = wes
+	}
+	return hosts
+}
+
+// Mutate changes the first endpoint of every step'th host, simulating churn between refreshes
+func Mutate(hosts map[string][]*v1alpha3.WorkloadEntry, step, generation int) {
+	i := 0
+	for host, wes := range hosts {
+		if i%step == 0 {
+			changed := make([]*v1alpha3.WorkloadEntry, len(wes))
+			copy(changed, wes)
+			changed[0] = infer.WorkloadEntry(address(generation<<20+i), 8080)
+			hosts[host] = changed
+		}
+		i++
+	}
+}
+
+func address(n int) string {
+	return fmt.Sprintf("10.%d.%d.%d", n>>16&0xff, n>>8&0xff, n&0xff)
+}
+
+// CloudMap is a fake Cloud Map API serving services registered services, with EndpointsPerService instances each
+type CloudMap struct {
+	namespaces []sdTypes.NamespaceSummary
+	services   map[string][]sdTypes.ServiceSummary // by namespace ID
+	instances  []sdTypes.HttpInstanceSummary
+}
+
+var _ cloudmap.ServiceDiscoveryClient = &CloudMap{}
+
+// NewCloudMap returns a fake Cloud Map API with services services
+func NewCloudMap(services int) *CloudMap {
+	c := &CloudMap{services: make(map[string][]sdTypes.ServiceSummary)}
+	for i := 0; i < services; i++ {
+		nsName := fmt.Sprintf("ns-%d", i/ServicesPerNamespace)
+		if i%ServicesPerNamespace == 0 {
+			c.namespaces = append(c.namespaces, sdTypes.NamespaceSummary{Id: &nsName, Name: &nsName})
+		}
+		svcName := fmt.Sprintf("svc-%d", i)
+		c.services[nsName] = append(c.services[nsName], sdTypes.ServiceSummary{Name: &svcName})
+	}
+	for j := 0; j < EndpointsPerService; j++ {
+		c.instances = append(c.instances, sdTypes.HttpInstanceSummary{Attributes: map[string]string{
+			"AWS_INSTANCE_IPV4": address(j),
+			"AWS_INSTANCE_PORT": "8080",
+		}})
+	}
+	return c
+}
+
+// ListNamespaces returns every namespace
+func (c *CloudMap) ListNamespaces(context.Context, *servicediscovery.ListNamespacesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	return &servicediscovery.ListNamespacesOutput{Namespaces: c.namespaces}, nil
+}
+
+// ListServices returns the services of the namespace in the filter
+func (c *CloudMap) ListServices(_ context.Context, in *servicediscovery.ListServicesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	return &servicediscovery.ListServicesOutput{Services: c.services[in.Filters[0].Values[0]]}, nil
+}
+
+// ListTagsForResource returns no tags
+func (c *CloudMap) ListTagsForResource(context.Context, *servicediscovery.ListTagsForResourceInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListTagsForResourceOutput, error) {
+	return &servicediscovery.ListTagsForResourceOutput{}, nil
+}
+
+// ListInstances returns the same EndpointsPerService instances for every service, as DiscoverInstances does
+func (c *CloudMap) ListInstances(context.Context, *servicediscovery.ListInstancesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListInstancesOutput, error) {
+	out := &servicediscovery.ListInstancesOutput{}
+	for _, instance := range c.instances {
+		out.Instances = append(out.Instances, sdTypes.InstanceSummary{Id: instance.InstanceId, Attributes: instance.Attributes})
+	}
+	return out, nil
+}
+
+// GetInstancesHealthStatus returns no statuses, as the services have no health checks
+func (c *CloudMap) GetInstancesHealthStatus(context.Context, *servicediscovery.GetInstancesHealthStatusInput,
+	...func(*servicediscovery.Options)) (*servicediscovery.GetInstancesHealthStatusOutput, error) {
+	return &servicediscovery.GetInstancesHealthStatusOutput{}, nil
+}
+
+// GetNamespace returns the namespace with the ID given
+func (c *CloudMap) GetNamespace(_ context.Context, in *servicediscovery.GetNamespaceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.GetNamespaceOutput, error) {
+	for _, ns := range c.namespaces {
+		if aws.ToString(ns.Id) == aws.ToString(in.Id) {
+			return &servicediscovery.GetNamespaceOutput{Namespace: &sdTypes.Namespace{Id: ns.Id, Name: ns.Name, Type: ns.Type}}, nil
+		}
+	}
+	return nil, &sdTypes.NamespaceNotFound{Message: in.Id}
+}
+
+// GetService returns the service with the ID given, without a creator request ID
+func (c *CloudMap) GetService(_ context.Context, in *servicediscovery.GetServiceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.GetServiceOutput, error) {
+	return &servicediscovery.GetServiceOutput{Service: &sdTypes.Service{Id: in.Id}}, nil
+}
+
+// DiscoverInstances returns the same EndpointsPerService instances for every service
+func (c *CloudMap) DiscoverInstances(context.Context, *servicediscovery.DiscoverInstancesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.DiscoverInstancesOutput, error) {
+	instances := make([]sdTypes.HttpInstanceSummary, len(c.instances))
+	copy(instances, c.instances)
+	return &servicediscovery.DiscoverInstancesOutput{Instances: instances}, nil
+}
+
+// ServiceEntries is an in-memory ServiceEntry API that feeds every change back into a serviceentry.Store,
+// standing in for the cluster and the informer watching it
+type ServiceEntries struct {
+	ic.ServiceEntryInterface
+
+	informed serviceentry.Store
+	m        sync.Mutex
+	entries  map[string]*icapi.ServiceEntry
+}
+
+// NewServiceEntries returns an empty ServiceEntry API informing informed of changes
+func NewServiceEntries(informed serviceentry.Store) *ServiceEntries {
+	return &ServiceEntries{informed: informed, entries: make(map[string]*icapi.ServiceEntry)}
+}
+
+var serviceEntryResource = schema.GroupResource{Group: "networking.istio.io", Resource: "serviceentries"}
+
+// Get returns the named entry
+func (s *ServiceEntries) Get(_ context.Context, name string, _ v1.GetOptions) (*icapi.ServiceEntry, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	se, ok := s.entries[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(serviceEntryResource, name)
+	}
+	return se, nil
+}
+
+// Create stores se
+func (s *ServiceEntries) Create(_ context.Context, se *icapi.ServiceEntry, _ v1.CreateOptions) (*icapi.ServiceEntry, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.entries[se.Name]; ok {
+		return nil, k8serrors.NewAlreadyExists(serviceEntryResource, se.Name)
+	}
+	s.entries[se.Name] = se
+	return se, s.informed.Insert(se)
+}
+
+// Update replaces the entry named like se
+func (s *ServiceEntries) Update(_ context.Context, se *icapi.ServiceEntry, _ v1.UpdateOptions) (*icapi.ServiceEntry, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	old, ok := s.entries[se.Name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(serviceEntryResource, se.Name)
+	}
+	s.entries[se.Name] = se
+	return se, s.informed.Update(old, se)
+}
+
+// Delete removes the named entry
+func (s *ServiceEntries) Delete(_ context.Context, name string, _ v1.DeleteOptions) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	se, ok := s.entries[name]
+	if !ok {
+		return k8serrors.NewNotFound(serviceEntryResource, name)
+	}
+	delete(s.entries, name)
+	return s.informed.Delete(se)
+}
+
+// Len returns the number of entries stored
+func (s *ServiceEntries) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.entries)
+}
@@ -0,0 +1,208 @@
+// Package bundle writes support bundles: a gzipped tarball of every pipeline's current state, to attach to
+// support tickets. Addresses and hostnames are redacted the way logs are.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	istioapi "istio.io/api/networking/v1alpha3"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// Pipeline is the state of one provider's pipeline to include in a bundle
+type Pipeline struct {
+	Prefix string
+	Store  provider.Store
+	// Ready reports whether the pipeline is ready; nil if no synchronizer is running
+	Ready func() error
+	// Audit lists the synchronizer's recent writes; nil if no synchronizer is running
+	Audit func() []control.AuditEntry
+}
+
+// Status summarizes a pipeline
+type Status struct {
+	Prefix    string     `json:"prefix"`
+	Hosts     int        `json:"hosts"`
+	Endpoints int        `json:"endpoints"`
+	Revision  uint64     `json:"revision"`
+	LastSync  *time.Time `json:"lastSync,omitempty"`
+	Ready     *bool      `json:"ready,omitempty"`
+	NotReady  string     `json:"notReady,omitempty"`
+}
+
+// ServiceEntryList is a v1 List of ServiceEntries, so they can be fed to kubectl
+type ServiceEntryList struct {
+	v1.TypeMeta `json:",inline"`
+	Items       []*v1alpha3.ServiceEntry `json:"items"`
+}
+
+// file is a file of a pipeline's directory, and how to produce its contents
+type file struct {
+	name string
+	data func() ([]byte, error)
+}
+
+// Write writes a bundle of pipelines to w. Each pipeline gets a directory named after its prefix holding
+// status.json, store.json, serviceentries.yaml and, if its synchronizer is running, audit.json.
+func Write(w io.Writer, version string, pipelines []Pipeline) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "failed to add %s to the bundle", name)
+		}
+		_, err := tw.Write(data)
+		return errors.Wrapf(err, "failed to add %s to the bundle", name)
+	}
+
+	if err := add("version.txt", []byte(fmt.Sprintf("istio-registry-sync %s\ncreated %s\n", version, now.UTC().Format(time.RFC3339)))); err != nil {
+		return err
+	}
+	for _, p := range pipelines {
+		dir := strings.TrimSuffix(p.Prefix, "-") + "/"
+		hosts := p.Store.Hosts()
+		files := []file{
+			{name: "status.json", data: func() ([]byte, error) { return marshalJSON(status(p, hosts)) }},
+			{name: "store.json", data: func() ([]byte, error) { return marshalJSON(redactHosts(hosts)) }},
+			{name: "serviceentries.yaml", data: func() ([]byte, error) { return yaml.Marshal(ServiceEntries(p.Prefix, hosts)) }},
+		}
+		if p.Audit != nil {
+			files = append(files, file{name: "audit.json", data: func() ([]byte, error) { return marshalJSON(redactAudit(p.Audit())) }})
+		}
+		for _, f := range files {
+			data, err := f.data()
+			if err != nil {
+				return errors.Wrapf(err, "failed to marshal %s%s", dir, f.name)
+			}
+			if err := add(dir+f.name, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish the bundle")
+	}
+	return errors.Wrap(gz.Close(), "failed to finish the bundle")
+}
+
+// ServiceEntries returns the ServiceEntries hosts translate to, sorted by host, with addresses and hostnames
+// redacted the way logs are. Ownership is left to the instance that applies them.
+func ServiceEntries(prefix string, hosts map[string][]*istioapi.WorkloadEntry) ServiceEntryList {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	list := ServiceEntryList{TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "List"}}
+	for _, host := range names {
+		se := infer.ServiceEntry(v1.OwnerReference{}, prefix, host, hosts[host])
+		se.OwnerReferences = nil
+		se.TypeMeta = v1.TypeMeta{APIVersion: v1alpha3.SchemeGroupVersion.String(), Kind: "ServiceEntry"}
+		// redact field by field, as redacting the output would also mangle the API group
+		se.Name = logging.Redact(se.Name)
+		for i, h := range se.Spec.Hosts {
+			se.Spec.Hosts[i] = logging.Redact(h)
+		}
+		for i, a := range se.Spec.Addresses {
+			se.Spec.Addresses[i] = logging.Redact(a)
+		}
+		// the entries are shared with the store, so they're copied before being redacted
+		se.Spec.Endpoints = redactEndpoints(se.Spec.Endpoints)
+		list.Items = append(list.Items, se)
+	}
+	return list
+}
+
+func status(p Pipeline, hosts map[string][]*istioapi.WorkloadEntry) Status {
+	s := Status{Prefix: p.Prefix, Hosts: len(hosts), Revision: p.Store.Revision()}
+	for _, wes := range hosts {
+		s.Endpoints += len(wes)
+	}
+	if last := p.Store.LastSync(); !last.IsZero() {
+		s.LastSync = &last
+	}
+	if p.Ready != nil {
+		err := p.Ready()
+		ready := err == nil
+		s.Ready = &ready
+		if err != nil {
+			s.NotReady = err.Error()
+		}
+	}
+	return s
+}
+
+func redactHosts(hosts map[string][]*istioapi.WorkloadEntry) map[string][]*istioapi.WorkloadEntry {
+	out := make(map[string][]*istioapi.WorkloadEntry, len(hosts))
+	for host, wes := range hosts {
+		out[logging.Redact(host)] = redactEndpoints(wes)
+	}
+	return out
+}
+
+func redactEndpoints(wes []*istioapi.WorkloadEntry) []*istioapi.WorkloadEntry {
+	out := make([]*istioapi.WorkloadEntry, len(wes))
+	for i, we := range wes {
+		out[i] = we.DeepCopy()
+		out[i].Address = logging.Redact(we.Address)
+	}
+	return out
+}
+
+func redactAudit(entries []control.AuditEntry) []control.AuditEntry {
+	for i := range entries {
+		entries[i].Name = logging.Redact(entries[i].Name)
+		entries[i].Error = logging.Redact(entries[i].Error)
+	}
+	return entries
+}
+
+func marshalJSON(v interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Handler serves a bundle of pipelines on GET
+func Handler(version string, pipelines []Pipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "the support bundle must be requested with GET", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", FileName(time.Now())))
+		if err := Write(w, version, pipelines); err != nil {
+			// the headers are gone, so all that's left is to cut the download short
+			log.Errorf("error writing support bundle: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// FileName is the default name of a bundle created at t
+func FileName(t time.Time) string {
+	return "istio-registry-sync-" + t.UTC().Format("20060102T150405Z") + ".tar.gz"
+}
@@ -0,0 +1,93 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWrite(t *testing.T) {
+	logging.SetRedaction(logging.RedactMask, nil)
+	defer logging.SetRedaction(logging.RedactNone, nil)
+
+	store := provider.NewStore()
+	store.Set(map[string][]*v1alpha3.WorkloadEntry{"svc.tetrate.io": {infer.WorkloadEntry("10.0.0.1", 8080)}})
+	pipelines := []Pipeline{
+		{Prefix: "cloudmap-", Store: store},
+		{
+			Prefix: "t1-consul-",
+			Store:  provider.NewStore(),
+			Ready:  func() error { return errors.New("provider \"t1-consul-\" has not synced yet") },
+			Audit: func() []control.AuditEntry {
+				return []control.AuditEntry{{Action: control.Create, Name: "t1-consul-svc.tetrate.io"}}
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, "test", pipelines); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{
+		"cloudmap/serviceentries.yaml", "cloudmap/status.json", "cloudmap/store.json",
+		"t1-consul/audit.json", "t1-consul/serviceentries.yaml", "t1-consul/status.json", "t1-consul/store.json",
+		"version.txt",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("bundle holds %v, want %v", names, want)
+	}
+	for name, data := range files {
+		for _, secret := range []string{"10.0.0.1", "svc.tetrate.io"} {
+			if strings.Contains(data, secret) {
+				t.Errorf("%s contains %q unredacted:\n%s", name, secret, data)
+			}
+		}
+	}
+	if !strings.Contains(files["cloudmap/serviceentries.yaml"], "apiVersion: networking.istio.io/v1alpha3") {
+		t.Errorf("serviceentries.yaml lost its API group to redaction:\n%s", files["cloudmap/serviceentries.yaml"])
+	}
+	if !strings.Contains(files["t1-consul/status.json"], `"ready": false`) {
+		t.Errorf("status.json doesn't report the pipeline unready:\n%s", files["t1-consul/status.json"])
+	}
+	if strings.Contains(files["cloudmap/status.json"], `"ready"`) {
+		t.Errorf("status.json reports readiness without a synchronizer:\n%s", files["cloudmap/status.json"])
+	}
+}
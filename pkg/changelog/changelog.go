@@ -0,0 +1,59 @@
+// Package changelog records which keys of a store changed at each of its revisions, so readers can catch up on
+// just the keys that changed since they last looked rather than rereading the whole store.
+package changelog
+
+// defaultLimit is the number of revisions a log reaches back
+const defaultLimit = 64
+
+// Log is a bounded history of changed keys. It isn't safe for concurrent use; the store owning it guards it.
+type Log struct {
+	revision uint64
+	limit    int
+	entries  []entry // oldest first
+}
+
+type entry struct {
+	revision uint64
+	keys     []string
+}
+
+// New returns an empty log at revision zero
+func New() *Log {
+	return &Log{limit: defaultLimit}
+}
+
+// Revision is the latest revision recorded
+func (l *Log) Revision() uint64 {
+	return l.revision
+}
+
+// Record starts a new revision in which keys changed
+func (l *Log) Record(keys ...string) {
+	l.revision++
+	if len(l.entries) == l.limit {
+		copy(l.entries, l.entries[1:])
+		l.entries = l.entries[:l.limit-1]
+	}
+	l.entries = append(l.entries, entry{revision: l.revision, keys: keys})
+}
+
+// Since returns the keys changed after revision since, or false if the log no longer reaches back that far and
+// the reader has to reread the whole store
+func (l *Log) Since(since uint64) (map[string]struct{}, bool) {
+	if since > l.revision {
+		return nil, false
+	}
+	if since < l.revision && (len(l.entries) == 0 || l.entries[0].revision > since+1) {
+		return nil, false
+	}
+	keys := make(map[string]struct{})
+	for _, e := range l.entries {
+		if e.revision <= since {
+			continue
+		}
+		for _, k := range e.keys {
+			keys[k] = struct{}{}
+		}
+	}
+	return keys, true
+}
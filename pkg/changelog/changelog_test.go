@@ -0,0 +1,38 @@
+package changelog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLog_Since(t *testing.T) {
+	l := &Log{limit: 3}
+	l.Record("a")
+	l.Record("b", "c")
+	l.Record("a")
+	l.Record("d")
+
+	tests := []struct {
+		name   string
+		since  uint64
+		want   map[string]struct{}
+		wantOK bool
+	}{
+		{name: "up to date", since: 4, want: map[string]struct{}{}, wantOK: true},
+		{name: "one revision behind", since: 3, want: map[string]struct{}{"d": {}}, wantOK: true},
+		{name: "as far back as the log reaches", since: 1, want: map[string]struct{}{"a": {}, "b": {}, "c": {}, "d": {}}, wantOK: true},
+		{name: "further back than the log reaches", since: 0},
+		{name: "ahead of the log", since: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := l.Since(tt.since)
+			if ok != tt.wantOK {
+				t.Fatalf("Since(%d) ok = %v, want %v", tt.since, ok, tt.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Since(%d) = %v, want %v", tt.since, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package cloudmap
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+)
+
+const (
+	// ServiceIDAnnotation is the ID of the Cloud Map service a Service Entry was synced from
+	ServiceIDAnnotation = "cloudmap." + infer.AnnotationDomain + "service-id"
+	// DescriptionAnnotation is the description of the Cloud Map service, if it has one
+	DescriptionAnnotation = "cloudmap." + infer.AnnotationDomain + "description"
+	// RoutingPolicyAnnotation is the routing policy of the DNS records of the Cloud Map service, if it has any
+	RoutingPolicyAnnotation = "cloudmap." + infer.AnnotationDomain + "routing-policy"
+	// CreatorRequestIDAnnotation is the ID of the request that created the Cloud Map service, if known
+	CreatorRequestIDAnnotation = "cloudmap." + infer.AnnotationDomain + "creator-request-id"
+)
+
+// WithServiceAnnotations annotates the Service Entry of every Cloud Map service with the service's ID, description,
+// DNS routing policy and creator request ID, so entries can be traced back to where they came from. The creator
+// request ID takes a GetService call per service, made once as it never changes.
+func WithServiceAnnotations() Option {
+	return func(w *watcher) {
+		w.annotate = true
+	}
+}
+
+// describe records the creator request ID of svc, unless it's known already. Failing to is only logged, as the
+// annotations aren't worth failing a refresh for, and is tried again on the next refresh.
+func (w *watcher) describe(ctx context.Context, svc *sdTypes.ServiceSummary) {
+	id := aws.ToString(svc.Id)
+	w.cacheM.Lock()
+	_, ok := w.creators[id]
+	w.cacheM.Unlock()
+	if ok {
+		return
+	}
+	callCtx, cancel, err := w.callContext(ctx)
+	if err != nil {
+		return
+	}
+	defer cancel()
+	out, err := w.cloudmap.GetService(callCtx, &servicediscovery.GetServiceInput{Id: svc.Id})
+	if err != nil {
+		log.Warnf("unable to describe Cloud Map service %q (%s) for its annotations: %v", aws.ToString(svc.Name), id, err)
+		return
+	}
+	w.cacheM.Lock()
+	defer w.cacheM.Unlock()
+	if w.creators == nil {
+		w.creators = make(map[string]string)
+	}
+	w.creators[id] = aws.ToString(out.Service.CreatorRequestId)
+}
+
+// annotations returns the annotations of the Service Entry of every host in origin, taken from the service synced as
+// the host; origin maps hosts to the ID of the namespace they were synced from, telling apart services sharing a host
+func (w *watcher) annotations(services map[string]serviceRef, origin map[string]string) map[string]map[string]string {
+	w.cacheM.Lock()
+	defer w.cacheM.Unlock()
+	annotations := make(map[string]map[string]string, len(origin))
+	for id, ref := range services {
+		host := w.host(&ref.service, &ref.namespace)
+		if ns, ok := origin[host]; !ok || ns != aws.ToString(ref.namespace.Id) {
+			continue
+		}
+		a := map[string]string{ServiceIDAnnotation: id}
+		if description := aws.ToString(ref.service.Description); description != "" {
+			a[DescriptionAnnotation] = description
+		}
+		if dns := ref.service.DnsConfig; dns != nil && dns.RoutingPolicy != "" {
+			a[RoutingPolicyAnnotation] = string(dns.RoutingPolicy)
+		}
+		if creator := w.creators[id]; creator != "" {
+			a[CreatorRequestIDAnnotation] = creator
+		}
+		annotations[host] = a
+	}
+	// services deleted since are described again should they come back
+	for id := range w.creators {
+		if _, ok := services[id]; !ok {
+			delete(w.creators, id)
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,87 @@
+package cloudmap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// describedSDAPI describes its services as created by a CloudFormation stack, unless failing
+type describedSDAPI struct {
+	mockSDAPI
+	failing   bool
+	described int
+}
+
+func (d *describedSDAPI) GetService(_ context.Context, in *servicediscovery.GetServiceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.GetServiceOutput, error) {
+	d.described++
+	if d.failing {
+		return nil, errors.New("access denied")
+	}
+	return &servicediscovery.GetServiceOutput{Service: &sdTypes.Service{
+		Id:               in.Id,
+		CreatorRequestId: aws.String("stack-" + aws.ToString(in.Id)),
+	}}, nil
+}
+
+func TestWatcher_serviceAnnotations(t *testing.T) {
+	mockAPI := &describedSDAPI{mockSDAPI: mockSDAPI{
+		ListNsResult: &goldenPathListNamespaces,
+		ListSvcResult: &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{{
+			Id:          aws.String("srv-1"),
+			Name:        &subdomain,
+			Description: aws.String("the demo"),
+			DnsConfig:   &sdTypes.DnsConfig{RoutingPolicy: sdTypes.RoutingPolicyMultivalue},
+		}}},
+		DiscInstResult: &goldenPathDiscoverInstances,
+	}}
+	store := provider.NewStore()
+	w := NewWatcherFromClient(mockAPI, store, WithServiceAnnotations())
+
+	steps := []struct {
+		name          string
+		failing       bool
+		want          map[string]string
+		wantDescribed int
+	}{
+		{
+			name:    "creator unknown while describing fails",
+			failing: true,
+			want: map[string]string{ServiceIDAnnotation: "srv-1", DescriptionAnnotation: "the demo",
+				RoutingPolicyAnnotation: "MULTIVALUE"},
+			wantDescribed: 1,
+		},
+		{
+			name: "described",
+			want: map[string]string{ServiceIDAnnotation: "srv-1", DescriptionAnnotation: "the demo",
+				RoutingPolicyAnnotation: "MULTIVALUE", CreatorRequestIDAnnotation: "stack-srv-1"},
+			wantDescribed: 2,
+		},
+		{
+			name: "described once",
+			want: map[string]string{ServiceIDAnnotation: "srv-1", DescriptionAnnotation: "the demo",
+				RoutingPolicyAnnotation: "MULTIVALUE", CreatorRequestIDAnnotation: "stack-srv-1"},
+			wantDescribed: 2,
+		},
+	}
+	for _, step := range steps {
+		mockAPI.failing = step.failing
+		if err := w.Refresh(context.TODO()); err != nil {
+			t.Fatalf("%s: Refresh() error = %v", step.name, err)
+		}
+		if got := store.Annotations()["demo.tetrate.io"]; !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: annotations = %v, want %v", step.name, got, step.want)
+		}
+		if mockAPI.described != step.wantDescribed {
+			t.Errorf("%s: GetService called %d times, want %d", step.name, mockAPI.described, step.wantDescribed)
+		}
+	}
+}
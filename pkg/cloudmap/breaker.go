@@ -0,0 +1,85 @@
+package cloudmap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+// DefaultBreakerFailures is how many refreshes in a row must fail for the breaker of WithCircuitBreaker to open, unless
+// overridden
+const DefaultBreakerFailures = 5
+
+// defaultProbeInterval is how often an open breaker lets a refresh through unless overridden with WithCircuitBreaker
+const defaultProbeInterval = time.Minute
+
+// WithCircuitBreaker opens the watcher's circuit once failures refreshes in a row have failed: rather than every
+// interval, the registry is then only read every probe, defaulting to a minute, until a refresh succeeds again, and the
+// watcher reports itself not ready meanwhile. Zero failures disables the breaker.
+func WithCircuitBreaker(failures int, probe time.Duration) Option {
+	return func(w *watcher) {
+		if probe <= 0 {
+			probe = defaultProbeInterval
+		}
+		w.breaker.threshold, w.breaker.probe = failures, probe
+	}
+}
+
+// breaker counts the refreshes failing in a row, opening once they reach threshold
+type breaker struct {
+	threshold int           // refreshes failing in a row that open the breaker; zero disables it
+	probe     time.Duration // how often an open breaker lets a refresh through
+
+	m        sync.Mutex
+	failures int       // refreshes failing in a row
+	last     time.Time // of the last refresh
+	err      error     // of the last refresh
+}
+
+// open returns whether enough refreshes failed in a row to open the breaker
+func (b *breaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// allow returns whether a refresh may go ahead at now: always, unless the breaker is open and the last refresh was
+// less than the probe interval ago
+func (b *breaker) allow(now time.Time) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return !b.open() || now.Sub(b.last) >= b.probe
+}
+
+// record counts the outcome of a refresh of the watcher with prefix that returned err
+func (b *breaker) record(prefix string, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	wasOpen := b.open()
+	b.last, b.err = time.Now(), err
+	if err == nil {
+		b.failures = 0
+		if wasOpen {
+			log.Infof("Cloud Map is back, closing the circuit of %q", prefix)
+			metrics.CloudMapCircuitOpen.WithLabelValues(prefix).Set(0)
+		}
+		return
+	}
+	b.failures++
+	if b.open() && !wasOpen {
+		log.Errorf("%d refreshes of %q failed in a row, opening its circuit and only probing Cloud Map every %v",
+			b.failures, prefix, b.probe)
+		metrics.CloudMapCircuitOpen.WithLabelValues(prefix).Set(1)
+	}
+}
+
+// ready returns an error while the breaker is open
+func (b *breaker) ready() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !b.open() {
+		return nil
+	}
+	return errors.Wrapf(b.err, "the last %d refreshes from Cloud Map failed, probing every %v", b.failures, b.probe)
+}
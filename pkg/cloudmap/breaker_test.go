@@ -0,0 +1,192 @@
+package cloudmap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"istio.io/api/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+func TestWatcher_circuitBreaker(t *testing.T) {
+	mockAPI := &mockSDAPI{
+		ListNsResult:   &goldenPathListNamespaces,
+		ListSvcResult:  &goldenPathListServices,
+		DiscInstResult: &goldenPathDiscoverInstances,
+	}
+	w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithPrefix("breaker-"),
+		WithCircuitBreaker(3, time.Hour)).(*watcher)
+
+	steps := []struct {
+		name      string
+		listErr   error
+		wantOpen  bool
+		wantAllow bool
+	}{
+		{name: "first failure", listErr: errors.New("bang"), wantAllow: true},
+		{name: "second failure", listErr: errors.New("bang"), wantAllow: true},
+		{name: "third failure opens", listErr: errors.New("bang"), wantOpen: true},
+		{name: "failed probe stays open", listErr: errors.New("bang"), wantOpen: true},
+		{name: "successful probe closes", wantAllow: true},
+		{name: "failure after closing", listErr: errors.New("bang"), wantAllow: true},
+	}
+	for _, step := range steps {
+		mockAPI.ListNsErr = step.listErr
+		if err := w.Refresh(context.TODO()); (err != nil) != (step.listErr != nil) {
+			t.Fatalf("%s: Refresh() error = %v", step.name, err)
+		}
+		if err := w.Ready(); (err != nil) != step.wantOpen {
+			t.Errorf("%s: Ready() error = %v, want open %v", step.name, err, step.wantOpen)
+		}
+		if got := w.breaker.allow(time.Now()); got != step.wantAllow {
+			t.Errorf("%s: allow() = %v, want %v", step.name, got, step.wantAllow)
+		}
+		if got := w.breaker.allow(time.Now().Add(time.Hour)); !got {
+			t.Errorf("%s: allow() an hour later = false, want a probe", step.name)
+		}
+		want := 0.0
+		if step.wantOpen {
+			want = 1
+		}
+		if got := testutil.ToFloat64(metrics.CloudMapCircuitOpen.WithLabelValues("breaker-")); got != want {
+			t.Errorf("%s: circuit open = %v, want %v", step.name, got, want)
+		}
+	}
+}
+
+func TestWatcher_circuitBreakerDisabled(t *testing.T) {
+	mockAPI := &mockSDAPI{ListNsErr: errors.New("bang")}
+	w := NewWatcherFromClient(mockAPI, provider.NewStore()).(*watcher)
+	for i := 0; i < 2*DefaultBreakerFailures; i++ {
+		_ = w.Refresh(context.TODO())
+	}
+	if err := w.Ready(); err != nil {
+		t.Errorf("Ready() error = %v, want ready without a breaker", err)
+	}
+	if !w.breaker.allow(time.Now()) {
+		t.Error("allow() = false, want every refresh allowed without a breaker")
+	}
+}
+
+// namespacesSDAPI is two namespaces, a.local and b.local, of a service each, whose services fail to list when failing
+type namespacesSDAPI struct {
+	mockSDAPI
+	failing map[string]bool
+}
+
+func (n *namespacesSDAPI) ListNamespaces(context.Context, *servicediscovery.ListNamespacesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	return &servicediscovery.ListNamespacesOutput{Namespaces: []sdTypes.NamespaceSummary{
+		{Id: aws.String("ns-a"), Name: aws.String("a.local")},
+		{Id: aws.String("ns-b"), Name: aws.String("b.local")},
+	}}, nil
+}
+
+func (n *namespacesSDAPI) ListServices(_ context.Context, in *servicediscovery.ListServicesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	id := in.Filters[0].Values[0]
+	if n.failing[id] {
+		return nil, errors.New("access denied")
+	}
+	return &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{
+		{Id: aws.String("srv-" + id), Name: aws.String("web")},
+	}}, nil
+}
+
+func TestWatcher_partialRefresh(t *testing.T) {
+	mockAPI := &namespacesSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+	store := provider.NewStore()
+	w := NewWatcherFromClient(mockAPI, store, WithPrefix("partial-"), WithPartialRefresh()).(*watcher)
+
+	steps := []struct {
+		name        string
+		failing     map[string]bool
+		instance    string
+		wantErr     bool
+		wantA       string
+		wantB       string
+		wantPartial float64
+	}{
+		{name: "b fails before it ever synced", failing: map[string]bool{"ns-b": true}, instance: ipv41, wantErr: true},
+		{name: "both sync", instance: ipv41, wantA: ipv41, wantB: ipv41},
+		{name: "b kept", failing: map[string]bool{"ns-b": true}, instance: ipv42, wantA: ipv42, wantB: ipv41, wantPartial: 1},
+		{
+			name:        "every namespace fails",
+			failing:     map[string]bool{"ns-a": true, "ns-b": true},
+			instance:    ipv41,
+			wantErr:     true,
+			wantA:       ipv42,
+			wantB:       ipv41,
+			wantPartial: 1,
+		},
+	}
+	for _, step := range steps {
+		mockAPI.failing = step.failing
+		mockAPI.DiscInstResult = &servicediscovery.DiscoverInstancesOutput{Instances: []sdTypes.HttpInstanceSummary{
+			{Attributes: map[string]string{"AWS_INSTANCE_IPV4": step.instance}},
+		}}
+		if err := w.Refresh(context.TODO()); (err != nil) != step.wantErr {
+			t.Fatalf("%s: Refresh() error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		hosts := store.Hosts()
+		for host, want := range map[string]string{"web.a.local": step.wantA, "web.b.local": step.wantB} {
+			got := ""
+			if wes := hosts[host]; len(wes) > 0 {
+				got = wes[0].Address
+			}
+			if got != want {
+				t.Errorf("%s: %s address = %q, want %q", step.name, host, got, want)
+			}
+		}
+		if got := testutil.ToFloat64(metrics.CloudMapPartialRefreshes.WithLabelValues("partial-")); got != step.wantPartial {
+			t.Errorf("%s: partial refreshes = %v, want %v", step.name, got, step.wantPartial)
+		}
+	}
+	if _, ok := w.services["srv-ns-b"]; !ok {
+		t.Error("services of the namespace kept aren't synced, want them refreshed by events")
+	}
+}
+
+func TestWatcher_partialRefreshNeverSynced(t *testing.T) {
+	// the first refresh after a restart, when b.local fails, must keep the ServiceEntry published for it before
+	mockAPI := &namespacesSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances},
+		failing: map[string]bool{"ns-b": true}}
+	store := provider.NewStore()
+	w := NewWatcherFromClient(mockAPI, store, WithPartialRefresh()).(*watcher)
+	owner := v1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "istio-registry-sync", UID: "uid"}
+	published := &icapi.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: infer.ServiceEntryName(w.Prefix(), "web.b.local"), Namespace: "default",
+			OwnerReferences: []v1.OwnerReference{owner}},
+		Spec: v1alpha3.ServiceEntry{Hosts: []string{"web.b.local"}},
+	}
+	client := fake.NewSimpleClientset(published).NetworkingV1alpha3().ServiceEntries("default")
+	serviceEntries := serviceentry.New(owner)
+	_ = serviceEntries.Insert(published)
+	s := control.NewSynchronizer(owner, serviceEntries, store, w.Prefix(), client,
+		control.WithStalenessThreshold(time.Minute))
+
+	if err := w.Refresh(context.TODO()); err == nil {
+		t.Fatal("Refresh() error = nil, want it to fail while b.local never synced")
+	}
+	s.Sync(context.TODO())
+	if _, err := client.Get(context.TODO(), published.Name, v1.GetOptions{}); err != nil {
+		t.Errorf("ServiceEntry of web.b.local is gone: %v", err)
+	}
+	if hosts := store.Hosts(); len(hosts) != 0 {
+		t.Errorf("Hosts() = %v, want none until every namespace synced once", hosts)
+	}
+}
@@ -0,0 +1,115 @@
+package cloudmap
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+)
+
+// fileCredentialsTTL is how long credentials read from files are used before the files are read again, in case their
+// rotation went unnoticed
+const fileCredentialsTTL = 5 * time.Minute
+
+// FileCredentials returns AWS credentials read from files, typically a mounted Kubernetes Secret, that are
+// re-read as soon as any of the files is rotated, and at least every 5 minutes. token, the session token of temporary
+// credentials, may be nil.
+func FileCredentials(id, key, token *secret.File) aws.CredentialsProvider {
+	// rather than wait for the credentials to expire, the cache is invalidated as soon as a file changes
+	cache := aws.NewCredentialsCache(fileCredentials{id: id, key: key, token: token})
+	for _, f := range []*secret.File{id, key, token} {
+		if f != nil {
+			f.OnChange(cache.Invalidate)
+		}
+	}
+	return cache
+}
+
+type fileCredentials struct {
+	id, key, token *secret.File
+}
+
+func (f fileCredentials) Retrieve(context.Context) (aws.Credentials, error) {
+	for _, file := range []*secret.File{f.id, f.key, f.token} {
+		if file != nil {
+			file.Reload()
+		}
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     f.id.Value(),
+		SecretAccessKey: f.key.Value(),
+		Source:          "FileCredentials",
+		CanExpire:       true,
+		Expires:         time.Now().Add(fileCredentialsTTL),
+	}
+	if f.token != nil {
+		creds.SessionToken = f.token.Value()
+	}
+	return creds, nil
+}
+
+// defaultSessionName identifies the sessions of assumed roles unless AssumeRole names them
+const defaultSessionName = "istio-registry-sync"
+
+// AssumeRole is a role to read Cloud Map as, e.g. one in another account, assumed with the watcher's other credentials
+type AssumeRole struct {
+	ARN string
+	// ExternalID is passed to STS if set, as the role's trust policy may require
+	ExternalID string
+	// SessionName identifies the watcher's sessions, e.g. in CloudTrail; defaults to "istio-registry-sync"
+	SessionName string
+}
+
+// assumeRoleCredentials returns the credentials of role, assumed through client and renewed before they expire
+func assumeRoleCredentials(client stscreds.AssumeRoleAPIClient, role AssumeRole) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(client, role.ARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = defaultSessionName
+		if role.SessionName != "" {
+			o.RoleSessionName = role.SessionName
+		}
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+	}))
+}
+
+// WebIdentity is a role assumed with a web identity token, e.g. the projected service account token and role that
+// IRSA sets AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN to
+type WebIdentity struct {
+	RoleARN string
+	// TokenFile is re-read whenever the credentials are renewed, as kubelet rotates the token
+	TokenFile string
+	// SessionName identifies the watcher's sessions, e.g. in CloudTrail; defaults to "istio-registry-sync"
+	SessionName string
+}
+
+// webIdentityCredentials returns the credentials of id's role, assumed through client and renewed before they expire
+func webIdentityCredentials(client stscreds.AssumeRoleWithWebIdentityAPIClient, id WebIdentity) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(client, id.RoleARN,
+		stscreds.IdentityTokenFile(id.TokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = defaultSessionName
+			if id.SessionName != "" {
+				o.RoleSessionName = id.SessionName
+			}
+		}))
+}
+
+// checkCredentials retrieves creds, failing with how to provide credentials if there are none
+func checkCredentials(ctx context.Context, creds aws.CredentialsProvider) error {
+	if creds == nil {
+		return errors.New(noCredentials)
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultCallTimeout)
+	defer cancel()
+	if _, err := creds.Retrieve(ctx); err != nil {
+		return errors.Wrap(err, noCredentials)
+	}
+	return nil
+}
+
+const noCredentials = "no usable AWS credentials: use IAM Roles for Service Accounts, i.e. a web identity token " +
+	"file and role ARN, or an access key ID and secret access key"
@@ -0,0 +1,248 @@
+package cloudmap
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	stsTypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+)
+
+func TestFileCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		withToken bool
+	}{
+		{name: "static keys"},
+		{name: "temporary credentials", withToken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dir := t.TempDir()
+			files := map[string]*secret.File{}
+			for _, name := range []string{"id", "key", "token"} {
+				if name == "token" && !tt.withToken {
+					continue
+				}
+				writeFile(t, filepath.Join(dir, name), name+"-1")
+				f, err := secret.Watch(ctx, filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				files[name] = f
+			}
+			creds := FileCredentials(files["id"], files["key"], files["token"])
+			wantToken := func(generation string) string {
+				if tt.withToken {
+					return "token-" + generation
+				}
+				return ""
+			}
+
+			got, err := creds.Retrieve(ctx)
+			if err != nil {
+				t.Fatalf("Retrieve() error = %v", err)
+			}
+			if got.AccessKeyID != "id-1" || got.SecretAccessKey != "key-1" || got.SessionToken != wantToken("1") {
+				t.Errorf("Retrieve() = %+v, want the first generation of credentials", got)
+			}
+			if !got.CanExpire || got.Expires.After(time.Now().Add(fileCredentialsTTL)) {
+				t.Errorf("Retrieve() = %+v, want credentials expiring within %v", got, fileCredentialsTTL)
+			}
+
+			rotated := make(chan struct{}, 1)
+			files["key"].OnChange(func() { rotated <- struct{}{} })
+			for name := range files {
+				writeFile(t, filepath.Join(dir, name), name+"-2")
+			}
+			select {
+			case <-rotated:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the rotation")
+			}
+			// the other files may still be reloading
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				got, err = creds.Retrieve(ctx)
+				if err != nil {
+					t.Fatalf("Retrieve() error = %v", err)
+				}
+				if got.AccessKeyID == "id-2" && got.SecretAccessKey == "key-2" && got.SessionToken == wantToken("2") {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Retrieve() = %+v, want the rotated credentials", got)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestFileCredentials_unnoticedRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dir := t.TempDir()
+	var files []*secret.File
+	for _, name := range []string{"id", "key"} {
+		writeFile(t, filepath.Join(dir, name), name+"-1")
+		f, err := secret.Watch(ctx, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	// stop watching, so only expiry has the files read again
+	cancel()
+	for _, name := range []string{"id", "key"} {
+		writeFile(t, filepath.Join(dir, name), name+"-2")
+	}
+	got, err := fileCredentials{id: files[0], key: files[1]}.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if got.AccessKeyID != "id-2" || got.SecretAccessKey != "key-2" {
+		t.Errorf("Retrieve() = %+v, want the rotated credentials", got)
+	}
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeSTS issues credentials for any role, recording the requests
+type fakeSTS struct {
+	requests            []*sts.AssumeRoleInput
+	webIdentityRequests []*sts.AssumeRoleWithWebIdentityInput
+}
+
+func (f *fakeSTS) AssumeRole(_ context.Context, in *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.requests = append(f.requests, in)
+	return &sts.AssumeRoleOutput{Credentials: &stsTypes.Credentials{
+		AccessKeyId:     aws.String("assumed-id"),
+		SecretAccessKey: aws.String("assumed-key"),
+		SessionToken:    aws.String("assumed-token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	arn := "arn:aws:iam::123456789012:role/cloudmap-reader"
+	tests := []struct {
+		name           string
+		role           AssumeRole
+		wantSession    string
+		wantExternalID *string
+	}{
+		{name: "defaults", role: AssumeRole{ARN: arn}, wantSession: defaultSessionName},
+		{
+			name:           "session name and external ID",
+			role:           AssumeRole{ARN: arn, ExternalID: "tenant-a", SessionName: "east"},
+			wantSession:    "east",
+			wantExternalID: aws.String("tenant-a"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSTS{}
+			creds, err := assumeRoleCredentials(client, tt.role).Retrieve(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if creds.AccessKeyID != "assumed-id" || creds.SessionToken != "assumed-token" {
+				t.Errorf("Retrieve() = %+v, want the assumed role's credentials", creds)
+			}
+			if len(client.requests) != 1 {
+				t.Fatalf("AssumeRole called %d times, want once", len(client.requests))
+			}
+			in := client.requests[0]
+			if aws.ToString(in.RoleArn) != arn || aws.ToString(in.RoleSessionName) != tt.wantSession {
+				t.Errorf("AssumeRole(%s, %s), want (%s, %s)", aws.ToString(in.RoleArn), aws.ToString(in.RoleSessionName), arn, tt.wantSession)
+			}
+			if aws.ToString(in.ExternalId) != aws.ToString(tt.wantExternalID) {
+				t.Errorf("AssumeRole external ID = %q, want %q", aws.ToString(in.ExternalId), aws.ToString(tt.wantExternalID))
+			}
+		})
+	}
+}
+
+func (f *fakeSTS) AssumeRoleWithWebIdentity(_ context.Context, in *sts.AssumeRoleWithWebIdentityInput, _ ...func(*sts.Options)) (
+	*sts.AssumeRoleWithWebIdentityOutput, error) {
+	f.webIdentityRequests = append(f.webIdentityRequests, in)
+	// already expired, so every Retrieve assumes the role again
+	return &sts.AssumeRoleWithWebIdentityOutput{Credentials: &stsTypes.Credentials{
+		AccessKeyId:     aws.String("web-identity-id"),
+		SecretAccessKey: aws.String("web-identity-key"),
+		SessionToken:    aws.String("web-identity-token"),
+		Expiration:      aws.Time(time.Now()),
+	}}, nil
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeFile(t, tokenFile, "jwt-1")
+	client := &fakeSTS{}
+	id := WebIdentity{RoleARN: "arn:aws:iam::123456789012:role/cloudmap-reader", TokenFile: tokenFile}
+	creds := webIdentityCredentials(client, id)
+
+	// kubelet rotates the token; each renewal reads the current one
+	for _, token := range []string{"jwt-1", "jwt-2"} {
+		writeFile(t, tokenFile, token)
+		got, err := creds.Retrieve(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.AccessKeyID != "web-identity-id" {
+			t.Errorf("Retrieve() = %+v, want the role's credentials", got)
+		}
+		in := client.webIdentityRequests[len(client.webIdentityRequests)-1]
+		if aws.ToString(in.WebIdentityToken) != token {
+			t.Errorf("AssumeRoleWithWebIdentity token = %q, want %q", aws.ToString(in.WebIdentityToken), token)
+		}
+		if aws.ToString(in.RoleArn) != id.RoleARN || aws.ToString(in.RoleSessionName) != defaultSessionName {
+			t.Errorf("AssumeRoleWithWebIdentity(%s, %s), want (%s, %s)",
+				aws.ToString(in.RoleArn), aws.ToString(in.RoleSessionName), id.RoleARN, defaultSessionName)
+		}
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		creds   aws.CredentialsProvider
+		wantErr bool
+	}{
+		{name: "usable", creds: credentials.NewStaticCredentialsProvider("id", "secret", "")},
+		{name: "none", wantErr: true},
+		{
+			name: "failing",
+			creds: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+				return aws.Credentials{}, errors.New("no EC2 IMDS role found")
+			}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCredentials(context.TODO(), tt.creds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "IAM Roles for Service Accounts") {
+				t.Errorf("checkCredentials() error = %v, want it to explain how to provide credentials", err)
+			}
+		})
+	}
+}
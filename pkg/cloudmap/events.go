@@ -0,0 +1,153 @@
+package cloudmap
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// defaultResync is how often a watcher driven by events reads the whole registry, in case an event was missed
+const defaultResync = 5 * time.Minute
+
+// receiveBackoff is how long the watcher waits to receive events again after failing to
+const receiveBackoff = 5 * time.Second
+
+// instanceEvents change the instances of a single service, so only that service needs discovering again
+var instanceEvents = map[string]bool{
+	"RegisterInstance":                 true,
+	"DeregisterInstance":               true,
+	"UpdateInstanceCustomHealthStatus": true,
+}
+
+// WithEvents refreshes the services whose instances q says changed as soon as it does, and reads the whole registry
+// only every resync, defaulting to 5 minutes, rather than every 5 seconds. Any other event, e.g. of a service created,
+// refreshes the whole registry.
+func WithEvents(q Queue, resync time.Duration) Option {
+	return func(w *watcher) {
+		if resync <= 0 {
+			resync = defaultResync
+		}
+		w.events, w.interval = q, resync
+	}
+}
+
+// WithSQSEvents is WithEvents with the SQS queue at queueURL, read with the watcher's region and credentials. It only
+// applies to watchers returned by NewWatcher.
+func WithSQSEvents(queueURL string, resync time.Duration) Option {
+	return func(w *watcher) {
+		w.queueURL, w.resync = queueURL, resync
+	}
+}
+
+// serviceRef is a service of the registry, by which an event's service ID is refreshed
+type serviceRef struct {
+	service   sdTypes.ServiceSummary
+	namespace sdTypes.NamespaceSummary
+}
+
+// event is what the watcher needs of an EventBridge event of a Cloud Map API call recorded by CloudTrail
+type event struct {
+	Detail struct {
+		EventName         string `json:"eventName"`
+		RequestParameters struct {
+			ServiceID string `json:"serviceId"`
+		} `json:"requestParameters"`
+	} `json:"detail"`
+}
+
+// serviceOf returns the ID of the service whose instances the event in body changed, or false if the event may have
+// changed more, or can't be told
+func serviceOf(body string) (string, bool) {
+	var e event
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		log.Warnf("refreshing everything for an event that isn't an EventBridge event: %v", err)
+		return "", false
+	}
+	id := e.Detail.RequestParameters.ServiceID
+	return id, instanceEvents[e.Detail.EventName] && id != ""
+}
+
+// receive refreshes the services the watcher's events say changed until ctx is cancelled
+func (w *watcher) receive(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := w.events.Receive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("failed to receive Cloud Map events, relying on resyncs every %v: %v", w.interval, err)
+				select {
+				case <-time.After(receiveBackoff):
+				case <-ctx.Done():
+				}
+			}
+			continue
+		}
+		if len(msgs) == 0 {
+			// nothing changed while we listened, so the store is as current as it gets
+			w.store.Synced()
+			continue
+		}
+		if err := w.handle(ctx, msgs); err != nil {
+			log.Errorf("failed to refresh for %d Cloud Map events, leaving them to be redelivered: %v", len(msgs), err)
+			continue
+		}
+		if err := w.events.Delete(ctx, msgs); err != nil {
+			log.Errorf("failed to delete %d handled Cloud Map events: %v", len(msgs), err)
+		}
+	}
+}
+
+// handle refreshes the services msgs changed, or the whole registry if any of them may have changed more
+func (w *watcher) handle(ctx context.Context, msgs []Message) error {
+	ids := make(map[string]struct{}, len(msgs))
+	for _, m := range msgs {
+		id, ok := serviceOf(m.Body)
+		if !ok {
+			return w.refreshStore(ctx)
+		}
+		ids[id] = struct{}{}
+	}
+	return w.refreshServices(ctx, ids)
+}
+
+// refreshServices discovers the instances of the services with ids again, updating only their hosts. Services the
+// last refresh didn't find are left to the next resync, as they're either new or in namespaces that aren't watched.
+func (w *watcher) refreshServices(ctx context.Context, ids map[string]struct{}) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	updated := make(map[string][]*v1alpha3.WorkloadEntry, len(ids))
+	for id := range ids {
+		ref, ok := w.services[id]
+		if !ok {
+			log.Debugf("skipping event of Cloud Map service %s, which isn't synced", id)
+			continue
+		}
+		wes, err := w.workloadEntriesForService(ctx, &ref.service, &ref.namespace)
+		if err != nil {
+			return err
+		}
+		host := w.host(&ref.service, &ref.namespace)
+		log.Infof("%v Workload Entries found for %q after an event", len(wes), host)
+		updated[host] = wes
+		if hosts := w.namespaceHosts[aws.ToString(ref.namespace.Id)]; hosts != nil {
+			hosts[host] = wes
+		}
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+	var dropped []provider.Dropped
+	for _, d := range w.cache {
+		dropped = append(dropped, d.dropped...)
+	}
+	w.drops.Set(dropped)
+	w.snapshot = 0
+	w.store.Apply(provider.Delta{Updated: updated})
+	return nil
+}
@@ -0,0 +1,135 @@
+package cloudmap
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// eventBody is the body of an SQS message of an EventBridge rule matching Cloud Map API calls
+func eventBody(eventName, serviceID string) string {
+	return `{"version": "0", "detail-type": "AWS API Call via CloudTrail", "source": "aws.servicediscovery",
+		"detail": {"eventName": "` + eventName + `", "requestParameters": {"serviceId": "` + serviceID + `"}}}`
+}
+
+func TestServiceOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		want   string
+		wantOK bool
+	}{
+		{name: "register", body: eventBody("RegisterInstance", "srv-1"), want: "srv-1", wantOK: true},
+		{name: "deregister", body: eventBody("DeregisterInstance", "srv-1"), want: "srv-1", wantOK: true},
+		{name: "health", body: eventBody("UpdateInstanceCustomHealthStatus", "srv-1"), want: "srv-1", wantOK: true},
+		{name: "service deleted", body: eventBody("DeleteService", "srv-1"), want: "srv-1"},
+		{name: "no service", body: eventBody("RegisterInstance", "")},
+		{name: "not JSON", body: "RegisterInstance srv-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := serviceOf(tt.body)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("serviceOf() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWatcher_handle(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []Message
+		// the services discovered again, as "service.namespace"
+		want []string
+	}{
+		{
+			name: "instance events",
+			msgs: []Message{
+				{Body: eventBody("RegisterInstance", "srv-a-ns-1")},
+				{Body: eventBody("DeregisterInstance", "srv-a-ns-1")},
+				{Body: eventBody("RegisterInstance", "srv-b-ns-2")},
+			},
+			want: []string{"a.one.io", "b.two.io"},
+		},
+		{name: "unsynced service", msgs: []Message{{Body: eventBody("RegisterInstance", "srv-c-ns-1")}}},
+		{
+			name: "service event",
+			msgs: []Message{{Body: eventBody("RegisterInstance", "srv-a-ns-1")}, {Body: eventBody("CreateService", "")}},
+			want: []string{"a.one.io", "a.two.io", "b.one.io", "b.two.io"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithEvents(&fakeQueue{}, 0)).(*watcher)
+			if err := w.Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			mockAPI.discovered = nil
+			if err := w.handle(context.TODO(), tt.msgs); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, in := range mockAPI.discovered {
+				got = append(got, aws.ToString(in.ServiceName)+"."+aws.ToString(in.NamespaceName))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discovered %v again, want %v", got, tt.want)
+			}
+			if len(w.Store().Hosts()) != 4 {
+				t.Errorf("store has %d hosts, want all 4 kept", len(w.Store().Hosts()))
+			}
+		})
+	}
+}
+
+func TestWatcher_receive(t *testing.T) {
+	q := &fakeQueue{batches: make(chan []Message, 1), deleted: make(chan []Message, 1)}
+	mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+	w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithEvents(q, 0)).(*watcher)
+	if w.interval != defaultResync {
+		t.Errorf("interval = %v, want resyncs every %v", w.interval, defaultResync)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	msgs := []Message{{ReceiptHandle: "r-1", Body: eventBody("RegisterInstance", "srv-a-ns-1")}}
+	q.batches <- msgs
+	select {
+	case got := <-q.deleted:
+		if !reflect.DeepEqual(got, msgs) {
+			t.Errorf("deleted %v, want %v", got, msgs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was never handled")
+	}
+}
+
+// fakeQueue delivers the batches sent to it, recording those deleted
+type fakeQueue struct {
+	batches chan []Message
+	deleted chan []Message
+}
+
+func (q *fakeQueue) Receive(ctx context.Context) ([]Message, error) {
+	select {
+	case msgs := <-q.batches:
+		return msgs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *fakeQueue) Delete(_ context.Context, msgs []Message) error {
+	q.deleted <- msgs
+	return nil
+}
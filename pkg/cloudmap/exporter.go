@@ -0,0 +1,319 @@
+package cloudmap
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/pkg/errors"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ExportAnnotation on a Kubernetes Service names the Cloud Map service to register its endpoints in by the host
+	// it's synced as, <service>.<namespace>
+	ExportAnnotation = "istio-registry-sync.tetrate.io/cloudmap-export"
+	// OwnerAttribute of the instances an exporter registers holds its owner, so it only ever deregisters its own
+	OwnerAttribute = "ISTIO_REGISTRY_SYNC_OWNER"
+	// ServiceAttribute of the instances an exporter registers holds their Kubernetes Service, as <namespace>/<name>
+	ServiceAttribute = "KUBERNETES_SERVICE"
+
+	// defaultExportInterval is how often an exporter registers Services unless WithExportInterval says otherwise
+	defaultExportInterval = 30 * time.Second
+)
+
+// RegistrationClient is what an exporter needs of the Cloud Map client
+type RegistrationClient interface {
+	ListNamespaces(ctx context.Context, params *servicediscovery.ListNamespacesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListNamespacesOutput, error)
+	ListServices(ctx context.Context, params *servicediscovery.ListServicesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListServicesOutput, error)
+	ListInstances(ctx context.Context, params *servicediscovery.ListInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListInstancesOutput, error)
+	RegisterInstance(ctx context.Context, params *servicediscovery.RegisterInstanceInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.RegisterInstanceOutput, error)
+	DeregisterInstance(ctx context.Context, params *servicediscovery.DeregisterInstanceInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.DeregisterInstanceOutput, error)
+}
+
+// NewRegistrationClient returns the Cloud Map client of region for an exporter, built from the options as NewWatcher
+// builds its own
+func NewRegistrationClient(ctx context.Context, region, id, secret string, opts ...Option) (RegistrationClient, error) {
+	o := &watcher{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	cfg, err := o.config(ctx, region, id, secret)
+	if err != nil {
+		return nil, err
+	}
+	return o.client(cfg), nil
+}
+
+// ExportOption configures optional behaviour of the exporter
+type ExportOption func(*Exporter)
+
+// WithExportInterval registers Services every interval rather than every 30 seconds
+func WithExportInterval(interval time.Duration) ExportOption {
+	return func(e *Exporter) {
+		e.interval = interval
+	}
+}
+
+// Exporter registers the ready endpoints of the Kubernetes Services annotated with ExportAnnotation as instances of
+// the Cloud Map services the annotations name, and deregisters them once they're gone, making the mesh's services
+// discoverable outside of it
+type Exporter struct {
+	cloudmap RegistrationClient
+	kube     kubernetes.Interface
+	owner    string
+	interval time.Duration
+
+	// the IDs of the Cloud Map services that may hold instances of ours; nil until the first sync looked in every one
+	known map[string]bool
+}
+
+// NewExporter returns an exporter registering instances through client, marked as owner's, e.g. the operator's ID
+func NewExporter(client RegistrationClient, kube kubernetes.Interface, owner string, opts ...ExportOption) *Exporter {
+	e := &Exporter{cloudmap: client, kube: kube, owner: owner, interval: defaultExportInterval}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.interval <= 0 {
+		e.interval = defaultExportInterval
+	}
+	return e
+}
+
+// Run the exporter until the context is cancelled
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	if err := e.Sync(ctx); err != nil {
+		log.Errorf("error exporting Services to Cloud Map: %v", err)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Sync(ctx); err != nil {
+				log.Errorf("error exporting Services to Cloud Map: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync registers the instances of the annotated Services that aren't yet, and deregisters those of ours that are
+// gone, once
+func (e *Exporter) Sync(ctx context.Context) error {
+	services, err := e.kube.CoreV1().Services(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list Services to export")
+	}
+	var exported []exportedService
+	for _, svc := range services.Items {
+		if host := svc.Annotations[ExportAnnotation]; host != "" {
+			exported = append(exported, exportedService{namespace: svc.Namespace, name: svc.Name, host: host})
+		}
+	}
+	if len(exported) == 0 && e.known != nil && len(e.known) == 0 {
+		return nil
+	}
+	ids, err := e.serviceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]map[string]map[string]string) // instances by ID by Cloud Map service ID
+	for _, s := range exported {
+		id, ok := ids[s.host]
+		if !ok {
+			log.Warnf("not exporting Service %s/%s: there's no Cloud Map service %q", s.namespace, s.name, s.host)
+			continue
+		}
+		instances, err := e.instances(ctx, s)
+		if err != nil {
+			return err
+		}
+		if want[id] == nil {
+			want[id] = make(map[string]map[string]string)
+		}
+		for instanceID, attributes := range instances {
+			want[id][instanceID] = attributes
+		}
+	}
+	reconcile := e.known
+	if reconcile == nil {
+		// instances of ours may be left from before a restart anywhere
+		reconcile = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			reconcile[id] = true
+		}
+	}
+	for id := range want {
+		reconcile[id] = true
+	}
+	known := make(map[string]bool, len(want))
+	var failed []string
+	for id := range reconcile {
+		if err := e.reconcile(ctx, id, want[id]); err != nil {
+			// it may still hold instances of ours to deregister
+			known[id] = true
+			failed = append(failed, err.Error())
+			continue
+		}
+		if len(want[id]) > 0 {
+			known[id] = true
+		}
+	}
+	e.known = known
+	if len(failed) > 0 {
+		return errors.Errorf("failed to export to %d Cloud Map services, the first: %s", len(failed), failed[0])
+	}
+	return nil
+}
+
+// exportedService is a Kubernetes Service annotated with the host of the Cloud Map service it's exported to
+type exportedService struct {
+	namespace, name, host string
+}
+
+// serviceIDs returns the ID of every Cloud Map service by its host
+func (e *Exporter) serviceIDs(ctx context.Context) (map[string]string, error) {
+	var namespaces []sdTypes.NamespaceSummary
+	nsPages := servicediscovery.NewListNamespacesPaginator(e.cloudmap, &servicediscovery.ListNamespacesInput{})
+	for nsPages.HasMorePages() {
+		callCtx, cancel := context.WithTimeout(ctx, defaultCallTimeout)
+		page, err := nsPages.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list Cloud Map namespaces to export to")
+		}
+		namespaces = append(namespaces, page.Namespaces...)
+	}
+	ids := make(map[string]string)
+	for _, ns := range namespaces {
+		pages := servicediscovery.NewListServicesPaginator(e.cloudmap, &servicediscovery.ListServicesInput{
+			Filters: []sdTypes.ServiceFilter{
+				{Name: serviceFilterNamespaceID, Values: []string{aws.ToString(ns.Id)}, Condition: filterConditionEquals},
+			},
+		})
+		for pages.HasMorePages() {
+			callCtx, cancel := context.WithTimeout(ctx, defaultCallTimeout)
+			page, err := pages.NextPage(callCtx)
+			cancel()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to list the services of Cloud Map namespace %q to export to",
+					aws.ToString(ns.Name))
+			}
+			for _, svc := range page.Services {
+				ids[fmt.Sprintf("%v.%v", aws.ToString(svc.Name), aws.ToString(ns.Name))] = aws.ToString(svc.Id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// instances returns the attributes of the instances s's ready IPv4 endpoints are registered as, by instance ID
+func (e *Exporter) instances(ctx context.Context, s exportedService) (map[string]map[string]string, error) {
+	slices, err := e.kube.DiscoveryV1().EndpointSlices(s.namespace).List(ctx,
+		v1.ListOptions{LabelSelector: discoveryv1.LabelServiceName + "=" + s.name})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the EndpointSlices of Service %s/%s", s.namespace, s.name)
+	}
+	instances := make(map[string]map[string]string)
+	for _, slice := range slices.Items {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+			continue
+		}
+		var port string
+		for _, p := range slice.Ports {
+			if p.Port != nil {
+				port = strconv.Itoa(int(*p.Port))
+				break
+			}
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, address := range ep.Addresses {
+				attributes := map[string]string{
+					"AWS_INSTANCE_IPV4": address,
+					OwnerAttribute:      e.owner,
+					ServiceAttribute:    s.namespace + "/" + s.name,
+				}
+				if port != "" {
+					attributes["AWS_INSTANCE_PORT"] = port
+				}
+				instances[e.instanceID(s, address)] = attributes
+			}
+		}
+	}
+	return instances, nil
+}
+
+// instanceID returns the ID of the instance address of s is registered as, unique to the owner and Service, as more
+// than one may be exported to the same Cloud Map service
+func (e *Exporter) instanceID(s exportedService, address string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(e.owner + "/" + s.namespace + "/" + s.name))
+	return fmt.Sprintf("k8s-%08x-%s", h.Sum32(), address)
+}
+
+// reconcile registers the instances of want in the Cloud Map service with id that aren't already, and deregisters
+// those of ours it holds that aren't wanted
+func (e *Exporter) reconcile(ctx context.Context, id string, want map[string]map[string]string) error {
+	have := make(map[string]map[string]string)
+	pages := servicediscovery.NewListInstancesPaginator(e.cloudmap, &servicediscovery.ListInstancesInput{ServiceId: aws.String(id)})
+	for pages.HasMorePages() {
+		callCtx, cancel := context.WithTimeout(ctx, defaultCallTimeout)
+		page, err := pages.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "failed to list the instances of Cloud Map service %s", id)
+		}
+		for _, instance := range page.Instances {
+			if instance.Attributes[OwnerAttribute] == e.owner {
+				have[aws.ToString(instance.Id)] = instance.Attributes
+			}
+		}
+	}
+	for instanceID, attributes := range want {
+		if reflect.DeepEqual(have[instanceID], attributes) {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, defaultCallTimeout)
+		_, err := e.cloudmap.RegisterInstance(callCtx, &servicediscovery.RegisterInstanceInput{
+			ServiceId:  aws.String(id),
+			InstanceId: aws.String(instanceID),
+			Attributes: attributes,
+		})
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "failed to register instance %s of Cloud Map service %s", instanceID, id)
+		}
+		log.Infof("registered instance %s of Cloud Map service %s for Service %s", instanceID, id, attributes[ServiceAttribute])
+	}
+	for instanceID := range have {
+		if _, ok := want[instanceID]; ok {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, defaultCallTimeout)
+		_, err := e.cloudmap.DeregisterInstance(callCtx, &servicediscovery.DeregisterInstanceInput{
+			ServiceId:  aws.String(id),
+			InstanceId: aws.String(instanceID),
+		})
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "failed to deregister instance %s of Cloud Map service %s", instanceID, id)
+		}
+		log.Infof("deregistered instance %s of Cloud Map service %s", instanceID, id)
+	}
+	return nil
+}
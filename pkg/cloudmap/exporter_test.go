@@ -0,0 +1,170 @@
+package cloudmap
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// registrySDAPI is a Cloud Map namespace apps.local whose services' instances can be registered and deregistered
+type registrySDAPI struct {
+	m         sync.Mutex
+	instances map[string]map[string]map[string]string // attributes by instance ID by service ID
+	writes    int
+}
+
+func (r *registrySDAPI) ListNamespaces(context.Context, *servicediscovery.ListNamespacesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	return &servicediscovery.ListNamespacesOutput{Namespaces: []sdTypes.NamespaceSummary{
+		{Id: aws.String("ns-1"), Name: aws.String("apps.local")},
+	}}, nil
+}
+
+func (r *registrySDAPI) ListServices(context.Context, *servicediscovery.ListServicesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	return &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{
+		{Id: aws.String("srv-web"), Name: aws.String("web")},
+		{Id: aws.String("srv-api"), Name: aws.String("api")},
+	}}, nil
+}
+
+func (r *registrySDAPI) ListInstances(_ context.Context, in *servicediscovery.ListInstancesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListInstancesOutput, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	out := &servicediscovery.ListInstancesOutput{}
+	for id, attributes := range r.instances[aws.ToString(in.ServiceId)] {
+		out.Instances = append(out.Instances, sdTypes.InstanceSummary{Id: aws.String(id), Attributes: attributes})
+	}
+	return out, nil
+}
+
+func (r *registrySDAPI) RegisterInstance(_ context.Context, in *servicediscovery.RegisterInstanceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.RegisterInstanceOutput, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.writes++
+	service := aws.ToString(in.ServiceId)
+	if r.instances[service] == nil {
+		r.instances[service] = map[string]map[string]string{}
+	}
+	r.instances[service][aws.ToString(in.InstanceId)] = in.Attributes
+	return &servicediscovery.RegisterInstanceOutput{}, nil
+}
+
+func (r *registrySDAPI) DeregisterInstance(_ context.Context, in *servicediscovery.DeregisterInstanceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.DeregisterInstanceOutput, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.writes++
+	delete(r.instances[aws.ToString(in.ServiceId)], aws.ToString(in.InstanceId))
+	return &servicediscovery.DeregisterInstanceOutput{}, nil
+}
+
+// addresses returns the address and port of every instance of service, with ours marked with a star
+func (r *registrySDAPI) addresses(service string) []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	var addresses []string
+	for _, attributes := range r.instances[service] {
+		address := attributes["AWS_INSTANCE_IPV4"] + ":" + attributes["AWS_INSTANCE_PORT"]
+		if attributes[OwnerAttribute] == "operator" {
+			address += "*"
+		}
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestExporter_Sync(t *testing.T) {
+	cloudmap := &registrySDAPI{instances: map[string]map[string]map[string]string{
+		"srv-web": {"ecs-task-1": {"AWS_INSTANCE_IPV4": "10.1.0.1", "AWS_INSTANCE_PORT": "80"}},
+		// left behind by a previous run, and not exported anymore
+		"srv-api": {"k8s-00000000-10.0.0.9": {"AWS_INSTANCE_IPV4": "10.0.0.9", OwnerAttribute: "operator"}},
+	}}
+	service := func(name, host string) *corev1.Service {
+		svc := &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"}}
+		if host != "" {
+			svc.Annotations = map[string]string{ExportAnnotation: host}
+		}
+		return svc
+	}
+	ready := func(ready bool) discoveryv1.EndpointConditions { return discoveryv1.EndpointConditions{Ready: &ready} }
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta:  v1.ObjectMeta{Name: "web-1", Namespace: "default", Labels: map[string]string{discoveryv1.LabelServiceName: "web"}},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Port: aws.Int32(8080)}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Conditions: ready(true)},
+			{Addresses: []string{"10.0.0.2"}, Conditions: ready(false)},
+		},
+	}
+	kube := fake.NewSimpleClientset(service("web", "web.apps.local"), service("missing", "missing.apps.local"),
+		service("plain", ""), slice)
+	e := NewExporter(cloudmap, kube, "operator")
+
+	steps := []struct {
+		name       string
+		update     func(t *testing.T)
+		wantWeb    []string
+		wantAPI    []string
+		wantWrites int
+	}{
+		{
+			name:       "registers ready endpoints and deregisters leftovers of ours",
+			wantWeb:    []string{"10.0.0.1:8080*", "10.1.0.1:80"},
+			wantWrites: 2,
+		},
+		{name: "leaves registered instances alone", wantWeb: []string{"10.0.0.1:8080*", "10.1.0.1:80"}},
+		{
+			name: "registers endpoints turning ready",
+			update: func(t *testing.T) {
+				slice.Endpoints[1].Conditions = ready(true)
+				if _, err := kube.DiscoveryV1().EndpointSlices("default").Update(context.TODO(), slice, v1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantWeb:    []string{"10.0.0.1:8080*", "10.0.0.2:8080*", "10.1.0.1:80"},
+			wantWrites: 1,
+		},
+		{
+			name: "deregisters the instances of Services no longer exported",
+			update: func(t *testing.T) {
+				if _, err := kube.CoreV1().Services("default").Update(context.TODO(), service("web", ""), v1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantWeb:    []string{"10.1.0.1:80"},
+			wantWrites: 2,
+		},
+	}
+	for _, step := range steps {
+		if step.update != nil {
+			step.update(t)
+		}
+		cloudmap.writes = 0
+		if err := e.Sync(context.TODO()); err != nil {
+			t.Fatalf("%s: Sync() error = %v", step.name, err)
+		}
+		if got := cloudmap.addresses("srv-web"); !reflect.DeepEqual(got, step.wantWeb) {
+			t.Errorf("%s: web instances = %v, want %v", step.name, got, step.wantWeb)
+		}
+		if got := cloudmap.addresses("srv-api"); !reflect.DeepEqual(got, step.wantAPI) {
+			t.Errorf("%s: api instances = %v, want %v", step.name, got, step.wantAPI)
+		}
+		if cloudmap.writes != step.wantWrites {
+			t.Errorf("%s: %d registrations and deregistrations, want %d", step.name, cloudmap.writes, step.wantWrites)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cloudmap
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+)
+
+// listInstances returns every instance of svc in ns of the health the watcher discovers, listed page by page as
+// DiscoverInstances can't be, bounding each call by the call timeout. Instances of services without health checks
+// are healthy, as DiscoverInstances has them.
+func (w *watcher) listInstances(ctx context.Context, svc *sdTypes.ServiceSummary, ns *sdTypes.NamespaceSummary) (
+	[]sdTypes.HttpInstanceSummary, error) {
+	var listed []sdTypes.InstanceSummary
+	pages := servicediscovery.NewListInstancesPaginator(w.cloudmap, &servicediscovery.ListInstancesInput{ServiceId: svc.Id})
+	for pages.HasMorePages() {
+		callCtx, cancel, err := w.callContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		page, err := pages.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		listed = append(listed, page.Instances...)
+	}
+	checked := svc.HealthCheckConfig != nil || svc.HealthCheckCustomConfig != nil
+	health := make(map[string]sdTypes.HealthStatus)
+	if checked {
+		statuses := servicediscovery.NewGetInstancesHealthStatusPaginator(w.cloudmap,
+			&servicediscovery.GetInstancesHealthStatusInput{ServiceId: svc.Id})
+		for statuses.HasMorePages() {
+			callCtx, cancel, err := w.callContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			page, err := statuses.NextPage(callCtx)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			for id, status := range page.Status {
+				health[id] = status
+			}
+		}
+	}
+	instances := make([]sdTypes.HttpInstanceSummary, 0, len(listed))
+	for _, instance := range listed {
+		status := sdTypes.HealthStatusHealthy
+		if checked {
+			if status = health[aws.ToString(instance.Id)]; status == "" {
+				status = sdTypes.HealthStatusUnknown
+			}
+		}
+		instances = append(instances, sdTypes.HttpInstanceSummary{
+			InstanceId:    instance.Id,
+			NamespaceName: ns.Name,
+			ServiceName:   svc.Name,
+			Attributes:    instance.Attributes,
+			HealthStatus:  status,
+		})
+	}
+	return filterHealth(instances, w.healthStatus), nil
+}
+
+// filterHealth returns the instances filter lets through, as DiscoverInstances would; left empty, only the healthy
+func filterHealth(instances []sdTypes.HttpInstanceSummary, filter sdTypes.HealthStatusFilter) []sdTypes.HttpInstanceSummary {
+	want := sdTypes.HealthStatusHealthy
+	switch filter {
+	case sdTypes.HealthStatusFilterAll:
+		return instances
+	case sdTypes.HealthStatusFilterUnhealthy:
+		want = sdTypes.HealthStatusUnhealthy
+	}
+	var filtered []sdTypes.HttpInstanceSummary
+	for _, instance := range instances {
+		if instance.HealthStatus == want {
+			filtered = append(filtered, instance)
+		}
+	}
+	if len(filtered) == 0 && filter == sdTypes.HealthStatusFilterHealthyOrElseAll {
+		return instances
+	}
+	return filtered
+}
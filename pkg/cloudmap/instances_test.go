@@ -0,0 +1,143 @@
+package cloudmap
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// largeSDAPI is a service with more instances than DiscoverInstances returns, every fourth of them unhealthy
+type largeSDAPI struct {
+	mockSDAPI
+	checked   bool
+	instances int
+}
+
+func (m *largeSDAPI) ListNamespaces(context.Context, *servicediscovery.ListNamespacesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	return &goldenPathListNamespaces, nil
+}
+
+func (m *largeSDAPI) ListServices(context.Context, *servicediscovery.ListServicesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	svc := sdTypes.ServiceSummary{Id: aws.String("srv-large"), Name: aws.String("large")}
+	if m.checked {
+		svc.HealthCheckCustomConfig = &sdTypes.HealthCheckCustomConfig{}
+	}
+	return &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{svc}}, nil
+}
+
+func (m *largeSDAPI) DiscoverInstances(_ context.Context, in *servicediscovery.DiscoverInstancesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.DiscoverInstancesOutput, error) {
+	out := &servicediscovery.DiscoverInstancesOutput{}
+	for i := 0; i < m.instances && i < int(aws.ToInt32(in.MaxResults)); i++ {
+		out.Instances = append(out.Instances, sdTypes.HttpInstanceSummary{Attributes: m.attributes(i)})
+	}
+	return out, nil
+}
+
+// ListInstances returns pages of 100 instances
+func (m *largeSDAPI) ListInstances(_ context.Context, in *servicediscovery.ListInstancesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListInstancesOutput, error) {
+	if aws.ToString(in.ServiceId) != "srv-large" {
+		return nil, fmt.Errorf("unknown service %q", aws.ToString(in.ServiceId))
+	}
+	start, _ := strconv.Atoi(aws.ToString(in.NextToken))
+	out := &servicediscovery.ListInstancesOutput{}
+	for i := start; i < m.instances && i < start+100; i++ {
+		out.Instances = append(out.Instances, sdTypes.InstanceSummary{Id: aws.String(strconv.Itoa(i)), Attributes: m.attributes(i)})
+	}
+	if start+100 < m.instances {
+		out.NextToken = aws.String(strconv.Itoa(start + 100))
+	}
+	return out, nil
+}
+
+func (m *largeSDAPI) GetInstancesHealthStatus(context.Context, *servicediscovery.GetInstancesHealthStatusInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.GetInstancesHealthStatusOutput, error) {
+	out := &servicediscovery.GetInstancesHealthStatusOutput{Status: map[string]sdTypes.HealthStatus{}}
+	for i := 0; i < m.instances; i++ {
+		out.Status[strconv.Itoa(i)] = sdTypes.HealthStatusHealthy
+		if i%4 == 0 {
+			out.Status[strconv.Itoa(i)] = sdTypes.HealthStatusUnhealthy
+		}
+	}
+	return out, nil
+}
+
+func (m *largeSDAPI) attributes(i int) map[string]string {
+	return map[string]string{"AWS_INSTANCE_IPV4": fmt.Sprintf("10.0.%d.%d", i/256, i%256), "AWS_INSTANCE_PORT": "8080"}
+}
+
+func TestWatcher_instanceLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances int
+		checked   bool
+		health    sdTypes.HealthStatusFilter
+		want      int
+		wantHits  float64
+	}{
+		{name: "within the limit", instances: 10, health: sdTypes.HealthStatusFilterHealthy, want: 10},
+		{name: "past the limit", instances: 1250, health: sdTypes.HealthStatusFilterHealthy, want: 1250, wantHits: 1},
+		{name: "healthy past the limit", instances: 1250, checked: true, health: sdTypes.HealthStatusFilterHealthy, want: 937, wantHits: 1},
+		{name: "unhealthy past the limit", instances: 1250, checked: true, health: sdTypes.HealthStatusFilterUnhealthy, want: 313, wantHits: 1},
+		{name: "all past the limit", instances: 1250, checked: true, health: sdTypes.HealthStatusFilterAll, want: 1250, wantHits: 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := fmt.Sprintf("limit-%d-", i)
+			mockAPI := &largeSDAPI{checked: tt.checked, instances: tt.instances}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithPrefix(prefix), WithHealthStatus(tt.health))
+			if err := w.Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(w.Store().Hosts()["large."+hostname]); got != tt.want {
+				t.Errorf("synced %d instances, want %d", got, tt.want)
+			}
+			if got := testutil.ToFloat64(metrics.CloudMapInstanceLimitHits.WithLabelValues(prefix)); got != tt.wantHits {
+				t.Errorf("instance limit hits = %v, want %v", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func Test_filterHealth(t *testing.T) {
+	instances := func(statuses ...sdTypes.HealthStatus) []sdTypes.HttpInstanceSummary {
+		var out []sdTypes.HttpInstanceSummary
+		for _, s := range statuses {
+			out = append(out, sdTypes.HttpInstanceSummary{HealthStatus: s})
+		}
+		return out
+	}
+	healthy, unhealthy, unknown := sdTypes.HealthStatusHealthy, sdTypes.HealthStatusUnhealthy, sdTypes.HealthStatusUnknown
+	tests := []struct {
+		name      string
+		instances []sdTypes.HttpInstanceSummary
+		filter    sdTypes.HealthStatusFilter
+		want      int
+	}{
+		{name: "default", instances: instances(healthy, unhealthy, unknown), want: 1},
+		{name: "healthy", instances: instances(healthy, unhealthy, unknown), filter: sdTypes.HealthStatusFilterHealthy, want: 1},
+		{name: "unhealthy", instances: instances(healthy, unhealthy, unhealthy), filter: sdTypes.HealthStatusFilterUnhealthy, want: 2},
+		{name: "all", instances: instances(healthy, unhealthy, unknown), filter: sdTypes.HealthStatusFilterAll, want: 3},
+		{name: "healthy or else all, some healthy", instances: instances(healthy, unhealthy), filter: sdTypes.HealthStatusFilterHealthyOrElseAll, want: 1},
+		{name: "healthy or else all, none healthy", instances: instances(unhealthy, unknown), filter: sdTypes.HealthStatusFilterHealthyOrElseAll, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(filterHealth(tt.instances, tt.filter)); got != tt.want {
+				t.Errorf("filterHealth() kept %d instances, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package cloudmap
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/aws/smithy-go/middleware"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+// throttles tells the errors of throttled calls apart as the SDK's retryer does
+var throttles = retry.IsErrorThrottles(retry.DefaultThrottles)
+
+// instrument returns client recording the calls, errors, throttles and latency of every operation in the metrics of
+// the watcher with prefix
+func instrument(client ServiceDiscoveryClient, prefix string) ServiceDiscoveryClient {
+	return &instrumentedClient{client: client, prefix: prefix}
+}
+
+type instrumentedClient struct {
+	client ServiceDiscoveryClient
+	prefix string
+}
+
+func (c *instrumentedClient) ListNamespaces(ctx context.Context, in *servicediscovery.ListNamespacesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListNamespacesOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListNamespaces(ctx, in, c.options("ListNamespaces", opts)...)
+	c.observe("ListNamespaces", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) ListServices(ctx context.Context, in *servicediscovery.ListServicesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListServicesOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListServices(ctx, in, c.options("ListServices", opts)...)
+	c.observe("ListServices", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) ListTagsForResource(ctx context.Context, in *servicediscovery.ListTagsForResourceInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListTagsForResourceOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListTagsForResource(ctx, in, c.options("ListTagsForResource", opts)...)
+	c.observe("ListTagsForResource", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) ListInstances(ctx context.Context, in *servicediscovery.ListInstancesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListInstancesOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListInstances(ctx, in, c.options("ListInstances", opts)...)
+	c.observe("ListInstances", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) GetInstancesHealthStatus(ctx context.Context, in *servicediscovery.GetInstancesHealthStatusInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.GetInstancesHealthStatusOutput, error) {
+	start := time.Now()
+	out, err := c.client.GetInstancesHealthStatus(ctx, in, c.options("GetInstancesHealthStatus", opts)...)
+	c.observe("GetInstancesHealthStatus", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) GetNamespace(ctx context.Context, in *servicediscovery.GetNamespaceInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.GetNamespaceOutput, error) {
+	start := time.Now()
+	out, err := c.client.GetNamespace(ctx, in, c.options("GetNamespace", opts)...)
+	c.observe("GetNamespace", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) GetService(ctx context.Context, in *servicediscovery.GetServiceInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.GetServiceOutput, error) {
+	start := time.Now()
+	out, err := c.client.GetService(ctx, in, c.options("GetService", opts)...)
+	c.observe("GetService", start, err)
+	return out, err
+}
+
+func (c *instrumentedClient) DiscoverInstances(ctx context.Context, in *servicediscovery.DiscoverInstancesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.DiscoverInstancesOutput, error) {
+	start := time.Now()
+	out, err := c.client.DiscoverInstances(ctx, in, c.options("DiscoverInstances", opts)...)
+	c.observe("DiscoverInstances", start, err)
+	return out, err
+}
+
+// observe records a call of op that started at start and returned err
+func (c *instrumentedClient) observe(op string, start time.Time, err error) {
+	metrics.CloudMapCalls.WithLabelValues(c.prefix, op).Inc()
+	metrics.CloudMapCallDuration.WithLabelValues(c.prefix, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.CloudMapCallErrors.WithLabelValues(c.prefix, op).Inc()
+	}
+}
+
+// options returns opts counting every throttled attempt of a call of op. The attempts the SDK retries are only seen
+// from within its middleware stack, so clients without one, e.g. fakes, count none.
+func (c *instrumentedClient) options(op string, opts []func(*servicediscovery.Options)) []func(*servicediscovery.Options) {
+	count := middleware.FinalizeMiddlewareFunc("CountThrottles", func(ctx context.Context, in middleware.FinalizeInput,
+		next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		out, md, err := next.HandleFinalize(ctx, in)
+		if err != nil && throttles.IsErrorThrottle(err) == aws.TrueTernary {
+			metrics.CloudMapThrottles.WithLabelValues(c.prefix, op).Inc()
+		}
+		return out, md, err
+	})
+	return append(opts[:len(opts):len(opts)], func(o *servicediscovery.Options) {
+		// added last, so after the retry middleware, to see each attempt
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Finalize.Add(count, middleware.After)
+		})
+	})
+}
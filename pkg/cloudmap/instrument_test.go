@@ -0,0 +1,82 @@
+package cloudmap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestInstrument(t *testing.T) {
+	tests := []struct {
+		name string
+		// responses of the calls to ListNamespaces, in order, the last repeated
+		responses    []int
+		wantErr      bool
+		wantThrottle float64
+	}{
+		{name: "success", responses: []int{http.StatusOK}},
+		{name: "throttled then retried", responses: []int{http.StatusBadRequest, http.StatusOK}, wantThrottle: 1},
+		{name: "throttled every time", responses: []int{http.StatusBadRequest}, wantErr: true, wantThrottle: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m sync.Mutex
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				m.Lock()
+				status := tt.responses[len(tt.responses)-1]
+				if calls < len(tt.responses) {
+					status = tt.responses[calls]
+				}
+				calls++
+				m.Unlock()
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				w.WriteHeader(status)
+				if status != http.StatusOK {
+					_, _ = w.Write([]byte(`{"__type":"RequestLimitExceeded","Message":"slow down"}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"Namespaces":[]}`))
+			}))
+			defer server.Close()
+
+			prefix := "instrument-" + tt.name + "-"
+			w, err := NewWatcher(context.TODO(), provider.NewStore(), "us-east-1", "", "",
+				WithCredentials(credentials.NewStaticCredentialsProvider("test", "test", "")), WithEndpoint(server.URL),
+				WithRetries(Retries{MaxAttempts: 2, MaxBackoff: time.Millisecond}), WithPrefix(prefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.(provider.Checker).Check(context.TODO())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := testutil.ToFloat64(metrics.CloudMapCalls.WithLabelValues(prefix, "ListNamespaces")); got != 1 {
+				t.Errorf("calls = %v, want 1 however often retried", got)
+			}
+			wantErrors := 0.0
+			if tt.wantErr {
+				wantErrors = 1
+			}
+			if got := testutil.ToFloat64(metrics.CloudMapCallErrors.WithLabelValues(prefix, "ListNamespaces")); got != wantErrors {
+				t.Errorf("errors = %v, want %v", got, wantErrors)
+			}
+			if got := testutil.ToFloat64(metrics.CloudMapThrottles.WithLabelValues(prefix, "ListNamespaces")); got != tt.wantThrottle {
+				t.Errorf("throttles = %v, want %v", got, tt.wantThrottle)
+			}
+			if got := testutil.CollectAndCount(metrics.CloudMapCallDuration); got == 0 {
+				t.Error("no call durations observed")
+			}
+		})
+	}
+}
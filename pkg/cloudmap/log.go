@@ -0,0 +1,5 @@
+package cloudmap
+
+import "github.com/tetratelabs/istio-registry-sync/pkg/logging"
+
+var log = logging.RegisterScope("cloudmap")
@@ -0,0 +1,106 @@
+package cloudmap
+
+import (
+	"context"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/pkg/errors"
+)
+
+// namespaceID matches the IDs Cloud Map gives namespaces, e.g. ns-abcdef0123456789, as opposed to their names
+var namespaceID = regexp.MustCompile(`^ns-[a-z0-9]{16}$`)
+
+// WithNamespaceLookup looks up the namespaces WithNamespaces allows rather than listing every namespace of the
+// account: those given by ID with GetNamespace, which IAM policies can scope to the namespaces' ARNs, and those given
+// by name with ListNamespaces filtered by name. Namespaces that no longer exist are skipped.
+func WithNamespaceLookup() Option {
+	return func(w *watcher) {
+		w.lookup = true
+	}
+}
+
+// namespaces returns the namespaces to sync, if they're allowed: those looked up with WithNamespaceLookup, or else
+// every namespace
+func (w *watcher) namespaces(ctx context.Context) ([]sdTypes.NamespaceSummary, error) {
+	if w.lookup {
+		return w.lookupNamespaces(ctx)
+	}
+	return w.listNamespaces(ctx)
+}
+
+// lookupNamespaces returns the namespaces WithNamespaces allows by ID or by name, in that order, bounding each call by
+// the call timeout
+func (w *watcher) lookupNamespaces(ctx context.Context) ([]sdTypes.NamespaceSummary, error) {
+	var ids, names []string
+	for ns := range w.allow {
+		if namespaceID.MatchString(ns) {
+			ids = append(ids, ns)
+		} else {
+			names = append(names, ns)
+		}
+	}
+	sort.Strings(ids)
+	sort.Strings(names)
+	var namespaces []sdTypes.NamespaceSummary
+	for _, id := range ids {
+		ns, err := w.getNamespace(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ns != nil {
+			namespaces = append(namespaces, *ns)
+		}
+	}
+	for _, name := range names {
+		pages := servicediscovery.NewListNamespacesPaginator(w.cloudmap, &servicediscovery.ListNamespacesInput{
+			Filters: []sdTypes.NamespaceFilter{{
+				Name:      sdTypes.NamespaceFilterNameName,
+				Values:    []string{name},
+				Condition: filterConditionEquals,
+			}},
+		})
+		found := false
+		for pages.HasMorePages() {
+			callCtx, cancel, err := w.callContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			page, err := pages.NextPage(callCtx)
+			cancel()
+			if err != nil {
+				return nil, errors.Wrapf(err, "error looking up Cloud Map namespace %q", name)
+			}
+			namespaces = append(namespaces, page.Namespaces...)
+			found = found || len(page.Namespaces) > 0
+		}
+		if !found {
+			log.Warnf("skipping Cloud Map namespace %q, which doesn't exist", name)
+		}
+	}
+	return namespaces, nil
+}
+
+// getNamespace returns the summary of the namespace with id, or nil if it doesn't exist
+func (w *watcher) getNamespace(ctx context.Context, id string) (*sdTypes.NamespaceSummary, error) {
+	callCtx, cancel, err := w.callContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	out, err := w.cloudmap.GetNamespace(callCtx, &servicediscovery.GetNamespaceInput{Id: aws.String(id)})
+	var notFound *sdTypes.NamespaceNotFound
+	if errors.As(err, &notFound) {
+		log.Warnf("skipping Cloud Map namespace %s, which doesn't exist", id)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up Cloud Map namespace %s", id)
+	}
+	ns := out.Namespace
+	return &sdTypes.NamespaceSummary{Arn: ns.Arn, CreateDate: ns.CreateDate, Description: ns.Description, Id: ns.Id,
+		Name: ns.Name, Properties: ns.Properties, ServiceCount: ns.ServiceCount, Type: ns.Type}, nil
+}
@@ -0,0 +1,98 @@
+package cloudmap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// lookupSDAPI only allows looking up namespaces, as credentials scoped to some namespaces would
+type lookupSDAPI struct {
+	mockSDAPI
+	namespaces []sdTypes.NamespaceSummary
+	gets       int
+}
+
+func (l *lookupSDAPI) ListNamespaces(_ context.Context, in *servicediscovery.ListNamespacesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	if len(in.Filters) != 1 || in.Filters[0].Name != sdTypes.NamespaceFilterNameName || len(in.Filters[0].Values) != 1 {
+		return nil, errors.New("access denied listing every namespace")
+	}
+	out := &servicediscovery.ListNamespacesOutput{}
+	for _, ns := range l.namespaces {
+		if aws.ToString(ns.Name) == in.Filters[0].Values[0] {
+			out.Namespaces = append(out.Namespaces, ns)
+		}
+	}
+	return out, nil
+}
+
+func (l *lookupSDAPI) GetNamespace(_ context.Context, in *servicediscovery.GetNamespaceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.GetNamespaceOutput, error) {
+	l.gets++
+	for _, ns := range l.namespaces {
+		if aws.ToString(ns.Id) == aws.ToString(in.Id) {
+			return &servicediscovery.GetNamespaceOutput{Namespace: &sdTypes.Namespace{Id: ns.Id, Name: ns.Name}}, nil
+		}
+	}
+	return nil, &sdTypes.NamespaceNotFound{Message: aws.String("not found")}
+}
+
+func TestWatcher_namespaceLookup(t *testing.T) {
+	apps := sdTypes.NamespaceSummary{Id: aws.String("ns-0123456789abcdef"), Name: aws.String("apps.local")}
+	prod := sdTypes.NamespaceSummary{Id: aws.String("ns-fedcba9876543210"), Name: aws.String("prod.local")}
+	tests := []struct {
+		name     string
+		allow    []string
+		want     []sdTypes.NamespaceSummary
+		wantGets int
+	}{
+		{name: "by ID", allow: []string{"ns-0123456789abcdef"}, want: []sdTypes.NamespaceSummary{apps}, wantGets: 1},
+		{name: "by name", allow: []string{"prod.local"}, want: []sdTypes.NamespaceSummary{prod}},
+		{
+			name:     "IDs then names",
+			allow:    []string{"prod.local", "ns-0123456789abcdef"},
+			want:     []sdTypes.NamespaceSummary{apps, prod},
+			wantGets: 1,
+		},
+		{
+			name:     "missing namespaces skipped",
+			allow:    []string{"ns-aaaaaaaaaaaaaaaa", "gone.local", "apps.local"},
+			want:     []sdTypes.NamespaceSummary{apps},
+			wantGets: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &lookupSDAPI{namespaces: []sdTypes.NamespaceSummary{apps, prod}}
+			w := NewWatcherFromClient(client, provider.NewStore(), WithNamespaces(tt.allow, nil), WithNamespaceLookup()).(*watcher)
+			got, err := w.namespaces(context.TODO())
+			if err != nil {
+				t.Fatalf("namespaces() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("namespaces() = %v, want %v", got, tt.want)
+			}
+			if client.gets != tt.wantGets {
+				t.Errorf("GetNamespace called %d times, want %d", client.gets, tt.wantGets)
+			}
+			if err := w.Check(context.TODO()); err != nil {
+				t.Errorf("Check() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewWatcher_namespaceLookup(t *testing.T) {
+	_, err := NewWatcher(context.TODO(), provider.NewStore(), "us-east-1", "", "", WithNamespaceLookup())
+	if err == nil {
+		t.Error("NewWatcher() looking up namespaces without any to sync, want error")
+	}
+}
@@ -0,0 +1,86 @@
+package cloudmap
+
+import (
+	"bytes"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/pkg/errors"
+)
+
+// Partitions of AWS whose regions, endpoints and ARNs are apart from the others'
+const (
+	PartitionAWS   = "aws"
+	PartitionChina = "aws-cn"
+	PartitionGov   = "aws-us-gov"
+)
+
+// Partition returns the partition of region, e.g. aws-us-gov for us-gov-west-1 and aws-cn for cn-north-1
+func Partition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return PartitionChina
+	case strings.HasPrefix(region, "us-gov-"):
+		return PartitionGov
+	}
+	return PartitionAWS
+}
+
+// WithFIPS calls Cloud Map and STS through their FIPS 140 endpoints, as GovCloud workloads commonly must; SQS is
+// called at the queue URL given, e.g. of sqs-fips.us-gov-west-1.amazonaws.com. China has none. It only applies to
+// watchers returned by NewWatcher.
+func WithFIPS() Option {
+	return func(w *watcher) {
+		w.fips = true
+	}
+}
+
+// WithCABundle trusts the PEM certificates in file, rather than the system's, to verify AWS endpoints, e.g. behind a
+// TLS-intercepting proxy. It only applies to watchers returned by NewWatcher.
+func WithCABundle(file string) Option {
+	return func(w *watcher) {
+		w.caBundle = file
+	}
+}
+
+// loadOptions returns the options loading the AWS config of region as w's options say
+func (w *watcher) loadOptions(region string) ([]func(*config.LoadOptions) error, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	client, err := w.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		opts = append(opts, config.WithHTTPClient(client))
+	}
+	if w.fips {
+		if Partition(region) == PartitionChina {
+			return nil, errors.Errorf("AWS region %q has no FIPS endpoints", region)
+		}
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if w.caBundle != "" {
+		pem, err := os.ReadFile(w.caBundle)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the AWS CA bundle")
+		}
+		opts = append(opts, config.WithCustomCABundle(bytes.NewReader(pem)))
+	}
+	return opts, nil
+}
+
+// checkPartition returns an error unless arn, e.g. of a role to assume, is in the partition of region, as AWS rejects
+// ARNs of other partitions with less helpful errors
+func checkPartition(region, arn string) error {
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) < 3 || parts[0] != "arn" {
+		return errors.Errorf("invalid ARN %q", arn)
+	}
+	if want := Partition(region); parts[1] != want {
+		return errors.Errorf("%q is in partition %s, but AWS region %q is in %s; use an arn:%s: ARN",
+			arn, parts[1], region, want, want)
+	}
+	return nil
+}
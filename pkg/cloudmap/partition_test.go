@@ -0,0 +1,106 @@
+package cloudmap
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestPartition(t *testing.T) {
+	for region, want := range map[string]string{
+		"us-east-1":     PartitionAWS,
+		"eu-west-1":     PartitionAWS,
+		"us-gov-west-1": PartitionGov,
+		"cn-north-1":    PartitionChina,
+	} {
+		if got := Partition(region); got != want {
+			t.Errorf("Partition(%q) = %q, want %q", region, got, want)
+		}
+	}
+}
+
+func TestCheckPartition(t *testing.T) {
+	tests := []struct {
+		region, arn string
+		wantErr     bool
+	}{
+		{region: "us-east-1", arn: "arn:aws:iam::123456789012:role/cloudmap"},
+		{region: "us-gov-west-1", arn: "arn:aws-us-gov:iam::123456789012:role/cloudmap"},
+		{region: "cn-north-1", arn: "arn:aws-cn:iam::123456789012:role/cloudmap"},
+		{region: "us-gov-west-1", arn: "arn:aws:iam::123456789012:role/cloudmap", wantErr: true},
+		{region: "us-east-1", arn: "arn:aws-cn:iam::123456789012:role/cloudmap", wantErr: true},
+		{region: "us-east-1", arn: "role/cloudmap", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region+" "+tt.arn, func(t *testing.T) {
+			if err := checkPartition(tt.region, tt.arn); (err != nil) != tt.wantErr {
+				t.Errorf("checkPartition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewWatcher_partition(t *testing.T) {
+	creds := WithCredentials(credentials.NewStaticCredentialsProvider("id", "secret", ""))
+	tests := []struct {
+		name    string
+		region  string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "FIPS in GovCloud", region: "us-gov-west-1", opts: []Option{WithFIPS()}},
+		{name: "FIPS in China", region: "cn-north-1", opts: []Option{WithFIPS()}, wantErr: true},
+		{name: "role of another partition", region: "us-gov-west-1", opts: []Option{WithAssumeRole(AssumeRole{ARN: "arn:aws:iam::123456789012:role/cloudmap"})}, wantErr: true},
+		{name: "web identity of another partition", region: "cn-north-1", opts: []Option{WithWebIdentity(WebIdentity{RoleARN: "arn:aws:iam::123456789012:role/cloudmap", TokenFile: "token"})}, wantErr: true},
+		{name: "missing CA bundle", region: "us-east-1", opts: []Option{WithCABundle(filepath.Join(t.TempDir(), "ca.pem"))}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWatcher(context.TODO(), provider.NewStore(), tt.region, "", "", append(tt.opts, creds)...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewWatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewWatcher_caBundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		_, _ = w.Write([]byte(`{"Namespaces":[]}`))
+	}))
+	defer server.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	creds := WithCredentials(credentials.NewStaticCredentialsProvider("id", "secret", ""))
+
+	for _, tt := range []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "untrusted", wantErr: true},
+		{name: "trusted", opts: []Option{WithCABundle(bundle)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher(context.TODO(), provider.NewStore(), "us-east-1", "", "",
+				append(tt.opts, creds, WithEndpoint(server.URL), WithRetries(Retries{MaxAttempts: 1}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(provider.Checker).Check(context.TODO()); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
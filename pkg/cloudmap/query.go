@@ -0,0 +1,79 @@
+package cloudmap
+
+import (
+	"io/ioutil"
+
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// AnyService keys the query parameters of the services without any of their own
+const AnyService = "*"
+
+// QueryParameters narrow the instances of a service discovered to those whose attributes match, e.g. stage=prod for
+// registries sharding a service's instances by attribute
+type QueryParameters struct {
+	// Query are the attributes every instance discovered has, with these values
+	Query map[string]string `json:"query,omitempty"`
+	// Optional are attributes the instances discovered have, with these values, if any instance does; otherwise every
+	// instance matching Query is discovered
+	Optional map[string]string `json:"optional,omitempty"`
+}
+
+// WithQueryParameters only discovers the instances of each service matching its parameters, keyed by the service's
+// host in Cloud Map, i.e. its name followed by its namespace's, or else those keyed by AnyService
+func WithQueryParameters(params map[string]QueryParameters) Option {
+	return func(w *watcher) {
+		w.queries = params
+	}
+}
+
+// LoadQueryParameters reads the query parameters of services by host from the YAML or JSON file at path
+func LoadQueryParameters(path string) (map[string]QueryParameters, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read Cloud Map query parameters %q", path)
+	}
+	var params map[string]QueryParameters
+	if err := yaml.UnmarshalStrict(data, &params); err != nil {
+		return nil, errors.Wrapf(err, "invalid Cloud Map query parameters %q", path)
+	}
+	return params, nil
+}
+
+// query returns the parameters the instances of the service with host in Cloud Map are discovered with
+func (w *watcher) query(host string) QueryParameters {
+	if q, ok := w.queries[host]; ok {
+		return q
+	}
+	return w.queries[AnyService]
+}
+
+// filterQuery returns the instances q lets through, as DiscoverInstances would
+func filterQuery(instances []sdTypes.HttpInstanceSummary, q QueryParameters) []sdTypes.HttpInstanceSummary {
+	var queried, optional []sdTypes.HttpInstanceSummary
+	for _, instance := range instances {
+		if !matches(instance.Attributes, q.Query) {
+			continue
+		}
+		queried = append(queried, instance)
+		if len(q.Optional) > 0 && matches(instance.Attributes, q.Optional) {
+			optional = append(optional, instance)
+		}
+	}
+	if len(optional) > 0 {
+		return optional
+	}
+	return queried
+}
+
+// matches returns whether attributes have every attribute of want, with the same value
+func matches(attributes, want map[string]string) bool {
+	for k, v := range want {
+		if attr, ok := attributes[k]; !ok || attr != v {
+			return false
+		}
+	}
+	return true
+}
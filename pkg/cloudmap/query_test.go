@@ -0,0 +1,127 @@
+package cloudmap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_queryParameters(t *testing.T) {
+	prod := QueryParameters{Query: map[string]string{"stage": "prod"}}
+	canary := QueryParameters{Optional: map[string]string{"track": "canary"}}
+	tests := []struct {
+		name    string
+		queries map[string]QueryParameters
+		want    map[string]QueryParameters // by host discovered
+	}{
+		{name: "none by default", want: map[string]QueryParameters{}},
+		{name: "by host", queries: map[string]QueryParameters{"a.one.io": prod, "b.two.io": canary},
+			want: map[string]QueryParameters{"a.one.io": prod, "b.two.io": canary}},
+		{name: "any service", queries: map[string]QueryParameters{"a.one.io": canary, AnyService: prod},
+			want: map[string]QueryParameters{"a.one.io": canary, "a.two.io": prod, "b.one.io": prod, "b.two.io": prod}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithQueryParameters(tt.queries))
+			if err := w.Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]QueryParameters{}
+			for _, in := range mockAPI.discovered {
+				if in.QueryParameters != nil || in.OptionalParameters != nil {
+					host := aws.ToString(in.ServiceName) + "." + aws.ToString(in.NamespaceName)
+					got[host] = QueryParameters{Query: in.QueryParameters, Optional: in.OptionalParameters}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discovered with %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_filterQuery(t *testing.T) {
+	instance := func(id string, attributes map[string]string) sdTypes.HttpInstanceSummary {
+		return sdTypes.HttpInstanceSummary{InstanceId: aws.String(id), Attributes: attributes}
+	}
+	instances := []sdTypes.HttpInstanceSummary{
+		instance("prod-1", map[string]string{"stage": "prod"}),
+		instance("prod-canary", map[string]string{"stage": "prod", "track": "canary"}),
+		instance("dev-canary", map[string]string{"stage": "dev", "track": "canary"}),
+	}
+	tests := []struct {
+		name  string
+		query QueryParameters
+		want  []string
+	}{
+		{name: "no parameters", want: []string{"prod-1", "prod-canary", "dev-canary"}},
+		{name: "query", query: QueryParameters{Query: map[string]string{"stage": "prod"}}, want: []string{"prod-1", "prod-canary"}},
+		{name: "query matching none", query: QueryParameters{Query: map[string]string{"stage": "test"}}},
+		{
+			name:  "optional matching some",
+			query: QueryParameters{Query: map[string]string{"stage": "prod"}, Optional: map[string]string{"track": "canary"}},
+			want:  []string{"prod-canary"},
+		},
+		{
+			name:  "optional matching none",
+			query: QueryParameters{Query: map[string]string{"stage": "prod"}, Optional: map[string]string{"track": "blue"}},
+			want:  []string{"prod-1", "prod-canary"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, instance := range filterQuery(instances, tt.query) {
+				got = append(got, aws.ToString(instance.InstanceId))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterQuery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadQueryParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    map[string]QueryParameters
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			file: "web.apps.local:\n  query:\n    stage: prod\n'*':\n  optional:\n    track: canary\n",
+			want: map[string]QueryParameters{
+				"web.apps.local": {Query: map[string]string{"stage": "prod"}},
+				AnyService:       {Optional: map[string]string{"track": "canary"}},
+			},
+		},
+		{name: "unknown field", file: "web.apps.local:\n  queries:\n    stage: prod\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "query.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadQueryParameters(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadQueryParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadQueryParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := LoadQueryParameters(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadQueryParameters() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,48 @@
+package cloudmap
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// NewRegionalWatchers returns a Cloud Map watcher for each of regions, each polling its region into a store of its own
+// from newStore. Their ServiceEntries are named with the prefix the options give, "cloudmap-" by default, qualified by
+// the region, e.g. "cloudmap-us-east-1-", so each region's are told apart. Each watcher keeps track of its own drops,
+// whatever WithDrops says.
+func NewRegionalWatchers(ctx context.Context, newStore func() provider.Store, regions []string, id, secret string,
+	opts ...Option) ([]provider.Watcher, error) {
+	if len(regions) == 0 {
+		return nil, errors.New("at least one AWS region must be specified")
+	}
+	o := &watcher{prefix: "cloudmap-"}
+	for _, opt := range opts {
+		opt(o)
+	}
+	seen := make(map[string]bool, len(regions))
+	watchers := make([]provider.Watcher, 0, len(regions))
+	for _, region := range regions {
+		if region == "" {
+			return nil, errors.New("AWS regions can't be empty")
+		}
+		if seen[region] {
+			return nil, errors.Errorf("AWS region %q is listed more than once", region)
+		}
+		seen[region] = true
+		prefix := RegionPrefix(o.prefix, region)
+		w, err := NewWatcher(ctx, newStore(), region, id, secret,
+			append(opts, WithPrefix(prefix), WithDrops(provider.NewDrops(prefix)))...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "region %q", region)
+		}
+		watchers = append(watchers, w)
+	}
+	return watchers, nil
+}
+
+// RegionPrefix returns prefix qualified by region, the prefix of the ServiceEntries of region's watcher
+func RegionPrefix(prefix, region string) string {
+	return prefix + region + "-"
+}
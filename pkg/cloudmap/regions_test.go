@@ -0,0 +1,58 @@
+package cloudmap
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestNewRegionalWatchers(t *testing.T) {
+	creds := WithCredentials(credentials.NewStaticCredentialsProvider("id", "secret", ""))
+	tests := []struct {
+		name         string
+		regions      []string
+		opts         []Option
+		wantPrefixes []string
+		wantErr      bool
+	}{
+		{
+			name:         "default prefix",
+			regions:      []string{"us-east-1", "eu-west-1"},
+			wantPrefixes: []string{"cloudmap-us-east-1-", "cloudmap-eu-west-1-"},
+		},
+		{
+			name:         "custom prefix",
+			regions:      []string{"us-east-1"},
+			opts:         []Option{WithPrefix("prod-")},
+			wantPrefixes: []string{"prod-us-east-1-"},
+		},
+		{name: "none", wantErr: true},
+		{name: "empty", regions: []string{"us-east-1", ""}, wantErr: true},
+		{name: "duplicate", regions: []string{"us-east-1", "us-east-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watchers, err := NewRegionalWatchers(context.TODO(), func() provider.Store { return provider.NewStore() },
+				tt.regions, "", "", append(tt.opts, creds)...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRegionalWatchers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var prefixes []string
+			stores := map[provider.Store]bool{}
+			for _, w := range watchers {
+				prefixes = append(prefixes, w.Prefix())
+				stores[w.Store()] = true
+			}
+			if !reflect.DeepEqual(prefixes, tt.wantPrefixes) {
+				t.Errorf("NewRegionalWatchers() prefixes = %v, want %v", prefixes, tt.wantPrefixes)
+			}
+			if len(stores) != len(watchers) {
+				t.Errorf("NewRegionalWatchers() shares stores between regions")
+			}
+		})
+	}
+}
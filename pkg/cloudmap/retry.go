@@ -0,0 +1,54 @@
+package cloudmap
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/pkg/errors"
+)
+
+// Retries configures how the Cloud Map client retries failed calls; zero values keep the SDK's defaults. The call
+// timeout bounds every attempt of a call together.
+type Retries struct {
+	// Mode is standard, or adaptive to also slow down calls while Cloud Map throttles them
+	Mode aws.RetryMode
+	// MaxAttempts of a call, the first one included; the SDK makes 3
+	MaxAttempts int
+	// MaxBackoff between attempts; the SDK waits up to 20s
+	MaxBackoff time.Duration
+}
+
+// WithRetries retries failed Cloud Map calls as r says rather than as the SDK does by default. It only applies to
+// watchers returned by NewWatcher.
+func WithRetries(r Retries) Option {
+	return func(w *watcher) {
+		w.retries = &r
+	}
+}
+
+// retryer returns the retryer r configures
+func (r Retries) retryer() (func() aws.Retryer, error) {
+	if r.MaxAttempts < 0 || r.MaxBackoff < 0 {
+		return nil, errors.New("AWS retry attempts and backoff can't be negative")
+	}
+	standard := func(o *retry.StandardOptions) {
+		if r.MaxAttempts > 0 {
+			o.MaxAttempts = r.MaxAttempts
+		}
+		if r.MaxBackoff > 0 {
+			o.MaxBackoff = r.MaxBackoff
+		}
+	}
+	switch r.Mode {
+	case "", aws.RetryModeStandard:
+		return func() aws.Retryer { return retry.NewStandard(standard) }, nil
+	case aws.RetryModeAdaptive:
+		return func() aws.Retryer {
+			return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+				o.StandardOptions = append(o.StandardOptions, standard)
+			})
+		}, nil
+	}
+	return nil, errors.Errorf("invalid AWS retry mode %q, must be standard or adaptive", r.Mode)
+}
@@ -0,0 +1,64 @@
+package cloudmap
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+func TestRetries_retryer(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      Retries
+		wantAdaptive bool
+		wantAttempts int
+		wantMaxDelay time.Duration
+		wantErr      bool
+	}{
+		{name: "defaults", wantAttempts: retry.DefaultMaxAttempts, wantMaxDelay: retry.DefaultMaxBackoff},
+		{
+			name:         "standard",
+			retries:      Retries{Mode: aws.RetryModeStandard, MaxAttempts: 5, MaxBackoff: time.Second},
+			wantAttempts: 5,
+			wantMaxDelay: time.Second,
+		},
+		{
+			name:         "adaptive",
+			retries:      Retries{Mode: aws.RetryModeAdaptive, MaxAttempts: 10},
+			wantAdaptive: true,
+			wantAttempts: 10,
+			wantMaxDelay: retry.DefaultMaxBackoff,
+		},
+		{name: "unknown mode", retries: Retries{Mode: "eager"}, wantErr: true},
+		{name: "negative attempts", retries: Retries{MaxAttempts: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newRetryer, err := tt.retries.retryer()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retryer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			r := newRetryer()
+			if _, adaptive := r.(*retry.AdaptiveMode); adaptive != tt.wantAdaptive {
+				t.Errorf("retryer() = %T, want adaptive %v", r, tt.wantAdaptive)
+			}
+			if attempts := r.MaxAttempts(); attempts != tt.wantAttempts {
+				t.Errorf("MaxAttempts() = %d, want %d", attempts, tt.wantAttempts)
+			}
+			// the backoff grows exponentially until it's capped
+			delay, err := r.RetryDelay(20, errors.New("throttled"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if delay > tt.wantMaxDelay {
+				t.Errorf("RetryDelay() = %v, want at most %v", delay, tt.wantMaxDelay)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package cloudmap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+// snapshot returns a hash of hosts and their entries, whatever order they're in, so refreshes finding the registry as
+// last synced can tell without comparing every host. Entries are hashed by the fields the watcher sets, formatted
+// rather than marshalled, as marshalling caches state in the messages. It's never zero.
+func snapshot(hosts map[string][]*v1alpha3.WorkloadEntry) uint64 {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	for _, host := range names {
+		entries := make([]string, 0, len(hosts[host]))
+		for _, we := range hosts[host] {
+			// fmt orders the keys of maps
+			entries = append(entries, fmt.Sprintf("%s %v %v %s %s %d %s", we.Address, we.Ports, we.Labels, we.Network,
+				we.Locality, we.Weight, we.ServiceAccount))
+		}
+		sort.Strings(entries)
+		_, _ = h.Write([]byte(host))
+		for _, e := range entries {
+			_, _ = h.Write([]byte{0})
+			_, _ = h.Write([]byte(e))
+		}
+		_, _ = h.Write([]byte{1})
+	}
+	if sum := h.Sum64(); sum != 0 {
+		return sum
+	}
+	return 1
+}
@@ -0,0 +1,90 @@
+package cloudmap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func Test_snapshot(t *testing.T) {
+	a := &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"http": 80, "https": 443}}
+	b := &v1alpha3.WorkloadEntry{Address: ipv42, Ports: map[string]uint32{"http": 80, "https": 443}}
+	hosts := map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {a, b}}
+	tests := []struct {
+		name  string
+		hosts map[string][]*v1alpha3.WorkloadEntry
+		same  bool
+	}{
+		{name: "same hosts", hosts: map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {a, b}}, same: true},
+		{name: "entries reordered", hosts: map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {b, a}}, same: true},
+		{name: "entry removed", hosts: map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {a}}},
+		{name: "host renamed", hosts: map[string][]*v1alpha3.WorkloadEntry{"web.tetrate.io": {a, b}}},
+		{name: "host added", hosts: map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {a, b}, "web.tetrate.io": {a}}},
+		{
+			name:  "labelled",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {a, {Address: ipv42, Ports: b.Ports, Labels: map[string]string{"app": "demo"}}}},
+		},
+		{
+			name:  "port changed",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{"demo.tetrate.io": {a, {Address: ipv42, Ports: map[string]uint32{"http": 8080}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snapshot(tt.hosts) == snapshot(hosts); got != tt.same {
+				t.Errorf("same snapshot = %v, want %v", got, tt.same)
+			}
+		})
+	}
+	if snapshot(nil) == 0 {
+		t.Error("snapshot of no hosts is zero")
+	}
+}
+
+func TestWatcher_unchangedSnapshot(t *testing.T) {
+	mockAPI := &mockSDAPI{
+		ListNsResult:   &goldenPathListNamespaces,
+		ListSvcResult:  &goldenPathListServices,
+		DiscInstResult: &goldenPathDiscoverInstances,
+	}
+	store := provider.NewStore()
+	w := NewWatcherFromClient(mockAPI, store, WithPrefix("snapshot-"))
+	noops := func() float64 { return testutil.ToFloat64(metrics.CloudMapNoopSyncs.WithLabelValues("snapshot-")) }
+
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	revision, lastSync := store.Revision(), store.LastSync()
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if store.Revision() != revision {
+		t.Error("an unchanged registry changed the store's revision")
+	}
+	if !store.LastSync().After(lastSync) {
+		t.Error("an unchanged registry didn't record a sync")
+	}
+	if got := noops(); got != 1 {
+		t.Errorf("no-op syncs = %v, want 1", got)
+	}
+
+	mockAPI.DiscInstResult = &servicediscovery.DiscoverInstancesOutput{Instances: []sdTypes.HttpInstanceSummary{
+		{Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv42}},
+	}}
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if store.Revision() == revision {
+		t.Error("a changed registry didn't change the store's revision")
+	}
+	if got := noops(); got != 1 {
+		t.Errorf("no-op syncs = %v, want still 1", got)
+	}
+}
@@ -0,0 +1,155 @@
+package cloudmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sqsWaitTime is how long a receive long-polls for messages, the most SQS allows
+	sqsWaitTime = 20 * time.Second
+	// sqsMaxMessages is the most messages SQS returns, and deletes, at once
+	sqsMaxMessages = 10
+)
+
+// Message is a message received from a Queue
+type Message struct {
+	ReceiptHandle string
+	Body          string
+}
+
+// Queue delivers the events of Cloud Map API calls, as an SQS queue fed by an EventBridge rule does
+type Queue interface {
+	// Receive waits for messages, returning none if there are none for a while
+	Receive(ctx context.Context) ([]Message, error)
+	// Delete acknowledges messages, which are otherwise delivered again
+	Delete(ctx context.Context, msgs []Message) error
+}
+
+// NewSQSQueue returns the SQS queue at queueURL, e.g. https://sqs.us-east-1.amazonaws.com/123456789012/cloudmap,
+// read with creds. The region is taken from the URL, or else is region.
+func NewSQSQueue(creds aws.CredentialsProvider, region, queueURL string) (Queue, error) {
+	return newSQSQueue(creds, region, queueURL, &http.Client{})
+}
+
+// newSQSQueue is NewSQSQueue sending requests through client, e.g. one trusting a custom CA bundle
+func newSQSQueue(creds aws.CredentialsProvider, region, queueURL string, client aws.HTTPClient) (Queue, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("invalid SQS queue URL %q", queueURL)
+	}
+	if parts := strings.Split(u.Hostname(), "."); len(parts) >= 4 && (parts[0] == "sqs" || parts[0] == "sqs-fips") {
+		region = parts[1]
+	}
+	if region == "" {
+		return nil, errors.Errorf("no AWS region for SQS queue %q", queueURL)
+	}
+	return &sqsQueue{
+		url:      queueURL,
+		endpoint: u.Scheme + "://" + u.Host + "/",
+		region:   region,
+		creds:    creds,
+		signer:   v4.NewSigner(),
+		client:   client,
+	}, nil
+}
+
+// sqsQueue speaks SQS's JSON protocol, which spares us a dependency on the SQS SDK for two calls
+type sqsQueue struct {
+	url      string
+	endpoint string
+	region   string
+	creds    aws.CredentialsProvider
+	signer   *v4.Signer
+	client   aws.HTTPClient
+}
+
+func (q *sqsQueue) Receive(ctx context.Context) ([]Message, error) {
+	var out struct {
+		Messages []Message
+	}
+	err := q.call(ctx, "ReceiveMessage", map[string]interface{}{
+		"QueueUrl":            q.url,
+		"MaxNumberOfMessages": sqsMaxMessages,
+		"WaitTimeSeconds":     int(sqsWaitTime / time.Second),
+	}, &out)
+	return out.Messages, err
+}
+
+func (q *sqsQueue) Delete(ctx context.Context, msgs []Message) error {
+	for len(msgs) > 0 {
+		batch := msgs
+		if len(batch) > sqsMaxMessages {
+			batch = batch[:sqsMaxMessages]
+		}
+		msgs = msgs[len(batch):]
+		entries := make([]map[string]string, 0, len(batch))
+		for i, m := range batch {
+			entries = append(entries, map[string]string{"Id": strconv.Itoa(i), "ReceiptHandle": m.ReceiptHandle})
+		}
+		var out struct {
+			Failed []struct {
+				Id      string
+				Message string
+			}
+		}
+		if err := q.call(ctx, "DeleteMessageBatch", map[string]interface{}{"QueueUrl": q.url, "Entries": entries}, &out); err != nil {
+			return err
+		}
+		if len(out.Failed) > 0 {
+			return errors.Errorf("failed to delete %d SQS messages, the first: %s", len(out.Failed), out.Failed[0].Message)
+		}
+	}
+	return nil
+}
+
+// call signs and sends action with input, decoding the response into out
+func (q *sqsQueue) call(ctx context.Context, action string, input, out interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	// long polls take a while on their own
+	ctx, cancel := context.WithTimeout(ctx, sqsWaitTime+defaultCallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	creds, err := q.creds.Retrieve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve AWS credentials for SQS")
+	}
+	hash := sha256.Sum256(body)
+	if err := q.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "sqs", q.region, time.Now()); err != nil {
+		return errors.Wrap(err, "failed to sign SQS request")
+	}
+	r, err := q.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "SQS %s failed", action)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&apiErr)
+		return errors.Errorf("SQS %s failed with %s: %s %s", action, r.Status, apiErr.Type, apiErr.Message)
+	}
+	return errors.Wrapf(json.NewDecoder(r.Body).Decode(out), "failed to decode SQS %s response", action)
+}
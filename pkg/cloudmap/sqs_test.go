@@ -0,0 +1,103 @@
+package cloudmap
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestNewSQSQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		region     string
+		url        string
+		wantRegion string
+		wantErr    bool
+	}{
+		{name: "region of the URL", region: "eu-west-1", url: "https://sqs.us-east-1.amazonaws.com/123456789012/cloudmap", wantRegion: "us-east-1"},
+		{name: "region of the FIPS URL", region: "eu-west-1", url: "https://sqs-fips.us-gov-west-1.amazonaws.com/123456789012/cloudmap", wantRegion: "us-gov-west-1"},
+		{name: "region of the watcher", region: "eu-west-1", url: "http://localhost:9324/queue/cloudmap", wantRegion: "eu-west-1"},
+		{name: "no region", url: "http://localhost:9324/queue/cloudmap", wantErr: true},
+		{name: "not a URL", region: "eu-west-1", url: "cloudmap", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewSQSQueue(credentials.NewStaticCredentialsProvider("id", "secret", ""), tt.region, tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSQSQueue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && q.(*sqsQueue).region != tt.wantRegion {
+				t.Errorf("NewSQSQueue() region = %q, want %q", q.(*sqsQueue).region, tt.wantRegion)
+			}
+		})
+	}
+}
+
+func TestSQSQueue(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/eu-west-1/sqs/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"__type": "com.amazonaws.sqs#InvalidSignature", "message": "unsigned"}`))
+			return
+		}
+		var in struct {
+			QueueUrl string
+			Entries  []struct{ ReceiptHandle string }
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || !strings.HasSuffix(in.QueueUrl, "/queue/cloudmap") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSQS.ReceiveMessage":
+			_, _ = w.Write([]byte(`{"Messages": [{"MessageId": "m-1", "ReceiptHandle": "r-1", "Body": "event"}]}`))
+		case "AmazonSQS.DeleteMessageBatch":
+			for _, e := range in.Entries {
+				deleted = append(deleted, e.ReceiptHandle)
+			}
+			_, _ = w.Write([]byte(`{"Successful": [], "Failed": []}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "com.amazonaws.sqs#InvalidAction", "message": "unknown"}`))
+		}
+	}))
+	defer server.Close()
+
+	q, err := NewSQSQueue(credentials.NewStaticCredentialsProvider("id", "secret", ""), "eu-west-1", server.URL+"/queue/cloudmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := q.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Message{{ReceiptHandle: "r-1", Body: "event"}}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("Receive() = %v, want %v", msgs, want)
+	}
+	// more than a batch is deleted in several
+	msgs = make([]Message, 0, 12)
+	for i := 0; i < 12; i++ {
+		msgs = append(msgs, Message{ReceiptHandle: "r-" + string(rune('a'+i))})
+	}
+	if err := q.Delete(context.TODO(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != len(msgs) {
+		t.Errorf("deleted %d messages, want %d", len(deleted), len(msgs))
+	}
+
+	q, err = NewSQSQueue(credentials.NewStaticCredentialsProvider("id", "secret", ""), "us-east-2", server.URL+"/queue/cloudmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Receive(context.TODO()); err == nil || !strings.Contains(err.Error(), "InvalidSignature") {
+		t.Errorf("Receive() error = %v, want SQS's error", err)
+	}
+}
@@ -0,0 +1,94 @@
+package cloudmap
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/pkg/errors"
+)
+
+// tagsTTL is how long the tags of a namespace or service are trusted before being listed again, so tagging one
+// takes up to this long to be noticed but a sync doesn't list the tags of every service
+const tagsTTL = 5 * time.Minute
+
+// Tag selects the namespaces and services carrying it; an empty Value matches any value of Key
+type Tag struct {
+	Key, Value string
+}
+
+// ParseTag returns the tag written as key=value, or key to match any value
+func ParseTag(s string) (Tag, error) {
+	key, value, _ := strings.Cut(s, "=")
+	if key == "" {
+		return Tag{}, errors.Errorf("invalid tag %q, must be key=value or key", s)
+	}
+	return Tag{Key: key, Value: value}, nil
+}
+
+func (t Tag) String() string {
+	if t.Value == "" {
+		return t.Key
+	}
+	return t.Key + "=" + t.Value
+}
+
+// WithTag only syncs the services carrying tag and those of namespaces carrying it, so a registry can be shared
+// with services that aren't part of the mesh. Tags are read with ListTagsForResource and trusted for 5 minutes.
+func WithTag(tag Tag) Option {
+	return func(w *watcher) {
+		w.tag = &tag
+	}
+}
+
+// tagged caches whether a resource carries the watcher's tag
+type tagged struct {
+	match bool
+	at    time.Time
+}
+
+// tagsCache is the tagged by ARN, safe for concurrent use
+type tagsCache struct {
+	m    sync.Mutex
+	arns map[string]tagged
+}
+
+// carriesTag returns whether the resource with arn carries the watcher's tag, listing its tags unless they were
+// listed lately. Resources without an ARN carry none.
+func (w *watcher) carriesTag(ctx context.Context, arn *string) (bool, error) {
+	if arn == nil {
+		return false, nil
+	}
+	w.tags.m.Lock()
+	t, ok := w.tags.arns[*arn]
+	w.tags.m.Unlock()
+	if ok && time.Since(t.at) < tagsTTL {
+		return t.match, nil
+	}
+	callCtx, cancel, err := w.callContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	out, err := w.cloudmap.ListTagsForResource(callCtx, &servicediscovery.ListTagsForResourceInput{ResourceARN: arn})
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing the tags of %s", *arn)
+	}
+	t = tagged{at: time.Now()}
+	for _, tag := range out.Tags {
+		if aws.ToString(tag.Key) == w.tag.Key && (w.tag.Value == "" || aws.ToString(tag.Value) == w.tag.Value) {
+			t.match = true
+			break
+		}
+	}
+	w.tags.m.Lock()
+	defer w.tags.m.Unlock()
+	if w.tags.arns == nil {
+		w.tags.arns = make(map[string]tagged)
+	}
+	w.tags.arns[*arn] = t
+	return t.match, nil
+}
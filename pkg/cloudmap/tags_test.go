@@ -0,0 +1,143 @@
+package cloudmap
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Tag
+		wantErr bool
+	}{
+		{in: "istio-sync=true", want: Tag{Key: "istio-sync", Value: "true"}},
+		{in: "istio-sync", want: Tag{Key: "istio-sync"}},
+		{in: "team=a=b", want: Tag{Key: "team", Value: "a=b"}},
+		{in: "=true", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTag(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// taggedSDAPI serves namespaces one.io and two.io of services a and b each, with the tags in tags by ARN, counting
+// the tags listed
+type taggedSDAPI struct {
+	pagedSDAPI
+	tags   map[string]map[string]string
+	m      sync.Mutex
+	listed int
+}
+
+func arn(id string) *string {
+	return aws.String("arn:aws:servicediscovery:us-east-1:123456789012:" + id)
+}
+
+func (m *taggedSDAPI) ListNamespaces(ctx context.Context, lni *servicediscovery.ListNamespacesInput, optFns ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	out, err := m.pagedSDAPI.ListNamespaces(ctx, lni, optFns...)
+	for i := range out.Namespaces {
+		out.Namespaces[i].Arn = arn(*out.Namespaces[i].Id)
+	}
+	return out, err
+}
+
+func (m *taggedSDAPI) ListServices(ctx context.Context, lsi *servicediscovery.ListServicesInput, optFns ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	out, err := m.pagedSDAPI.ListServices(ctx, lsi, optFns...)
+	for i := range out.Services {
+		out.Services[i].Arn = arn(*out.Services[i].Id)
+	}
+	return out, err
+}
+
+func (m *taggedSDAPI) ListTagsForResource(_ context.Context, in *servicediscovery.ListTagsForResourceInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListTagsForResourceOutput, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.listed++
+	out := &servicediscovery.ListTagsForResourceOutput{}
+	for k, v := range m.tags[*in.ResourceARN] {
+		out.Tags = append(out.Tags, sdTypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+func TestWatcher_tag(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		tags       map[string]map[string]string
+		want       []string
+		wantListed int
+	}{
+		{
+			name: "every service without a tag",
+			tags: map[string]map[string]string{*arn("ns-1"): {"istio-sync": "true"}},
+			want: []string{"a.one.io", "a.two.io", "b.one.io", "b.two.io"},
+		},
+		{
+			name:       "every service of a tagged namespace",
+			opts:       []Option{WithTag(Tag{Key: "istio-sync", Value: "true"})},
+			tags:       map[string]map[string]string{*arn("ns-1"): {"istio-sync": "true"}},
+			want:       []string{"a.one.io", "b.one.io"},
+			wantListed: 4,
+		},
+		{
+			name:       "tagged services",
+			opts:       []Option{WithTag(Tag{Key: "istio-sync", Value: "true"})},
+			tags:       map[string]map[string]string{*arn("srv-b-ns-2"): {"istio-sync": "true"}, *arn("srv-a-ns-2"): {"istio-sync": "false"}},
+			want:       []string{"b.two.io"},
+			wantListed: 6,
+		},
+		{
+			name:       "any value",
+			opts:       []Option{WithTag(Tag{Key: "istio-sync"})},
+			tags:       map[string]map[string]string{*arn("srv-b-ns-2"): {"istio-sync": "true"}, *arn("srv-a-ns-2"): {"istio-sync": "false"}},
+			want:       []string{"a.two.io", "b.two.io"},
+			wantListed: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &taggedSDAPI{pagedSDAPI: pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}, tags: tt.tags}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...)
+			for i := 0; i < 2; i++ {
+				if err := w.Refresh(context.TODO()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			for host := range w.Store().Hosts() {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+			// the second refresh trusts the tags the first listed
+			if mockAPI.listed != tt.wantListed {
+				t.Errorf("listed tags %d times, want %d", mockAPI.listed, tt.wantListed)
+			}
+		})
+	}
+}
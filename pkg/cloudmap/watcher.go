@@ -3,8 +3,13 @@ package cloudmap
 import (
 	"context"
 	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -12,64 +17,509 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
 	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
-	"github.com/tetratelabs/log"
 )
 
 // consts aren't memory addressable in Go
 var serviceFilterNamespaceID = sdTypes.ServiceFilterNameNamespaceId
 var filterConditionEquals = sdTypes.FilterConditionEq
 
+// defaultCallTimeout bounds each Cloud Map API call unless overridden with WithCallTimeout
+const defaultCallTimeout = 10 * time.Second
+
+// defaultInterval is how often the registry is read unless overridden with WithInterval
+const defaultInterval = 5 * time.Second
+
+// MinInterval and MaxInterval bound the interval NewWatcher accepts: more often than every second costs a lot of API
+// calls for little gain, and less often than hourly leaves Istio with badly outdated endpoints
+const (
+	MinInterval = time.Second
+	MaxInterval = time.Hour
+)
+
+// defaultConcurrency is how many services' instances are discovered at once unless overridden with WithConcurrency
+const defaultConcurrency = 8
+
+// maxInstances is the most instances DiscoverInstances returns, which isn't paginated; it returns 100 by default.
+// Services with more are listed page by page instead.
+const maxInstances = 1000
+
+// Option configures a Cloud Map watcher
+type Option func(*watcher)
+
+// WithCallTimeout bounds each Cloud Map API call, so a hung request fails instead of stalling the refresh.
+// Zero disables the bound.
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(w *watcher) {
+		w.callTimeout = timeout
+	}
+}
+
+// WithInterval reads the registry every interval instead of every 5 seconds, e.g. less often to stay within Cloud
+// Map's quotas and cost, or more often for faster failover. It's superseded by the resync interval of WithEvents.
+func WithInterval(interval time.Duration) Option {
+	return func(w *watcher) {
+		w.interval = interval
+	}
+}
+
+// WithRateLimit spends at most rps Cloud Map API calls per second on average, in bursts of at most burst, waiting for
+// its turn before each call so a refresh of a large registry is spread out rather than throttled. A burst of zero
+// defaults to rps rounded up; an rps of zero disables the limit.
+func WithRateLimit(rps float64, burst int) Option {
+	return func(w *watcher) {
+		if rps <= 0 {
+			w.limiter = nil
+			return
+		}
+		if burst <= 0 {
+			burst = int(math.Ceil(rps))
+		}
+		// every watcher gets a bucket of its own, as each account and region is throttled on its own
+		w.limiter = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+}
+
+// WithConcurrency discovers the instances of up to n services at once rather than 8, so a refresh of a registry with
+// hundreds of services takes a fraction of the time. One discovers them one after the other, and zero keeps the
+// default.
+func WithConcurrency(n int) Option {
+	return func(w *watcher) {
+		w.concurrency = n
+	}
+}
+
+// WithIncremental only discovers the instances of the services whose summary, their instance count and creation date,
+// changed since they were last discovered, discovering every service again at least every fullSync. Instances whose
+// health or attributes change without the count changing are only noticed by the next full sync.
+func WithIncremental(fullSync time.Duration) Option {
+	return func(w *watcher) {
+		w.fullSync = fullSync
+	}
+}
+
+// WithPartialRefresh keeps the hosts of a Cloud Map namespace as last synced when refreshing it fails, still updating
+// those of the other namespaces, rather than failing the whole refresh. A refresh only fails if every namespace does,
+// or one that never synced, which has no hosts to keep.
+func WithPartialRefresh() Option {
+	return func(w *watcher) {
+		w.partial = true
+	}
+}
+
+// WithInstancesTTL reuses the instances of a service discovered less than ttl ago rather than discovering them on every
+// sync, so services are discovered at most once per ttl. Full syncs of WithIncremental discover every service
+// regardless, as do events.
+func WithInstancesTTL(ttl time.Duration) Option {
+	return func(w *watcher) {
+		w.instancesTTL = ttl
+	}
+}
+
+// WithDNSResolution publishes the hosts of services Route 53 resolves, those of DNS namespaces with A, AAAA or CNAME
+// records, to be resolved through DNS rather than discovering their instances. The proxies must be able to resolve
+// the namespace, e.g. run in a VPC a private namespace is associated with.
+func WithDNSResolution() Option {
+	return func(w *watcher) {
+		w.resolveDNS = true
+	}
+}
+
+// WithEndpoint sends Cloud Map API calls to endpoint, e.g. LocalStack's http://localhost:4566 or a proxy, rather than
+// the region's. It only applies to watchers returned by NewWatcher.
+func WithEndpoint(endpoint string) Option {
+	return func(w *watcher) {
+		w.endpoint = endpoint
+	}
+}
+
+// WithCredentials reads Cloud Map with creds rather than the id and secret passed to NewWatcher or the
+// default credential chain
+func WithCredentials(creds aws.CredentialsProvider) Option {
+	return func(w *watcher) {
+		w.credentials = creds
+	}
+}
+
+// WithAssumeRole reads Cloud Map as role, assuming it with the credentials the watcher would otherwise read Cloud Map
+// with, so a single controller can read registries in other accounts
+func WithAssumeRole(role AssumeRole) Option {
+	return func(w *watcher) {
+		w.assumeRole = &role
+	}
+}
+
+// WithWebIdentity reads Cloud Map as the role of id, assumed with its web identity token, unless the watcher is given
+// other credentials. This is how IAM Roles for Service Accounts (IRSA) grant pods on EKS access to AWS.
+func WithWebIdentity(id WebIdentity) Option {
+	return func(w *watcher) {
+		w.webIdentity = &id
+	}
+}
+
+// WithDrops keeps track of the instances the watcher drops in d, rather than in drops labelled with its prefix
+func WithDrops(d *provider.Drops) Option {
+	return func(w *watcher) {
+		w.drops = d
+	}
+}
+
+// WithPrefix names the watcher's ServiceEntries, and labels its metrics, with prefix instead of the default "cloudmap-",
+// so watchers of different accounts or regions can publish into one cluster
+func WithPrefix(prefix string) Option {
+	return func(w *watcher) {
+		w.prefix = prefix
+	}
+}
+
+// WithNamespaces only syncs the Cloud Map namespaces in allow, unless it's empty, and never those in deny. Namespaces
+// are matched by name or ID.
+func WithNamespaces(allow, deny []string) Option {
+	return func(w *watcher) {
+		w.allow, w.deny = set(allow), set(deny)
+	}
+}
+
+// WithServiceNames only syncs the Cloud Map services whose name matches include, unless it's nil, and never those
+// matching exclude, unless it's nil, e.g. ^debug- to keep debugging services out of the mesh without tagging the rest
+func WithServiceNames(include, exclude *regexp.Regexp) Option {
+	return func(w *watcher) {
+		w.include, w.exclude = include, exclude
+	}
+}
+
+// WithHostSuffixes publishes the services of the Cloud Map namespaces in suffixes, by name or ID, as hosts ending in
+// their suffix rather than the namespace's name, so they match the hosts clients dial, e.g. mapping prod-ns to
+// prod.internal.corp publishes web.prod-ns as web.prod.internal.corp. A suffix starting with a dot is appended to the
+// namespace's name instead, e.g. .corp publishes web.prod-ns.corp.
+func WithHostSuffixes(suffixes map[string]string) Option {
+	return func(w *watcher) {
+		w.suffixes = suffixes
+	}
+}
+
+// WithHealthStatus discovers the instances matching filter rather than only healthy ones, e.g.
+// HEALTHY_OR_ELSE_ALL to fail open when none are healthy. Services without health checks always return every instance.
+func WithHealthStatus(filter sdTypes.HealthStatusFilter) Option {
+	return func(w *watcher) {
+		w.healthStatus = filter
+	}
+}
+
+// WithPortAttributes takes the port of an instance from the first of attributes it has, e.g. SERVICE_PORT, for
+// registrars that don't record it as AWS_INSTANCE_PORT. Instances with none of them fall back to AWS_INSTANCE_PORT.
+func WithPortAttributes(attributes []string) Option {
+	return func(w *watcher) {
+		w.attributes.ports = attributes
+	}
+}
+
+// WithWeightAttribute takes the load balancing weight of an instance from attribute rather than AWS_INSTANCE_WEIGHT,
+// so traffic can be shifted between pools of instances of different sizes
+func WithWeightAttribute(attribute string) Option {
+	return func(w *watcher) {
+		w.attributes.weight = attribute
+	}
+}
+
+// WithLabelAttributes labels the entries of instances with the values of their attributes, keyed by the label each
+// attribute names, e.g. ECS_CLUSTER_NAME=ecs.amazonaws.com/cluster, so telemetry and routing can tell ECS clusters,
+// services and task families apart. Values that aren't valid label values are left out.
+func WithLabelAttributes(labels map[string]string) Option {
+	return func(w *watcher) {
+		w.attributes.labels = labels
+	}
+}
+
+// attributeNames are the attributes instances are converted by, beyond those Cloud Map defines
+type attributeNames struct {
+	ports  []string          // probed for the port ahead of AWS_INSTANCE_PORT
+	weight string            // holds the weight; AWS_INSTANCE_WEIGHT if empty
+	labels map[string]string // label keys by the attribute holding their value
+}
+
+// WithUnhealthyAttribute leaves out the instances whose attribute name has one of values, compared case-insensitively,
+// for applications that report their health through an attribute they keep up to date rather than a health check
+func WithUnhealthyAttribute(name string, values []string) Option {
+	return func(w *watcher) {
+		w.healthAttribute, w.unhealthyValues = name, values
+	}
+}
+
+// ParseHealthStatus returns the health status filter named s: HEALTHY, ALL or HEALTHY_OR_ELSE_ALL
+func ParseHealthStatus(s string) (sdTypes.HealthStatusFilter, error) {
+	switch f := sdTypes.HealthStatusFilter(strings.ToUpper(s)); f {
+	case sdTypes.HealthStatusFilterHealthy, sdTypes.HealthStatusFilterAll, sdTypes.HealthStatusFilterHealthyOrElseAll:
+		return f, nil
+	}
+	return "", errors.Errorf("invalid health status %q, must be HEALTHY, ALL or HEALTHY_OR_ELSE_ALL", s)
+}
+
+// WithClientWrapper sends every Cloud Map API call through the client returned by wrap, e.g. to inject faults
+func WithClientWrapper(wrap func(ServiceDiscoveryClient) ServiceDiscoveryClient) Option {
+	return func(w *watcher) {
+		w.wrapClient = wrap
+	}
+}
+
 // NewWatcher returns a Cloud Map watcher
-func NewWatcher(ctx context.Context, store provider.Store, region, id, secret string) (provider.Watcher, error) {
+func NewWatcher(ctx context.Context, store provider.Store, region, id, secret string, opts ...Option) (provider.Watcher, error) {
+	// credentials are needed to build the client, ahead of the watcher the options apply to
+	o := &watcher{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.concurrency < 0 {
+		return nil, errors.Errorf("Cloud Map concurrency %d can't be negative", o.concurrency)
+	}
+	if o.fullSync < 0 {
+		return nil, errors.Errorf("Cloud Map full sync interval %v can't be negative", o.fullSync)
+	}
+	if o.instancesTTL < 0 {
+		return nil, errors.Errorf("Cloud Map instances TTL %v can't be negative", o.instancesTTL)
+	}
+	for ns, suffix := range o.suffixes {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(suffix, ".")); len(errs) > 0 {
+			return nil, errors.Errorf("invalid host suffix %q of Cloud Map namespace %q: %s", suffix, ns, strings.Join(errs, ", "))
+		}
+	}
+	for attribute, label := range o.attributes.labels {
+		if errs := validation.IsQualifiedName(label); len(errs) > 0 {
+			return nil, errors.Errorf("invalid label %q of Cloud Map attribute %q: %s", label, attribute, strings.Join(errs, ", "))
+		}
+	}
+	if o.lookup && len(o.allow) == 0 {
+		return nil, errors.New("looking up Cloud Map namespaces takes the namespaces to sync")
+	}
+	if o.interval != 0 && (o.interval < MinInterval || o.interval > MaxInterval) {
+		return nil, errors.Errorf("Cloud Map sync interval %v must be between %v and %v", o.interval, MinInterval, MaxInterval)
+	}
+	cfg, err := o.config(ctx, region, id, secret)
+	if err != nil {
+		return nil, err
+	}
+	if o.queueURL != "" {
+		q, err := newSQSQueue(cfg.Credentials, cfg.Region, o.queueURL, cfg.HTTPClient)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts[:len(opts):len(opts)], WithEvents(q, o.resync))
+	}
+	return NewWatcherFromClient(o.client(cfg), store, opts...), nil
+}
+
+// config loads the AWS config of region, or else $AWS_REGION, that the options call for, with their credentials or else id and secret, or
+// else the default chain, checking the credentials can be retrieved
+func (o *watcher) config(ctx context.Context, region, id, secret string) (aws.Config, error) {
 	if len(region) == 0 {
 		var ok bool
 		if region, ok = os.LookupEnv("AWS_REGION"); !ok {
-			return nil, errors.New("AWS region must be specified")
+			return aws.Config{}, errors.New("AWS region must be specified")
+		}
+	}
+	if o.endpoint != "" {
+		if u, err := url.Parse(o.endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return aws.Config{}, errors.Errorf("invalid Cloud Map endpoint %q, must be a URL such as http://localhost:4566", o.endpoint)
+		}
+	}
+	if o.assumeRole != nil {
+		if err := checkPartition(region, o.assumeRole.ARN); err != nil {
+			return aws.Config{}, errors.Wrap(err, "role to assume")
+		}
+	}
+	if o.webIdentity != nil {
+		if err := checkPartition(region, o.webIdentity.RoleARN); err != nil {
+			return aws.Config{}, errors.Wrap(err, "web identity role")
 		}
 	}
+	loadOpts, err := o.loadOptions(region)
+	if err != nil {
+		return aws.Config{}, err
+	}
 	var cfg aws.Config
-	var err error
-	if len(id) != 0 && len(secret) != 0 {
+	if o.credentials != nil {
+		cfg, err = config.LoadDefaultConfig(ctx, append(loadOpts, config.WithCredentialsProvider(o.credentials))...)
+	} else if len(id) != 0 && len(secret) != 0 {
 		// Use AWS id and secret from CLI parameters
 		creds := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(id, secret, ""))
-		cfg, err = config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(creds), config.WithRegion(region))
+		cfg, err = config.LoadDefaultConfig(ctx, append(loadOpts, config.WithCredentialsProvider(creds))...)
 	} else {
-		cfg, err = config.LoadDefaultConfig(ctx, config.WithRegion(region))
+		cfg, err = config.LoadDefaultConfig(ctx, loadOpts...)
+		if err == nil && o.webIdentity != nil {
+			// the token is exchanged without signing, so STS needs no other credentials
+			cfg.Credentials = webIdentityCredentials(sts.NewFromConfig(cfg), *o.webIdentity)
+		}
 	}
 	if err != nil {
-		return nil, errors.Wrap(err, "error loading AWS config")
+		return aws.Config{}, errors.Wrap(err, "error loading AWS config")
+	}
+	if o.retries != nil {
+		if cfg.Retryer, err = o.retries.retryer(); err != nil {
+			return aws.Config{}, err
+		}
+	}
+	if o.assumeRole != nil {
+		cfg.Credentials = assumeRoleCredentials(sts.NewFromConfig(cfg), *o.assumeRole)
+	}
+	if err := checkCredentials(ctx, cfg.Credentials); err != nil {
+		return aws.Config{}, err
+	}
+	return cfg, nil
+}
+
+// client returns the Cloud Map client of cfg, calling the options' endpoint if any
+func (o *watcher) client(cfg aws.Config) *servicediscovery.Client {
+	return servicediscovery.NewFromConfig(cfg, func(so *servicediscovery.Options) {
+		if o.endpoint != "" {
+			so.BaseEndpoint = aws.String(o.endpoint)
+		}
+	})
+}
+
+// NewWatcherFromClient returns a Cloud Map watcher reading through client, e.g. one configured by the caller or a fake
+func NewWatcherFromClient(client ServiceDiscoveryClient, store provider.Store, opts ...Option) provider.Watcher {
+	w := &watcher{
+		cloudmap:     client,
+		store:        store,
+		prefix:       "cloudmap-",
+		interval:     defaultInterval,
+		concurrency:  defaultConcurrency,
+		callTimeout:  defaultCallTimeout,
+		healthStatus: sdTypes.HealthStatusFilterHealthy,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.interval <= 0 {
+		w.interval = defaultInterval
+	}
+	if w.concurrency <= 0 {
+		w.concurrency = defaultConcurrency
 	}
-	sdclient := servicediscovery.NewFromConfig(cfg)
-	return &watcher{cloudmap: sdclient, store: store, interval: time.Second * 5}, nil
+	if w.drops == nil {
+		w.drops = provider.NewDrops(w.prefix)
+	}
+	if w.wrapClient != nil {
+		w.cloudmap = w.wrapClient(w.cloudmap)
+	}
+	w.cloudmap = instrument(w.cloudmap, w.prefix)
+	return w
 }
 
 type ServiceDiscoveryClient interface {
 	DiscoverInstances(ctx context.Context, params *servicediscovery.DiscoverInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.DiscoverInstancesOutput, error)
 	ListNamespaces(ctx context.Context, params *servicediscovery.ListNamespacesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListNamespacesOutput, error)
 	ListServices(ctx context.Context, params *servicediscovery.ListServicesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListServicesOutput, error)
+	ListTagsForResource(ctx context.Context, params *servicediscovery.ListTagsForResourceInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListTagsForResourceOutput, error)
+	ListInstances(ctx context.Context, params *servicediscovery.ListInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListInstancesOutput, error)
+	GetInstancesHealthStatus(ctx context.Context, params *servicediscovery.GetInstancesHealthStatusInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.GetInstancesHealthStatusOutput, error)
+	GetNamespace(ctx context.Context, params *servicediscovery.GetNamespaceInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.GetNamespaceOutput, error)
+	GetService(ctx context.Context, params *servicediscovery.GetServiceInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.GetServiceOutput, error)
 }
 
 // watcher polls Cloud Map and caches a list of services and their instances
 
 type watcher struct {
-	cloudmap ServiceDiscoveryClient
-	store    provider.Store
-	interval time.Duration
+	cloudmap    ServiceDiscoveryClient
+	store       provider.Store
+	prefix      string
+	interval    time.Duration
+	concurrency int           // services whose instances are discovered at once; zero means defaultConcurrency
+	fullSync    time.Duration // how often every service is discovered; zero means on every refresh
+	lastFull    time.Time     // of the last refresh that discovered every service
+	callTimeout time.Duration // bounds each API call; zero means unbounded
+	limiter     *rate.Limiter // paces API calls, if not nil
+	retries     *Retries      // of the client NewWatcher builds, if not nil
+	endpoint    string        // the client NewWatcher builds calls instead of the region's, if not empty
+	fips        bool          // of the clients NewWatcher builds
+	caBundle    string        // file of the certificates the clients NewWatcher builds trust, if not empty
+	transport   Transport     // of the clients NewWatcher builds
+	credentials aws.CredentialsProvider
+	assumeRole  *AssumeRole  // assumed with credentials, if not nil
+	webIdentity *WebIdentity // replaces the default credential chain, if not nil
+	wrapClient  func(ServiceDiscoveryClient) ServiceDiscoveryClient
+	events      Queue               // refreshes the services whose instances changed, if not nil
+	queueURL    string              // of the SQS queue NewWatcher reads events from, if not empty
+	resync      time.Duration       // of the watcher reading events from queueURL
+	allow, deny map[string]struct{} // namespace names and IDs; every namespace is allowed if allow is empty
+	lookup      bool                // looks up the allowed namespaces rather than listing every namespace
+	partial     bool                // keeps the hosts of namespaces failing a refresh rather than failing it
+	annotate    bool                // annotates the Service Entries of services with where they come from
+	include     *regexp.Regexp      // matches the names of the services synced, if not nil
+	exclude     *regexp.Regexp      // matches the names of the services never synced, if not nil
+	resolveDNS  bool                // publishes hosts Route 53 resolves without discovering their instances
+	tag         *Tag                // the namespaces and services synced carry, if not nil
+	tags        tagsCache
+	// the instances discovered; left empty, Cloud Map's own default applies
+	healthStatus sdTypes.HealthStatusFilter
+	// the parameters instances are discovered with by host in Cloud Map, or AnyService
+	queries map[string]QueryParameters
+	// the suffixes of hosts by namespace name or ID, replacing the name, or appended to it if starting with a dot
+	suffixes map[string]string
+	// how long discovered instances are reused; zero means not at all
+	instancesTTL time.Duration
+	// the custom attributes instances' ports and weights are taken from
+	attributes attributeNames
+	// the attribute whose unhealthyValues leave instances out, if not empty
+	healthAttribute string
+	unhealthyValues []string
+	m               sync.Mutex // serializes refreshes triggered by the ticker and on demand
+	// the instances last discovered per host and the entries built from them, reused while they're unchanged
+	cache map[string]discovered
+	// the creator request IDs of the services last synced by ID, for WithServiceAnnotations
+	creators map[string]string
+	// guards cache and creators while a refresh discovers services concurrently
+	cacheM sync.Mutex
+	// the services last synced by ID, for events to refresh
+	services map[string]serviceRef
+	drops    *provider.Drops
+	// slows refreshes down to probes while Cloud Map keeps failing them
+	breaker breaker
+	// hash of the hosts last set in the store; zero if events changed them since
+	snapshot uint64
+	// the hosts last synced by namespace ID, kept for the namespaces failing WithPartialRefresh
+	namespaceHosts map[string]map[string][]*v1alpha3.WorkloadEntry
+}
+
+type discovered struct {
+	revision        string    // of the service's summary when last discovered
+	at              time.Time // of the last discovery
+	instances       []sdTypes.HttpInstanceSummary
+	workloadEntries []*v1alpha3.WorkloadEntry
+	dropped         []provider.Dropped
 }
 
 var _ provider.Watcher = &watcher{}
+var _ provider.Checker = &watcher{}
+var _ provider.DroppedLister = &watcher{}
+var _ provider.Readier = &watcher{}
 
 func (w *watcher) Store() provider.Store {
 	return w.store
 }
 
 func (w *watcher) Prefix() string {
-	return "cloudmap-"
+	return w.prefix
+}
+
+// Dropped lists the instances of the last successful sync that aren't synced as Cloud Map describes them
+func (w *watcher) Dropped() []provider.Dropped {
+	return w.drops.List()
+}
+
+// Ready returns an error while the circuit breaker is open, as Cloud Map keeps failing to refresh the store
+func (w *watcher) Ready() error {
+	return w.breaker.ready()
 }
 
 // Run the watcher until the context is cancelled
@@ -78,45 +528,329 @@ func (w *watcher) Run(ctx context.Context) {
 	defer ticker.Stop()
 
 	// Initial sync on startup
-	w.refreshStore(ctx)
+	w.refresh(ctx)
+	if w.events != nil {
+		go w.receive(ctx)
+	}
 	for {
 		select {
 		case <-ticker.C:
-			w.refreshStore(ctx)
+			if !w.breaker.allow(time.Now()) {
+				continue
+			}
+			w.refresh(ctx)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (w *watcher) refreshStore(ctx context.Context) {
+// refresh syncs the store, logging why it failed to, for Run
+func (w *watcher) refresh(ctx context.Context) {
+	if err := w.refreshStore(ctx); err != nil {
+		log.Errorf("unable to refresh Cloud Map cache, using existing cache: %v", err)
+	}
+}
+
+// Refresh syncs Cloud Map into the store once
+func (w *watcher) Refresh(ctx context.Context) error {
+	return w.refreshStore(ctx)
+}
+
+// Check lists a single namespace, or looks up those allowed WithNamespaceLookup, to verify the region and credentials
+// can read Cloud Map
+func (w *watcher) Check(ctx context.Context) error {
+	var err error
+	if w.lookup {
+		// the credentials may only be allowed to read the namespaces looked up
+		_, err = w.lookupNamespaces(ctx)
+	} else {
+		callCtx, cancel, cerr := w.callContext(ctx)
+		if cerr != nil {
+			return cerr
+		}
+		_, err = w.cloudmap.ListNamespaces(callCtx, &servicediscovery.ListNamespacesInput{MaxResults: aws.Int32(1)})
+		cancel()
+	}
+	if err == nil {
+		return nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDeniedException":
+			return errors.Wrap(err, "the AWS credentials are not allowed to read Cloud Map; grant them "+
+				"servicediscovery:ListNamespaces (or servicediscovery:GetNamespace when looking namespaces up), "+
+				"servicediscovery:ListServices and servicediscovery:DiscoverInstances")
+		case "UnrecognizedClientException", "InvalidClientTokenId", "InvalidSignatureException", "ExpiredTokenException":
+			return errors.Wrap(err, "the AWS credentials were rejected; check the access key ID and secret, or refresh the session token")
+		}
+	}
+	return errors.Wrap(err, "failed to list Cloud Map namespaces; check the AWS region and that credentials are available")
+}
+
+func (w *watcher) refreshStore(ctx context.Context) (err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	defer func() {
+		w.breaker.record(w.prefix, err)
+	}()
+
+	start := time.Now()
+	full := w.fullSync <= 0 || start.Sub(w.lastFull) >= w.fullSync
 	log.Info("Syncing Cloud Map store")
-	// TODO: allow users to specify namespaces to watch
-	nsResp, err := w.cloudmap.ListNamespaces(ctx, &servicediscovery.ListNamespacesInput{})
+	namespaces, err := w.namespaces(ctx)
 	if err != nil {
-		log.Errorf("error retrieving namespace list from Cloud Map: %v", err)
-		return
+		return errors.Wrap(err, "error retrieving namespace list from Cloud Map")
 	}
 	// We want to continue to use existing store on error
 	tempStore := map[string][]*v1alpha3.WorkloadEntry{}
-	for _, ns := range nsResp.Namespaces {
-		hosts, err := w.hostsForNamespace(ctx, &ns)
+	services := map[string]serviceRef{}
+	namespaceHosts := make(map[string]map[string][]*v1alpha3.WorkloadEntry, len(namespaces))
+	// the namespaces watched, and those of them that failed along with the last failure, for WithPartialRefresh
+	watched, failed := 0, 0
+	var failure error
+	// the ID of the namespace each host was synced from
+	origin := map[string]string{}
+	for _, ns := range namespaces {
+		if !w.watches(&ns) {
+			log.Debugf("skipping Cloud Map namespace %q (%s)", aws.ToString(ns.Name), aws.ToString(ns.Id))
+			continue
+		}
+		watched++
+		refs := map[string]serviceRef{}
+		hosts, err := w.hostsForNamespace(ctx, &ns, refs, full)
+		if err != nil && !w.partial {
+			return errors.Wrapf(err, "error refreshing Cloud Map namespace %q", aws.ToString(ns.Name))
+		}
 		if err != nil {
-			log.Errorf("unable to refresh Cloud Map cache due to error, using existing cache: %v", err)
-			return
+			last, synced := w.namespaceHosts[aws.ToString(ns.Id)]
+			if !synced {
+				// with no hosts to keep, syncing the others would have its ServiceEntries collected
+				return errors.Wrapf(err, "error refreshing Cloud Map namespace %q, which never synced",
+					aws.ToString(ns.Name))
+			}
+			log.Errorf("unable to refresh Cloud Map namespace %q, keeping its hosts as last synced: %v",
+				aws.ToString(ns.Name), err)
+			failed, failure = failed+1, err
+			hosts, refs = last, w.servicesOf(&ns)
+		}
+		namespaceHosts[aws.ToString(ns.Id)] = hosts
+		for id, ref := range refs {
+			services[id] = ref
 		}
-		// Hosts are "svcName.nsName" so by definition can't be the same across namespaces or services
+		// Hosts are "svcName.nsName" so by definition can't be the same across namespaces or services, unless host
+		// suffixes map several namespaces to one
 		for host, wes := range hosts {
+			if _, ok := tempStore[host]; ok {
+				log.Warnf("skipping %q of Cloud Map namespace %q, already synced from another namespace", host,
+					aws.ToString(ns.Name))
+				continue
+			}
 			tempStore[host] = wes
+			origin[host] = aws.ToString(ns.Id)
 		}
 	}
+	if failed > 0 && failed == watched {
+		return errors.Wrap(failure, "error refreshing every Cloud Map namespace")
+	}
+	if failed > 0 {
+		metrics.CloudMapPartialRefreshes.WithLabelValues(w.prefix).Inc()
+	}
+	var dropped []provider.Dropped
+	for host, d := range w.cache {
+		if _, ok := tempStore[host]; !ok {
+			delete(w.cache, host)
+			continue
+		}
+		dropped = append(dropped, d.dropped...)
+	}
+	w.drops.Set(dropped)
+	w.services = services
+	if w.partial {
+		w.namespaceHosts = namespaceHosts
+	}
+	// the namespaces that failed weren't synced in full
+	if full && failed == 0 {
+		w.lastFull = start
+	}
+	if w.annotate {
+		w.store.Annotate(w.annotations(services, origin))
+	}
+	// publishing an unchanged registry only costs the store, and everything watching it, a comparison of every host
+	snap := snapshot(tempStore)
+	if snap == w.snapshot {
+		log.Info("Cloud Map store sync successful, nothing changed")
+		metrics.CloudMapNoopSyncs.WithLabelValues(w.prefix).Inc()
+		w.store.Synced()
+		return nil
+	}
+	w.snapshot = snap
 	log.Info("Cloud Map store sync successful")
 	w.store.Set(tempStore)
+	return nil
+}
+
+// servicesOf returns the services of ns last synced by ID
+func (w *watcher) servicesOf(ns *sdTypes.NamespaceSummary) map[string]serviceRef {
+	refs := map[string]serviceRef{}
+	for id, ref := range w.services {
+		if aws.ToString(ref.namespace.Id) == aws.ToString(ns.Id) {
+			refs[id] = ref
+		}
+	}
+	return refs
+}
+
+// watches returns whether ns is allowed and not denied by WithNamespaces
+func (w *watcher) watches(ns *sdTypes.NamespaceSummary) bool {
+	name, id := aws.ToString(ns.Name), aws.ToString(ns.Id)
+	if _, ok := w.deny[name]; ok {
+		return false
+	}
+	if _, ok := w.deny[id]; ok {
+		return false
+	}
+	if len(w.allow) == 0 {
+		return true
+	}
+	_, byName := w.allow[name]
+	_, byID := w.allow[id]
+	return byName || byID
+}
+
+// syncs returns whether the name of svc is included and not excluded by WithServiceNames
+func (w *watcher) syncs(svc *sdTypes.ServiceSummary) bool {
+	name := aws.ToString(svc.Name)
+	if w.exclude != nil && w.exclude.MatchString(name) {
+		return false
+	}
+	return w.include == nil || w.include.MatchString(name)
+}
+
+// host returns the host svc in ns is published as: its name followed by the host suffix of ns, or else the name of ns
+func (w *watcher) host(svc *sdTypes.ServiceSummary, ns *sdTypes.NamespaceSummary) string {
+	suffix, ok := w.suffixes[aws.ToString(ns.Name)]
+	if !ok {
+		suffix, ok = w.suffixes[aws.ToString(ns.Id)]
+	}
+	switch {
+	case !ok:
+		suffix = aws.ToString(ns.Name)
+	case strings.HasPrefix(suffix, "."):
+		suffix = aws.ToString(ns.Name) + suffix
+	}
+	return aws.ToString(svc.Name) + "." + suffix
 }
 
-func (w *watcher) hostsForNamespace(ctx context.Context, ns *sdTypes.NamespaceSummary) (map[string][]*v1alpha3.WorkloadEntry, error) {
-	hosts := map[string][]*v1alpha3.WorkloadEntry{}
-	svcResp, err := w.cloudmap.ListServices(ctx, &servicediscovery.ListServicesInput{
+// set returns the elements of list as a set
+func set(list []string) map[string]struct{} {
+	s := make(map[string]struct{}, len(list))
+	for _, e := range list {
+		s[e] = struct{}{}
+	}
+	return s
+}
+
+// hostsForNamespace returns the hosts of the services in ns, recording the services by ID in refs unless it's nil.
+// Services are discovered concurrently, and if any of them fails the others are cancelled and nothing is returned.
+// Unless full, services whose summary is unchanged keep the entries they were last discovered with, and unless a full
+// sync of WithIncremental is due, so do services discovered within the instances TTL.
+func (w *watcher) hostsForNamespace(ctx context.Context, ns *sdTypes.NamespaceSummary, refs map[string]serviceRef,
+	full bool) (map[string][]*v1alpha3.WorkloadEntry, error) {
+	services, err := w.listServices(ctx, ns)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error retrieving service list from Cloud Map for namespace %q", *ns.Name)
+	}
+	// every service of a namespace carrying the tag is synced, otherwise only those carrying it themselves
+	nsTagged := w.tag == nil
+	if !nsTagged {
+		if nsTagged, err = w.carriesTag(ctx, ns.Arn); err != nil {
+			return nil, err
+		}
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, len(services))
+	var m sync.Mutex // guards hosts and refs
+	record := func(svc *sdTypes.ServiceSummary, host string, wes []*v1alpha3.WorkloadEntry) {
+		m.Lock()
+		defer m.Unlock()
+		hosts[host] = wes
+		if refs != nil {
+			refs[aws.ToString(svc.Id)] = serviceRef{service: *svc, namespace: *ns}
+		}
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	if w.concurrency > 0 {
+		g.SetLimit(w.concurrency)
+	}
+	for i := range services {
+		svc := &services[i]
+		host := w.host(svc, ns)
+		if !w.syncs(svc) {
+			log.Debugf("skipping Cloud Map service %q, filtered out by name", host)
+			continue
+		}
+		g.Go(func() error {
+			if !nsTagged {
+				if ok, err := w.carriesTag(gctx, svc.Arn); err != nil || !ok {
+					return err
+				}
+			}
+			if w.annotate {
+				w.describe(gctx, svc)
+			}
+			if !full {
+				if wes, ok := w.unchanged(host, svc); ok {
+					log.Debugf("skipping %q, unchanged since last discovered", host)
+					record(svc, host, wes)
+					return nil
+				}
+			}
+			if !full || w.fullSync <= 0 {
+				if wes, ok := w.fresh(host); ok {
+					log.Debugf("skipping %q, discovered within the last %v", host, w.instancesTTL)
+					record(svc, host, wes)
+					return nil
+				}
+			}
+			wes, err := w.workloadEntriesForService(gctx, svc, ns)
+			if err != nil {
+				return err
+			}
+			log.Infof("%v Workload Entries found for %q", len(wes), host)
+			record(svc, host, wes)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// listNamespaces returns every page of namespaces, bounding each call by the call timeout
+func (w *watcher) listNamespaces(ctx context.Context) ([]sdTypes.NamespaceSummary, error) {
+	var namespaces []sdTypes.NamespaceSummary
+	pages := servicediscovery.NewListNamespacesPaginator(w.cloudmap, &servicediscovery.ListNamespacesInput{})
+	for pages.HasMorePages() {
+		callCtx, cancel, err := w.callContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		page, err := pages.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, page.Namespaces...)
+	}
+	return namespaces, nil
+}
+
+// listServices returns every page of the services in ns, bounding each call by the call timeout
+func (w *watcher) listServices(ctx context.Context, ns *sdTypes.NamespaceSummary) ([]sdTypes.ServiceSummary, error) {
+	var services []sdTypes.ServiceSummary
+	pages := servicediscovery.NewListServicesPaginator(w.cloudmap, &servicediscovery.ListServicesInput{
 		Filters: []sdTypes.ServiceFilter{
 			{
 				Name:      serviceFilterNamespaceID,
@@ -125,60 +859,313 @@ func (w *watcher) hostsForNamespace(ctx context.Context, ns *sdTypes.NamespaceSu
 			},
 		},
 	})
-	if err != nil {
-		return nil, errors.Wrapf(err, "error retrieving service list from Cloud Map for namespace %q", *ns.Name)
-	}
-	for _, svc := range svcResp.Services {
-		host := fmt.Sprintf("%v.%v", *svc.Name, *ns.Name)
-		wes, err := w.workloadEntriesForService(ctx, &svc, ns)
+	for pages.HasMorePages() {
+		callCtx, cancel, err := w.callContext(ctx)
 		if err != nil {
 			return nil, err
 		}
-		log.Infof("%v Workload Entries found for %q", len(wes), host)
-		hosts[host] = wes
+		page, err := pages.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, page.Services...)
 	}
-	return hosts, nil
+	return services, nil
 }
 
 func (w *watcher) workloadEntriesForService(ctx context.Context, svc *sdTypes.ServiceSummary, ns *sdTypes.NamespaceSummary) ([]*v1alpha3.WorkloadEntry, error) {
-	// TODO: use health filter?
-	instOutput, err := w.cloudmap.DiscoverInstances(ctx, &servicediscovery.DiscoverInstancesInput{ServiceName: svc.Name, NamespaceName: ns.Name})
+	// the name Route 53 resolves the service by, whatever host it's published as
+	name := fmt.Sprintf("%v.%v", *svc.Name, *ns.Name)
+	host := w.host(svc, ns)
+	if w.resolveDNS && resolvable(ns, svc) {
+		w.cacheM.Lock()
+		delete(w.cache, host)
+		w.cacheM.Unlock()
+		// an entry addressed by the service's name is resolved through DNS; the ports are unknown without instances
+		return []*v1alpha3.WorkloadEntry{{Address: name, Ports: map[string]uint32{"http": 80, "https": 443}}}, nil
+	}
+	callCtx, cancel, err := w.callContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	query := w.query(name)
+	instOutput, err := w.cloudmap.DiscoverInstances(callCtx, &servicediscovery.DiscoverInstancesInput{
+		ServiceName:        svc.Name,
+		NamespaceName:      ns.Name,
+		MaxResults:         aws.Int32(maxInstances),
+		HealthStatus:       w.healthStatus,
+		QueryParameters:    query.Query,
+		OptionalParameters: query.Optional,
+	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "error retrieving instance list from Cloud Map for %q in %q", *svc.Name, *ns.Name)
 	}
+	instances := instOutput.Instances
+	if len(instances) >= maxInstances {
+		log.Warnf("%q has at least %d instances, the most Cloud Map discovers at once; listing them instead", host, maxInstances)
+		metrics.CloudMapInstanceLimitHits.WithLabelValues(w.prefix).Inc()
+		if instances, err = w.listInstances(ctx, svc, ns); err != nil {
+			return nil, errors.Wrapf(err, "error listing the instances of %q past the %d Cloud Map discovers", host, maxInstances)
+		}
+		// ListInstances has no query parameters
+		instances = filterQuery(instances, query)
+	}
+	instances = w.healthy(host, instances)
 	// Inject host based instance if there are no instances
-	if len(instOutput.Instances) == 0 {
-		host := fmt.Sprintf("%v.%v", *svc.Name, *ns.Name)
-		instOutput.Instances = []sdTypes.HttpInstanceSummary{
-			{Attributes: map[string]string{"AWS_INSTANCE_CNAME": host}},
+	if len(instances) == 0 {
+		instances = []sdTypes.HttpInstanceSummary{
+			{Attributes: map[string]string{"AWS_INSTANCE_CNAME": name}},
+		}
+	}
+	w.cacheM.Lock()
+	defer w.cacheM.Unlock()
+	if d, ok := w.cache[host]; ok && sameInstances(d.instances, instances) {
+		d.revision, d.at = revision(svc), time.Now()
+		w.cache[host] = d
+		return d.workloadEntries, nil
+	}
+	wes, dropped := instancesToWorkloadEntries(host, instances, w.attributes)
+	if w.cache == nil {
+		w.cache = make(map[string]discovered)
+	}
+	w.cache[host] = discovered{revision: revision(svc), at: time.Now(), instances: instances, workloadEntries: wes,
+		dropped: dropped}
+	return wes, nil
+}
+
+// unchanged returns the entries host was last discovered with if svc's summary hasn't changed since
+func (w *watcher) unchanged(host string, svc *sdTypes.ServiceSummary) ([]*v1alpha3.WorkloadEntry, bool) {
+	rev := revision(svc)
+	if rev == "" {
+		return nil, false
+	}
+	w.cacheM.Lock()
+	defer w.cacheM.Unlock()
+	d, ok := w.cache[host]
+	return d.workloadEntries, ok && d.revision == rev
+}
+
+// fresh returns the entries host was last discovered with if that was within the instances TTL
+func (w *watcher) fresh(host string) ([]*v1alpha3.WorkloadEntry, bool) {
+	if w.instancesTTL <= 0 {
+		return nil, false
+	}
+	w.cacheM.Lock()
+	defer w.cacheM.Unlock()
+	d, ok := w.cache[host]
+	return d.workloadEntries, ok && time.Since(d.at) < w.instancesTTL
+}
+
+// revision returns what of svc's summary changes along with its instances, or "" if it doesn't say. The count misses
+// instances replaced or updated in place, and the creation date tells a service deleted and created again apart.
+func revision(svc *sdTypes.ServiceSummary) string {
+	if svc.InstanceCount == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", *svc.InstanceCount, aws.ToTime(svc.CreateDate).UnixNano())
+}
+
+// healthy returns the instances of host whose health attribute doesn't say they're unhealthy
+func (w *watcher) healthy(host string, instances []sdTypes.HttpInstanceSummary) []sdTypes.HttpInstanceSummary {
+	if w.healthAttribute == "" {
+		return instances
+	}
+	healthy := make([]sdTypes.HttpInstanceSummary, 0, len(instances))
+	for _, inst := range instances {
+		if unhealthy(inst.Attributes[w.healthAttribute], w.unhealthyValues) {
+			log.Debugf("leaving out instance %s of %q, whose %s is %q", aws.ToString(inst.InstanceId), host,
+				w.healthAttribute, inst.Attributes[w.healthAttribute])
+			continue
+		}
+		healthy = append(healthy, inst)
+	}
+	return healthy
+}
+
+// unhealthy returns whether value is one of values, ignoring case
+func unhealthy(value string, values []string) bool {
+	for _, v := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvable returns whether Route 53 resolves the host of svc in ns: svc is in a DNS namespace and has A, AAAA or
+// CNAME records. HTTP services in DNS namespaces have no records, and SRV records alone don't resolve the host.
+func resolvable(ns *sdTypes.NamespaceSummary, svc *sdTypes.ServiceSummary) bool {
+	if ns.Type != sdTypes.NamespaceTypeDnsPublic && ns.Type != sdTypes.NamespaceTypeDnsPrivate {
+		return false
+	}
+	if svc.Type == sdTypes.ServiceTypeHttp || svc.DnsConfig == nil {
+		return false
+	}
+	for _, r := range svc.DnsConfig.DnsRecords {
+		switch r.Type {
+		case sdTypes.RecordTypeA, sdTypes.RecordTypeAaaa, sdTypes.RecordTypeCname:
+			return true
+		}
+	}
+	return false
+}
+
+// sameInstances returns whether a and b would convert to the same workload entries
+func sameInstances(a, b []sdTypes.HttpInstanceSummary) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if aws.ToString(a[i].InstanceId) != aws.ToString(b[i].InstanceId) || len(a[i].Attributes) != len(b[i].Attributes) {
+			return false
+		}
+		for k, v := range a[i].Attributes {
+			if bv, ok := b[i].Attributes[k]; !ok || bv != v {
+				return false
+			}
 		}
 	}
-	return instancesToWorkloadEntries(instOutput.Instances), nil
+	return true
 }
 
-func instancesToWorkloadEntries(instances []sdTypes.HttpInstanceSummary) []*v1alpha3.WorkloadEntry {
+// callContext waits for the rate limit to allow a single API call, then returns a context bounding it by the call
+// timeout, which the wait doesn't count against
+func (w *watcher) callContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	if w.limiter != nil {
+		if err := w.limiter.Wait(ctx); err != nil {
+			return nil, nil, errors.Wrap(err, "waiting for the Cloud Map rate limit")
+		}
+	}
+	if w.callTimeout <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.callTimeout)
+	return ctx, cancel, nil
+}
+
+// instancesToWorkloadEntries converts the instances of host by names, returning those it dropped alongside
+func instancesToWorkloadEntries(host string, instances []sdTypes.HttpInstanceSummary, names attributeNames) (
+	[]*v1alpha3.WorkloadEntry, []provider.Dropped) {
 	wes := make([]*v1alpha3.WorkloadEntry, 0, len(instances))
+	var dropped []provider.Dropped
 	for _, inst := range instances {
-		we := instanceToWorkloadEntry(&inst)
+		we, drop := instanceToWorkloadEntry(host, &inst, names)
 		if we != nil {
 			wes = append(wes, we)
 		}
+		if drop != nil {
+			dropped = append(dropped, *drop)
+		}
 	}
-	return wes
+	return wes, dropped
 }
 
-func instanceToWorkloadEntry(instance *sdTypes.HttpInstanceSummary) *v1alpha3.WorkloadEntry {
+// instanceToWorkloadEntry converts an instance of host. If it's dropped, or converted with an assumed port, the
+// returned Dropped says why.
+func instanceToWorkloadEntry(host string, instance *sdTypes.HttpInstanceSummary, names attributeNames) (
+	*v1alpha3.WorkloadEntry, *provider.Dropped) {
+	// dual-stack instances are synced by their IPv4 address, which every cluster can route to
 	var address string
 	if ip, ok := instance.Attributes["AWS_INSTANCE_IPV4"]; ok {
 		address = ip
+	} else if ip, ok := instance.Attributes["AWS_INSTANCE_IPV6"]; ok {
+		address = ip
 	} else if cname, ok := instance.Attributes["AWS_INSTANCE_CNAME"]; ok {
 		address = cname
 	}
 	if address == "" {
 		log.Infof("instance %v of %v.%v is of a type that is not currently supported", *instance.InstanceId, *instance.ServiceName, *instance.NamespaceName)
-		return nil
+		detail := "no AWS_INSTANCE_IPV4, AWS_INSTANCE_IPV6 or AWS_INSTANCE_CNAME attribute"
+		if _, ok := instance.Attributes["AWS_ALIAS_DNS_NAME"]; ok {
+			detail = "alias records are not supported"
+		}
+		return nil, &provider.Dropped{Host: host, ID: aws.ToString(instance.InstanceId), Reason: provider.DroppedUnsupported, Detail: detail}
+	}
+	portAttribute, port := "AWS_INSTANCE_PORT", ""
+	for _, name := range append(names.ports[:len(names.ports):len(names.ports)], "AWS_INSTANCE_PORT") {
+		if p, ok := instance.Attributes[name]; ok && p != "" {
+			portAttribute, port = name, p
+			break
+		}
+	}
+	we := workloadEntry(address, port)
+	we.Labels = labels(instance.Attributes, names.labels)
+	we.Locality = locality(instance.Attributes)
+	if _, err := strconv.Atoi(port); port != "" && err != nil {
+		return we, &provider.Dropped{Host: host, ID: aws.ToString(instance.InstanceId), Reason: provider.DroppedInvalidPort,
+			Detail: fmt.Sprintf("%s %q is not a number, assuming http (80) and https (443)", portAttribute, port)}
+	}
+	weightAttribute := names.weight
+	if weightAttribute == "" {
+		weightAttribute = "AWS_INSTANCE_WEIGHT"
+	}
+	if weight, ok := instance.Attributes[weightAttribute]; ok {
+		w, err := strconv.ParseUint(weight, 10, 32)
+		if err != nil {
+			return we, &provider.Dropped{Host: host, ID: aws.ToString(instance.InstanceId), Reason: provider.DroppedInvalidWeight,
+				Detail: fmt.Sprintf("%s %q is not a whole number, leaving the weight unset", weightAttribute, weight)}
+		}
+		we.Weight = uint32(w)
+	}
+	return we, nil
+}
+
+// labels returns the TLS labels of an instance's attributes along with the attributes keyed by their label in names
+func labels(attributes, names map[string]string) map[string]string {
+	l := infer.TLSLabels(attributes)
+	for attribute, label := range names {
+		v, ok := attributes[attribute]
+		if !ok || len(validation.IsValidLabelValue(v)) > 0 {
+			continue
+		}
+		if _, ok := l[label]; ok {
+			continue
+		}
+		if l == nil {
+			l = make(map[string]string, len(names))
+		}
+		l[label] = v
+	}
+	return l
+}
+
+// zoneRegion matches the region a zone is named after, e.g. us-west-2 of us-west-2a and of the local zone
+// us-west-2-lax-1a
+var zoneRegion = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+`)
+
+// locality returns the region/zone of an instance, as ECS and EC2 registrars record it, for locality-aware load
+// balancing. A zone name without a region is in the region it's named after, e.g. us-east-1a in us-east-1.
+func locality(attributes map[string]string) string {
+	zone := firstAttribute(attributes, "AVAILABILITY_ZONE", "AWS_AVAILABILITY_ZONE")
+	region := firstAttribute(attributes, "REGION", "AWS_REGION")
+	if region == "" {
+		// zone IDs, e.g. use1-az1, don't name their region
+		region = zoneRegion.FindString(zone)
+	}
+	switch {
+	case region == "":
+		return ""
+	case zone == "":
+		return region
 	}
-	if port, ok := instance.Attributes["AWS_INSTANCE_PORT"]; ok {
+	return region + "/" + zone
+}
+
+// firstAttribute returns the value of the first of names attributes has
+func firstAttribute(attributes map[string]string, names ...string) string {
+	for _, name := range names {
+		if v := attributes[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func workloadEntry(address, port string) *v1alpha3.WorkloadEntry {
+	if port != "" {
 		p, err := strconv.Atoi(port)
 		if err == nil {
 			return infer.WorkloadEntry(address, uint32(p))
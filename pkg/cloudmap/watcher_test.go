@@ -4,13 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/aws/smithy-go"
 	"istio.io/api/networking/v1alpha3"
 
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
 	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
 )
 
@@ -50,6 +61,7 @@ func (m *mockSDAPI) DiscoverInstances(ctx context.Context, dii *servicediscovery
 }
 
 // various strings to allow pointer usage
+var ipv6 = "2001:db8::1"
 var ipv41, ipv42, subdomain, hostname, portStr, httpPortStr = "8.8.8.8", "9.9.9.9", "demo", "tetrate.io", "9999", "80"
 var cname = fmt.Sprintf("%v.%v", subdomain, hostname)
 
@@ -111,7 +123,7 @@ func TestWatcher_refreshCache(t *testing.T) {
 				ListSvcResult: tt.listSvcRes, ListSvcErr: tt.listSvcErr,
 				DiscInstResult: tt.discInstRes, DiscInstErr: tt.discInstErr,
 			}
-			w := &watcher{cloudmap: mockAPI, store: provider.NewStore()}
+			w := &watcher{cloudmap: mockAPI, store: provider.NewStore(), drops: provider.NewDrops("cloudmap-")}
 			w.refreshStore(context.TODO())
 			if !reflect.DeepEqual(w.store.Hosts(), tt.want) {
 				t.Errorf("Watcher.store = %v, want %v", w.store.Hosts(), tt.want)
@@ -120,6 +132,205 @@ func TestWatcher_refreshCache(t *testing.T) {
 	}
 }
 
+func TestWatcher_Dropped(t *testing.T) {
+	alias := sdTypes.HttpInstanceSummary{
+		InstanceId: &subdomain, ServiceName: &subdomain, NamespaceName: &hostname,
+		Attributes: map[string]string{"AWS_ALIAS_DNS_NAME": hostname},
+	}
+	mockAPI := &mockSDAPI{
+		ListNsResult:  &goldenPathListNamespaces,
+		ListSvcResult: &goldenPathListServices,
+		DiscInstResult: &servicediscovery.DiscoverInstancesOutput{Instances: []sdTypes.HttpInstanceSummary{
+			{Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41}}, alias,
+		}},
+	}
+	w := NewWatcherFromClient(mockAPI, provider.NewStore()).(*watcher)
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	want := []provider.Dropped{{Host: cname, ID: subdomain, Reason: provider.DroppedUnsupported, Detail: "alias records are not supported"}}
+	if got := w.Dropped(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Dropped() = %v, want %v", got, want)
+	}
+
+	// the cached drops are kept while instances are unchanged, and forgotten once they are
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Dropped(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Dropped() = %v after an unchanged refresh, want %v", got, want)
+	}
+	mockAPI.DiscInstResult = &goldenPathDiscoverInstances
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Dropped(); len(got) != 0 {
+		t.Errorf("Dropped() = %v, want none", got)
+	}
+}
+
+func TestWatcher_namespaces(t *testing.T) {
+	tetrateID, exampleID, example := "ns-1", "ns-2", "example.com"
+	listNs := &servicediscovery.ListNamespacesOutput{Namespaces: []sdTypes.NamespaceSummary{
+		{Id: &tetrateID, Name: &hostname},
+		{Id: &exampleID, Name: &example},
+	}}
+	tests := []struct {
+		name        string
+		allow, deny []string
+		want        []string
+	}{
+		{name: "every namespace by default", want: []string{"demo.example.com", "demo.tetrate.io"}},
+		{name: "allowed by name", allow: []string{"tetrate.io"}, want: []string{"demo.tetrate.io"}},
+		{name: "allowed by ID", allow: []string{"ns-2"}, want: []string{"demo.example.com"}},
+		{name: "denied by name", deny: []string{"tetrate.io"}, want: []string{"demo.example.com"}},
+		{name: "denied by ID", deny: []string{"ns-2"}, want: []string{"demo.tetrate.io"}},
+		{name: "deny wins", allow: []string{"tetrate.io", "example.com"}, deny: []string{"ns-1"}, want: []string{"demo.example.com"}},
+		{name: "none allowed", allow: []string{"other.io"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &mockSDAPI{
+				ListNsResult:   listNs,
+				ListSvcResult:  &goldenPathListServices,
+				DiscInstResult: &goldenPathDiscoverInstances,
+			}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithNamespaces(tt.allow, tt.deny))
+			if err := w.Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for host := range w.Store().Hosts() {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_hostSuffixes(t *testing.T) {
+	tetrateID, exampleID, example := "ns-1", "ns-2", "example.com"
+	listNs := &servicediscovery.ListNamespacesOutput{Namespaces: []sdTypes.NamespaceSummary{
+		{Id: &tetrateID, Name: &hostname},
+		{Id: &exampleID, Name: &example},
+	}}
+	tests := []struct {
+		name     string
+		suffixes map[string]string
+		want     []string
+	}{
+		{name: "namespace names by default", want: []string{"demo.example.com", "demo.tetrate.io"}},
+		{name: "replaced by name", suffixes: map[string]string{"tetrate.io": "prod.internal.corp"},
+			want: []string{"demo.example.com", "demo.prod.internal.corp"}},
+		{name: "replaced by ID", suffixes: map[string]string{"ns-2": "svc.cluster.local"},
+			want: []string{"demo.svc.cluster.local", "demo.tetrate.io"}},
+		{name: "appended", suffixes: map[string]string{"example.com": ".corp"}, want: []string{"demo.example.com.corp", "demo.tetrate.io"}},
+		{name: "colliding", suffixes: map[string]string{"ns-1": "corp", "ns-2": "corp"}, want: []string{"demo.corp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &mockSDAPI{
+				ListNsResult:   listNs,
+				ListSvcResult:  &goldenPathListServices,
+				DiscInstResult: &goldenPathDiscoverInstances,
+			}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithHostSuffixes(tt.suffixes))
+			if err := w.Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for host := range w.Store().Hosts() {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_serviceNames(t *testing.T) {
+	listSvc := &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{
+		{Name: aws.String("web")}, {Name: aws.String("debug-web")}, {Name: aws.String("api")},
+	}}
+	tests := []struct {
+		name             string
+		include, exclude *regexp.Regexp
+		want             []string
+	}{
+		{name: "every service by default", want: []string{"api.tetrate.io", "debug-web.tetrate.io", "web.tetrate.io"}},
+		{name: "included", include: regexp.MustCompile(`web$`), want: []string{"debug-web.tetrate.io", "web.tetrate.io"}},
+		{name: "excluded", exclude: regexp.MustCompile(`^debug-`), want: []string{"api.tetrate.io", "web.tetrate.io"}},
+		{name: "exclude wins", include: regexp.MustCompile(`web`), exclude: regexp.MustCompile(`^debug-`), want: []string{"web.tetrate.io"}},
+		{name: "none included", include: regexp.MustCompile(`^db$`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &mockSDAPI{
+				ListNsResult:   &goldenPathListNamespaces,
+				ListSvcResult:  listSvc,
+				DiscInstResult: &goldenPathDiscoverInstances,
+			}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), WithServiceNames(tt.include, tt.exclude))
+			if err := w.Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for host := range w.Store().Hosts() {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		listNsErr error
+		wantErr   string
+	}{
+		{name: "passes when namespaces can be listed"},
+		{
+			name:      "explains access denied",
+			listNsErr: &smithy.GenericAPIError{Code: "AccessDeniedException"},
+			wantErr:   "servicediscovery:ListNamespaces",
+		},
+		{
+			name:      "explains rejected credentials",
+			listNsErr: &smithy.GenericAPIError{Code: "UnrecognizedClientException"},
+			wantErr:   "credentials were rejected",
+		},
+		{
+			name:      "wraps other errors",
+			listNsErr: errors.New("bang"),
+			wantErr:   "failed to list Cloud Map namespaces",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &watcher{cloudmap: &mockSDAPI{ListNsResult: &goldenPathListNamespaces, ListNsErr: tt.listNsErr}}
+			err := w.Check(context.TODO())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Check() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Check() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestWatcher_hostsForNamespace(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -168,7 +379,7 @@ func TestWatcher_hostsForNamespace(t *testing.T) {
 				ListSvcResult: tt.listSvcRes, ListSvcErr: tt.listSvcErr,
 			}
 			w := &watcher{cloudmap: mockAPI}
-			got, err := w.hostsForNamespace(context.TODO(), &tt.ns)
+			got, err := w.hostsForNamespace(context.TODO(), &tt.ns, nil, true)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Watcher.hostsForNamespace() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -228,11 +439,35 @@ func TestWatcher_workloadEntriesForService(t *testing.T) {
 	}
 }
 
+func TestWatcher_reusesWorkloadEntries(t *testing.T) {
+	discover := func(ip string) *servicediscovery.DiscoverInstancesOutput {
+		return &servicediscovery.DiscoverInstancesOutput{Instances: []sdTypes.HttpInstanceSummary{
+			{InstanceId: &ipv41, Attributes: map[string]string{"AWS_INSTANCE_IPV4": ip}},
+		}}
+	}
+	mockAPI := &mockSDAPI{DiscInstResult: discover(ipv41)}
+	w := &watcher{cloudmap: mockAPI}
+	svc, ns := sdTypes.ServiceSummary{Name: &subdomain}, sdTypes.NamespaceSummary{Name: &hostname}
+
+	first, _ := w.workloadEntriesForService(context.TODO(), &svc, &ns)
+	mockAPI.DiscInstResult = discover(ipv41)
+	unchanged, _ := w.workloadEntriesForService(context.TODO(), &svc, &ns)
+	if unchanged[0] != first[0] {
+		t.Errorf("unchanged instances converted to new Workload Entries")
+	}
+	mockAPI.DiscInstResult = discover(ipv42)
+	changed, _ := w.workloadEntriesForService(context.TODO(), &svc, &ns)
+	if changed[0] == first[0] || changed[0].Address != ipv42 {
+		t.Errorf("changed instances returned %v, want a new Workload Entry for %s", changed[0], ipv42)
+	}
+}
+
 func Test_instancesToWorkloadEntries(t *testing.T) {
 	tests := []struct {
-		name      string
-		instances []sdTypes.HttpInstanceSummary
-		want      []*v1alpha3.WorkloadEntry
+		name        string
+		instances   []sdTypes.HttpInstanceSummary
+		want        []*v1alpha3.WorkloadEntry
+		wantDropped []provider.Dropped
 	}{
 		{
 			name: "Handles multiple instances of the same type",
@@ -252,6 +487,9 @@ func Test_instancesToWorkloadEntries(t *testing.T) {
 				},
 			},
 			want: []*v1alpha3.WorkloadEntry{inferedIPv41WorkloadEntry},
+			wantDropped: []provider.Dropped{{
+				Host: hostname, ID: subdomain, Reason: provider.DroppedUnsupported, Detail: "alias records are not supported",
+			}},
 		},
 		{
 			name: "handles empty instance attributes map",
@@ -262,6 +500,10 @@ func Test_instancesToWorkloadEntries(t *testing.T) {
 				},
 			},
 			want: []*v1alpha3.WorkloadEntry{},
+			wantDropped: []provider.Dropped{{
+				Host: hostname, ID: subdomain, Reason: provider.DroppedUnsupported,
+				Detail: "no AWS_INSTANCE_IPV4, AWS_INSTANCE_IPV6 or AWS_INSTANCE_CNAME attribute",
+			}},
 		},
 		{
 			name:      "Handles empty instances slice",
@@ -276,18 +518,24 @@ func Test_instancesToWorkloadEntries(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := instancesToWorkloadEntries(tt.instances); !reflect.DeepEqual(got, tt.want) {
+			got, dropped := instancesToWorkloadEntries(hostname, tt.instances, attributeNames{})
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("instancesToWorkloadEntries() = %v, want %v", got, tt.want)
 			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("instancesToWorkloadEntries() dropped %v, want %v", dropped, tt.wantDropped)
+			}
 		})
 	}
 }
 
 func Test_instanceToWorkloadEntry(t *testing.T) {
 	tests := []struct {
-		name     string
-		instance *sdTypes.HttpInstanceSummary
-		want     *v1alpha3.WorkloadEntry
+		name       string
+		instance   *sdTypes.HttpInstanceSummary
+		names      attributeNames
+		want       *v1alpha3.WorkloadEntry
+		wantReason string // of the drop, if any
 	}{
 		{
 			name: "Workload Entry from AWS_INSTANCE_IPV4 instance with AWS_INSTANCE_PORT set to known proto",
@@ -296,6 +544,20 @@ func Test_instanceToWorkloadEntry(t *testing.T) {
 			},
 			want: &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"http": 80}},
 		},
+		{
+			name: "Workload Entry from AWS_INSTANCE_IPV6 instance with AWS_INSTANCE_PORT set to known proto",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV6": ipv6, "AWS_INSTANCE_PORT": httpPortStr},
+			},
+			want: &v1alpha3.WorkloadEntry{Address: ipv6, Ports: map[string]uint32{"http": 80}},
+		},
+		{
+			name: "Workload Entry from dual-stack instance uses AWS_INSTANCE_IPV4",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_IPV6": ipv6, "AWS_INSTANCE_PORT": httpPortStr},
+			},
+			want: &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"http": 80}},
+		},
 		{
 			name: "Workload Entry from AWS_INSTANCE_CNAME instance with AWS_INSTANCE_PORT set to known proto",
 			instance: &sdTypes.HttpInstanceSummary{
@@ -329,7 +591,92 @@ func Test_instanceToWorkloadEntry(t *testing.T) {
 			instance: &sdTypes.HttpInstanceSummary{
 				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": hostname},
 			},
-			want: inferedIPv41WorkloadEntry,
+			want:       inferedIPv41WorkloadEntry,
+			wantReason: provider.DroppedInvalidPort,
+		},
+		{
+			name: "Workload Entry with the port of the first port attribute the instance has",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": httpPortStr, "SERVICE_PORT": portStr},
+			},
+			names: attributeNames{ports: []string{"PORT_8080", "SERVICE_PORT"}},
+			want:  &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"tcp": 9999}},
+		},
+		{
+			name: "Workload Entry falling back to AWS_INSTANCE_PORT without port attributes",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": httpPortStr, "SERVICE_PORT": ""},
+			},
+			names: attributeNames{ports: []string{"SERVICE_PORT"}},
+			want:  &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"http": 80}},
+		},
+		{
+			name: "Workload Entry infering http and https from a non-int port attribute",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": httpPortStr, "SERVICE_PORT": hostname},
+			},
+			names:      attributeNames{ports: []string{"SERVICE_PORT"}},
+			want:       inferedIPv41WorkloadEntry,
+			wantReason: provider.DroppedInvalidPort,
+		},
+		{
+			name: "Workload Entry in the locality of the instance's availability zone",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": portStr, "AVAILABILITY_ZONE": "us-east-1a", "REGION": "us-east-1"},
+			},
+			want: &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"tcp": 9999}, Locality: "us-east-1/us-east-1a"},
+		},
+		{
+			name: "Workload Entry weighted by AWS_INSTANCE_WEIGHT",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": portStr, "AWS_INSTANCE_WEIGHT": "20"},
+			},
+			want: &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"tcp": 9999}, Weight: 20},
+		},
+		{
+			name: "Workload Entry weighted by the weight attribute",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": portStr, "AWS_INSTANCE_WEIGHT": "20", "weight": "5"},
+			},
+			names: attributeNames{weight: "weight"},
+			want:  &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"tcp": 9999}, Weight: 5},
+		},
+		{
+			name: "Workload Entry without a weight for an invalid weight",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": portStr, "AWS_INSTANCE_WEIGHT": "-1"},
+			},
+			want:       &v1alpha3.WorkloadEntry{Address: ipv41, Ports: map[string]uint32{"tcp": 9999}},
+			wantReason: provider.DroppedInvalidWeight,
+		},
+		{
+			name: "Workload Entry labelled with the TLS settings of the instance's attributes",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": portStr, "tls": "true", "tls-sni": hostname},
+			},
+			want: &v1alpha3.WorkloadEntry{
+				Address: ipv41,
+				Ports:   map[string]uint32{"tcp": 9999},
+				Labels:  map[string]string{infer.TLSModeLabel: "SIMPLE", infer.TLSSNILabel: hostname},
+			},
+		},
+		{
+			name: "Workload Entry labelled with the label attributes of the instance",
+			instance: &sdTypes.HttpInstanceSummary{
+				Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "AWS_INSTANCE_PORT": portStr, "tls": "true",
+					"ECS_CLUSTER_NAME": "prod", "ECS_SERVICE_NAME": "web", "ECS_TASK_DEFINITION_FAMILY": "not a label value"},
+			},
+			names: attributeNames{labels: map[string]string{
+				"ECS_CLUSTER_NAME": "ecs.amazonaws.com/cluster", "ECS_SERVICE_NAME": "ecs.amazonaws.com/service",
+				"ECS_TASK_DEFINITION_FAMILY": "ecs.amazonaws.com/task-definition-family", "AVAILABILITY_ZONE": "zone",
+				"tls": infer.TLSModeLabel,
+			}},
+			want: &v1alpha3.WorkloadEntry{
+				Address: ipv41,
+				Ports:   map[string]uint32{"tcp": 9999},
+				Labels: map[string]string{infer.TLSModeLabel: "SIMPLE", "ecs.amazonaws.com/cluster": "prod",
+					"ecs.amazonaws.com/service": "web"},
+			},
 		},
 		{
 			name: "Nil for instance with AWS_ALIAS_DNS_NAME",
@@ -337,14 +684,634 @@ func Test_instanceToWorkloadEntry(t *testing.T) {
 				InstanceId: &subdomain, ServiceName: &subdomain, NamespaceName: &hostname,
 				Attributes: map[string]string{"AWS_ALIAS_DNS_NAME": hostname},
 			},
-			want: nil,
+			want:       nil,
+			wantReason: provider.DroppedUnsupported,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := instanceToWorkloadEntry(tt.instance); !reflect.DeepEqual(got, tt.want) {
+			got, drop := instanceToWorkloadEntry(hostname, tt.instance, tt.names)
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("instanceToWorkloadEntry() = %v, want %v", got, tt.want)
 			}
+			var reason string
+			if drop != nil {
+				reason = drop.Reason
+			}
+			if reason != tt.wantReason {
+				t.Errorf("instanceToWorkloadEntry() dropped with reason %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+// hangingSDAPI blocks every call until its context is done
+type hangingSDAPI struct {
+	ServiceDiscoveryClient
+}
+
+func (hangingSDAPI) ListNamespaces(ctx context.Context, _ *servicediscovery.ListNamespacesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWatcher_callTimeout(t *testing.T) {
+	w := &watcher{cloudmap: hangingSDAPI{}, store: provider.NewStore(), drops: provider.NewDrops("cloudmap-"), callTimeout: 10 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- w.Refresh(context.TODO()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Refresh() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Refresh() did not time out")
+	}
+}
+
+// pagedSDAPI serves namespaces and services two pages at a time, recording the instances discovered
+type pagedSDAPI struct {
+	mockSDAPI
+	m          sync.Mutex
+	discovered []*servicediscovery.DiscoverInstancesInput
+}
+
+func (m *pagedSDAPI) ListNamespaces(_ context.Context, lni *servicediscovery.ListNamespacesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	if lni.NextToken == nil {
+		next, id, name := "ns-page-2", "ns-1", "one.io"
+		return &servicediscovery.ListNamespacesOutput{Namespaces: []sdTypes.NamespaceSummary{{Id: &id, Name: &name}}, NextToken: &next}, nil
+	}
+	id, name := "ns-2", "two.io"
+	return &servicediscovery.ListNamespacesOutput{Namespaces: []sdTypes.NamespaceSummary{{Id: &id, Name: &name}}}, nil
+}
+
+func (m *pagedSDAPI) ListServices(_ context.Context, lsi *servicediscovery.ListServicesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	ns := lsi.Filters[0].Values[0]
+	if lsi.NextToken == nil {
+		next, id, name := "svc-page-2", "srv-a-"+ns, "a"
+		return &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{{Id: &id, Name: &name}}, NextToken: &next}, nil
+	}
+	id, name := "srv-b-"+ns, "b"
+	return &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{{Id: &id, Name: &name}}}, nil
+}
+
+func (m *pagedSDAPI) DiscoverInstances(ctx context.Context, dii *servicediscovery.DiscoverInstancesInput, optFns ...func(*servicediscovery.Options)) (
+	*servicediscovery.DiscoverInstancesOutput, error) {
+	m.m.Lock()
+	m.discovered = append(m.discovered, dii)
+	m.m.Unlock()
+	return m.mockSDAPI.DiscoverInstances(ctx, dii, optFns...)
+}
+
+func TestWatcher_paginates(t *testing.T) {
+	mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+	w := NewWatcherFromClient(mockAPI, provider.NewStore())
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for host := range w.Store().Hosts() {
+		got = append(got, host)
+	}
+	sort.Strings(got)
+	if want := []string{"a.one.io", "a.two.io", "b.one.io", "b.two.io"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts = %v, want %v", got, want)
+	}
+	for _, in := range mockAPI.discovered {
+		if max := aws.ToInt32(in.MaxResults); max != maxInstances {
+			t.Errorf("DiscoverInstances MaxResults = %d, want %d", max, maxInstances)
+		}
+	}
+}
+
+func TestWatcher_healthStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want sdTypes.HealthStatusFilter
+	}{
+		{name: "healthy by default", want: sdTypes.HealthStatusFilterHealthy},
+		{
+			name: "configured",
+			opts: []Option{WithHealthStatus(sdTypes.HealthStatusFilterHealthyOrElseAll)},
+			want: sdTypes.HealthStatusFilterHealthyOrElseAll,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+			if err := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...).Refresh(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+			for _, in := range mockAPI.discovered {
+				if in.HealthStatus != tt.want {
+					t.Errorf("DiscoverInstances HealthStatus = %q, want %q", in.HealthStatus, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHealthStatus(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    sdTypes.HealthStatusFilter
+		wantErr bool
+	}{
+		{in: "HEALTHY", want: sdTypes.HealthStatusFilterHealthy},
+		{in: "all", want: sdTypes.HealthStatusFilterAll},
+		{in: "healthy_or_else_all", want: sdTypes.HealthStatusFilterHealthyOrElseAll},
+		{in: "UNHEALTHY", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseHealthStatus(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseHealthStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseHealthStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_rateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		wantBurst int
+		wantErr   bool
+	}{
+		{name: "unlimited by default"},
+		{name: "disabled", opts: []Option{WithRateLimit(0, 10)}},
+		{name: "within the burst", opts: []Option{WithRateLimit(1, 100)}, wantBurst: 100},
+		// the second call would only be allowed after the refresh's deadline
+		{name: "throttled", opts: []Option{WithRateLimit(1, 1)}, wantBurst: 1, wantErr: true},
+		{name: "default burst", opts: []Option{WithRateLimit(2.5, 0)}, wantBurst: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...).(*watcher)
+			var burst int
+			if w.limiter != nil {
+				burst = w.limiter.Burst()
+			}
+			if burst != tt.wantBurst {
+				t.Errorf("burst = %d, want %d", burst, tt.wantBurst)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			err := w.Refresh(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "rate limit") {
+				t.Errorf("Refresh() error = %v, want it to blame the rate limit", err)
+			}
 		})
 	}
 }
+
+func TestNewWatcher_interval(t *testing.T) {
+	creds := WithCredentials(credentials.NewStaticCredentialsProvider("id", "secret", ""))
+	tests := []struct {
+		name    string
+		opts    []Option
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: defaultInterval},
+		{name: "zero", opts: []Option{WithInterval(0)}, want: defaultInterval},
+		{name: "slower", opts: []Option{WithInterval(time.Minute)}, want: time.Minute},
+		{name: "fastest", opts: []Option{WithInterval(MinInterval)}, want: MinInterval},
+		{name: "too fast", opts: []Option{WithInterval(100 * time.Millisecond)}, wantErr: true},
+		{name: "too slow", opts: []Option{WithInterval(2 * time.Hour)}, wantErr: true},
+		{name: "resync", opts: []Option{WithInterval(time.Minute), WithEvents(&fakeQueue{}, 10*time.Minute)}, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatcher(context.TODO(), provider.NewStore(), "us-east-1", "", "", append(tt.opts, creds)...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewWatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && w.(*watcher).interval != tt.want {
+				t.Errorf("interval = %v, want %v", w.(*watcher).interval, tt.want)
+			}
+		})
+	}
+}
+
+// slowSDAPI serves a namespace of many services whose instances take a while to discover, recording how many are
+// discovered at once. Discovering the service named fail fails.
+type slowSDAPI struct {
+	mockSDAPI
+	services          int
+	m                 sync.Mutex
+	inFlight, maxSeen int
+}
+
+func (m *slowSDAPI) ListNamespaces(context.Context, *servicediscovery.ListNamespacesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	return &goldenPathListNamespaces, nil
+}
+
+func (m *slowSDAPI) ListServices(context.Context, *servicediscovery.ListServicesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	out := &servicediscovery.ListServicesOutput{}
+	for i := 0; i < m.services; i++ {
+		out.Services = append(out.Services, sdTypes.ServiceSummary{Id: aws.String(fmt.Sprintf("srv-%d", i)), Name: aws.String(fmt.Sprintf("svc%d", i))})
+	}
+	if m.ListSvcResult != nil {
+		out.Services = append(out.Services, m.ListSvcResult.Services...)
+	}
+	return out, nil
+}
+
+func (m *slowSDAPI) DiscoverInstances(ctx context.Context, dii *servicediscovery.DiscoverInstancesInput, _ ...func(*servicediscovery.Options)) (
+	*servicediscovery.DiscoverInstancesOutput, error) {
+	m.m.Lock()
+	m.inFlight++
+	if m.inFlight > m.maxSeen {
+		m.maxSeen = m.inFlight
+	}
+	m.m.Unlock()
+	defer func() {
+		m.m.Lock()
+		m.inFlight--
+		m.m.Unlock()
+	}()
+	if aws.ToString(dii.ServiceName) == "fail" {
+		return nil, errors.New("bang")
+	}
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &goldenPathDiscoverInstances, nil
+}
+
+func TestWatcher_concurrency(t *testing.T) {
+	fail := &servicediscovery.ListServicesOutput{Services: []sdTypes.ServiceSummary{{Id: aws.String("srv-fail"), Name: aws.String("fail")}}}
+	tests := []struct {
+		name      string
+		opts      []Option
+		failing   *servicediscovery.ListServicesOutput
+		wantMax   int
+		wantHosts int
+		wantErr   bool
+	}{
+		{name: "sequential", opts: []Option{WithConcurrency(1)}, wantMax: 1, wantHosts: 20},
+		{name: "bounded", opts: []Option{WithConcurrency(4)}, wantMax: 4, wantHosts: 20},
+		{name: "default", wantMax: defaultConcurrency, wantHosts: 20},
+		{name: "all or nothing", opts: []Option{WithConcurrency(4)}, failing: fail, wantMax: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &slowSDAPI{mockSDAPI: mockSDAPI{ListSvcResult: tt.failing}, services: 20}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...)
+			err := w.Refresh(context.TODO())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mockAPI.maxSeen > tt.wantMax {
+				t.Errorf("discovered %d services at once, want at most %d", mockAPI.maxSeen, tt.wantMax)
+			}
+			if !tt.wantErr && mockAPI.maxSeen != tt.wantMax {
+				t.Errorf("discovered %d services at once, want %d", mockAPI.maxSeen, tt.wantMax)
+			}
+			if got := len(w.Store().Hosts()); got != tt.wantHosts {
+				t.Errorf("%d hosts synced, want %d", got, tt.wantHosts)
+			}
+		})
+	}
+}
+
+// countedSDAPI serves a namespace of two services with the instance counts in counts, counting the instances discovered
+type countedSDAPI struct {
+	mockSDAPI
+	counts     map[string]int32
+	m          sync.Mutex
+	discovered int
+}
+
+func (m *countedSDAPI) ListNamespaces(context.Context, *servicediscovery.ListNamespacesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListNamespacesOutput, error) {
+	return &goldenPathListNamespaces, nil
+}
+
+func (m *countedSDAPI) ListServices(context.Context, *servicediscovery.ListServicesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	out := &servicediscovery.ListServicesOutput{}
+	for _, name := range []string{"a", "b"} {
+		svc := sdTypes.ServiceSummary{Id: aws.String("srv-" + name), Name: aws.String(name)}
+		if count, ok := m.counts[name]; ok {
+			svc.InstanceCount = aws.Int32(count)
+		}
+		out.Services = append(out.Services, svc)
+	}
+	return out, nil
+}
+
+func (m *countedSDAPI) DiscoverInstances(context.Context, *servicediscovery.DiscoverInstancesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.DiscoverInstancesOutput, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.discovered++
+	return &goldenPathDiscoverInstances, nil
+}
+
+func TestWatcher_incremental(t *testing.T) {
+	type step struct {
+		counts         map[string]int32
+		fullSyncDue    bool
+		wantDiscovered int
+	}
+	tests := []struct {
+		name  string
+		opts  []Option
+		steps []step
+	}{
+		{
+			name: "full by default",
+			steps: []step{
+				{counts: map[string]int32{"a": 1, "b": 1}, wantDiscovered: 2},
+				{counts: map[string]int32{"a": 1, "b": 1}, wantDiscovered: 2},
+			},
+		},
+		{
+			name: "skips unchanged services",
+			opts: []Option{WithIncremental(time.Hour)},
+			steps: []step{
+				{counts: map[string]int32{"a": 1, "b": 1}, wantDiscovered: 2},
+				{counts: map[string]int32{"a": 1, "b": 1}, wantDiscovered: 0},
+				{counts: map[string]int32{"a": 2, "b": 1}, wantDiscovered: 1},
+				{counts: map[string]int32{"a": 2, "b": 1}, wantDiscovered: 0},
+				{counts: map[string]int32{"a": 2, "b": 1}, fullSyncDue: true, wantDiscovered: 2},
+			},
+		},
+		{
+			name: "discovers services without a count",
+			opts: []Option{WithIncremental(time.Hour)},
+			steps: []step{
+				{counts: map[string]int32{"a": 1}, wantDiscovered: 2},
+				{counts: map[string]int32{"a": 1}, wantDiscovered: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &countedSDAPI{}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...).(*watcher)
+			for i, s := range tt.steps {
+				mockAPI.counts, mockAPI.discovered = s.counts, 0
+				if s.fullSyncDue {
+					w.lastFull = time.Now().Add(-2 * time.Hour)
+				}
+				if err := w.Refresh(context.TODO()); err != nil {
+					t.Fatal(err)
+				}
+				if mockAPI.discovered != s.wantDiscovered {
+					t.Errorf("refresh %d discovered %d services, want %d", i, mockAPI.discovered, s.wantDiscovered)
+				}
+				if got := len(w.Store().Hosts()); got != 2 {
+					t.Errorf("refresh %d synced %d hosts, want 2", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWatcher_instancesTTL(t *testing.T) {
+	type step struct {
+		// expired ages the instances last discovered past the TTL
+		expired        bool
+		fullSyncDue    bool
+		wantDiscovered int
+	}
+	tests := []struct {
+		name  string
+		opts  []Option
+		steps []step
+	}{
+		{
+			name: "reuses instances within the TTL",
+			opts: []Option{WithInstancesTTL(time.Hour)},
+			steps: []step{
+				{wantDiscovered: 2},
+				{wantDiscovered: 0},
+				{expired: true, wantDiscovered: 2},
+				{wantDiscovered: 0},
+			},
+		},
+		{
+			name: "full syncs discover regardless",
+			opts: []Option{WithInstancesTTL(time.Hour), WithIncremental(2 * time.Hour)},
+			steps: []step{
+				{wantDiscovered: 2},
+				{wantDiscovered: 0},
+				{fullSyncDue: true, wantDiscovered: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// without instance counts, incremental syncs can't tell services are unchanged
+			mockAPI := &countedSDAPI{}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...).(*watcher)
+			for i, s := range tt.steps {
+				mockAPI.discovered = 0
+				if s.expired {
+					for host, d := range w.cache {
+						d.at = d.at.Add(-2 * time.Hour)
+						w.cache[host] = d
+					}
+				}
+				if s.fullSyncDue {
+					w.lastFull = time.Now().Add(-3 * time.Hour)
+				}
+				if err := w.Refresh(context.TODO()); err != nil {
+					t.Fatal(err)
+				}
+				if mockAPI.discovered != s.wantDiscovered {
+					t.Errorf("refresh %d discovered %d services, want %d", i, mockAPI.discovered, s.wantDiscovered)
+				}
+				if got := len(w.Store().Hosts()); got != 2 {
+					t.Errorf("refresh %d synced %d hosts, want 2", i, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_resolvable(t *testing.T) {
+	dnsNs := sdTypes.NamespaceSummary{Type: sdTypes.NamespaceTypeDnsPrivate}
+	records := func(types ...sdTypes.RecordType) *sdTypes.DnsConfig {
+		c := &sdTypes.DnsConfig{}
+		for _, t := range types {
+			c.DnsRecords = append(c.DnsRecords, sdTypes.DnsRecord{Type: t})
+		}
+		return c
+	}
+	tests := []struct {
+		name string
+		ns   sdTypes.NamespaceSummary
+		svc  sdTypes.ServiceSummary
+		want bool
+	}{
+		{name: "A record", ns: dnsNs, svc: sdTypes.ServiceSummary{DnsConfig: records(sdTypes.RecordTypeA)}, want: true},
+		{
+			name: "public namespace",
+			ns:   sdTypes.NamespaceSummary{Type: sdTypes.NamespaceTypeDnsPublic},
+			svc:  sdTypes.ServiceSummary{Type: sdTypes.ServiceTypeDnsHttp, DnsConfig: records(sdTypes.RecordTypeAaaa)},
+			want: true,
+		},
+		{name: "CNAME record", ns: dnsNs, svc: sdTypes.ServiceSummary{DnsConfig: records(sdTypes.RecordTypeCname)}, want: true},
+		{name: "SRV record only", ns: dnsNs, svc: sdTypes.ServiceSummary{DnsConfig: records(sdTypes.RecordTypeSrv)}},
+		{name: "SRV and A records", ns: dnsNs, svc: sdTypes.ServiceSummary{DnsConfig: records(sdTypes.RecordTypeSrv, sdTypes.RecordTypeA)}, want: true},
+		{name: "HTTP service", ns: dnsNs, svc: sdTypes.ServiceSummary{Type: sdTypes.ServiceTypeHttp}},
+		{name: "no DNS config", ns: dnsNs},
+		{
+			name: "HTTP namespace",
+			ns:   sdTypes.NamespaceSummary{Type: sdTypes.NamespaceTypeHttp},
+			svc:  sdTypes.ServiceSummary{DnsConfig: records(sdTypes.RecordTypeA)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvable(&tt.ns, &tt.svc); got != tt.want {
+				t.Errorf("resolvable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_dnsResolution(t *testing.T) {
+	ns := sdTypes.NamespaceSummary{Name: &hostname, Type: sdTypes.NamespaceTypeDnsPrivate}
+	svc := sdTypes.ServiceSummary{Name: &subdomain, DnsConfig: &sdTypes.DnsConfig{DnsRecords: []sdTypes.DnsRecord{{Type: sdTypes.RecordTypeA}}}}
+	tests := []struct {
+		name string
+		opts []Option
+		want []*v1alpha3.WorkloadEntry
+	}{
+		{name: "discovers by default", want: []*v1alpha3.WorkloadEntry{inferedIPv41WorkloadEntry}},
+		{name: "resolves", opts: []Option{WithDNSResolution()}, want: []*v1alpha3.WorkloadEntry{inferedHostWorkloadEntry}},
+		{name: "resolves the name of a renamed host", opts: []Option{WithDNSResolution(), WithHostSuffixes(map[string]string{hostname: "corp"})},
+			want: []*v1alpha3.WorkloadEntry{inferedHostWorkloadEntry}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &pagedSDAPI{mockSDAPI: mockSDAPI{DiscInstResult: &goldenPathDiscoverInstances}}
+			w := NewWatcherFromClient(mockAPI, provider.NewStore(), tt.opts...).(*watcher)
+			got, err := w.workloadEntriesForService(context.TODO(), &svc, &ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("workloadEntriesForService() = %v, want %v", got, tt.want)
+			}
+			if resolved := len(mockAPI.discovered) == 0; resolved != (tt.opts != nil) {
+				t.Errorf("discovered %d times", len(mockAPI.discovered))
+			}
+		})
+	}
+}
+
+func TestWatcher_unhealthyAttribute(t *testing.T) {
+	instances := &servicediscovery.DiscoverInstancesOutput{Instances: []sdTypes.HttpInstanceSummary{
+		{InstanceId: aws.String("ok"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv41, "health": "ok"}},
+		{InstanceId: aws.String("sick"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": ipv42, "health": "Unhealthy"}},
+		{InstanceId: aws.String("draining"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": "10.0.0.1", "health": "draining"}},
+		{InstanceId: aws.String("unset"), Attributes: map[string]string{"AWS_INSTANCE_IPV4": "10.0.0.2"}},
+	}}
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{name: "every instance by default", want: []string{ipv41, ipv42, "10.0.0.1", "10.0.0.2"}},
+		{
+			name: "leaves out unhealthy values",
+			opts: []Option{WithUnhealthyAttribute("health", []string{"UNHEALTHY", "draining"})},
+			want: []string{ipv41, "10.0.0.2"},
+		},
+		{
+			name: "leaves out every instance",
+			opts: []Option{WithUnhealthyAttribute("health", []string{"ok", "unhealthy", "draining", ""})},
+			// as when none is discovered, the host itself is synced
+			want: []string{cname},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWatcherFromClient(&mockSDAPI{DiscInstResult: instances}, provider.NewStore(), tt.opts...).(*watcher)
+			wes, err := w.workloadEntriesForService(context.TODO(), &sdTypes.ServiceSummary{Name: &subdomain}, &sdTypes.NamespaceSummary{Name: &hostname})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, we := range wes {
+				got = append(got, we.Address)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addresses = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_locality(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		want       string
+	}{
+		{name: "none"},
+		{name: "ECS", attributes: map[string]string{"AVAILABILITY_ZONE": "eu-west-1b", "REGION": "eu-west-1"}, want: "eu-west-1/eu-west-1b"},
+		{name: "AWS prefixed", attributes: map[string]string{"AWS_AVAILABILITY_ZONE": "eu-west-1b", "AWS_REGION": "eu-west-1"}, want: "eu-west-1/eu-west-1b"},
+		{name: "region from the zone", attributes: map[string]string{"AWS_AVAILABILITY_ZONE": "us-west-2c"}, want: "us-west-2/us-west-2c"},
+		{name: "local zone", attributes: map[string]string{"AVAILABILITY_ZONE": "us-west-2-lax-1a"}, want: "us-west-2/us-west-2-lax-1a"},
+		{name: "GovCloud", attributes: map[string]string{"AVAILABILITY_ZONE": "us-gov-west-1a"}, want: "us-gov-west-1/us-gov-west-1a"},
+		{name: "region only", attributes: map[string]string{"REGION": "eu-west-1"}, want: "eu-west-1"},
+		{name: "zone ID", attributes: map[string]string{"AVAILABILITY_ZONE": "use1-az1"}},
+		{name: "zone ID and region", attributes: map[string]string{"AVAILABILITY_ZONE": "use1-az1", "REGION": "us-east-1"}, want: "us-east-1/use1-az1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := locality(tt.attributes); got != tt.want {
+				t.Errorf("locality() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWatcher_endpoint(t *testing.T) {
+	var target string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		_, _ = w.Write([]byte(`{"Namespaces":[]}`))
+	}))
+	defer server.Close()
+	creds := WithCredentials(credentials.NewStaticCredentialsProvider("test", "test", ""))
+
+	if _, err := NewWatcher(context.TODO(), provider.NewStore(), "us-east-1", "", "", creds, WithEndpoint("localhost:4566")); err == nil {
+		t.Error("NewWatcher() accepted an endpoint that isn't a URL")
+	}
+	w, err := NewWatcher(context.TODO(), provider.NewStore(), "us-east-1", "", "", creds, WithEndpoint(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(provider.Checker).Check(context.TODO()); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if !strings.HasSuffix(target, ".ListNamespaces") {
+		t.Errorf("endpoint called with target %q, want ListNamespaces", target)
+	}
+}
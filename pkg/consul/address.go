@@ -0,0 +1,36 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// WithTaggedAddress reaches instances at their tagged address of the name given rather than their default one, e.g.
+// wan to reach them from another datacenter, or virtual for the virtual IPs of Consul's transparent proxies. The
+// service's tagged address wins, along with its port, over its node's; instances with neither are reached at their
+// default address.
+func WithTaggedAddress(name string) Option {
+	return func(w *watcher) {
+		w.conversion.taggedAddress = name
+	}
+}
+
+// address returns the address and port to reach c at, as its tagged address of the name tagged, if not empty, says,
+// or its service's address, falling back to its node's, as instances registered without an address of their own are
+// reached at their node's
+func address(c *api.CatalogService, tagged string) (string, int) {
+	if tagged != "" {
+		if a, ok := c.ServiceTaggedAddresses[tagged]; ok && a.Address != "" {
+			if a.Port > 0 {
+				return a.Address, a.Port
+			}
+			return a.Address, c.ServicePort
+		}
+		if a := c.TaggedAddresses[tagged]; a != "" {
+			return a, c.ServicePort
+		}
+	}
+	if c.ServiceAddress != "" {
+		return c.ServiceAddress, c.ServicePort
+	}
+	return c.Address, c.ServicePort
+}
@@ -0,0 +1,45 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestAddress(t *testing.T) {
+	tagged := &api.CatalogService{
+		Address:         "10.0.0.1",
+		TaggedAddresses: map[string]string{"lan": "10.0.0.1", "wan": "203.0.113.1"},
+		ServiceAddress:  "10.1.0.1",
+		ServicePort:     8080,
+		ServiceTaggedAddresses: map[string]api.ServiceAddress{
+			"wan":     {Address: "203.0.113.10", Port: 18080},
+			"virtual": {Address: "240.0.0.1"},
+		},
+	}
+	tests := []struct {
+		name        string
+		c           *api.CatalogService
+		tagged      string
+		wantAddress string
+		wantPort    int
+	}{
+		{name: "service address", c: tagged, wantAddress: "10.1.0.1", wantPort: 8080},
+		{name: "node address", c: &api.CatalogService{Address: "10.0.0.1", ServicePort: 8080}, wantAddress: "10.0.0.1",
+			wantPort: 8080},
+		{name: "service tagged address", c: tagged, tagged: "wan", wantAddress: "203.0.113.10", wantPort: 18080},
+		{name: "service tagged address without port", c: tagged, tagged: "virtual", wantAddress: "240.0.0.1",
+			wantPort: 8080},
+		{name: "node tagged address", c: tagged, tagged: "lan", wantAddress: "10.0.0.1", wantPort: 8080},
+		{name: "no tagged address", c: tagged, tagged: "lan_ipv6", wantAddress: "10.1.0.1", wantPort: 8080},
+		{name: "no address", c: &api.CatalogService{}, tagged: "wan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, port := address(tt.c, tt.tagged)
+			if address != tt.wantAddress || port != tt.wantPort {
+				t.Errorf("address() = %s, %d, want %s, %d", address, port, tt.wantAddress, tt.wantPort)
+			}
+		})
+	}
+}
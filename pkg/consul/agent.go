@@ -0,0 +1,118 @@
+package consul
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// WithAgentServices syncs the services registered with the Consul agent the watcher reads, through the agent's own
+// API, rather than every service of the catalog, e.g. to run alongside a client agent at the edge where the token
+// can't read the catalog. With WithHealthStatus the agent's checks tell the health of its services, and WithFilter
+// selects services by the fields the agent lists them with, e.g. "mesh" in Tags.
+func WithAgentServices() Option {
+	return func(w *watcher) {
+		w.agentLocal = true
+	}
+}
+
+// agent is what the agent reports of itself, and of the services registered with it
+type agent struct {
+	self struct {
+		Config struct {
+			Datacenter, NodeName, NodeID string
+		}
+		Member struct {
+			Addr string
+		}
+		Meta map[string]string
+	}
+	services map[string]*api.AgentService
+	checks   map[string]*api.AgentCheck
+}
+
+// readAgent reads the agent, its services and, with a health status, their checks
+func (w *watcher) readAgent(ctx context.Context) (*agent, error) {
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{Namespace: w.namespace})
+	defer cancel()
+	var a agent
+	if _, err := w.client.Raw().Query("/v1/agent/self", &a.self, opts); err != nil {
+		return nil, errors.Wrap(err, "failed to read the agent")
+	}
+	opts.Filter = w.filter
+	if _, err := w.client.Raw().Query("/v1/agent/services", &a.services, opts); err != nil {
+		return nil, errors.Wrap(err, "failed to list the agent's services")
+	}
+	if w.health == "" {
+		return &a, nil
+	}
+	opts.Filter = ""
+	if _, err := w.client.Raw().Query("/v1/agent/checks", &a.checks, opts); err != nil {
+		return nil, errors.Wrap(err, "failed to list the agent's checks")
+	}
+	return &a, nil
+}
+
+// agentServices lists the services registered with the agent, with the tags of their instances, recording the
+// instances for describeAgentService. The index returned moves whenever the instances do.
+func (w *watcher) agentServices(ctx context.Context) (map[string][]string, uint64, error) {
+	a, err := w.readAgent(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	node := &api.Node{ID: a.self.Config.NodeID, Node: a.self.Config.NodeName, Address: a.self.Member.Addr,
+		Datacenter: a.self.Config.Datacenter, Meta: a.self.Meta}
+	instances := make(map[string][]*api.ServiceEntry)
+	names := make(map[string][]string)
+	for _, s := range a.services {
+		e := &api.ServiceEntry{Node: node, Service: s}
+		for _, c := range a.checks {
+			// the node's checks apply to every instance on it
+			if c.ServiceID == s.ID || c.ServiceID == "" {
+				e.Checks = append(e.Checks, &api.HealthCheck{Node: c.Node, CheckID: c.CheckID, Name: c.Name,
+					Status: c.Status, ServiceID: c.ServiceID, ServiceName: c.ServiceName, Type: c.Type})
+			}
+		}
+		sort.Slice(e.Checks, func(i, j int) bool {
+			return e.Checks[i].CheckID < e.Checks[j].CheckID
+		})
+		instances[s.Service] = append(instances[s.Service], e)
+		names[s.Service] = append(names[s.Service], s.Tags...)
+	}
+	for _, entries := range instances {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Service.ID < entries[j].Service.ID
+		})
+	}
+	if !reflect.DeepEqual(instances, w.agentInstances) {
+		w.agentIndex++
+		w.agentInstances = instances
+	}
+	return names, w.agentIndex, nil
+}
+
+// describeAgentService returns the instances of the service name registered with the agent as last listed, as
+// healthy as the health status requires
+func (w *watcher) describeAgentService(name string) ([]*api.CatalogService, uint64) {
+	entries := w.agentInstances[name]
+	if w.health != "" {
+		return w.healthy(entries), w.agentIndex
+	}
+	svcs := make([]*api.CatalogService, 0, len(entries))
+	for _, e := range entries {
+		svcs = append(svcs, catalogService(e))
+	}
+	return svcs, w.agentIndex
+}
+
+// checkAgent reads the agent once to verify the ACL token can read its services
+func (w *watcher) checkAgent(ctx context.Context) error {
+	if _, err := w.readAgent(ctx); err != nil {
+		return errors.Wrapf(err, "failed to read the services of the Consul agent at %s; the ACL token needs "+
+			"agent:read and service:read", w.endpoint)
+	}
+	return nil
+}
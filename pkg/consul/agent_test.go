@@ -0,0 +1,117 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_agentServices(t *testing.T) {
+	services := map[string]*api.AgentService{
+		// registered without an address, at the agent's
+		"web-1": {ID: "web-1", Service: "web", Port: 8080},
+		"web-2": {ID: "web-2", Service: "web", Address: "192.0.2.2", Port: 8080},
+		"db":    {ID: "db", Service: "db", Address: "192.0.2.3", Port: 5432},
+	}
+	checks := map[string]*api.AgentCheck{
+		"service:web-1": {CheckID: "service:web-1", ServiceID: "web-1", Status: api.HealthPassing},
+		"service:web-2": {CheckID: "service:web-2", ServiceID: "web-2", Status: api.HealthCritical},
+		"service:db":    {CheckID: "service:db", ServiceID: "db", Status: api.HealthPassing},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			_, _ = rw.Write([]byte(`{"Config": {"Datacenter": "dc1", "NodeName": "edge"}, "Member": {"Addr": "192.0.2.1"}}`))
+		case "/v1/agent/services":
+			_ = json.NewEncoder(rw).Encode(services)
+		case "/v1/agent/checks":
+			_ = json.NewEncoder(rw).Encode(checks)
+		default:
+			// the catalog isn't readable
+			http.Error(rw, "Permission denied", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		health string
+		want   map[string][]string
+	}{
+		{name: "all", want: map[string][]string{"web": {"192.0.2.1:8080", "192.0.2.2:8080"}, "db": {"192.0.2.3:5432"}}},
+		{name: "passing", health: api.HealthPassing,
+			want: map[string][]string{"web": {"192.0.2.1:8080"}, "db": {"192.0.2.3:5432"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := NewWatcher(store, server.URL, "", WithAgentServices(), WithHealthStatus(tt.health))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(*watcher).Check(context.Background()); err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if got := agentEndpoints(store); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("deregistered", func(t *testing.T) {
+		store := provider.NewStore()
+		w, err := NewWatcher(store, server.URL, "", WithAgentServices())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+		delete(services, "db")
+		defer func() { services["db"] = &api.AgentService{ID: "db", Service: "db", Address: "192.0.2.3", Port: 5432} }()
+		if err := w.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+		want := map[string][]string{"web": {"192.0.2.1:8080", "192.0.2.2:8080"}}
+		if got := agentEndpoints(store); !reflect.DeepEqual(got, want) {
+			t.Errorf("hosts = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestNewWatcher_agentServices(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"namespaces":      WithAllNamespaces(),
+		"peers":           WithPeers(),
+		"service watches": WithServiceWatches(),
+		"connect":         WithConnect(),
+	} {
+		if _, err := NewWatcher(provider.NewStore(), "http://127.0.0.1:8500", "", WithAgentServices(), opt); err == nil {
+			t.Errorf("NewWatcher() with agent services and %s: want error", name)
+		}
+	}
+}
+
+// agentEndpoints returns the address and port of every endpoint in the store, by host
+func agentEndpoints(store provider.Store) map[string][]string {
+	got := make(map[string][]string)
+	for host, wes := range store.Hosts() {
+		for _, we := range wes {
+			for _, port := range we.Ports {
+				got[host] = append(got[host], we.Address+":"+strconv.Itoa(int(port)))
+			}
+		}
+	}
+	return got
+}
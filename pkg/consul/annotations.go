@@ -0,0 +1,133 @@
+package consul
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+)
+
+const (
+	// ServiceAnnotation is the name of the Consul service a Service Entry was synced from
+	ServiceAnnotation = "consul." + infer.AnnotationDomain + "service"
+	// DatacenterAnnotation is the datacenter the Consul service is registered in, once known
+	DatacenterAnnotation = "consul." + infer.AnnotationDomain + "datacenter"
+	// NamespaceAnnotation is the Consul Enterprise namespace of the service, if any
+	NamespaceAnnotation = "consul." + infer.AnnotationDomain + "namespace"
+	// PartitionAnnotation is the Consul Enterprise admin partition of the service, if read from one
+	PartitionAnnotation = "consul." + infer.AnnotationDomain + "partition"
+	// PeerAnnotation is the cluster peer the service is imported from, if any
+	PeerAnnotation = "consul." + infer.AnnotationDomain + "peer"
+	// ModifyIndexAnnotation is the highest modify index of the service's instances in the catalog
+	ModifyIndexAnnotation = "consul." + infer.AnnotationDomain + "modify-index"
+)
+
+// WithServiceAnnotations annotates the Service Entry of every Consul service with the service's name, datacenter,
+// namespace, partition, peer and modify index, so entries can be traced back to where they came from
+func WithServiceAnnotations() Option {
+	return func(w *watcher) {
+		w.annotate = true
+	}
+}
+
+// entries converts the instances svcs of the service name, read at index, into the entries cached for it
+func (w *watcher) entries(name string, index uint64, svcs []*api.CatalogService) indexedEntries {
+	wes, drops := w.convert(name, svcs)
+	e := indexedEntries{index: index, workloadEntries: wes, dropped: drops}
+	if w.annotate {
+		e.annotations = w.serviceAnnotations(name, svcs)
+	}
+	return e
+}
+
+// serviceAnnotations returns the annotations telling where the instances svcs of the service name come from
+func (w *watcher) serviceAnnotations(name string, svcs []*api.CatalogService) map[string]string {
+	a := map[string]string{ServiceAnnotation: name}
+	datacenter, namespace := w.datacenter, w.namespace
+	var modifyIndex uint64
+	for _, c := range svcs {
+		if c.Datacenter != "" {
+			datacenter = c.Datacenter
+		}
+		if c.Namespace != "" {
+			namespace = c.Namespace
+		}
+		if c.ModifyIndex > modifyIndex {
+			modifyIndex = c.ModifyIndex
+		}
+	}
+	for key, value := range map[string]string{DatacenterAnnotation: datacenter, NamespaceAnnotation: namespace,
+		PartitionAnnotation: w.partition, PeerAnnotation: w.peer} {
+		if value != "" {
+			a[key] = value
+		}
+	}
+	if modifyIndex > 0 {
+		a[ModifyIndexAnnotation] = strconv.FormatUint(modifyIndex, 10)
+	}
+	return a
+}
+
+// annotations returns the annotations of the Service Entries of the services synced, by host, as WithServiceAnnotations
+// and their overrides say
+func (w *watcher) annotations() map[string]map[string]string {
+	annotations := make(map[string]map[string]string)
+	for name, c := range w.cache {
+		a := make(map[string]string, len(c.annotations)+1)
+		// the hosts of services without instances are removed
+		if len(c.workloadEntries) > 0 {
+			for key, value := range c.annotations {
+				a[key] = value
+			}
+		}
+		if o, ok := w.overrides[name]; ok && len(o.ExportTo) > 0 {
+			a[infer.ExportToAnnotation] = strings.Join(o.ExportTo, ",")
+		}
+		if len(a) > 0 {
+			annotations[w.host(name)] = a
+		}
+	}
+	return annotations
+}
+
+// publishAnnotations annotates the hosts of the services synced in the store, if they're annotated at all; w.m must be
+// held
+func (w *watcher) publishAnnotations() {
+	if !w.annotate && w.overridesPrefix == "" {
+		return
+	}
+	w.annotationSets.annotate(w.store, w, w.annotations())
+}
+
+// annotationSets merges the annotations of the watchers sharing a store, those of every namespace or peer, as the
+// store replaces every host's annotations at once
+type annotationSets struct {
+	m    sync.Mutex
+	sets map[*watcher]map[string]map[string]string
+}
+
+// annotate replaces the annotations of w, or drops them if nil, and annotates store with those of every watcher
+func (s *annotationSets) annotate(store interface {
+	Annotate(map[string]map[string]string)
+}, w *watcher, annotations map[string]map[string]string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.sets == nil {
+		s.sets = make(map[*watcher]map[string]map[string]string)
+	}
+	if annotations == nil {
+		delete(s.sets, w)
+	} else {
+		s.sets[w] = annotations
+	}
+	merged := make(map[string]map[string]string)
+	for _, set := range s.sets {
+		for host, a := range set {
+			merged[host] = a
+		}
+	}
+	store.Annotate(merged)
+}
@@ -0,0 +1,91 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_serviceAnnotations(t *testing.T) {
+	var m sync.Mutex
+	// services of every namespace, by namespace
+	namespaces := map[string][]string{"default": {"web"}, "team-a": {"api", "idle"}}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		ns := r.URL.Query().Get("ns")
+		switch {
+		case r.URL.Path == "/v1/namespaces":
+			var out []*api.Namespace
+			for name := range namespaces {
+				out = append(out, &api.Namespace{Name: name})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		case r.URL.Path == "/v1/catalog/services":
+			names := map[string][]string{}
+			for _, name := range namespaces[ns] {
+				names[name] = nil
+			}
+			_ = json.NewEncoder(rw).Encode(names)
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+			name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+			out := []*api.CatalogService{}
+			if name != "idle" {
+				out = append(out,
+					&api.CatalogService{ServiceName: name, Address: "192.0.2.1", ServicePort: 80, Datacenter: "dc1",
+						Namespace: ns, ModifyIndex: 7},
+					&api.CatalogService{ServiceName: name, Address: "192.0.2.2", ServicePort: 80, Datacenter: "dc1",
+						Namespace: ns, ModifyIndex: 12})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithAllNamespaces(), WithServiceAnnotations(), WithPartition("team"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := func(service, namespace string) map[string]string {
+		return map[string]string{ServiceAnnotation: service, DatacenterAnnotation: "dc1", NamespaceAnnotation: namespace,
+			PartitionAnnotation: "team", ModifyIndexAnnotation: "12"}
+	}
+	steps := []struct {
+		name   string
+		change func()
+		want   map[string]map[string]string
+	}{
+		// every namespace's hosts are annotated, but those of services without instances, which aren't synced
+		{name: "every namespace", change: func() {}, want: map[string]map[string]string{
+			"web.default.consul": annotations("web", "default"),
+			"api.team-a.consul":  annotations("api", "team-a"),
+		}},
+		{name: "namespace deleted", change: func() { delete(namespaces, "team-a") }, want: map[string]map[string]string{
+			"web.default.consul": annotations("web", "default"),
+		}},
+	}
+	for _, step := range steps {
+		m.Lock()
+		step.change()
+		m.Unlock()
+		if err := w.Refresh(context.Background()); err != nil {
+			t.Fatalf("%s: Refresh() error = %v", step.name, err)
+		}
+		if got := store.Annotations(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: Annotations() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
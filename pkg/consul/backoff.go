@@ -0,0 +1,74 @@
+package consul
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMaxBackoff caps the wait between attempts while Consul keeps failing
+const defaultMaxBackoff = 2 * time.Minute
+
+// WithMaxBackoff caps the wait between attempts while Consul keeps failing. After a failure the watcher waits for
+// its refresh interval, then twice as long after each further failure up to max, so that a flapping Consul isn't
+// retried in a tight loop; waits are jittered so that watchers failing together don't retry together.
+func WithMaxBackoff(max time.Duration) Option {
+	return func(w *watcher) {
+		w.maxBackoff = max
+	}
+}
+
+// backoff is the wait after consecutive failures of a loop calling Consul
+type backoff struct {
+	base, max time.Duration
+	failures  int
+}
+
+// newBackoff returns the backoff of a loop calling Consul, waiting the tick interval after a first failure
+func (w *watcher) newBackoff() *backoff {
+	return &backoff{base: w.tickInterval, max: w.maxBackoff}
+}
+
+// next records a failure and returns how long to wait before the next attempt, between half the scheduled wait and
+// all of it
+func (b *backoff) next() time.Duration {
+	d := b.base
+	for i := 0; i < b.failures && (b.max <= 0 || d < b.max) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if b.max > 0 && d > b.max {
+		d = b.max
+	}
+	b.failures++
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// reset records a success, so the next failure is waited on as a first one
+func (b *backoff) reset() {
+	b.failures = 0
+}
+
+// validBackoff returns an error unless the cap of the backoff is positive
+func validBackoff(max time.Duration) error {
+	if max <= 0 {
+		return errors.Errorf("Consul max backoff %v must be positive", max)
+	}
+	return nil
+}
+
+// backOff waits as b says after a failed call, returning false if ctx is done first
+func (w *watcher) backOff(ctx context.Context, b *backoff) bool {
+	wait := b.next()
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
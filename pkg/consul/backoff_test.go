@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{base: time.Second, max: 8 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 8, 8, 8} {
+		want *= time.Second
+		if got := b.next(); got < want/2 || got > want {
+			t.Errorf("next() = %v, want between %v and %v", got, want/2, want)
+		}
+	}
+	b.reset()
+	if got := b.next(); got > time.Second {
+		t.Errorf("next() after reset() = %v, want at most 1s", got)
+	}
+	// without a cap, waits keep growing without overflowing
+	b = &backoff{base: time.Second}
+	for i := 0; i < 100; i++ {
+		if got := b.next(); got <= 0 {
+			t.Fatalf("next() after %d failures = %v, want positive", i, got)
+		}
+	}
+}
+
+func TestNewWatcher_maxBackoff(t *testing.T) {
+	if _, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "", WithMaxBackoff(0)); err == nil {
+		t.Error("NewWatcher() error = nil, want one")
+	}
+}
+
+func TestWatcher_indexBackwards(t *testing.T) {
+	var m sync.Mutex
+	// a restored server may report an index already seen for different instances
+	index, address := 10, "192.0.2.1"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil})
+		case "/v1/catalog/service/web":
+			rw.Header().Set("X-Consul-Index", "5")
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{Address: address, ServicePort: 80}})
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(*watcher).refreshStore(context.Background()); err != nil {
+		t.Fatalf("refreshStore() error = %v", err)
+	}
+	m.Lock()
+	index, address = 7, "192.0.2.2"
+	m.Unlock()
+	if err := w.(*watcher).refreshStore(context.Background()); err != nil {
+		t.Fatalf("refreshStore() error = %v", err)
+	}
+	if got := store.Hosts()["web"][0].Address; got != "192.0.2.2" {
+		t.Errorf("address = %s, want 192.0.2.2", got)
+	}
+}
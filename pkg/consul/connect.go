@@ -0,0 +1,69 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// WithConnect syncs the Connect sidecar proxies of Consul services rather than their instances, so that traffic from
+// the mesh enters Consul's service mesh through the proxies. Services without proxies keep their instances synced,
+// and the proxies themselves aren't synced as services of their own.
+func WithConnect() Option {
+	return func(w *watcher) {
+		w.connect = true
+	}
+}
+
+// describeConnectService gets the Connect proxies of the service name, or else its instances if it has none, and the
+// index they were read at. A proxy's own service is described as having no instances, as it's synced as the service
+// it proxies.
+func (w *watcher) describeConnectService(ctx context.Context, name string, waitIndex uint64) ([]*api.CatalogService,
+	uint64, error) {
+	proxies, registered, index, err := w.describeProxies(ctx, name, waitIndex)
+	if err != nil || registered {
+		return proxies, index, err
+	}
+	// the wait, if any, is over
+	svcs, lastIndex, err := w.describeInstances(ctx, name, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if lastIndex > index {
+		index = lastIndex
+	}
+	for _, c := range svcs {
+		if !isProxy(c) {
+			return svcs, index, nil
+		}
+	}
+	return nil, index, nil
+}
+
+// describeProxies gets the Connect proxies of the service name as healthy as the watcher's health status requires,
+// whether it has any registered regardless of their health, and the index they were read at
+func (w *watcher) describeProxies(ctx context.Context, name string, waitIndex uint64) ([]*api.CatalogService, bool,
+	uint64, error) {
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{WaitIndex: waitIndex, Namespace: w.namespace, Filter: w.filter})
+	defer cancel()
+	if w.health == "" {
+		proxies, meta, err := w.client.Catalog().Connect(name, "", opts)
+		if err != nil {
+			return nil, false, 0, errors.Wrapf(err, "failed to describe Connect proxies of svc: %s", name)
+		}
+		return proxies, len(proxies) > 0, meta.LastIndex, nil
+	}
+	// failing proxies are listed too, so that a service whose proxies all fail has none synced rather than its
+	// instances
+	entries, meta, err := w.client.Health().Connect(name, "", false, opts)
+	if err != nil {
+		return nil, false, 0, errors.Wrapf(err, "failed to describe Connect proxies of svc: %s", name)
+	}
+	return w.healthy(entries), len(entries) > 0, meta.LastIndex, nil
+}
+
+// isProxy returns whether c is a Connect proxy of another service
+func isProxy(c *api.CatalogService) bool {
+	return c.ServiceProxy != nil && c.ServiceProxy.DestinationServiceName != ""
+}
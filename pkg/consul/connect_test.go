@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_connect(t *testing.T) {
+	proxy := &api.CatalogService{ServiceID: "web-sidecar-proxy", ServiceName: "web-sidecar-proxy", Address: "192.0.2.1",
+		ServicePort: 21000, ServiceProxy: &api.AgentServiceConnectProxyConfig{DestinationServiceName: "web"}}
+	// instances and Connect proxies by service
+	instances := map[string][]*api.CatalogService{
+		"web":               {{ServiceID: "web", ServiceName: "web", Address: "192.0.2.1", ServicePort: 8080}},
+		"web-sidecar-proxy": {proxy},
+		"legacy":            {{ServiceID: "legacy", ServiceName: "legacy", Address: "192.0.2.2", ServicePort: 8080}},
+	}
+	proxies := map[string][]*api.CatalogService{"web": {proxy}}
+	health := func(svcs []*api.CatalogService, status string) []*api.ServiceEntry {
+		entries := make([]*api.ServiceEntry, 0, len(svcs))
+		for _, c := range svcs {
+			entries = append(entries, &api.ServiceEntry{
+				Node: &api.Node{Node: "node", Address: c.Address},
+				Service: &api.AgentService{ID: c.ServiceID, Service: c.ServiceName, Port: c.ServicePort,
+					Proxy: c.ServiceProxy},
+				Checks: api.HealthChecks{&api.HealthCheck{CheckID: c.ServiceID, Status: status}},
+			})
+		}
+		return entries
+	}
+	var proxyStatus string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Consul-Index", "1")
+		switch path := r.URL.Path; {
+		case path == "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil, "web-sidecar-proxy": nil, "legacy": nil})
+		case strings.HasPrefix(path, "/v1/catalog/service/"):
+			_ = json.NewEncoder(rw).Encode(instances[strings.TrimPrefix(path, "/v1/catalog/service/")])
+		case strings.HasPrefix(path, "/v1/catalog/connect/"):
+			_ = json.NewEncoder(rw).Encode(proxies[strings.TrimPrefix(path, "/v1/catalog/connect/")])
+		case strings.HasPrefix(path, "/v1/health/service/"):
+			_ = json.NewEncoder(rw).Encode(health(instances[strings.TrimPrefix(path, "/v1/health/service/")],
+				api.HealthPassing))
+		case strings.HasPrefix(path, "/v1/health/connect/"):
+			_ = json.NewEncoder(rw).Encode(health(proxies[strings.TrimPrefix(path, "/v1/health/connect/")],
+				proxyStatus))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		health      string
+		proxyStatus string
+		want        map[string]string
+	}{
+		{name: "catalog", want: map[string]string{"web": "192.0.2.1:21000", "legacy": "192.0.2.2:8080"}},
+		{name: "healthy proxy", health: api.HealthPassing, proxyStatus: api.HealthPassing,
+			want: map[string]string{"web": "192.0.2.1:21000", "legacy": "192.0.2.2:8080"}},
+		// the service isn't reached past its failing proxy
+		{name: "failing proxy", health: api.HealthPassing, proxyStatus: api.HealthCritical,
+			want: map[string]string{"legacy": "192.0.2.2:8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyStatus = tt.proxyStatus
+			store := provider.NewStore()
+			w, err := NewWatcher(store, server.URL, "", WithConnect(), WithHealthStatus(tt.health))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			got := make(map[string]string)
+			for host, wes := range store.Hosts() {
+				for _, we := range wes {
+					for _, port := range we.Ports {
+						got[host] = we.Address + ":" + strconv.Itoa(int(port))
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package consul
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// Consistency modes of the reads of a watcher, as Consul names them
+const (
+	ConsistencyDefault    = "default"
+	ConsistencyStale      = "stale"
+	ConsistencyConsistent = "consistent"
+)
+
+// WithConsistency reads the catalog in the consistency mode given: ConsistencyStale lets any server answer, spreading
+// reads across them, ConsistencyConsistent has the leader confirm its leadership for every read, and
+// ConsistencyDefault, as when left empty, has the leader answer. Stale reads are at most maxStale behind the leader,
+// once it's positive, as Consul has the leader answer reads of servers lagging further.
+func WithConsistency(mode string, maxStale time.Duration) Option {
+	return func(w *watcher) {
+		w.consistency, w.maxStale = mode, maxStale
+	}
+}
+
+// validConsistency returns an error unless mode and maxStale are ones WithConsistency accepts
+func validConsistency(mode string, maxStale time.Duration) error {
+	switch mode {
+	case "", ConsistencyDefault, ConsistencyConsistent:
+		if maxStale != 0 {
+			return errors.Errorf("a maximum staleness only applies to %s Consul reads", ConsistencyStale)
+		}
+		return nil
+	case ConsistencyStale:
+		if maxStale < 0 {
+			return errors.Errorf("invalid maximum staleness %v of Consul reads", maxStale)
+		}
+		return nil
+	}
+	return errors.Errorf("invalid Consul consistency mode %q, must be %s, %s or %s", mode, ConsistencyDefault,
+		ConsistencyStale, ConsistencyConsistent)
+}
+
+// consistent sets the consistency mode of the watcher on opts
+func (w *watcher) consistent(opts *api.QueryOptions) {
+	opts.AllowStale = w.consistency == ConsistencyStale
+	opts.RequireConsistent = w.consistency == ConsistencyConsistent
+}
+
+// maxStaleTransport sends every request through next, bounding the staleness of those allowing stale reads. The API
+// client predates max_stale, so it's added to the query.
+type maxStaleTransport struct {
+	maxStale time.Duration
+	next     http.RoundTripper
+}
+
+func (t *maxStaleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if _, stale := r.URL.Query()["stale"]; !stale {
+		return t.next.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	query := r.URL.Query()
+	query.Set("max_stale", t.maxStale.String())
+	r.URL.RawQuery = query.Encode()
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,86 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_consistency(t *testing.T) {
+	var m sync.Mutex
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		query := r.URL.Query()
+		queries = append(queries, url.Values{"stale": query["stale"], "consistent": query["consistent"],
+			"max_stale": query["max_stale"]})
+		rw.Header().Set("X-Consul-Index", "1")
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			_, _ = rw.Write([]byte(`{"web":[]}`))
+		case "/v1/catalog/service/web":
+			_, _ = rw.Write([]byte(`[{"ServiceName":"web","Address":"192.0.2.1","ServicePort":80}]`))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		mode     string
+		maxStale time.Duration
+		want     url.Values
+		wantErr  bool
+	}{
+		{name: "unset", want: url.Values{}},
+		{name: "default", mode: ConsistencyDefault, want: url.Values{}},
+		{name: "consistent", mode: ConsistencyConsistent, want: url.Values{"consistent": {""}}},
+		{name: "stale", mode: ConsistencyStale, want: url.Values{"stale": {""}}},
+		{name: "bounded stale", mode: ConsistencyStale, maxStale: 10 * time.Second,
+			want: url.Values{"stale": {""}, "max_stale": {"10s"}}},
+		{name: "bounded consistent", mode: ConsistencyConsistent, maxStale: 10 * time.Second, wantErr: true},
+		{name: "negative staleness", mode: ConsistencyStale, maxStale: -time.Second, wantErr: true},
+		{name: "unknown", mode: "eventual", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.Lock()
+			queries = nil
+			m.Unlock()
+			w, err := NewWatcher(provider.NewStore(), server.URL, "", WithConsistency(tt.mode, tt.maxStale))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewWatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			m.Lock()
+			defer m.Unlock()
+			if len(queries) != 2 {
+				t.Fatalf("%d calls, want to list and describe", len(queries))
+			}
+			for _, query := range queries {
+				for k, v := range query {
+					if v == nil {
+						delete(query, k)
+					}
+				}
+				if !reflect.DeepEqual(query, tt.want) {
+					t.Errorf("query = %v, want %v", query, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// setEndpoint points config at the Consul endpoint given, returning the path prefix its API is served under, if any.
+// The endpoint is an http:// or https:// URL, whose path is the prefix of a reverse proxy serving the API under it,
+// e.g. https://gateway.example.com/consul, or a unix:// URL of the path of an agent's socket, e.g.
+// unix:///var/run/consul/consul.sock.
+func setEndpoint(config *api.Config, endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing endpoint: %s", endpoint)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "", errors.Errorf("Consul endpoint %s has no host", endpoint)
+		}
+		config.Scheme, config.Address = u.Scheme, u.Host
+		return strings.TrimSuffix(u.Path, "/"), nil
+	case "unix":
+		if u.Path == "" {
+			return "", errors.Errorf("Consul endpoint %s has no socket path", endpoint)
+		}
+		// the client would replace a transport of ours if given the unix:// address, so ours dials the socket
+		// instead, the host being a placeholder
+		socket := u.Path
+		config.Transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		config.Scheme, config.Address = "http", "consul"
+		return "", nil
+	}
+	return "", errors.Errorf("Consul endpoint %s must have scheme http, https or unix", endpoint)
+}
+
+// prefixTransport sends every request through next with its path under the prefix of a reverse proxy. The API client
+// predates path prefixes, so the prefix is added to the path of every call.
+type prefixTransport struct {
+	prefix string
+	next   http.RoundTripper
+}
+
+func (t *prefixTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Path = t.prefix + r.URL.Path
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = t.prefix + r.URL.RawPath
+	}
+	return t.next.RoundTrip(r)
+}
+
+// failoverEndpoint is one of the Consul endpoints a watcher fails over between
+type failoverEndpoint struct {
+	scheme, host, prefix string
+}
+
+func (e failoverEndpoint) String() string {
+	return e.scheme + "://" + e.host + e.prefix
+}
+
+// failoverEndpoints parses endpoint as a comma-separated list of http:// or https:// URLs of Consul endpoints, e.g.
+// the agents or servers of a cluster, returning nil if it names a single one
+func failoverEndpoints(endpoint string) ([]failoverEndpoint, error) {
+	if !strings.Contains(endpoint, ",") {
+		return nil, nil
+	}
+	var endpoints []failoverEndpoint
+	for _, e := range strings.Split(endpoint, ",") {
+		e = strings.TrimSpace(e)
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing endpoint: %s", e)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errors.Errorf("Consul endpoint %s failed over to must have scheme http or https", e)
+		}
+		if u.Host == "" {
+			return nil, errors.Errorf("Consul endpoint %s has no host", e)
+		}
+		endpoints = append(endpoints, failoverEndpoint{scheme: u.Scheme, host: u.Host,
+			prefix: strings.TrimSuffix(u.Path, "/")})
+	}
+	return endpoints, nil
+}
+
+// failoverTransport sends every request through next to the active one of several endpoints. Once the active endpoint
+// is unreachable, the next one becomes active, and the request is sent to it, until every endpoint failed it; one
+// timing out becomes inactive as well, the request being out of time. The active endpoint stays so until it fails.
+type failoverTransport struct {
+	endpoints []failoverEndpoint
+	next      http.RoundTripper
+
+	m      sync.Mutex // guards active
+	active int
+}
+
+func (t *failoverTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	active := t.active
+	t.m.Unlock()
+	for tried := 1; ; tried++ {
+		resp, err := t.next.RoundTrip(t.to(r, t.endpoints[active]))
+		if err == nil || r.Context().Err() == context.Canceled {
+			return resp, err
+		}
+		active = t.failed(active, err)
+		if tried == len(t.endpoints) || r.Context().Err() != nil || (r.Body != nil && r.GetBody == nil) {
+			return resp, err
+		}
+		if r.GetBody != nil {
+			body, bodyErr := r.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			r = r.Clone(r.Context())
+			r.Body = body
+		}
+	}
+}
+
+// to returns r sent to the endpoint e
+func (t *failoverTransport) to(r *http.Request, e failoverEndpoint) *http.Request {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host, r.Host = e.scheme, e.host, e.host
+	r.URL.Path = e.prefix + r.URL.Path
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = e.prefix + r.URL.RawPath
+	}
+	return r
+}
+
+// failed makes the endpoint after failed active, unless another request did already, returning the active one
+func (t *failoverTransport) failed(failed int, err error) int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.active == failed {
+		t.active = (failed + 1) % len(t.endpoints)
+		log.Warnf("Consul endpoint %s failed, failing over to %s: %v", t.endpoints[failed], t.endpoints[t.active], err)
+	}
+	return t.active
+}
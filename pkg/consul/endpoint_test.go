@@ -0,0 +1,135 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestNewWatcher_endpoint(t *testing.T) {
+	// serves a catalog of a single service under prefix
+	catalog := func(prefix string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("X-Consul-Index", "1")
+			switch r.URL.Path {
+			case prefix + "/v1/catalog/services":
+				_, _ = rw.Write([]byte(`{"web":[]}`))
+			case prefix + "/v1/catalog/service/web":
+				_, _ = rw.Write([]byte(`[{"ServiceName":"web","Address":"192.0.2.1","ServicePort":80}]`))
+			default:
+				http.NotFound(rw, r)
+			}
+		})
+	}
+	server := httptest.NewServer(catalog(""))
+	defer server.Close()
+	proxied := httptest.NewServer(catalog("/consul"))
+	defer proxied.Close()
+	socket := filepath.Join(t.TempDir(), "consul.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &http.Server{Handler: catalog("")}
+	go func() { _ = agent.Serve(l) }()
+	defer agent.Close()
+	unreachable := httptest.NewServer(catalog(""))
+	unreachable.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		wantErr  string
+	}{
+		{name: "http", endpoint: server.URL},
+		{name: "path prefix", endpoint: proxied.URL + "/consul"},
+		{name: "path prefix with trailing slash", endpoint: proxied.URL + "/consul/"},
+		{name: "unix socket", endpoint: "unix://" + socket},
+		{name: "no scheme", endpoint: "localhost:8500", wantErr: "must have scheme http, https or unix"},
+		{name: "unknown scheme", endpoint: "ftp://localhost:8500", wantErr: "must have scheme http, https or unix"},
+		{name: "no host", endpoint: "https:///v1", wantErr: "has no host"},
+		{name: "no socket path", endpoint: "unix://", wantErr: "has no socket path"},
+		{name: "failover", endpoint: unreachable.URL + ", " + server.URL},
+		{name: "failover with path prefix", endpoint: unreachable.URL + "," + proxied.URL + "/consul"},
+		{name: "failover to unix socket", endpoint: server.URL + ",unix://" + socket,
+			wantErr: "must have scheme http or https"},
+		{name: "failover to no host", endpoint: server.URL + ",http://", wantErr: "has no host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := NewWatcher(store, tt.endpoint, "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewWatcher() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if _, ok := store.Hosts()["web"]; !ok {
+				t.Errorf("hosts = %v, want web", store.Hosts())
+			}
+		})
+	}
+}
+
+func TestFailoverTransport(t *testing.T) {
+	var served []string
+	serve := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			served = append(served, name)
+		}))
+	}
+	a, b, c := serve("a"), serve("b"), serve("c")
+	defer a.Close()
+	defer c.Close()
+	var endpoints []failoverEndpoint
+	for _, s := range []*httptest.Server{a, b, c} {
+		endpoints = append(endpoints, failoverEndpoint{scheme: "http", host: strings.TrimPrefix(s.URL, "http://")})
+	}
+	client := &http.Client{Transport: &failoverTransport{endpoints: endpoints, next: http.DefaultTransport}}
+	get := func() error {
+		resp, err := client.Get(a.URL + "/v1/catalog/services")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	steps := []struct {
+		name    string
+		change  func()
+		want    []string
+		wantErr bool
+	}{
+		{name: "active", change: func() {}, want: []string{"a"}},
+		// b is failed over to and stays active, as long as it's reachable
+		{name: "active unreachable", change: a.Close, want: []string{"b"}},
+		{name: "failed over", change: func() {}, want: []string{"b"}},
+		// the next one after b is c, whichever failed before
+		{name: "failed over unreachable", change: b.Close, want: []string{"c"}},
+		{name: "all unreachable", change: c.Close, wantErr: true},
+	}
+	for _, step := range steps {
+		step.change()
+		served = nil
+		if err := get(); (err != nil) != step.wantErr {
+			t.Fatalf("%s: error = %v, want error %v", step.name, err, step.wantErr)
+		}
+		if !reflect.DeepEqual(served, step.want) {
+			t.Errorf("%s: served by %v, want %v", step.name, served, step.want)
+		}
+	}
+}
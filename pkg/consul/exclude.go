@@ -0,0 +1,40 @@
+package consul
+
+import (
+	"regexp"
+)
+
+// WithExclusions never syncs the Consul services whose name matches names, unless it's nil, e.g. ^consul to keep
+// Consul's own services out of the mesh, nor those any instance of which has one of tags, e.g. connect-proxy for
+// the pseudo-services of sidecar proxies
+func WithExclusions(names *regexp.Regexp, tags []string) Option {
+	return func(w *watcher) {
+		w.excludeNames, w.excludeTags = names, make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			w.excludeTags[tag] = true
+		}
+	}
+}
+
+// exclude removes the services excluded by WithExclusions from those listed, by name with the tags of their instances
+func (w *watcher) exclude(services map[string][]string) {
+	for name, tags := range services {
+		if w.excluded(name, tags) {
+			log.Debugf("skipping Consul service %q, excluded", name)
+			delete(services, name)
+		}
+	}
+}
+
+// excluded returns whether the service name, with tags, is excluded by WithExclusions
+func (w *watcher) excluded(name string, tags []string) bool {
+	if w.excludeNames != nil && w.excludeNames.MatchString(name) {
+		return true
+	}
+	for _, tag := range tags {
+		if w.excludeTags[tag] {
+			return true
+		}
+	}
+	return false
+}
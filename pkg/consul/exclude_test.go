@@ -0,0 +1,69 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_exclusions(t *testing.T) {
+	services := map[string][]string{
+		"web":               {"v1"},
+		"web-sidecar-proxy": {"v1", "connect-proxy"},
+		"consul":            nil,
+		"consul-esm":        nil,
+		"api":               nil,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Consul-Index", "1")
+		if r.URL.Path == "/v1/catalog/services" {
+			_ = json.NewEncoder(rw).Encode(services)
+			return
+		}
+		name := r.URL.Path[len("/v1/catalog/service/"):]
+		_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: "192.0.2.1", ServicePort: 80}})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		names *regexp.Regexp
+		tags  []string
+		want  []string
+	}{
+		{name: "none", want: []string{"api", "consul", "consul-esm", "web", "web-sidecar-proxy"}},
+		{name: "by name", names: regexp.MustCompile(`^consul`), want: []string{"api", "web", "web-sidecar-proxy"}},
+		{name: "by tag", tags: []string{"connect-proxy"}, want: []string{"api", "consul", "consul-esm", "web"}},
+		{name: "both", names: regexp.MustCompile(`^consul`), tags: []string{"connect-proxy", "v2"},
+			want: []string{"api", "web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := NewWatcher(store, server.URL, "", WithExclusions(tt.names, tt.tags))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			var got []string
+			for host := range store.Hosts() {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// WithFilter only syncs the instances matching the Consul filter expression given, e.g.
+// ServiceMeta["istio-sync"] == "true" or "canary" not in ServiceTags. The expression selects the fields of catalog
+// services, or with WithHealthStatus those of service health entries, e.g. Service.Meta["istio-sync"] == "true".
+func WithFilter(filter string) Option {
+	return func(w *watcher) {
+		w.filter = filter
+	}
+}
+
+// invalidFilter returns whether Consul rejected a call for the watcher's filter expression
+func (w *watcher) invalidFilter(err error) bool {
+	return w.filter != "" && statusCode(err) == http.StatusBadRequest
+}
+
+// checkFilter describes the consul service, which every catalog has, to verify Consul accepts the filter expression
+func (w *watcher) checkFilter(ctx context.Context) error {
+	if w.filter == "" {
+		return nil
+	}
+	if _, _, err := w.describeService(ctx, "consul", 0); err != nil {
+		if w.invalidFilter(err) {
+			return errors.Wrapf(err, "invalid Consul filter %q", w.filter)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_filter(t *testing.T) {
+	var m sync.Mutex
+	var filters []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		filter := r.URL.Query().Get("filter")
+		switch {
+		case r.URL.Path == "/v1/catalog/services":
+			_, _ = rw.Write([]byte(`{"consul":[],"web":[],"api":[]}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+			filters = append(filters, filter)
+			if strings.Contains(filter, "==") && !strings.Contains(filter, `"`) {
+				http.Error(rw, "Failed to create boolean expression evaluator", http.StatusBadRequest)
+				return
+			}
+			name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+			if filter != "" && name != "web" {
+				_, _ = rw.Write([]byte(`[]`))
+				return
+			}
+			_, _ = rw.Write([]byte(`[{"ServiceName":"` + name + `","Address":"192.0.2.1","ServicePort":80}]`))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		filter  string
+		want    []string
+		wantErr string
+	}{
+		{name: "no filter", want: []string{"api", "consul", "web"}},
+		{name: "filter", filter: `ServiceMeta["istio-sync"] == "true"`, want: []string{"web"}},
+		{name: "invalid filter", filter: `ServiceMeta[istio-sync] == true`, wantErr: "invalid Consul filter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.Lock()
+			filters = nil
+			m.Unlock()
+			store := provider.NewStore()
+			store.Apply(provider.Delta{Updated: map[string][]*v1alpha3.WorkloadEntry{"db": {{Address: "192.0.2.9"}}}})
+			w, err := NewWatcher(store, server.URL, "", WithFilter(tt.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.(provider.Checker).Check(context.Background())
+			if err == nil {
+				err = w.Refresh(context.Background())
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				// the refresh fails rather than removing every host
+				if err := w.Refresh(context.Background()); err == nil || len(store.Hosts()) != 1 {
+					t.Errorf("Refresh() error = %v with %d hosts, want an error leaving the store alone", err,
+						len(store.Hosts()))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for host := range store.Hosts() {
+				if host != "db" {
+					got = append(got, host)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+			m.Lock()
+			defer m.Unlock()
+			for _, got := range filters {
+				if got != tt.filter {
+					t.Errorf("described with filter %q, want %q", got, tt.filter)
+				}
+			}
+		})
+	}
+}
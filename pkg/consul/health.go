@@ -0,0 +1,86 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// WithHealthStatus only syncs the instances whose checks, the node's included, are passing, or with api.HealthWarning
+// passing or warning, reading them through the health API rather than the catalog. Instances in maintenance are
+// critical. Left empty, every instance of the catalog is synced.
+func WithHealthStatus(status string) Option {
+	return func(w *watcher) {
+		w.health = status
+	}
+}
+
+// validHealthStatus returns an error unless status is one WithHealthStatus accepts
+func validHealthStatus(status string) error {
+	switch status {
+	case "", api.HealthPassing, api.HealthWarning:
+		return nil
+	}
+	return errors.Errorf("invalid Consul health status %q, must be %s or %s", status, api.HealthPassing, api.HealthWarning)
+}
+
+// describeHealthyService gets the catalog services for name whose checks are as healthy as the watcher syncs, and the
+// index they were read at, blocking as describeService does
+func (w *watcher) describeHealthyService(ctx context.Context, name string, waitIndex uint64) ([]*api.CatalogService,
+	uint64, error) {
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{WaitIndex: waitIndex, Namespace: w.namespace, Filter: w.filter})
+	defer cancel()
+	entries, meta, err := w.client.Health().Service(name, "", w.health == api.HealthPassing, opts)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to describe svc: %s", name)
+	}
+	return w.healthy(entries), meta.LastIndex, nil
+}
+
+// healthy returns the instances of entries whose checks are as healthy as the watcher's health status requires, as
+// the catalog lists them
+func (w *watcher) healthy(entries []*api.ServiceEntry) []*api.CatalogService {
+	svcs := make([]*api.CatalogService, 0, len(entries))
+	for _, e := range entries {
+		if status := e.Checks.AggregatedStatus(); status != api.HealthPassing && status != w.health {
+			continue
+		} else if status == api.HealthWarning && e.Service != nil && e.Service.Weights.Passing > 0 &&
+			e.Service.Weights.Warning == 0 {
+			// weighted to take no traffic while warning
+			continue
+		}
+		svcs = append(svcs, catalogService(e))
+	}
+	return svcs
+}
+
+// catalogService returns the instance e as the catalog lists it
+func catalogService(e *api.ServiceEntry) *api.CatalogService {
+	c := &api.CatalogService{Checks: e.Checks}
+	if n := e.Node; n != nil {
+		c.ID, c.Node, c.Address, c.Datacenter = n.ID, n.Node, n.Address, n.Datacenter
+		c.TaggedAddresses, c.NodeMeta = n.TaggedAddresses, n.Meta
+	}
+	if s := e.Service; s != nil {
+		c.ServiceID, c.ServiceName, c.ServiceAddress, c.ServicePort = s.ID, s.Service, s.Address, s.Port
+		c.ServiceTags, c.ServiceMeta, c.Namespace = s.Tags, s.Meta, s.Namespace
+		c.ServiceWeights = api.Weights{Passing: s.Weights.Passing, Warning: s.Weights.Warning}
+		c.ServiceTaggedAddresses, c.ServiceProxy = s.TaggedAddresses, s.Proxy
+		c.CreateIndex, c.ModifyIndex = s.CreateIndex, s.ModifyIndex
+	}
+	return c
+}
+
+// weight returns the load balancing weight of c, its warning weight while its checks are warning and its passing one
+// otherwise, or zero to leave it to the mesh's default of 1, as for instances registered without weights
+func weight(c *api.CatalogService) uint32 {
+	w := c.ServiceWeights.Passing
+	if c.ServiceWeights.Passing > 0 && c.Checks.AggregatedStatus() == api.HealthWarning {
+		w = c.ServiceWeights.Warning
+	}
+	if w <= 1 {
+		return 0
+	}
+	return uint32(w)
+}
@@ -0,0 +1,268 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_healthStatus(t *testing.T) {
+	// instances of web by address, with the status of their single check
+	instances := map[string]string{
+		"192.0.2.1": api.HealthPassing,
+		"192.0.2.2": api.HealthWarning,
+		"192.0.2.3": api.HealthCritical,
+		"192.0.2.4": api.HealthMaint,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Consul-Index", "1")
+		switch {
+		case r.URL.Path == "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil})
+		case r.URL.Path == "/v1/catalog/service/web":
+			var out []*api.CatalogService
+			for address := range instances {
+				out = append(out, &api.CatalogService{ServiceName: "web", Address: address, ServicePort: 80})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		case r.URL.Path == "/v1/health/service/web":
+			var out []*api.ServiceEntry
+			for address, status := range instances {
+				if _, passingOnly := r.URL.Query()["passing"]; passingOnly && status != api.HealthPassing {
+					continue
+				}
+				check := &api.HealthCheck{CheckID: "web", Status: status}
+				if status == api.HealthMaint {
+					check = &api.HealthCheck{CheckID: api.ServiceMaintPrefix + "web", Status: api.HealthCritical}
+				}
+				out = append(out, &api.ServiceEntry{
+					Node:    &api.Node{Node: "node-" + address, Address: address},
+					Service: &api.AgentService{Service: "web", Port: 80, Tags: []string{"tls=true"}},
+					Checks:  api.HealthChecks{check},
+				})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		status  string
+		want    []string
+		wantErr string
+	}{
+		{status: "", want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}},
+		{status: api.HealthPassing, want: []string{"192.0.2.1"}},
+		{status: api.HealthWarning, want: []string{"192.0.2.1", "192.0.2.2"}},
+		{status: api.HealthCritical, wantErr: "invalid Consul health status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := NewWatcher(store, server.URL, "", WithHealthStatus(tt.status))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewWatcher() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			var got []string
+			for _, we := range store.Hosts()["web"] {
+				got = append(got, we.Address)
+				if tt.status != "" && we.Labels[infer.TLSModeLabel] == "" {
+					t.Errorf("instance %s lost the tags of its service", we.Address)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("synced %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_weights(t *testing.T) {
+	// instances of web by address, with the status of their single check and their weights
+	instances := map[string]struct {
+		status  string
+		weights api.AgentWeights
+	}{
+		"192.0.2.1": {status: api.HealthPassing, weights: api.AgentWeights{Passing: 10, Warning: 1}},
+		"192.0.2.2": {status: api.HealthWarning, weights: api.AgentWeights{Passing: 10, Warning: 3}},
+		"192.0.2.3": {status: api.HealthWarning, weights: api.AgentWeights{Passing: 10}},
+		"192.0.2.4": {status: api.HealthWarning, weights: api.AgentWeights{Passing: 1, Warning: 1}},
+		"192.0.2.5": {status: api.HealthPassing},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Consul-Index", "1")
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil})
+		case "/v1/health/service/web":
+			var out []*api.ServiceEntry
+			for address, i := range instances {
+				out = append(out, &api.ServiceEntry{
+					Node:    &api.Node{Node: "node-" + address, Address: address},
+					Service: &api.AgentService{Service: "web", Port: 80, Weights: i.weights},
+					Checks:  api.HealthChecks{&api.HealthCheck{CheckID: "web", Status: i.status}},
+				})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithHealthStatus(api.HealthWarning))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	got := make(map[string]uint32)
+	for _, we := range store.Hosts()["web"] {
+		got[we.Address] = we.Weight
+	}
+	// a warning weight of zero takes no traffic, and a weight of 1 is the mesh's default
+	want := map[string]uint32{"192.0.2.1": 10, "192.0.2.2": 3, "192.0.2.4": 0, "192.0.2.5": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("weights = %v, want %v", got, want)
+	}
+}
+
+func TestWatcher_healthWatch(t *testing.T) {
+	var m sync.Mutex
+	index, status := 1, api.HealthPassing // of 192.0.2.2's single check
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		checks := api.HealthChecks{
+			&api.HealthCheck{Node: "node-1", CheckID: "web", ServiceName: "web", Status: api.HealthPassing},
+			&api.HealthCheck{Node: "node-2", CheckID: "web", ServiceName: "web", Status: status},
+		}
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil})
+		case "/v1/health/service/web":
+			var out []*api.ServiceEntry
+			for i, c := range checks {
+				if c.Status != api.HealthPassing {
+					continue
+				}
+				out = append(out, &api.ServiceEntry{
+					Node:    &api.Node{Node: c.Node, Address: fmt.Sprintf("192.0.2.%d", i+1)},
+					Service: &api.AgentService{Service: "web", Port: 80},
+					Checks:  api.HealthChecks{c},
+				})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		case "/v1/health/state/any":
+			if r.URL.Query().Get("index") == strconv.Itoa(index) {
+				// block briefly rather than until the wait time
+				m.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				m.Lock()
+			}
+			_ = json.NewEncoder(rw).Encode(checks)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithHealthStatus(api.HealthPassing), WithHealthWatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	instances := func(want int) {
+		t.Helper()
+		// well within the 10 seconds between refreshes
+		deadline := time.Now().Add(3 * time.Second)
+		for len(store.Hosts()["web"]) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d instances of web, want %d", len(store.Hosts()["web"]), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	instances(2)
+	m.Lock()
+	index, status = 2, api.HealthCritical
+	m.Unlock()
+	instances(1)
+	m.Lock()
+	index, status = 3, api.HealthPassing
+	m.Unlock()
+	instances(2)
+}
+
+func TestChangedServices(t *testing.T) {
+	last := map[checkKey]checkState{
+		{node: "node-1", id: "serfHealth"}: {status: api.HealthPassing},
+		{node: "node-1", id: "web"}:        {service: "web", status: api.HealthPassing},
+		{node: "node-1", id: "api"}:        {service: "api", status: api.HealthPassing},
+	}
+	tests := []struct {
+		name    string
+		current map[checkKey]checkState
+		want    []string
+		all     bool
+	}{
+		{"unchanged", last, []string{}, false},
+		{"service check failing", map[checkKey]checkState{
+			{node: "node-1", id: "serfHealth"}: {status: api.HealthPassing},
+			{node: "node-1", id: "web"}:        {service: "web", status: api.HealthCritical},
+			{node: "node-1", id: "api"}:        {service: "api", status: api.HealthPassing},
+		}, []string{"web"}, false},
+		{"service check added and removed", map[checkKey]checkState{
+			{node: "node-1", id: "serfHealth"}: {status: api.HealthPassing},
+			{node: "node-1", id: "web"}:        {service: "web", status: api.HealthPassing},
+			{node: "node-2", id: "db"}:         {service: "db", status: api.HealthPassing},
+		}, []string{"api", "db"}, false},
+		{"node check failing", map[checkKey]checkState{
+			{node: "node-1", id: "serfHealth"}: {status: api.HealthCritical},
+			{node: "node-1", id: "web"}:        {service: "web", status: api.HealthPassing},
+			{node: "node-1", id: "api"}:        {service: "api", status: api.HealthPassing},
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, all := changedServices(last, tt.current)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) || all != tt.all {
+				t.Errorf("changedServices() = %v, %v, want %v, %v", got, all, tt.want, tt.all)
+			}
+		})
+	}
+}
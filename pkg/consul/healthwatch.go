@@ -0,0 +1,139 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// WithHealthWatch keeps a blocking query open on the checks of every instance alongside the list of services, so
+// that with WithHealthStatus an instance failing its checks, or passing them again, is synced as soon as Consul
+// reports it rather than at the next registration, re-reading only the services whose checks changed. It takes a
+// single connection to Consul, unlike WithServiceWatches, which watches the health of each service already.
+func WithHealthWatch() Option {
+	return func(w *watcher) {
+		w.healthWatch = true
+	}
+}
+
+// checkKey identifies a check, of a node or of an instance on it
+type checkKey struct {
+	node, id string
+}
+
+// checkState is the state of a check, and the service of the instance it checks, if not a node check
+type checkState struct {
+	service, status string
+}
+
+// watchHealth keeps a blocking query open on every check, re-reading the services whose checks changed, until ctx
+// is done
+func (w *watcher) watchHealth(ctx context.Context) {
+	var index uint64
+	var last map[checkKey]checkState
+	b := w.newBackoff()
+	for {
+		opts, cancel := w.queryOptions(ctx, &api.QueryOptions{WaitIndex: index, Namespace: w.namespace})
+		checks, meta, err := w.client.Health().State(api.HealthAny, opts)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Errorf("error watching checks from Consul: %v", err)
+			if !w.backOff(ctx, b) {
+				return
+			}
+			continue
+		}
+		b.reset()
+		if meta.LastIndex == index {
+			continue
+		}
+		index = nextIndex(index, meta.LastIndex)
+		current := make(map[checkKey]checkState, len(checks))
+		for _, c := range checks {
+			current[checkKey{node: c.Node, id: c.CheckID}] = checkState{service: c.ServiceName, status: c.Status}
+		}
+		if last != nil {
+			if services, all := changedServices(last, current); all || (w.connect && len(services) > 0) {
+				// a node's check fails, or passes again, every instance on it, and the checks of Connect proxies
+				// are told apart from those of the services they proxy by reading every service
+				w.m.Lock()
+				w.lastIndex = 0
+				w.m.Unlock()
+				if err := w.refreshStore(ctx); err != nil && ctx.Err() == nil {
+					log.Errorf("error refreshing from Consul for changed health checks: %v", err)
+				}
+			} else if len(services) > 0 {
+				w.refreshServices(ctx, services)
+			}
+		}
+		last = current
+	}
+}
+
+// changedServices returns the services whose checks differ between last and current, or all if a node's check does
+func changedServices(last, current map[checkKey]checkState) ([]string, bool) {
+	changed := make(map[string]bool)
+	diff := func(from, to map[checkKey]checkState) bool {
+		for key, state := range from {
+			if other, ok := to[key]; ok && other == state {
+				continue
+			}
+			if state.service == "" {
+				return true
+			}
+			changed[state.service] = true
+		}
+		return false
+	}
+	if diff(last, current) || diff(current, last) {
+		return nil, true
+	}
+	services := make([]string, 0, len(changed))
+	for name := range changed {
+		services = append(services, name)
+	}
+	return services, false
+}
+
+// refreshServices syncs the instances of the services names already synced, keeping those failing to be described
+// as last synced
+func (w *watcher) refreshServices(ctx context.Context, names []string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	delta := provider.Delta{Updated: make(map[string][]*v1alpha3.WorkloadEntry)}
+	for _, name := range names {
+		c, ok := w.cache[name]
+		if !ok {
+			// listed at the next refresh, if registered
+			continue
+		}
+		svcs, index, err := w.describeServiceRetrying(ctx, name)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Errorf("error describing service catalog from Consul: %v ", err)
+			continue
+		}
+		if index != 0 && c.index == index {
+			continue
+		}
+		e := w.entries(name, index, svcs)
+		w.cache[name] = e
+		if len(e.workloadEntries) > 0 {
+			delta.Updated[w.host(name)] = e.workloadEntries
+		} else {
+			delta.Removed = append(delta.Removed, w.host(name))
+		}
+	}
+	if len(delta.Updated) == 0 && len(delta.Removed) == 0 {
+		return
+	}
+	w.setDrops()
+	w.store.Apply(delta)
+	w.publishAnnotations()
+}
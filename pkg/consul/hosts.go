@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// HostValues are what a host template can refer to
+type HostValues struct {
+	// Service is the name of the Consul service, e.g. web
+	Service string
+	// Datacenter is the datacenter the service's instances are registered in, e.g. dc1
+	Datacenter string
+	// Namespace is the Consul Enterprise namespace of the service, if the watcher reads one
+	Namespace string
+	// Partition is the admin partition of the service, if the watcher reads one
+	Partition string
+	// Peer is the cluster peer that exported the service, if it was imported
+	Peer string
+}
+
+// ParseHostTemplate parses text, a Go template of the host a Consul service is published as, e.g.
+// {{.Service}}.service.{{.Datacenter}}.consul, and checks it renders a valid host
+func ParseHostTemplate(text string) (*template.Template, error) {
+	t, err := template.New("host").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := renderHost(t, HostValues{Service: "web", Datacenter: "dc1", Namespace: "default",
+		Partition: "default", Peer: "peer"}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// WithHostTemplate publishes every Consul service as the host t renders from its HostValues, e.g. to match the
+// Consul DNS names applications already dial, rather than its name qualified by its namespace or peer, if any.
+// Services whose host fails to render are published as they would be without.
+func WithHostTemplate(t *template.Template) Option {
+	return func(w *watcher) {
+		w.hostTemplate = t
+	}
+}
+
+// renderHost returns the host t renders from v, if valid
+func renderHost(t *template.Template, v HostValues) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, v); err != nil {
+		return "", errors.Wrap(err, "failed to render host")
+	}
+	host := strings.ToLower(strings.TrimSpace(buf.String()))
+	if problems := validation.IsDNS1123Subdomain(host); len(problems) > 0 {
+		return "", errors.Errorf("rendered invalid host %q: %s", host, strings.Join(problems, ", "))
+	}
+	return host, nil
+}
+
+// learnDatacenter records the datacenter the instances svcs are registered in, unless it's known already, as every
+// service the watcher reads is of the same datacenter
+func (w *watcher) learnDatacenter(svcs []*api.CatalogService) {
+	if w.datacenter != "" {
+		return
+	}
+	for _, c := range svcs {
+		if c.Datacenter != "" {
+			w.datacenter = c.Datacenter
+			return
+		}
+	}
+}
+
+// templatedHost returns the host the template renders for the service name, or false if it can't
+func (w *watcher) templatedHost(name string) (string, bool) {
+	host, err := renderHost(w.hostTemplate, HostValues{Service: name, Datacenter: w.datacenter, Namespace: w.namespace,
+		Partition: w.partition, Peer: w.peer})
+	if err != nil && w.datacenter == "" {
+		// until the instances of a service tell the datacenter, if the template refers to it
+		log.Debugf("publishing Consul service %q under its name: %v", name, err)
+		return "", false
+	} else if err != nil {
+		log.Warnf("publishing Consul service %q under its name: %v", name, err)
+		return "", false
+	}
+	return host, true
+}
@@ -0,0 +1,87 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestParseHostTemplate(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+	}{
+		{text: "{{.Service}}.service.{{.Datacenter}}.consul"},
+		{text: "{{.Service}}.{{.Namespace}}.ns.{{.Partition}}.ap.{{.Datacenter}}.dc.consul"},
+		{text: "{{.Service}}.service.{{.Datacenter}}"},
+		{text: "{{.Service", wantErr: true},
+		{text: "{{.Name}}.consul", wantErr: true},
+		{text: "{{.Service}}_{{.Datacenter}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if _, err := ParseHostTemplate(tt.text); (err != nil) != tt.wantErr {
+				t.Errorf("ParseHostTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatcher_hostTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Consul-Index", "1")
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil, "Api": nil, "idle": nil})
+		case "/v1/catalog/service/idle":
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{})
+		default:
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{Datacenter: "dc1", Address: "192.0.2.1",
+				ServicePort: 80}})
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		template string
+		want     []string
+	}{
+		{name: "datacenter", template: "{{.Service}}.service.{{.Datacenter}}.consul",
+			want: []string{"api.service.dc1.consul", "web.service.dc1.consul"}},
+		{name: "no datacenter", template: "{{.Service}}.service.consul",
+			want: []string{"api.service.consul", "web.service.consul"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseHostTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := provider.NewStore()
+			w, err := NewWatcher(store, server.URL, "", WithHostTemplate(tmpl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			var got []string
+			for host := range store.Hosts() {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+)
+
+func TestWatcher_tokenFile(t *testing.T) {
+	var m sync.Mutex
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		token = r.Header.Get("X-Consul-Token")
+		m.Unlock()
+		_, _ = rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := secret.Watch(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := make(chan struct{}, 1)
+	f.OnChange(func() { rotated <- struct{}{} })
+	w, err := NewWatcher(provider.NewStore(), server.URL, "", WithTokenFile(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		if want == "second" {
+			if err := ioutil.WriteFile(path, []byte(want), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-rotated:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the rotation")
+			}
+		}
+		if err := w.(provider.Checker).Check(ctx); err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		m.Lock()
+		got := token
+		m.Unlock()
+		if got != want {
+			t.Errorf("sent token %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWatcher_token(t *testing.T) {
+	var m sync.Mutex
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		token = r.Header.Get("X-Consul-Token")
+		m.Unlock()
+		_, _ = rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	envFile := filepath.Join(t.TempDir(), "env-token")
+	if err := ioutil.WriteFile(envFile, []byte("from-env-file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		env       map[string]string
+		token     string
+		tokenFile string
+		want      string
+	}{
+		{name: "none"},
+		{name: "environment", env: map[string]string{"CONSUL_HTTP_TOKEN": "from-env"}, want: "from-env"},
+		{name: "over environment", env: map[string]string{"CONSUL_HTTP_TOKEN": "from-env"}, token: "static", want: "static"},
+		{name: "over environment file", env: map[string]string{"CONSUL_HTTP_TOKEN_FILE": envFile}, token: "static",
+			want: "static"},
+		{name: "under token file", token: "static", tokenFile: "rotated", want: "rotated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONSUL_HTTP_TOKEN", "")
+			t.Setenv("CONSUL_HTTP_TOKEN_FILE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var opts []Option
+			if tt.token != "" {
+				opts = append(opts, WithToken(tt.token))
+			}
+			if tt.tokenFile != "" {
+				path := filepath.Join(t.TempDir(), "token")
+				if err := ioutil.WriteFile(path, []byte(tt.tokenFile), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				f, err := secret.Watch(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts = append(opts, WithTokenFile(f))
+			}
+			w, err := NewWatcher(provider.NewStore(), server.URL, "", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(provider.Checker).Check(ctx); err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			m.Lock()
+			defer m.Unlock()
+			if token != tt.want {
+				t.Errorf("sent token %q, want %q", token, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_cancellation(t *testing.T) {
+	// the server holds every request open until the client gives up, like a blocking query on an unchanging catalog
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, w provider.Watcher) error
+	}{
+		{name: "Refresh", call: func(ctx context.Context, w provider.Watcher) error { return w.Refresh(ctx) }},
+		{name: "Check", call: func(ctx context.Context, w provider.Watcher) error { return w.(provider.Checker).Check(ctx) }},
+		{
+			name: "Run",
+			call: func(ctx context.Context, w provider.Watcher) error {
+				w.Run(ctx)
+				return ctx.Err()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := NewWatcher(store, server.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := tt.call(ctx, w); err == nil {
+				t.Errorf("%s() succeeded, want an error", tt.name)
+			}
+			// well within the 15s call timeout
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("%s() returned after %v, want it to return once the context is done", tt.name, took)
+			}
+			if !store.LastSync().IsZero() {
+				t.Errorf("store synced at %v, want it untouched", store.LastSync())
+			}
+		})
+	}
+}
+
+func TestWatcher_checkDenied(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "denied", status: http.StatusForbidden, body: "Permission denied", wantErr: "not allowed to read the catalog"},
+		// an error merely mentioning 403 isn't a denial
+		{name: "server error", status: http.StatusInternalServerError, body: "rpc error: 403 peers", wantErr: "failed to reach Consul"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				http.Error(rw, tt.body, tt.status)
+			}))
+			defer server.Close()
+			w, err := NewWatcher(provider.NewStore(), server.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(provider.Checker).Check(context.Background()); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Check() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatcher_incremental(t *testing.T) {
+	type service struct {
+		index   uint64
+		address string
+	}
+	var m sync.Mutex
+	catalog := map[string]service{"a": {index: 1, address: "192.0.2.1"}, "b": {index: 1, address: "192.0.2.2"}}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/"); name != r.URL.Path {
+			svc := catalog[name]
+			rw.Header().Set("X-Consul-Index", strconv.FormatUint(svc.index, 10))
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: svc.address, ServicePort: 80}})
+			return
+		}
+		names := map[string][]string{}
+		for name := range catalog {
+			names[name] = nil
+		}
+		rw.Header().Set("X-Consul-Index", "1")
+		_ = json.NewEncoder(rw).Encode(names)
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name   string
+		change func()
+		want   map[string]struct{}
+	}{
+		{name: "first refresh", change: func() {}, want: map[string]struct{}{"a": {}, "b": {}}},
+		{name: "nothing changed", change: func() {}, want: map[string]struct{}{}},
+		{name: "service changed", change: func() { catalog["b"] = service{index: 2, address: "192.0.2.3"} }, want: map[string]struct{}{"b": {}}},
+		{name: "service removed", change: func() { delete(catalog, "a") }, want: map[string]struct{}{"a": {}}},
+	}
+	for _, step := range steps {
+		m.Lock()
+		step.change()
+		m.Unlock()
+		revision := store.Revision()
+		if err := w.Refresh(context.Background()); err != nil {
+			t.Fatalf("%s: Refresh() error = %v", step.name, err)
+		}
+		got, ok := store.Changes(revision)
+		if !ok || !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: changed %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestWatcher_describeFailures(t *testing.T) {
+	var m sync.Mutex
+	// calls failing before describing a service succeeds, by service; -1 fails every call
+	failures := map[string]int{"a": 0, "b": 1, "c": 0}
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		if name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/"); name != r.URL.Path {
+			calls[name]++
+			if f := failures[name]; f < 0 || calls[name] <= f {
+				http.Error(rw, "rpc error", http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: "192.0.2.1", ServicePort: 80}})
+			return
+		}
+		names := map[string][]string{}
+		for name := range failures {
+			names[name] = nil
+		}
+		_ = json.NewEncoder(rw).Encode(names)
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if got := len(store.Hosts()); got != 3 {
+		t.Fatalf("synced %d hosts, want b to be synced once retried", got)
+	}
+	m.Lock()
+	if calls["b"] != 2 {
+		t.Errorf("described b %d times, want it retried once", calls["b"])
+	}
+	m.Unlock()
+
+	m.Lock()
+	failures["c"], calls["c"] = -1, 0
+	m.Unlock()
+	if err := w.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if _, ok := store.Hosts()["c"]; !ok {
+		t.Error("c was removed, want it kept as last synced while it fails to be described")
+	}
+	m.Lock()
+	defer m.Unlock()
+	if calls["c"] != describeAttempts {
+		t.Errorf("described c %d times, want %d", calls["c"], describeAttempts)
+	}
+}
+
+func TestNewWatcher_concurrency(t *testing.T) {
+	if _, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "", WithConcurrency(0)); err == nil {
+		t.Error("NewWatcher() succeeded with a concurrency of 0, want an error")
+	}
+}
@@ -0,0 +1,5 @@
+package consul
+
+import "github.com/tetratelabs/istio-registry-sync/pkg/logging"
+
+var log = logging.RegisterScope("consul")
@@ -0,0 +1,120 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+const defaultBearerTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Login configures logging in to Consul with an auth method, e.g. one of type kubernetes, rather than authenticating
+// with a static ACL token
+type Login struct {
+	// AuthMethod is the name of the auth method to log in with
+	AuthMethod string
+	// BearerTokenPath is the JWT to log in with, read again at every login so it can be rotated; defaults to the
+	// service account token mounted into the pod
+	BearerTokenPath string
+}
+
+// WithLogin authenticates every Consul API call with an ACL token obtained by logging in as l says. The token is
+// replaced by logging in again once two thirds of its lifetime have passed, or once Consul no longer knows it. It
+// takes precedence over WithToken and WithTokenFile.
+func WithLogin(l Login) Option {
+	return func(w *watcher) {
+		w.login = &l
+	}
+}
+
+// loginTransport sends every request through next with a token it logs in to Consul for
+type loginTransport struct {
+	login Login
+	acl   *api.ACL // of a client that doesn't log in
+	next  http.RoundTripper
+
+	m       sync.Mutex // guards token and renewAt, and serializes logins
+	token   string
+	renewAt time.Time // zero if the token doesn't expire
+}
+
+func newLoginTransport(l Login, config api.Config, next http.RoundTripper) (*loginTransport, error) {
+	if l.BearerTokenPath == "" {
+		l.BearerTokenPath = defaultBearerTokenPath
+	}
+	config.Token, config.TokenFile = "", ""
+	config.HttpClient = &http.Client{Transport: next}
+	client, err := api.NewClient(&config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating login client")
+	}
+	return &loginTransport{login: l, acl: client.ACL(), next: next}, nil
+}
+
+func (t *loginTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.currentToken()
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Consul-Token", token)
+	resp, err := t.next.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+	// Consul answers a token it doesn't know, e.g. one that expired or was deleted, with "ACL not found"
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if strings.Contains(string(body), "ACL not found") {
+		t.forget(token)
+	}
+	return resp, nil
+}
+
+// currentToken returns the token to call Consul with, logging in if there's none or it's due to be renewed
+func (t *loginTransport) currentToken() (string, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.token != "" && (t.renewAt.IsZero() || time.Now().Before(t.renewAt)) {
+		return t.token, nil
+	}
+	jwt, err := ioutil.ReadFile(t.login.BearerTokenPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the bearer token to log in to Consul with")
+	}
+	token, _, err := t.acl.Login(&api.ACLLoginParams{AuthMethod: t.login.AuthMethod,
+		BearerToken: strings.TrimSpace(string(jwt))}, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to log in to Consul with auth method %q", t.login.AuthMethod)
+	}
+	t.token, t.renewAt = token.SecretID, time.Time{}
+	if token.ExpirationTime != nil {
+		created := token.CreateTime
+		if created.IsZero() {
+			created = time.Now()
+		}
+		t.renewAt = created.Add(token.ExpirationTime.Sub(created) * 2 / 3)
+	}
+	log.Infof("logged in to Consul with auth method %q as token %s, expiring %v", t.login.AuthMethod,
+		token.AccessorID, token.ExpirationTime)
+	return t.token, nil
+}
+
+// forget drops token, unless already replaced, so the next call logs in again
+func (t *loginTransport) forget(token string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.token == token {
+		t.token = ""
+	}
+}
@@ -0,0 +1,101 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_login(t *testing.T) {
+	var m sync.Mutex
+	var logins int
+	var ttl time.Duration
+	var used []string
+	revoked := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if r.URL.Path == "/v1/acl/login" {
+			var params api.ACLLoginParams
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.AuthMethod != "kubernetes" ||
+				params.BearerToken != "jwt" {
+				http.Error(rw, "Permission denied", http.StatusForbidden)
+				return
+			}
+			logins++
+			token := &api.ACLToken{AccessorID: "accessor", SecretID: "token-" + strconv.Itoa(logins), CreateTime: time.Now()}
+			if ttl > 0 {
+				expires := token.CreateTime.Add(ttl)
+				token.ExpirationTime = &expires
+			}
+			_ = json.NewEncoder(rw).Encode(token)
+			return
+		}
+		token := r.Header.Get("X-Consul-Token")
+		used = append(used, token)
+		if revoked[token] {
+			http.Error(rw, "ACL not found", http.StatusForbidden)
+			return
+		}
+		_, _ = rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	jwt := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(jwt, []byte("jwt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name    string
+		change  func()
+		wantErr bool
+		want    string
+	}{
+		{name: "logs in", change: func() {}, want: "token-1"},
+		{name: "reuses the token", change: func() {}, want: "token-1"},
+		{name: "revoked token fails", change: func() { revoked["token-1"] = true }, wantErr: true, want: "token-1"},
+		{name: "logs in again once revoked", change: func() {}, want: "token-2"},
+		{name: "revoked again", change: func() { ttl, revoked["token-2"] = 150*time.Millisecond, true }, wantErr: true,
+			want: "token-2"},
+		{name: "logs in for an expiring token", change: func() {}, want: "token-3"},
+		// token-3 expires 150ms in, so it's renewed 100ms in
+		{name: "renews before expiry", change: func() { time.Sleep(110 * time.Millisecond) }, want: "token-4"},
+		{name: "reuses the renewed token", change: func() {}, want: "token-4"},
+	}
+	w, err := NewWatcher(provider.NewStore(), server.URL, "", WithToken("static"),
+		WithLogin(Login{AuthMethod: "kubernetes", BearerTokenPath: jwt}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		m.Lock()
+		step.change()
+		m.Unlock()
+		if err := w.(provider.Checker).Check(context.Background()); (err != nil) != step.wantErr {
+			t.Fatalf("%s: Check() error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		m.Lock()
+		if got := used[len(used)-1]; got != step.want {
+			t.Errorf("%s: called with %q, want %q", step.name, got, step.want)
+		}
+		m.Unlock()
+	}
+
+}
+
+func TestNewWatcher_login(t *testing.T) {
+	if _, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "", WithLogin(Login{})); err == nil {
+		t.Error("NewWatcher() without an auth method succeeded, want an error")
+	}
+}
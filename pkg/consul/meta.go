@@ -0,0 +1,84 @@
+package consul
+
+import (
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+)
+
+// ProtocolMeta is the key of the service meta naming the protocol of the service's port, as Consul's service-defaults
+// do, e.g. grpc or http2; ports of services without it are named after their number
+const ProtocolMeta = "protocol"
+
+// Node meta keys of the locality of the instances on a node, e.g. us-east-1, us-east-1a and rack-4; a node without a
+// zone is in the zone of its network segment, if any
+const (
+	RegionMeta  = "region"
+	ZoneMeta    = "zone"
+	SubzoneMeta = "subzone"
+	segmentMeta = "consul-network-segment"
+)
+
+// settings are the meta keys configuring the sync of an instance, rather than copied into its labels
+var settings = map[string]bool{ProtocolMeta: true, "tls": true, "tls-sni": true, "tls-credential-name": true}
+
+// portName returns the name of the port of c as protocol, unless empty, or else its protocol meta says, or an empty
+// string if it says none Istio knows of
+func portName(c *api.CatalogService, protocol string) string {
+	if protocol != "" {
+		return protocol
+	}
+	protocol, ok := c.ServiceMeta[ProtocolMeta]
+	if !ok {
+		return ""
+	}
+	if name := strings.ToLower(protocol); infer.Protocol(name) == strings.ToUpper(name) {
+		return name
+	}
+	log.Infof("instance %s of %s has unknown protocol %q, inferring it from its port", c.ServiceID, c.ServiceName,
+		protocol)
+	return ""
+}
+
+// labels returns the TLS labels of c's meta and tags along with the rest of its meta, leaving out keys and values
+// that aren't valid as labels
+func labels(c *api.CatalogService) map[string]string {
+	l := infer.TLSLabels(metadata(c))
+	for key, value := range c.ServiceMeta {
+		if settings[key] || len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+		if _, ok := l[key]; ok {
+			continue
+		}
+		if l == nil {
+			l = make(map[string]string, len(c.ServiceMeta))
+		}
+		l[key] = value
+	}
+	return l
+}
+
+// locality returns the locality of c's node as its meta says, e.g. us-east-1/us-east-1a, or an empty string without a
+// region, as Istio's localities start with one
+func locality(c *api.CatalogService) string {
+	region := c.NodeMeta[RegionMeta]
+	if region == "" {
+		return ""
+	}
+	zone := c.NodeMeta[ZoneMeta]
+	if zone == "" {
+		zone = c.NodeMeta[segmentMeta]
+	}
+	subzone := c.NodeMeta[SubzoneMeta]
+	switch {
+	case zone == "":
+		return region
+	case subzone == "":
+		return region + "/" + zone
+	}
+	return region + "/" + zone + "/" + subzone
+}
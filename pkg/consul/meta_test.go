@@ -0,0 +1,85 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+)
+
+func TestCatalogServiceToWorkloadEntry_meta(t *testing.T) {
+	tests := []struct {
+		name       string
+		meta       map[string]string
+		port       int
+		wantPorts  map[string]uint32
+		wantLabels map[string]string
+	}{
+		{name: "no meta", port: 8080, wantPorts: map[string]uint32{"tcp": 8080}},
+		{
+			name:      "protocol",
+			meta:      map[string]string{ProtocolMeta: "GRPC"},
+			port:      8080,
+			wantPorts: map[string]uint32{"grpc": 8080},
+		},
+		{name: "unknown protocol", meta: map[string]string{ProtocolMeta: "carrier-pigeon"}, port: 443,
+			wantPorts: map[string]uint32{"https": 443}},
+		{
+			name:      "protocol without port",
+			meta:      map[string]string{ProtocolMeta: "grpc"},
+			wantPorts: map[string]uint32{"http": 80, "https": 443},
+		},
+		{
+			name: "labels",
+			meta: map[string]string{"version": "v2", "team": "billing", "tls": "true", "owner email": "a@b",
+				"description": "bills customers"},
+			port:      8080,
+			wantPorts: map[string]uint32{"tcp": 8080},
+			wantLabels: map[string]string{"version": "v2", "team": "billing",
+				infer.TLSModeLabel: "SIMPLE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := catalogServiceToWorkloadEntry(&api.CatalogService{ServiceID: "billing-1", ServiceName: "billing",
+				Address: "192.0.2.10", ServicePort: tt.port, ServiceMeta: tt.meta}, conversion{})
+			if !reflect.DeepEqual(we.Ports, tt.wantPorts) {
+				t.Errorf("ports = %v, want %v", we.Ports, tt.wantPorts)
+			}
+			if !reflect.DeepEqual(we.Labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", we.Labels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestCatalogServiceToWorkloadEntry_locality(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeMeta map[string]string
+		want     string
+	}{
+		{name: "no meta"},
+		{name: "region", nodeMeta: map[string]string{RegionMeta: "us-east-1"}, want: "us-east-1"},
+		{name: "zone", nodeMeta: map[string]string{RegionMeta: "us-east-1", ZoneMeta: "us-east-1a"},
+			want: "us-east-1/us-east-1a"},
+		{name: "subzone", nodeMeta: map[string]string{RegionMeta: "us-east-1", ZoneMeta: "us-east-1a",
+			SubzoneMeta: "rack-4"}, want: "us-east-1/us-east-1a/rack-4"},
+		{name: "network segment", nodeMeta: map[string]string{RegionMeta: "eu-west-1", segmentMeta: "dmz"},
+			want: "eu-west-1/dmz"},
+		{name: "zone over network segment", nodeMeta: map[string]string{RegionMeta: "eu-west-1",
+			ZoneMeta: "eu-west-1b", segmentMeta: "dmz"}, want: "eu-west-1/eu-west-1b"},
+		{name: "zone without region", nodeMeta: map[string]string{ZoneMeta: "us-east-1a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := catalogServiceToWorkloadEntry(&api.CatalogService{ServiceID: "billing-1", ServiceName: "billing",
+				Address: "192.0.2.10", ServicePort: 8080, NodeMeta: tt.nodeMeta}, conversion{})
+			if we.Locality != tt.want {
+				t.Errorf("locality = %q, want %q", we.Locality, tt.want)
+			}
+		})
+	}
+}
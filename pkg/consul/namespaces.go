@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// WithAllNamespaces syncs the services of every namespace the ACL token can read, as hosts qualified by their
+// namespace, <service>.<namespace>.consul, rather than the services of a single namespace. Namespaces created or
+// deleted are picked up every tick. Namespaces are a feature of Consul Enterprise.
+func WithAllNamespaces() Option {
+	return func(w *watcher) {
+		w.allNamespaces = true
+	}
+}
+
+// namespaced is the watcher of a namespace of a watcher of every namespace, or of a peer of a watcher of peers
+type namespaced struct {
+	watcher *watcher
+	cancel  context.CancelFunc // stopping the watcher's Run, if running
+}
+
+// runNamespaces runs a watcher per namespace, picking up namespaces created or deleted every tick, until ctx is done
+func (w *watcher) runNamespaces(ctx context.Context) {
+	ticker := time.NewTicker(w.tickInterval)
+	defer ticker.Stop()
+
+	w.m.Lock()
+	w.runCtx = ctx
+	w.m.Unlock()
+	for {
+		if err := w.syncNamespaces(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("error listing namespaces from Consul: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshNamespaces syncs every namespace into the store once
+func (w *watcher) refreshNamespaces(ctx context.Context) error {
+	if err := w.syncNamespaces(ctx); err != nil {
+		return err
+	}
+	w.m.Lock()
+	watchers := make([]*watcher, 0, len(w.namespaces))
+	for _, ns := range w.namespaces {
+		watchers = append(watchers, ns.watcher)
+	}
+	w.m.Unlock()
+	for _, nw := range watchers {
+		if err := nw.Refresh(ctx); err != nil {
+			return errors.Wrapf(err, "namespace %s", nw.namespace)
+		}
+	}
+	return nil
+}
+
+// syncNamespaces lists the namespaces, adding a watcher for each new one, run if w is, and removing the watchers of
+// those deleted along with their hosts
+func (w *watcher) syncNamespaces(ctx context.Context) error {
+	names, err := w.listNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.namespaces == nil {
+		w.namespaces = make(map[string]*namespaced)
+	}
+	w.syncWatchers(w.namespaces, names, w.namespaceWatcher, "namespace")
+	return nil
+}
+
+// syncWatchers adds a watcher made by child to watchers for each of names it lacks, run if w is, and removes the
+// watchers of those no longer named along with their hosts; kind names what they watch in logs. w.m must be held.
+func (w *watcher) syncWatchers(watchers map[string]*namespaced, names []string, child func(string) *watcher,
+	kind string) {
+	for _, name := range names {
+		if _, ok := watchers[name]; ok {
+			continue
+		}
+		ns := &namespaced{watcher: child(name)}
+		if w.runCtx != nil && w.runCtx.Err() == nil {
+			var runCtx context.Context
+			runCtx, ns.cancel = context.WithCancel(w.runCtx)
+			go ns.watcher.Run(runCtx)
+		}
+		watchers[name] = ns
+		log.Infof("watching Consul %s %s", kind, name)
+	}
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+	}
+	for name, ns := range watchers {
+		if listed[name] {
+			continue
+		}
+		if ns.cancel != nil {
+			ns.cancel()
+		}
+		ns.watcher.forget()
+		delete(watchers, name)
+		log.Infof("stopped watching deleted Consul %s %s", kind, name)
+	}
+}
+
+// listNamespaces returns the names of the namespaces the ACL token can read, but those being deleted, sorted
+func (w *watcher) listNamespaces(ctx context.Context) ([]string, error) {
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{})
+	defer cancel()
+	namespaces, _, err := w.client.Namespaces().List(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list namespaces")
+	}
+	names := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if ns.DeletedAt == nil {
+			names = append(names, ns.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// namespaceWatcher returns a watcher of the namespace name configured as w, publishing its services as hosts
+// qualified by the namespace into w's store
+func (w *watcher) namespaceWatcher(name string) *watcher {
+	return &watcher{
+		client:         w.client,
+		endpoint:       w.endpoint,
+		store:          w.store,
+		prefix:         w.prefix,
+		tickInterval:   w.tickInterval,
+		callTimeout:    w.callTimeout,
+		concurrency:    w.concurrency,
+		maxBackoff:     w.maxBackoff,
+		token:          w.token,
+		namespace:      name,
+		health:         w.health,
+		filter:         w.filter,
+		watches:        w.watches,
+		connect:        w.connect,
+		partition:      w.partition,
+		hostTemplate:   w.hostTemplate,
+		healthWatch:    w.healthWatch,
+		excludeNames:   w.excludeNames,
+		excludeTags:    w.excludeTags,
+		annotate:       w.annotate,
+		annotationSets: w.annotationSets,
+		consistency:    w.consistency,
+		conversion:     w.conversion,
+		hostSuffix:     "." + name + ".consul",
+		drops:          provider.NewDrops(w.prefix),
+	}
+}
+
+// forget removes the hosts of the services w synced from the store, once it no longer runs
+func (w *watcher) forget() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	removed := make([]string, 0, len(w.cache))
+	for name := range w.cache {
+		removed = append(removed, w.host(name))
+	}
+	w.cache = nil
+	w.drops.Set(nil)
+	w.store.Apply(provider.Delta{Removed: removed})
+	if w.annotate {
+		w.annotationSets.annotate(w.store, w, nil)
+	}
+}
+
+// checkNamespaces lists the namespaces once to verify Consul is reachable and the ACL token can read them
+func (w *watcher) checkNamespaces(ctx context.Context) error {
+	_, err := w.listNamespaces(ctx)
+	if err == nil {
+		return nil
+	}
+	if statusCode(err) == http.StatusForbidden {
+		return errors.Wrap(err, "the Consul ACL token is not allowed to list namespaces; it needs operator:read, "+
+			"or service:read and node:read in the namespaces to sync")
+	}
+	return errors.Wrapf(err, "failed to reach Consul at %s", w.endpoint)
+}
+
+// host returns the host of the service name, as its override names it, or else the host template renders, or else
+// qualified by the host suffix
+func (w *watcher) host(name string) string {
+	if host := w.overrides[name].Host; host != "" {
+		return host
+	}
+	if w.hostTemplate != nil {
+		if host, ok := w.templatedHost(name); ok {
+			return host
+		}
+	}
+	return name + w.hostSuffix
+}
@@ -0,0 +1,89 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_allNamespaces(t *testing.T) {
+	var m sync.Mutex
+	// services of every namespace, by namespace
+	namespaces := map[string][]string{"default": {"web"}, "team-a": {"web", "api"}}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		ns := r.URL.Query().Get("ns")
+		switch {
+		case r.URL.Path == "/v1/namespaces":
+			var out []*api.Namespace
+			for name := range namespaces {
+				out = append(out, &api.Namespace{Name: name})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		case r.URL.Path == "/v1/catalog/services":
+			names := map[string][]string{}
+			for _, name := range namespaces[ns] {
+				names[name] = nil
+			}
+			_ = json.NewEncoder(rw).Encode(names)
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+			name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: "192.0.2.1", ServicePort: 80,
+				Namespace: ns}})
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewWatcher(provider.NewStore(), server.URL, "apps", WithAllNamespaces()); err == nil {
+		t.Error("NewWatcher() of every namespace and a namespace succeeded, want an error")
+	}
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithAllNamespaces())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(provider.Checker).Check(context.Background()); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{name: "every namespace", change: func() {}, want: []string{"api.team-a.consul", "web.default.consul", "web.team-a.consul"}},
+		{name: "namespace created", change: func() { namespaces["team-b"] = []string{"db"} },
+			want: []string{"api.team-a.consul", "db.team-b.consul", "web.default.consul", "web.team-a.consul"}},
+		{name: "namespace deleted", change: func() { delete(namespaces, "team-a") },
+			want: []string{"db.team-b.consul", "web.default.consul"}},
+	}
+	for _, step := range steps {
+		m.Lock()
+		step.change()
+		m.Unlock()
+		if err := w.Refresh(context.Background()); err != nil {
+			t.Fatalf("%s: Refresh() error = %v", step.name, err)
+		}
+		var got []string
+		for host := range store.Hosts() {
+			got = append(got, host)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: hosts = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// WithOverrides reads how to sync each Consul service from Consul's KV store, as JSON under prefix followed by the
+// service's name, e.g. istio-registry-sync/services/web holding {"protocol": "grpc", "exportTo": ["."]}, so service
+// owners can configure their own services. Overrides are read again at every refresh, and an invalid one is ignored.
+func WithOverrides(prefix string) Option {
+	return func(w *watcher) {
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		w.overridesPrefix = prefix
+	}
+}
+
+// override configures how a single service is synced, over the watcher's configuration
+type override struct {
+	// Protocol names the protocol of the port registered by the service's instances, over their protocol meta
+	Protocol string `json:"protocol,omitempty"`
+	// Host is published rather than the service's name qualified by the watcher's host suffix
+	Host string `json:"host,omitempty"`
+	// ExportTo lists the namespaces the service's Service Entry is exported to, "." for its own and "*" for all
+	ExportTo []string `json:"exportTo,omitempty"`
+}
+
+// validate returns why o can't be applied, or an empty string if it can
+func (o override) validate() string {
+	if name := strings.ToLower(o.Protocol); name != "" && infer.Protocol(name) != strings.ToUpper(name) {
+		return "unknown protocol " + o.Protocol
+	}
+	if o.Host != "" {
+		if problems := validation.IsDNS1123Subdomain(o.Host); len(problems) > 0 {
+			return "invalid host: " + strings.Join(problems, ", ")
+		}
+	}
+	for _, ns := range o.ExportTo {
+		if ns == "." || ns == "*" {
+			continue
+		}
+		if problems := validation.IsDNS1123Label(ns); len(problems) > 0 {
+			return "invalid exportTo namespace: " + strings.Join(problems, ", ")
+		}
+	}
+	return ""
+}
+
+// readOverrides returns the overrides of WithOverrides by service
+func (w *watcher) readOverrides(ctx context.Context) (map[string]override, error) {
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{Namespace: w.namespace})
+	defer cancel()
+	pairs, _, err := w.client.KV().List(w.overridesPrefix, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read overrides")
+	}
+	overrides := make(map[string]override, len(pairs))
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(pair.Key, w.overridesPrefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		var o override
+		if err := json.Unmarshal(pair.Value, &o); err != nil {
+			log.Warnf("ignoring override of Consul service %q at %s: %v", name, pair.Key, err)
+			continue
+		}
+		if problem := o.validate(); problem != "" {
+			log.Warnf("ignoring override of Consul service %q at %s: %s", name, pair.Key, problem)
+			continue
+		}
+		o.Protocol = strings.ToLower(o.Protocol)
+		overrides[name] = o
+	}
+	return overrides, nil
+}
+
+// convert converts the instances svcs of the service name as the watcher configures, and its override says
+func (w *watcher) convert(name string, svcs []*api.CatalogService) ([]*v1alpha3.WorkloadEntry, []provider.Dropped) {
+	w.learnDatacenter(svcs)
+	conv := w.conversion
+	conv.protocol = w.overrides[name].Protocol
+	return catalogServicesToWorkloadEntries(w.host(name), conv, svcs)
+}
+
+// checkOverrides reads the overrides once to verify the ACL token can read them
+func (w *watcher) checkOverrides(ctx context.Context) error {
+	if w.overridesPrefix == "" {
+		return nil
+	}
+	if _, err := w.readOverrides(ctx); err != nil {
+		if statusCode(err) == http.StatusForbidden {
+			return errors.Wrapf(err, "the Consul ACL token is not allowed to read the overrides; it needs key_prefix "+
+				"%q read", w.overridesPrefix)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_overrides(t *testing.T) {
+	var m sync.Mutex
+	overrides := map[string]string{
+		"web": `{"host": "web.internal.corp", "protocol": "GRPC", "exportTo": [".", "istio-system"]}`,
+		"db":  `{"protocol": "bogus"}`,
+		"api": `not json`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		switch {
+		case r.URL.Path == "/v1/kv/istio-registry-sync/services/":
+			var pairs api.KVPairs
+			for name, value := range overrides {
+				pairs = append(pairs, &api.KVPair{Key: "istio-registry-sync/services/" + name, Value: []byte(value)})
+			}
+			// keys further down are left alone
+			pairs = append(pairs, &api.KVPair{Key: "istio-registry-sync/services/web/notes", Value: []byte(`{}`)})
+			_ = json.NewEncoder(rw).Encode(pairs)
+		case r.URL.Path == "/v1/catalog/services":
+			_ = json.NewEncoder(rw).Encode(map[string][]string{"web": nil, "db": nil, "api": nil})
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+			name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: "192.0.2.1",
+				ServicePort: 8080}})
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithOverrides("istio-registry-sync/services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	ports := func() map[string]map[string]uint32 {
+		got := make(map[string]map[string]uint32)
+		for host, wes := range store.Hosts() {
+			got[host] = wes[0].Ports
+		}
+		return got
+	}
+	want := map[string]map[string]uint32{
+		"web.internal.corp": {"grpc": 8080},
+		"db":                {"tcp": 8080},
+		"api":               {"tcp": 8080},
+	}
+	if got := ports(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts = %v, want %v", got, want)
+	}
+	wantAnnotations := map[string]map[string]string{
+		"web.internal.corp": {infer.ExportToAnnotation: ".,istio-system"},
+	}
+	if got := store.Annotations(); !reflect.DeepEqual(got, wantAnnotations) {
+		t.Errorf("annotations = %v, want %v", got, wantAnnotations)
+	}
+
+	// the catalog is unchanged, yet dropping the override publishes web as it would be without
+	m.Lock()
+	delete(overrides, "web")
+	m.Unlock()
+	if err := w.(*watcher).refreshStore(context.Background()); err != nil {
+		t.Fatalf("refreshStore() error = %v", err)
+	}
+	want = map[string]map[string]uint32{
+		"web": {"tcp": 8080},
+		"db":  {"tcp": 8080},
+		"api": {"tcp": 8080},
+	}
+	if got := ports(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts = %v, want %v", got, want)
+	}
+	if got := store.Annotations(); len(got) != 0 {
+		t.Errorf("annotations = %v, want none", got)
+	}
+}
+
+func TestNewWatcher_overrides(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"all namespaces": {WithAllNamespaces()},
+		"watches":        {WithServiceWatches()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "",
+				append(opts, WithOverrides("istio-registry-sync/services/"))...)
+			if err == nil {
+				t.Error("NewWatcher() error = nil, want one")
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package consul
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// WithPartition reads the catalog of the Consul Enterprise admin partition given, rather than the token's default
+// partition. The API client predates partitions, so the partition is added to the query of every call.
+func WithPartition(partition string) Option {
+	return func(w *watcher) {
+		w.partition = partition
+	}
+}
+
+// validPartition returns an error unless partition is empty or a valid partition name
+func validPartition(partition string) error {
+	if partition == "" || len(validation.IsDNS1123Label(partition)) == 0 {
+		return nil
+	}
+	return errors.Errorf("invalid Consul admin partition %q: %s", partition,
+		strings.Join(validation.IsDNS1123Label(partition), "; "))
+}
+
+// partitionTransport sends every request through next with the partition in its query
+type partitionTransport struct {
+	partition string
+	next      http.RoundTripper
+}
+
+func (t *partitionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	query := r.URL.Query()
+	query.Set("partition", t.partition)
+	r.URL.RawQuery = query.Encode()
+	return t.next.RoundTrip(r)
+}
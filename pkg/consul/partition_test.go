@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// roundTripFunc is an http.RoundTripper calling itself
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestWatcher_partition(t *testing.T) {
+	var m sync.Mutex
+	var partitions []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		partitions = append(partitions, r.URL.Query().Get("partition"))
+		m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		_, _ = rw.Write([]byte(`{"web":[]}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		partition string
+		wantErr   string
+	}{
+		{partition: ""},
+		{partition: "team-a"},
+		{partition: "Team_A", wantErr: "invalid Consul admin partition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.partition, func(t *testing.T) {
+			m.Lock()
+			partitions = nil
+			m.Unlock()
+			wrapped := 0
+			w, err := NewWatcher(provider.NewStore(), server.URL, "", WithPartition(tt.partition),
+				WithTransportWrapper(func(next http.RoundTripper) http.RoundTripper {
+					return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+						wrapped++
+						return next.RoundTrip(r)
+					})
+				}))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewWatcher() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			m.Lock()
+			defer m.Unlock()
+			if len(partitions) == 0 || wrapped != len(partitions) {
+				t.Fatalf("%d calls, %d through the wrapped transport, want every one", len(partitions), wrapped)
+			}
+			for _, got := range partitions {
+				if got != tt.partition {
+					t.Errorf("call of partition %q, want %q", got, tt.partition)
+				}
+			}
+		})
+	}
+}
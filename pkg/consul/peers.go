@@ -0,0 +1,155 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// WithPeers syncs the services the cluster peers of Consul export to the watcher's, each peer by a watcher of its
+// own, as hosts qualified by the peer, <service>.<peer>.peer.consul, along with the services of the watcher's own
+// catalog. Peerings established or deleted are picked up every tick. Cluster peering takes Consul 1.13 or later; the
+// API client predates it, so the peer is added to the query of the calls of a peer's watcher.
+func WithPeers() Option {
+	return func(w *watcher) {
+		w.peered = true
+	}
+}
+
+// peering is a cluster peering, as listed by Consul
+type peering struct {
+	Name  string
+	State string
+}
+
+// peerKey keys the peer whose imported services a call reads in its context
+type peerKey struct{}
+
+// runPeers runs a watcher per peer, picking up peerings established or deleted every tick, until ctx is done
+func (w *watcher) runPeers(ctx context.Context) {
+	ticker := time.NewTicker(w.tickInterval)
+	defer ticker.Stop()
+
+	w.m.Lock()
+	w.runCtx = ctx
+	w.m.Unlock()
+	for {
+		if err := w.syncPeers(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("error listing peers from Consul: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshPeers syncs the services imported from every peer into the store once
+func (w *watcher) refreshPeers(ctx context.Context) error {
+	if err := w.syncPeers(ctx); err != nil {
+		return err
+	}
+	w.m.Lock()
+	watchers := make([]*watcher, 0, len(w.peers))
+	for _, p := range w.peers {
+		watchers = append(watchers, p.watcher)
+	}
+	w.m.Unlock()
+	for _, pw := range watchers {
+		if err := pw.Refresh(ctx); err != nil {
+			return errors.Wrapf(err, "peer %s", pw.peer)
+		}
+	}
+	return nil
+}
+
+// syncPeers lists the peers, adding a watcher for each new one, run if w is, and removing the watchers of those
+// deleted along with their hosts
+func (w *watcher) syncPeers(ctx context.Context) error {
+	names, err := w.listPeers(ctx)
+	if err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.peers == nil {
+		w.peers = make(map[string]*namespaced)
+	}
+	w.syncWatchers(w.peers, names, w.peerWatcher, "peer")
+	return nil
+}
+
+// listPeers returns the names of the peers of the watcher's partition, but those being deleted or terminated, sorted
+func (w *watcher) listPeers(ctx context.Context) ([]string, error) {
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{})
+	defer cancel()
+	var peerings []peering
+	if _, err := w.client.Raw().Query("/v1/peerings", &peerings, opts); err != nil {
+		return nil, errors.Wrap(err, "failed to list peers")
+	}
+	names := make([]string, 0, len(peerings))
+	for _, p := range peerings {
+		if p.State != "DELETING" && p.State != "TERMINATED" {
+			names = append(names, p.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// peerWatcher returns a watcher of the services imported from the peer name configured as w, publishing them as
+// hosts qualified by the peer into w's store
+func (w *watcher) peerWatcher(name string) *watcher {
+	pw := w.namespaceWatcher(w.namespace)
+	pw.peer, pw.hostSuffix = name, "."+name+".peer.consul"
+	// the checks of imported services aren't listed by state
+	pw.healthWatch = false
+	return pw
+}
+
+// checkPeers lists the peers once to verify the ACL token can read them
+func (w *watcher) checkPeers(ctx context.Context) error {
+	_, err := w.listPeers(ctx)
+	if err == nil {
+		return nil
+	}
+	if statusCode(err) == http.StatusForbidden {
+		return errors.Wrap(err, "the Consul ACL token is not allowed to list peers; it needs peering:read")
+	}
+	return errors.Wrapf(err, "failed to reach Consul at %s", w.endpoint)
+}
+
+// peerDropped lists the instances dropped by the watchers of every peer
+func (w *watcher) peerDropped() []provider.Dropped {
+	w.m.Lock()
+	defer w.m.Unlock()
+	var dropped []provider.Dropped
+	for _, p := range w.peers {
+		dropped = append(dropped, p.watcher.Dropped()...)
+	}
+	return dropped
+}
+
+// peerTransport sends every request through next with the peer of its context, if any, in its query
+type peerTransport struct {
+	next http.RoundTripper
+}
+
+func (t *peerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	peer, _ := r.Context().Value(peerKey{}).(string)
+	if peer == "" {
+		return t.next.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	query := r.URL.Query()
+	query.Set("peer", peer)
+	r.URL.RawQuery = query.Encode()
+	return t.next.RoundTrip(r)
+}
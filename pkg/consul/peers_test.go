@@ -0,0 +1,89 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_peers(t *testing.T) {
+	var m sync.Mutex
+	// services of the catalog, by peer they're imported from, the catalog's own under ""
+	catalogs := map[string][]string{"": {"web"}, "dc2": {"web", "api"}}
+	states := map[string]string{"dc2": "ACTIVE"}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		rw.Header().Set("X-Consul-Index", "1")
+		peer := r.URL.Query().Get("peer")
+		switch {
+		case r.URL.Path == "/v1/peerings":
+			var out []peering
+			for name, state := range states {
+				out = append(out, peering{Name: name, State: state})
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+		case r.URL.Path == "/v1/catalog/services":
+			names := map[string][]string{}
+			for _, name := range catalogs[peer] {
+				names[name] = nil
+			}
+			_ = json.NewEncoder(rw).Encode(names)
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+			name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: "192.0.2.1", ServicePort: 80}})
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewWatcher(provider.NewStore(), server.URL, "", WithAllNamespaces(), WithPeers()); err == nil {
+		t.Error("NewWatcher() of every namespace and peers succeeded, want an error")
+	}
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(provider.Checker).Check(context.Background()); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{name: "every peer", change: func() {}, want: []string{"api.dc2.peer.consul", "web", "web.dc2.peer.consul"}},
+		{name: "peering established", change: func() { catalogs["dc3"], states["dc3"] = []string{"db"}, "ACTIVE" },
+			want: []string{"api.dc2.peer.consul", "db.dc3.peer.consul", "web", "web.dc2.peer.consul"}},
+		{name: "peering deleted", change: func() { states["dc2"] = "DELETING" },
+			want: []string{"db.dc3.peer.consul", "web"}},
+	}
+	for _, step := range steps {
+		m.Lock()
+		step.change()
+		m.Unlock()
+		if err := w.Refresh(context.Background()); err != nil {
+			t.Fatalf("%s: Refresh() error = %v", step.name, err)
+		}
+		var got []string
+		for host := range store.Hosts() {
+			got = append(got, host)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: hosts = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// WithPortTags publishes further ports of instances named by their tags matching re, whose first submatch is the
+// name of a port and second its number, alongside the port they're registered with, e.g. ^(.+)\.port=(\d+)$ for
+// tags like grpc.port=8443, or ^(metrics|admin)=(\d+)$ for tags like metrics=9090. As for ports of instances, Istio
+// takes a port's protocol from its name, e.g. grpc or http-admin.
+func WithPortTags(re *regexp.Regexp) Option {
+	return func(w *watcher) {
+		w.conversion.portTags = re
+	}
+}
+
+// taggedPorts returns the ports of c its tags matching re name, by name, leaving out those that aren't valid, or nil
+// without any
+func taggedPorts(c *api.CatalogService, re *regexp.Regexp) map[string]uint32 {
+	if re == nil {
+		return nil
+	}
+	var ports map[string]uint32
+	for _, tag := range c.ServiceTags {
+		m := re.FindStringSubmatch(tag)
+		if len(m) < 3 {
+			continue
+		}
+		name := strings.ToLower(m[1])
+		port, err := strconv.ParseUint(m[2], 10, 16)
+		if err != nil || port == 0 || len(validation.IsDNS1123Label(name)) > 0 {
+			log.Infof("instance %s of %s has tag %q naming no valid port, ignoring it", c.ServiceID, c.ServiceName, tag)
+			continue
+		}
+		if ports == nil {
+			ports = make(map[string]uint32)
+		}
+		ports[name] = uint32(port)
+	}
+	return ports
+}
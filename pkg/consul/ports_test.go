@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestCatalogServiceToWorkloadEntry_portTags(t *testing.T) {
+	dotPort := regexp.MustCompile(`^(.+)\.port=(\d+)$`)
+	tests := []struct {
+		name string
+		re   *regexp.Regexp
+		port int
+		tags []string
+		want map[string]uint32
+	}{
+		{name: "no expression", port: 8080, tags: []string{"grpc.port=8443"}, want: map[string]uint32{"tcp": 8080}},
+		{name: "dotted", re: dotPort, port: 8080, tags: []string{"grpc.port=8443", "http-admin.port=9901", "canary"},
+			want: map[string]uint32{"tcp": 8080, "grpc": 8443, "http-admin": 9901}},
+		{name: "named", re: regexp.MustCompile(`^(metrics|admin)=(\d+)$`), port: 80,
+			tags: []string{"metrics=9090", "version=2", "tls=true"}, want: map[string]uint32{"http": 80, "metrics": 9090}},
+		{name: "invalid", re: dotPort, port: 8080, tags: []string{"grpc.port=70000", "grpc_api.port=8443", "x.port=0"},
+			want: map[string]uint32{"tcp": 8080}},
+		{name: "registered port wins", re: dotPort, port: 8080, tags: []string{"tcp.port=9000"},
+			want: map[string]uint32{"tcp": 8080}},
+		{name: "without registered port", re: dotPort, tags: []string{"grpc.port=8443"},
+			want: map[string]uint32{"grpc": 8443}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := catalogServiceToWorkloadEntry(&api.CatalogService{ServiceID: "billing-1", ServiceName: "billing",
+				Address: "192.0.2.10", ServicePort: tt.port, ServiceTags: tt.tags}, conversion{portTags: tt.re})
+			if !reflect.DeepEqual(we.Ports, tt.want) {
+				t.Errorf("ports = %v, want %v", we.Ports, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWatcher_portTags(t *testing.T) {
+	_, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "", WithPortTags(regexp.MustCompile(`^metrics=\d+$`)))
+	if err == nil {
+		t.Error("NewWatcher() succeeded with an expression without submatches, want an error")
+	}
+}
@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenFileTTL is how long the ACL token read from a file is used before the file is read again, in case its rotation
+// went unnoticed
+const tokenFileTTL = 5 * time.Minute
+
+// tokenSource holds an ACL token read from a file, e.g. a *secret.File
+type tokenSource interface {
+	Value() string
+	Reload()
+}
+
+// tokenFileTransport sends every request through next with the ACL token of file, reading the file again at least
+// every tokenFileTTL, and as soon as Consul denies a request, e.g. once a short-lived token issued by Vault expired,
+// so the token rotated since is used from the next request on
+type tokenFileTransport struct {
+	file tokenSource
+	next http.RoundTripper
+
+	m      sync.Mutex // guards readAt
+	readAt time.Time
+}
+
+func (t *tokenFileTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	if time.Since(t.readAt) >= tokenFileTTL {
+		t.file.Reload()
+		t.readAt = time.Now()
+	}
+	t.m.Unlock()
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Consul-Token", t.file.Value())
+	resp, err := t.next.RoundTrip(r)
+	if err == nil && resp.StatusCode == http.StatusForbidden {
+		t.m.Lock()
+		t.file.Reload()
+		t.readAt = time.Now()
+		t.m.Unlock()
+	}
+	return resp, err
+}
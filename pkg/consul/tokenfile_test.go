@@ -0,0 +1,79 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeTokenFile holds the token last read, and the one the file holds now
+type fakeTokenFile struct {
+	value, onDisk string
+	reloads       int
+}
+
+func (f *fakeTokenFile) Value() string {
+	return f.value
+}
+
+func (f *fakeTokenFile) Reload() {
+	f.reloads++
+	f.value = f.onDisk
+}
+
+func TestTokenFileTransport(t *testing.T) {
+	valid := "token-1"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != valid {
+			http.Error(rw, "ACL not found", http.StatusForbidden)
+			return
+		}
+		_, _ = rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	file := &fakeTokenFile{value: "token-1", onDisk: "token-1"}
+	client := &http.Client{Transport: &tokenFileTransport{file: file, next: http.DefaultTransport}}
+	get := func() int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/catalog/services", nil)
+		// the client's own token is replaced by the file's
+		req.Header.Set("X-Consul-Token", "static")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	steps := []struct {
+		name        string
+		rotate      func(tr *tokenFileTransport)
+		wantStatus  int
+		wantReloads int
+	}{
+		// read when first used
+		{name: "initial", wantStatus: http.StatusOK, wantReloads: 1},
+		{name: "unchanged", wantStatus: http.StatusOK, wantReloads: 1},
+		// the rotation went unnoticed: the expired token is denied, and the file read again
+		{name: "expired", rotate: func(*tokenFileTransport) { valid, file.onDisk = "token-2", "token-2" },
+			wantStatus: http.StatusForbidden, wantReloads: 2},
+		{name: "rotated", wantStatus: http.StatusOK, wantReloads: 2},
+		// the file is read again once it's been used for long enough, before the token is denied
+		{name: "stale", rotate: func(tr *tokenFileTransport) {
+			valid, file.onDisk = "token-3", "token-3"
+			tr.readAt = time.Now().Add(-tokenFileTTL)
+		}, wantStatus: http.StatusOK, wantReloads: 3},
+	}
+	for _, step := range steps {
+		if step.rotate != nil {
+			step.rotate(client.Transport.(*tokenFileTransport))
+		}
+		if got := get(); got != step.wantStatus || file.reloads != step.wantReloads {
+			t.Errorf("%s: status %d after %d reloads, want %d after %d", step.name, got, file.reloads,
+				step.wantStatus, step.wantReloads)
+		}
+	}
+}
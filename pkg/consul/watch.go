@@ -0,0 +1,143 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// WithServiceWatches keeps a blocking query open on every service, rather than re-reading every service whenever the
+// list of services changes, so changes to a service's instances, and with WithHealthStatus to their health, are
+// synced as soon as Consul reports them. It takes a connection to Consul per service.
+func WithServiceWatches() Option {
+	return func(w *watcher) {
+		w.watches = true
+	}
+}
+
+// runWatches keeps a blocking query open on the list of services, watching each service listed until it's gone,
+// until ctx is done
+func (w *watcher) runWatches(ctx context.Context) {
+	watches := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range watches {
+			cancel()
+		}
+	}()
+	var index uint64
+	b := w.newBackoff()
+	for {
+		names, lastIndex, err := w.serviceNames(ctx, index)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Errorf("error listing services from Consul: %v", err)
+			if !w.backOff(ctx, b) {
+				return
+			}
+			continue
+		}
+		b.reset()
+		if lastIndex == index {
+			// the wait time passed without changes
+			w.store.Synced()
+			continue
+		}
+		index = nextIndex(index, lastIndex)
+		for name := range names {
+			if _, ok := watches[name]; !ok {
+				watchCtx, cancel := context.WithCancel(ctx)
+				watches[name] = cancel
+				go w.watchService(watchCtx, name)
+			}
+		}
+		var removed []string
+		for name, cancel := range watches {
+			if _, ok := names[name]; !ok {
+				cancel()
+				delete(watches, name)
+				removed = append(removed, name)
+			}
+		}
+		if len(removed) > 0 {
+			w.m.Lock()
+			hosts := make([]string, 0, len(removed))
+			for _, name := range removed {
+				delete(w.cache, name)
+				hosts = append(hosts, w.host(name))
+			}
+			w.setDrops()
+			w.store.Apply(provider.Delta{Removed: hosts})
+			w.publishAnnotations()
+			w.m.Unlock()
+		}
+	}
+}
+
+// watchService syncs the instances of the service name every time its index changes, until ctx is done
+func (w *watcher) watchService(ctx context.Context, name string) {
+	var index uint64
+	b := w.newBackoff()
+	for {
+		svcs, lastIndex, err := w.describeService(ctx, name, index)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Errorf("error describing service catalog from Consul: %v ", err)
+			if !w.backOff(ctx, b) {
+				return
+			}
+			continue
+		}
+		b.reset()
+		if lastIndex == index {
+			continue
+		}
+		index = nextIndex(index, lastIndex)
+		w.applyService(ctx, name, lastIndex, svcs)
+	}
+}
+
+// nextIndex returns the index to wait on after a query waiting on index returned lastIndex. Consul's index may go
+// backwards, e.g. when a server's state is restored, so the next query mustn't wait on it then.
+func nextIndex(index, lastIndex uint64) uint64 {
+	if lastIndex < index {
+		return 0
+	}
+	return lastIndex
+}
+
+// applyService syncs the instances svcs of the service name, read at index, unless ctx is done as the service is gone
+func (w *watcher) applyService(ctx context.Context, name string, index uint64, svcs []*api.CatalogService) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	e := w.entries(name, index, svcs)
+	if w.cache == nil {
+		w.cache = make(map[string]indexedEntries)
+	}
+	w.cache[name] = e
+	w.setDrops()
+	delta := provider.Delta{Updated: make(map[string][]*v1alpha3.WorkloadEntry)}
+	if len(e.workloadEntries) > 0 {
+		delta.Updated[w.host(name)] = e.workloadEntries
+	} else {
+		delta.Removed = []string{w.host(name)}
+	}
+	w.store.Apply(delta)
+	w.publishAnnotations()
+}
+
+// setDrops sets the instances dropped to those of the cached services; w.m must be held
+func (w *watcher) setDrops() {
+	var dropped []provider.Dropped
+	for _, c := range w.cache {
+		dropped = append(dropped, c.dropped...)
+	}
+	w.drops.Set(dropped)
+}
@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestWatcher_serviceWatches(t *testing.T) {
+	type service struct {
+		index   uint64
+		address string
+	}
+	var m sync.Mutex
+	listIndex := uint64(1)
+	catalog := map[string]service{"a": {index: 1, address: "192.0.2.1"}, "b": {index: 1, address: "192.0.2.2"}}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+		// blocks until the index passes the one waited on, or a short wait time passes
+		for deadline := time.Now().Add(50 * time.Millisecond); ; time.Sleep(5 * time.Millisecond) {
+			m.Lock()
+			index := listIndex
+			if name != r.URL.Path {
+				index = catalog[name].index
+			}
+			if wait == 0 || index != wait || time.Now().After(deadline) {
+				break
+			}
+			m.Unlock()
+		}
+		defer m.Unlock()
+		if name != r.URL.Path {
+			svc := catalog[name]
+			rw.Header().Set("X-Consul-Index", strconv.FormatUint(svc.index, 10))
+			_ = json.NewEncoder(rw).Encode([]*api.CatalogService{{ServiceName: name, Address: svc.address, ServicePort: 80}})
+			return
+		}
+		names := map[string][]string{}
+		for name := range catalog {
+			names[name] = nil
+		}
+		rw.Header().Set("X-Consul-Index", strconv.FormatUint(listIndex, 10))
+		_ = json.NewEncoder(rw).Encode(names)
+	}))
+	defer server.Close()
+
+	store := provider.NewStore()
+	w, err := NewWatcher(store, server.URL, "", WithServiceWatches())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	// addresses returns the address of every host in the store
+	addresses := func() map[string]string {
+		got := map[string]string{}
+		for host, wes := range store.Hosts() {
+			got[host] = wes[0].Address
+		}
+		return got
+	}
+	steps := []struct {
+		name   string
+		change func()
+		want   map[string]string
+	}{
+		{name: "first sync", change: func() {}, want: map[string]string{"a": "192.0.2.1", "b": "192.0.2.2"}},
+		{
+			name: "instance changed",
+			change: func() {
+				catalog["b"] = service{index: 2, address: "192.0.2.3"}
+			},
+			want: map[string]string{"a": "192.0.2.1", "b": "192.0.2.3"},
+		},
+		{
+			name: "service removed",
+			change: func() {
+				delete(catalog, "a")
+				listIndex++
+			},
+			want: map[string]string{"b": "192.0.2.3"},
+		},
+	}
+	for _, step := range steps {
+		m.Lock()
+		step.change()
+		m.Unlock()
+		deadline := time.Now().Add(5 * time.Second)
+		for got := addresses(); !reflect.DeepEqual(got, step.want); got = addresses() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: synced %v, want %v", step.name, got, step.want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
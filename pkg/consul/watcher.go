@@ -2,62 +2,293 @@ package consul
 
 import (
 	"context"
-	"net/url"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 	"istio.io/api/networking/v1alpha3"
 
 	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
 	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
-	"github.com/tetratelabs/log"
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
 )
 
 var errIndexChangeTimeout = errors.New("blocking request timeout while waiting for index to change")
 
 type watcher struct {
-	client       *api.Client
-	store        provider.Store
-	tickInterval time.Duration
-	lastIndex    uint64 // lastly synced index of Catalog
-	namespace    string
+	client          *api.Client
+	endpoint        string
+	store           provider.Store
+	prefix          string
+	tickInterval    time.Duration
+	maxBackoff      time.Duration // caps the wait between attempts while Consul keeps failing; unbounded if zero
+	callTimeout     time.Duration // bounds each API call; zero means unbounded
+	concurrency     int           // services described at once; zero means unbounded
+	wrapTransport   func(http.RoundTripper) http.RoundTripper
+	token           *secret.File // ACL token, if any; read for every call so rotation takes effect immediately
+	staticToken     string       // ACL token of the client, if not empty, overridden by token
+	lastIndex       uint64       // lastly synced index of Catalog
+	namespace       string
+	health          string                         // worst aggregated check status of the instances synced; empty to sync the catalog's
+	watches         bool                           // whether Run keeps a blocking query open on every service rather than polling
+	healthWatch     bool                           // whether Run keeps a blocking query open on every check while polling
+	excludeNames    *regexp.Regexp                 // matches the names of the services never synced, if not nil
+	excludeTags     map[string]bool                // tags of the services never synced
+	annotate        bool                           // whether to annotate Service Entries with the services they're synced from
+	agentLocal      bool                           // whether to sync the services of the agent read rather than the catalog's
+	agentInstances  map[string][]*api.ServiceEntry // instances registered with the agent as last listed, by service
+	agentIndex      uint64                         // moves whenever agentInstances do
+	connect         bool                           // whether to sync the Connect sidecar proxies of services rather than their instances
+	overridesPrefix string                         // prefix of the KV keys overriding how services are synced, if not empty
+	overrides       map[string]override            // overrides last applied, by service
+	hostSuffix      string                         // qualifying the hosts of services, named after them
+	hostTemplate    *template.Template             // renders the hosts of services rather than the host suffix, if not nil
+	datacenter      string                         // the instances read are registered in, once known
+	allNamespaces   bool                           // whether to sync every namespace, each by a watcher of its own
+	peered          bool                           // whether to sync the services imported from every peer, each by a watcher of its own
+	peer            string                         // peer whose imported services to sync, if not the catalog's own
+	partition       string                         // admin partition to read, if not the token's
+	login           *Login                         // to log in with for the ACL token, if any
+	filter          string                         // expression the instances synced match, if not empty
+	conversion      conversion                     // of instances into WorkloadEntries
+	consistency     string                         // consistency mode of reads; empty for Consul's default
+	maxStale        time.Duration                  // how far behind the leader stale reads may be, if positive
+	m               sync.Mutex                     // guards lastIndex and cache, and serializes refreshes triggered by the ticker and on demand
+	// entries built per service at the index they were read at, reused while the service's index is unchanged
+	cache map[string]indexedEntries
+	drops *provider.Drops
+	// annotations of every watcher sharing the store, for publishAnnotations
+	annotationSets *annotationSets
+
+	// watchers by namespace of a watcher of every namespace, or by peer of a watcher of peers, and the context of its
+	// Run once running; guarded by m
+	namespaces map[string]*namespaced
+	peers      map[string]*namespaced
+	runCtx     context.Context
+}
+
+type indexedEntries struct {
+	index           uint64
+	workloadEntries []*v1alpha3.WorkloadEntry
+	dropped         []provider.Dropped
+	annotations     map[string]string // of the service's Service Entry, with WithServiceAnnotations
+}
+
+// described are a service's catalog entries and the index they were read at
+type described struct {
+	index    uint64
+	services []*api.CatalogService
 }
 
 const (
 	// TODO: allow users to specify these
 	defaultBlockingRequestWaitTimeDuration = 5 * time.Second
 	defaultTickIntervalDuration            = 10 * time.Second
+	// must exceed the blocking request wait time, which Consul may extend by up to 1/16th as jitter
+	defaultCallTimeout = 15 * time.Second
+	// defaultConcurrency is how many services are described at once unless overridden with WithConcurrency
+	defaultConcurrency = 8
+	// a service failing to be described is retried after describeBackoff, doubled for every retry, up to
+	// describeAttempts calls in all
+	describeAttempts = 3
+	describeBackoff  = 250 * time.Millisecond
 )
 
+// Option configures a Consul watcher
+type Option func(*watcher)
+
+// WithCallTimeout bounds each Consul API call, so a hung request fails instead of stalling the refresh.
+// Zero disables the bound.
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(w *watcher) {
+		w.callTimeout = timeout
+	}
+}
+
+// WithConcurrency describes up to n services at once rather than 8, so a refresh of a catalog with hundreds of
+// services takes a fraction of the time. One describes them one after the other.
+func WithConcurrency(n int) Option {
+	return func(w *watcher) {
+		w.concurrency = n
+	}
+}
+
+// WithTokenFile authenticates every Consul API call with the ACL token in f, read again at least every 5 minutes and
+// whenever Consul denies a call, besides when f is seen changing
+func WithTokenFile(f *secret.File) Option {
+	return func(w *watcher) {
+		w.token = f
+	}
+}
+
+// WithToken authenticates every Consul API call with the static ACL token given, rather than the one
+// CONSUL_HTTP_TOKEN or the file CONSUL_HTTP_TOKEN_FILE names, if any. WithTokenFile takes precedence over it.
+func WithToken(token string) Option {
+	return func(w *watcher) {
+		w.staticToken = token
+	}
+}
+
+// WithDrops keeps track of the instances the watcher drops in d, rather than in drops labelled with its prefix
+func WithDrops(d *provider.Drops) Option {
+	return func(w *watcher) {
+		w.drops = d
+	}
+}
+
+// WithPrefix names the watcher's ServiceEntries, and labels its metrics, with prefix instead of the default "consul-",
+// so watchers of different datacenters can publish into one cluster
+func WithPrefix(prefix string) Option {
+	return func(w *watcher) {
+		w.prefix = prefix
+	}
+}
+
+// WithTransportWrapper sends every Consul API call through the transport returned by wrap, e.g. to inject faults
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(w *watcher) {
+		w.wrapTransport = wrap
+	}
+}
+
 var _ provider.Watcher = &watcher{}
+var _ provider.Checker = &watcher{}
+var _ provider.DroppedLister = &watcher{}
 
-func NewWatcher(store provider.Store, endpoint string, namespace string) (provider.Watcher, error) {
+func NewWatcher(store provider.Store, endpoint string, namespace string, opts ...Option) (provider.Watcher, error) {
 	if len(endpoint) == 0 {
 		return nil, errors.New("Consul endpoint not specified")
 	}
 
 	config := api.DefaultConfig()
-	u, err := url.Parse(endpoint)
+	failover, err := failoverEndpoints(endpoint)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing endpoint: %s", endpoint)
+		return nil, err
+	}
+	var pathPrefix string
+	if failover != nil {
+		// requests are sent to the active endpoint by the failover transport
+		config.Scheme, config.Address = failover[0].scheme, failover[0].host
+	} else if pathPrefix, err = setEndpoint(config, endpoint); err != nil {
+		return nil, err
 	}
 
-	// TODO: allow users to specify TOKEN
-	config.Scheme = u.Scheme
-	config.Address = u.Host
+	// DefaultConfig reads a static ACL token from CONSUL_HTTP_TOKEN or CONSUL_HTTP_TOKEN_FILE, unless WithToken
+	// overrides it; the transport sets a rotated one of WithTokenFile on every request
 	config.WaitTime = defaultBlockingRequestWaitTimeDuration
 
-	client, err := api.NewClient(config)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating client")
-	}
-	return &watcher{client: client,
+	w := &watcher{
+		endpoint:     endpoint,
 		store:        store,
+		prefix:       "consul-",
 		tickInterval: defaultTickIntervalDuration,
+		callTimeout:  defaultCallTimeout,
+		concurrency:  defaultConcurrency,
+		maxBackoff:   defaultMaxBackoff,
+		// shared with the watchers of every namespace or peer
+		annotationSets: &annotationSets{},
 		// TODO: Since namespace feature is only available in Enterprise (+1.7.0), we haven't tested yet
 		namespace: namespace,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.drops == nil {
+		w.drops = provider.NewDrops(w.prefix)
+	}
+	if re := w.conversion.portTags; re != nil && re.NumSubexp() < 2 {
+		return nil, errors.Errorf("Consul port tags expression %q must have submatches of a port's name and number",
+			re.String())
+	}
+	if w.healthWatch && (w.health == "" || w.watches) {
+		return nil, errors.New("a Consul health watch only applies with a health status, and without service watches")
+	}
+	if w.concurrency <= 0 {
+		return nil, errors.Errorf("Consul concurrency %d must be positive", w.concurrency)
+	}
+	if w.allNamespaces && w.namespace != "" {
+		return nil, errors.New("a Consul watcher of every namespace can't be given a namespace")
+	}
+	if w.allNamespaces && w.peered {
+		return nil, errors.New("a Consul watcher of every namespace can't sync the services of peers")
+	}
+	if w.agentLocal && (w.allNamespaces || w.peered || w.watches || w.healthWatch || w.connect) {
+		return nil, errors.New("a Consul watcher of the agent's services polls the agent alone, without namespaces, " +
+			"peers, watches or Connect")
+	}
+	if w.overridesPrefix != "" && (w.allNamespaces || w.watches) {
+		return nil, errors.New("Consul overrides only apply to a watcher of a single namespace, without service watches")
+	}
+	if err := validHealthStatus(w.health); err != nil {
+		return nil, err
+	}
+	if err := validPartition(w.partition); err != nil {
+		return nil, err
+	}
+	if err := validBackoff(w.maxBackoff); err != nil {
+		return nil, err
+	}
+	if err := validConsistency(w.consistency, w.maxStale); err != nil {
+		return nil, err
+	}
+	if w.staticToken != "" {
+		// the client would read the token file over the token otherwise
+		config.Token, config.TokenFile = w.staticToken, ""
+	}
+	if w.callTimeout > 0 && w.callTimeout <= config.WaitTime+config.WaitTime/16 {
+		return nil, errors.Errorf("Consul call timeout %v must exceed the blocking request wait time of %v",
+			w.callTimeout, config.WaitTime+config.WaitTime/16)
+	}
+	if w.wrapTransport != nil || w.partition != "" || w.login != nil || w.token != nil || w.maxStale > 0 || w.peered ||
+		pathPrefix != "" || failover != nil {
+		// built as NewClient would, so TLS settings from the environment still apply
+		httpClient, err := api.NewHttpClient(config.Transport, config.TLSConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating HTTP client")
+		}
+		if pathPrefix != "" {
+			httpClient.Transport = &prefixTransport{prefix: pathPrefix, next: httpClient.Transport}
+		}
+		if failover != nil {
+			httpClient.Transport = &failoverTransport{endpoints: failover, next: httpClient.Transport}
+		}
+		if w.partition != "" {
+			httpClient.Transport = &partitionTransport{partition: w.partition, next: httpClient.Transport}
+		}
+		if w.maxStale > 0 {
+			httpClient.Transport = &maxStaleTransport{maxStale: w.maxStale, next: httpClient.Transport}
+		}
+		if w.peered {
+			httpClient.Transport = &peerTransport{next: httpClient.Transport}
+		}
+		if w.token != nil && w.login == nil {
+			httpClient.Transport = &tokenFileTransport{file: w.token, next: httpClient.Transport}
+		}
+		if w.login != nil {
+			if w.login.AuthMethod == "" {
+				return nil, errors.New("Consul auth method to log in with not specified")
+			}
+			if httpClient.Transport, err = newLoginTransport(*w.login, *config, httpClient.Transport); err != nil {
+				return nil, err
+			}
+		}
+		if w.wrapTransport != nil {
+			httpClient.Transport = w.wrapTransport(httpClient.Transport)
+		}
+		config.HttpClient = httpClient
+	}
+	if w.client, err = api.NewClient(config); err != nil {
+		return nil, errors.Wrap(err, "error creating client")
+	}
+	return w, nil
 }
 
 func (w *watcher) Store() provider.Store {
@@ -65,108 +296,428 @@ func (w *watcher) Store() provider.Store {
 }
 
 func (w *watcher) Prefix() string {
-	return "consul-"
+	return w.prefix
+}
+
+// Dropped lists the instances of the last successful sync that aren't synced as the catalog describes them
+func (w *watcher) Dropped() []provider.Dropped {
+	if w.allNamespaces {
+		w.m.Lock()
+		defer w.m.Unlock()
+		var dropped []provider.Dropped
+		for _, ns := range w.namespaces {
+			dropped = append(dropped, ns.watcher.Dropped()...)
+		}
+		return dropped
+	}
+	if w.peered {
+		return append(w.drops.List(), w.peerDropped()...)
+	}
+	return w.drops.List()
 }
 
 // Run the watcher until the context is cancelled
 func (w *watcher) Run(ctx context.Context) {
-	ticker := time.NewTicker(w.tickInterval)
-	defer ticker.Stop()
-
-	w.refreshStore() // init
+	if w.allNamespaces {
+		w.runNamespaces(ctx)
+		return
+	}
+	if w.peered {
+		go w.runPeers(ctx)
+	}
+	if w.watches {
+		w.runWatches(ctx)
+		return
+	}
+	if w.healthWatch {
+		go w.watchHealth(ctx)
+	}
+	b := w.newBackoff()
 	for {
+		wait := w.tickInterval
+		if err := w.refreshStore(ctx); err != nil && ctx.Err() == nil {
+			// rather than at the next tick, so a failing Consul is retried less and less often
+			wait = b.next()
+			log.Errorf("error refreshing from Consul, again in %v: %v", wait, err)
+		} else {
+			b.reset()
+		}
 		select {
-		case <-ticker.C:
-			w.refreshStore()
+		case <-time.After(wait):
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// fetch services and workload entries from consul catalog and sync them with Store
-func (w *watcher) refreshStore() {
-	names, err := w.listServices()
+// Refresh syncs the Consul catalog into the store once, regardless of whether its index changed
+func (w *watcher) Refresh(ctx context.Context) error {
+	if w.allNamespaces {
+		return w.refreshNamespaces(ctx)
+	}
+	w.m.Lock()
+	w.lastIndex = 0
+	w.m.Unlock()
+	if err := w.refreshStore(ctx); err != nil || !w.peered {
+		return err
+	}
+	return w.refreshPeers(ctx)
+}
+
+// Check lists the catalog once, without blocking, to verify Consul is reachable and the ACL token can read it
+func (w *watcher) Check(ctx context.Context) error {
+	if w.allNamespaces {
+		return w.checkNamespaces(ctx)
+	}
+	if w.agentLocal {
+		return w.checkAgent(ctx)
+	}
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{Namespace: w.namespace})
+	defer cancel()
+	_, _, err := w.client.Catalog().Services(opts)
+	if err == nil && w.peered {
+		if err := w.checkPeers(ctx); err != nil {
+			return err
+		}
+	}
+	if err == nil {
+		if err := w.checkOverrides(ctx); err != nil {
+			return err
+		}
+		return w.checkFilter(ctx)
+	}
+	if statusCode(err) == http.StatusForbidden {
+		return errors.Wrap(err, "the Consul ACL token is not allowed to read the catalog; it needs service:read and node:read")
+	}
+	return errors.Wrapf(err, "failed to reach Consul at %s", w.endpoint)
+}
+
+// statusCode returns the HTTP status Consul answered the call that failed with err, or zero if it didn't answer. This
+// version of the API client has no api.StatusError, so the status is read from the error it formats instead.
+func statusCode(err error) int {
+	var code int
+	if _, scanErr := fmt.Sscanf(errors.Cause(err).Error(), "Unexpected response code: %d", &code); scanErr != nil {
+		return 0
+	}
+	return code
+}
+
+// fetch services and workload entries from consul catalog and sync them with Store. Calls are cancelled with ctx,
+// leaving the store untouched.
+func (w *watcher) refreshStore(ctx context.Context) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	overrides := w.overrides
+	if w.overridesPrefix != "" {
+		var err error
+		if overrides, err = w.readOverrides(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "error reading overrides from Consul")
+		}
+	}
+	// changed overrides apply to every service, so the catalog must be read in full
+	reconvert := !reflect.DeepEqual(overrides, w.overrides)
+	if reconvert {
+		w.lastIndex = 0
+	}
+	previous := w.lastIndex
+	names, err := w.listServices(ctx)
 	if err == errIndexChangeTimeout {
 		log.Infof("waiting for index to change: current index: %d", w.lastIndex)
-		return
+		w.store.Synced()
+		return nil
+	} else if ctx.Err() != nil {
+		// shutting down, or the caller's deadline passed
+		return ctx.Err()
 	} else if err != nil {
-		log.Errorf("error listing services from Consul: %v", err)
-		return
+		return errors.Wrap(err, "error listing services from Consul")
+	}
+	if w.lastIndex < previous {
+		// Consul's index went backwards, e.g. as a server's state was restored, so the indexes of services can't
+		// tell whether they changed
+		log.Infof("Consul's index went back from %d to %d, reading every service", previous, w.lastIndex)
+		reconvert = true
 	}
 
-	css := w.describeServices(names)
-	data := make(map[string][]*v1alpha3.WorkloadEntry, len(css))
-	for name, cs := range css {
-		wes := make([]*v1alpha3.WorkloadEntry, 0, len(cs))
-		for _, c := range cs {
-			if we := catalogServiceToWorkloadEntry(c); we != nil {
-				wes = append(wes, we)
-			}
+	css, failed, err := w.describeServices(ctx, names)
+	if err != nil {
+		// the catalog was only partly read, so it must be read in full next time
+		w.lastIndex = 0
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrap(err, "error describing services from Consul")
+	}
+	if len(failed) > 0 {
+		// as for a partly read catalog, though the services read are synced
+		w.lastIndex = 0
+	}
+	// the hosts services were last published as, as overrides may rename them
+	hosts := make(map[string]string, len(w.cache))
+	for name := range w.cache {
+		hosts[name] = w.host(name)
+	}
+	w.overrides = overrides
+	for _, d := range css {
+		// before converting services without instances
+		w.learnDatacenter(d.services)
+	}
+	// only services whose index moved are converted and passed on to the store, unless every service must be
+	delta := provider.Delta{Updated: make(map[string][]*v1alpha3.WorkloadEntry)}
+	cache := make(map[string]indexedEntries, len(css))
+	var dropped []provider.Dropped
+	for name, d := range css {
+		if c, ok := w.cache[name]; ok && !reconvert && d.index != 0 && c.index == d.index {
+			cache[name] = c
+			dropped = append(dropped, c.dropped...)
+			continue
 		}
-		if len(wes) > 0 {
-			data[name] = wes
+		e := w.entries(name, d.index, d.services)
+		cache[name] = e
+		dropped = append(dropped, e.dropped...)
+		if len(e.workloadEntries) > 0 {
+			delta.Updated[w.host(name)] = e.workloadEntries
+		} else {
+			delta.Removed = append(delta.Removed, w.host(name))
 		}
 	}
-	w.store.Set(data)
+	for _, name := range failed {
+		// still listed, so kept as last synced rather than removed
+		if c, ok := w.cache[name]; ok {
+			cache[name] = c
+			dropped = append(dropped, c.dropped...)
+		}
+	}
+	for name, host := range hosts {
+		if _, ok := cache[name]; (!ok || w.host(name) != host) && delta.Updated[host] == nil {
+			delta.Removed = append(delta.Removed, host)
+		}
+	}
+	w.cache = cache
+	w.drops.Set(dropped)
+	w.store.Apply(delta)
+	w.publishAnnotations()
+	return nil
 }
 
-// listServices lists services
-func (w *watcher) listServices() (map[string][]string, error) {
-	data, metadata, err := w.client.Catalog().Services(
-		&api.QueryOptions{WaitIndex: w.lastIndex, Namespace: w.namespace},
-	)
+// listServices lists services, blocking until the catalog changes or the wait time passes
+func (w *watcher) listServices(ctx context.Context) (map[string][]string, error) {
+	data, lastIndex, err := w.serviceNames(ctx, w.lastIndex)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list services")
+		return nil, err
 	}
 
-	if w.lastIndex == metadata.LastIndex {
+	if w.lastIndex == lastIndex {
 		// this case indicates the request reaches timeout of blocking request
 		return nil, errIndexChangeTimeout
 	}
 
-	w.lastIndex = metadata.LastIndex
+	w.lastIndex = lastIndex
 	return data, nil
 }
 
-// describeServices gets catalog services for given service names
-func (w *watcher) describeServices(names map[string][]string) map[string][]*api.CatalogService {
-	ss := make(map[string][]*api.CatalogService, len(names))
-	for name := range names { // ignore tags in value
-		svcs, err := w.describeService(name)
+// serviceNames lists services and the index they were read at, blocking until the index passes waitIndex or the wait
+// time passes
+func (w *watcher) serviceNames(ctx context.Context, waitIndex uint64) (map[string][]string, uint64, error) {
+	if w.agentLocal {
+		data, index, err := w.agentServices(ctx)
 		if err != nil {
-			log.Errorf("error describing service catalog from Consul: %v ", err)
-			continue
+			return nil, 0, err
 		}
-		ss[name] = svcs
+		w.exclude(data)
+		return data, index, nil
+	}
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{WaitIndex: waitIndex, Namespace: w.namespace})
+	defer cancel()
+	data, metadata, err := w.client.Catalog().Services(opts)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to list services")
 	}
-	return ss
+	w.exclude(data)
+	return data, metadata.LastIndex, nil
 }
 
-func (w *watcher) describeService(name string) ([]*api.CatalogService, error) {
-	svcs, _, err := w.client.Catalog().Service(name, "", &api.QueryOptions{
-		Namespace: w.namespace,
-	})
+// describeServices gets catalog services for given service names, up to the watcher's concurrency at once, along with
+// the names of those that failed to be described even when retried. It fails only if ctx is done or Consul rejects
+// the filter expression.
+func (w *watcher) describeServices(ctx context.Context, names map[string][]string) (map[string]described, []string,
+	error) {
+	ss := make(map[string]described, len(names))
+	var failed []string
+	var m sync.Mutex // guards ss and failed
+	g, gctx := errgroup.WithContext(ctx)
+	if w.concurrency > 0 {
+		g.SetLimit(w.concurrency)
+	}
+	for name := range names { // ignore tags in value
+		name := name
+		g.Go(func() error {
+			svcs, index, err := w.describeServiceRetrying(gctx, name)
+			if gctx.Err() != nil {
+				return gctx.Err()
+			}
+			m.Lock()
+			defer m.Unlock()
+			if err != nil && w.invalidFilter(err) {
+				// every service would be left out, as if gone
+				return errors.Wrapf(err, "invalid Consul filter %q", w.filter)
+			} else if err != nil {
+				log.Errorf("error describing service catalog from Consul: %v ", err)
+				failed = append(failed, name)
+				return nil
+			}
+			ss[name] = described{index: index, services: svcs}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+	return ss, failed, nil
+}
+
+// describeServiceRetrying gets the catalog services for name as describeService does without blocking, retrying a
+// failed call with exponential backoff up to describeAttempts calls in all
+func (w *watcher) describeServiceRetrying(ctx context.Context, name string) ([]*api.CatalogService, uint64, error) {
+	backoff := describeBackoff
+	for attempt := 1; ; attempt++ {
+		svcs, index, err := w.describeService(ctx, name, 0)
+		if err == nil || attempt == describeAttempts || ctx.Err() != nil || w.invalidFilter(err) {
+			return svcs, index, err
+		}
+		log.Debugf("retrying to describe %s in %v: %v", name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// describeService gets the catalog services for name and the index they were read at, blocking until the index passes
+// waitIndex, unless zero, or the wait time passes
+func (w *watcher) describeService(ctx context.Context, name string, waitIndex uint64) ([]*api.CatalogService, uint64, error) {
+	if w.agentLocal {
+		svcs, index := w.describeAgentService(name)
+		return svcs, index, nil
+	}
+	if w.connect {
+		return w.describeConnectService(ctx, name, waitIndex)
+	}
+	return w.describeInstances(ctx, name, waitIndex)
+}
+
+// describeInstances gets the instances of the service name as describeService does, regardless of Connect
+func (w *watcher) describeInstances(ctx context.Context, name string, waitIndex uint64) ([]*api.CatalogService, uint64,
+	error) {
+	if w.health != "" {
+		return w.describeHealthyService(ctx, name, waitIndex)
+	}
+	opts, cancel := w.queryOptions(ctx, &api.QueryOptions{WaitIndex: waitIndex, Namespace: w.namespace, Filter: w.filter})
+	defer cancel()
+	svcs, meta, err := w.client.Catalog().Service(name, "", opts)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to describe svc: %s", name)
+		return nil, 0, errors.Wrapf(err, "failed to describe svc: %s", name)
+	}
+	return svcs, meta.LastIndex, nil
+}
+
+// queryOptions reads a single API call made with opts in the consistency mode of the watcher from its peer, if any,
+// cancels it with ctx and bounds it by the call timeout. The transport authenticates it.
+func (w *watcher) queryOptions(ctx context.Context, opts *api.QueryOptions) (*api.QueryOptions, context.CancelFunc) {
+	if w.peer != "" {
+		ctx = context.WithValue(ctx, peerKey{}, w.peer)
+	}
+	w.consistent(opts)
+	if w.callTimeout <= 0 {
+		return opts.WithContext(ctx), func() {}
 	}
-	return svcs, nil
+	ctx, cancel := context.WithTimeout(ctx, w.callTimeout)
+	return opts.WithContext(ctx), cancel
 }
 
-// catalogServiceToWorkloadEntry converts catalog service to workload entry
-func catalogServiceToWorkloadEntry(c *api.CatalogService) *v1alpha3.WorkloadEntry {
-	address := c.Address
+// conversion configures how instances are converted into WorkloadEntries
+type conversion struct {
+	taggedAddress string         // name of the tagged address to reach instances at, if not their default one
+	portTags      *regexp.Regexp // matches the tags naming further ports of instances, if not nil
+	protocol      string         // protocol of the port registered by instances, over their protocol meta, if not empty
+}
+
+// catalogServicesToWorkloadEntries converts the catalog services of host as conv configures, returning those it
+// dropped alongside
+func catalogServicesToWorkloadEntries(host string, conv conversion, cs []*api.CatalogService) ([]*v1alpha3.WorkloadEntry,
+	[]provider.Dropped) {
+	wes := make([]*v1alpha3.WorkloadEntry, 0, len(cs))
+	var dropped []provider.Dropped
+	for _, c := range cs {
+		if we := catalogServiceToWorkloadEntry(c, conv); we != nil {
+			wes = append(wes, we)
+		} else {
+			dropped = append(dropped, provider.Dropped{Host: host, ID: c.ServiceID, Reason: provider.DroppedUnsupported,
+				Detail: "no service or node address"})
+		}
+	}
+	return wes, dropped
+}
+
+// catalogServiceToWorkloadEntry converts catalog service to workload entry as conv configures
+func catalogServiceToWorkloadEntry(c *api.CatalogService, conv conversion) *v1alpha3.WorkloadEntry {
+	address, port := address(c, conv.taggedAddress)
 	if address == "" {
 		log.Infof("instance %s of %s.%v is of a type that is not currently supported",
 			c.ServiceID, c.ServiceName, c.Namespace)
 		return nil
 	}
 
-	port := c.ServicePort
+	var we *v1alpha3.WorkloadEntry
+	tagged := taggedPorts(c, conv.portTags)
 	if port > 0 { // port is optional and defaults to zero
-		return infer.WorkloadEntry(address, uint32(port))
+		we = infer.WorkloadEntry(address, uint32(port))
+		if name := portName(c, conv.protocol); name != "" {
+			we.Ports = map[string]uint32{name: uint32(port)}
+		}
+		for name, p := range tagged {
+			// the port registered wins over one of the same name
+			if _, ok := we.Ports[name]; !ok {
+				we.Ports[name] = p
+			}
+		}
+	} else if len(tagged) > 0 {
+		we = &v1alpha3.WorkloadEntry{Address: address, Ports: tagged}
+	} else {
+		log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
+		we = &v1alpha3.WorkloadEntry{Address: address, Ports: map[string]uint32{"http": 80, "https": 443}}
 	}
+	we.Labels = labels(c)
+	we.Locality = locality(c)
+	we.Weight = weight(c)
+	return we
+}
 
-	log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
-	return &v1alpha3.WorkloadEntry{Address: address, Ports: map[string]uint32{"http": 80, "https": 443}}
+// metadata merges the service's meta with its tags: `key=value` tags, and bare tags set to true, so either can
+// carry settings like tls=true
+func metadata(c *api.CatalogService) map[string]string {
+	if len(c.ServiceTags) == 0 {
+		return c.ServiceMeta
+	}
+	m := make(map[string]string, len(c.ServiceMeta)+len(c.ServiceTags))
+	for _, tag := range c.ServiceTags {
+		if i := strings.Index(tag, "="); i >= 0 {
+			m[tag[:i]] = tag[i+1:]
+		} else {
+			m[tag] = "true"
+		}
+	}
+	// meta is explicit, so it wins over tags
+	for k, v := range c.ServiceMeta {
+		m[k] = v
+	}
+	return m
 }
@@ -1,11 +1,14 @@
 package consul
 
 import (
+	"context"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
 	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
 )
 
@@ -39,9 +42,9 @@ func TestWatcher(t *testing.T) {
 }
 
 func checkConsulEmpty(t *testing.T) {
-	w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
+	w := &watcher{client: testClient, store: provider.NewStore(), drops: provider.NewDrops("consul-"), tickInterval: time.Second * 10}
 
-	if n, err := w.listServices(); err != nil {
+	if n, err := w.listServices(context.TODO()); err != nil {
 		t.Fatalf("listServices failed: %v", err)
 	} else if len(n) != 1 {
 		t.Fatalf("service must be empty")
@@ -135,8 +138,8 @@ func testRefreshStore(t *testing.T) {
 				}
 			}()
 
-			w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-			w.refreshStore()
+			w := &watcher{client: testClient, store: provider.NewStore(), drops: provider.NewDrops("consul-"), tickInterval: time.Second * 10}
+			w.refreshStore(context.TODO())
 
 			actual := w.store.Hosts()
 			if len(actual) != len(tt.services)+1 {
@@ -165,7 +168,7 @@ func testRefreshStore(t *testing.T) {
 			}
 
 			prevIndex := w.lastIndex
-			w.refreshStore() // supposed to immediately return since the index not change
+			w.refreshStore(context.TODO()) // supposed to immediately return since the index not change
 			if prevIndex != w.lastIndex {
 				t.Fatalf("indexes must not change but have %d != %d", prevIndex, w.lastIndex)
 			}
@@ -213,8 +216,8 @@ func testDescribeService(t *testing.T) {
 				}()
 			}
 
-			w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-			ret, err := w.describeService(tt.sc.Service.Service)
+			w := &watcher{client: testClient, store: provider.NewStore(), drops: provider.NewDrops("consul-"), tickInterval: time.Second * 10}
+			ret, _, err := w.describeService(context.TODO(), tt.sc.Service.Service, 0)
 			if tt.sc.Service.Service != "" {
 				if err != nil {
 					t.Fatal(err)
@@ -265,8 +268,8 @@ func testListServices(t *testing.T) {
 				}
 			}()
 
-			w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-			actual, err := w.listServices()
+			w := &watcher{client: testClient, store: provider.NewStore(), drops: provider.NewDrops("consul-"), tickInterval: time.Second * 10}
+			actual, err := w.listServices(context.TODO())
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -295,13 +298,13 @@ func testListServices(t *testing.T) {
 			}
 		}()
 
-		w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-		_, err = w.listServices()
+		w := &watcher{client: testClient, store: provider.NewStore(), drops: provider.NewDrops("consul-"), tickInterval: time.Second * 10}
+		_, err = w.listServices(context.TODO())
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		_, err = w.listServices()
+		_, err = w.listServices(context.TODO())
 		if err != errIndexChangeTimeout {
 			t.Fatalf(
 				"`%v` must be returned but got `%v`",
@@ -311,16 +314,30 @@ func testListServices(t *testing.T) {
 	})
 }
 
+func TestCatalogServicesToWorkloadEntries(t *testing.T) {
+	wes, dropped := catalogServicesToWorkloadEntries("billing", conversion{}, []*api.CatalogService{
+		{ServiceID: "billing-1", Address: "192.0.2.10", ServicePort: 8080},
+		{ServiceID: "billing-2"},
+	})
+	if len(wes) != 1 || wes[0].Address != "192.0.2.10" {
+		t.Errorf("workload entries must be of billing-1 only but got %v", wes)
+	}
+	want := []provider.Dropped{{Host: "billing", ID: "billing-2", Reason: provider.DroppedUnsupported, Detail: "no service or node address"}}
+	if !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped must be %v but got %v", want, dropped)
+	}
+}
+
 func TestCatalogServiceToWorkloadEntry(t *testing.T) {
 	// empty address
-	res := catalogServiceToWorkloadEntry(&api.CatalogService{})
+	res := catalogServiceToWorkloadEntry(&api.CatalogService{}, conversion{})
 	if res != nil {
 		t.Errorf("result must be nil but got %v", res)
 	}
 
 	// empty port
 	in := &api.CatalogService{Address: "192.0.2.4"}
-	res = catalogServiceToWorkloadEntry(in)
+	res = catalogServiceToWorkloadEntry(in, conversion{})
 	if res.Address != in.Address {
 		t.Errorf("address must be %s but got %s", in.Address, res.Address)
 	}
@@ -333,11 +350,30 @@ func TestCatalogServiceToWorkloadEntry(t *testing.T) {
 
 	// address and ports are provided
 	in = &api.CatalogService{Address: "192.0.2.10", ServicePort: 8080}
-	res = catalogServiceToWorkloadEntry(in)
+	res = catalogServiceToWorkloadEntry(in, conversion{})
 	if res.Address != in.Address {
 		t.Errorf("address must be %s but got %s", in.Address, res.Address)
 	}
 	if res.Ports["tcp"] != uint32(in.ServicePort) {
 		t.Errorf("port %d must be of name tcp", in.ServicePort)
 	}
+
+	// service address over node address
+	in = &api.CatalogService{Address: "192.0.2.10", ServiceAddress: "198.51.100.7", ServicePort: 8080}
+	res = catalogServiceToWorkloadEntry(in, conversion{})
+	if res.Address != in.ServiceAddress {
+		t.Errorf("address must be %s but got %s", in.ServiceAddress, res.Address)
+	}
+
+	// TLS settings from tags and meta, meta winning
+	in = &api.CatalogService{
+		Address:     "192.0.2.10",
+		ServiceTags: []string{"tls", "tls-sni=billing.tetrate.io"},
+		ServiceMeta: map[string]string{"tls": "mutual"},
+	}
+	res = catalogServiceToWorkloadEntry(in, conversion{})
+	want := map[string]string{infer.TLSModeLabel: "MUTUAL", infer.TLSSNILabel: "billing.tetrate.io"}
+	if !reflect.DeepEqual(res.Labels, want) {
+		t.Errorf("labels must be %v but got %v", want, res.Labels)
+	}
 }
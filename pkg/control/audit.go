@@ -0,0 +1,41 @@
+package control
+
+import (
+	"sync"
+	"time"
+)
+
+// auditLimit is the number of recent writes the synchronizer remembers
+const auditLimit = 256
+
+// AuditEntry records a write a sync made to a Service Entry, or failed to make
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action Action    `json:"action"`
+	Name   string    `json:"name"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// auditLog keeps the most recent entries, oldest first
+type auditLog struct {
+	m       sync.Mutex
+	entries []AuditEntry
+}
+
+func (a *auditLog) add(entries []AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.entries = append(a.entries, entries...)
+	if over := len(a.entries) - auditLimit; over > 0 {
+		a.entries = append([]AuditEntry(nil), a.entries[over:]...)
+	}
+}
+
+func (a *auditLog) list() []AuditEntry {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return append([]AuditEntry(nil), a.entries...)
+}
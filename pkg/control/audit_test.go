@@ -0,0 +1,20 @@
+package control
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var a auditLog
+	for i := 0; i < auditLimit+10; i++ {
+		a.add([]AuditEntry{{Action: Create, Name: fmt.Sprint(i)}})
+	}
+	got := a.list()
+	if len(got) != auditLimit {
+		t.Fatalf("kept %d entries, want %d", len(got), auditLimit)
+	}
+	if got[0].Name != "10" || got[len(got)-1].Name != fmt.Sprint(auditLimit+9) {
+		t.Errorf("kept entries %s to %s, want the most recent", got[0].Name, got[len(got)-1].Name)
+	}
+}
@@ -0,0 +1,104 @@
+package control
+
+import (
+	"reflect"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+// damper holds back changes to a host's endpoints until the change has been observed for a number of
+// consecutive cycles. Hosts whose endpoints revert to their last stable state before that happens are
+// flapping; the stable state is kept and the flap is counted.
+type damper struct {
+	cycles  int
+	prefix  string
+	stable  map[string][]*v1alpha3.WorkloadEntry // the state we last propagated, per host
+	pending map[string]*pendingChange            // changes that haven't persisted long enough yet, per host
+}
+
+type pendingChange struct {
+	workloadEntries []*v1alpha3.WorkloadEntry
+	present         bool // false if the pending change is the removal of the host
+	seen            int  // consecutive cycles the change has been observed for
+}
+
+func newDamper(cycles int, prefix string) *damper {
+	return &damper{
+		cycles:  cycles,
+		prefix:  prefix,
+		pending: make(map[string]*pendingChange),
+	}
+}
+
+// apply records the observed hosts for this cycle and returns the hosts that should be propagated
+func (d *damper) apply(observed map[string][]*v1alpha3.WorkloadEntry) map[string][]*v1alpha3.WorkloadEntry {
+	// The first observation has nothing to be damped against
+	if d.stable == nil {
+		d.stable = copyHosts(observed)
+		return copyHosts(d.stable)
+	}
+
+	for host, wes := range observed {
+		d.observe(host, wes, true)
+	}
+	for host := range d.stable {
+		if _, ok := observed[host]; !ok {
+			d.observe(host, nil, false)
+		}
+	}
+	// Hosts that appeared and vanished again before persisting are neither stable nor observed
+	for host := range d.pending {
+		_, isStable := d.stable[host]
+		_, isObserved := observed[host]
+		if !isStable && !isObserved {
+			d.flapped(host)
+		}
+	}
+
+	metrics.DampedHosts.WithLabelValues(d.prefix).Set(float64(len(d.pending)))
+	return copyHosts(d.stable)
+}
+
+func (d *damper) observe(host string, wes []*v1alpha3.WorkloadEntry, present bool) {
+	stable, isStable := d.stable[host]
+	if isStable == present && (!present || reflect.DeepEqual(stable, wes)) {
+		// Back at (or still at) the stable state; anything pending never persisted
+		if _, ok := d.pending[host]; ok {
+			d.flapped(host)
+		}
+		return
+	}
+
+	p, ok := d.pending[host]
+	if !ok || p.present != present || !reflect.DeepEqual(p.workloadEntries, wes) {
+		p = &pendingChange{workloadEntries: wes, present: present}
+		d.pending[host] = p
+	}
+	p.seen++
+	if p.seen < d.cycles {
+		return
+	}
+
+	delete(d.pending, host)
+	if present {
+		d.stable[host] = wes
+	} else {
+		delete(d.stable, host)
+	}
+}
+
+func (d *damper) flapped(host string) {
+	log.Warnf("host %q is flapping, holding its last stable state", host)
+	metrics.HostFlaps.WithLabelValues(d.prefix).Inc()
+	delete(d.pending, host)
+}
+
+func copyHosts(m map[string][]*v1alpha3.WorkloadEntry) map[string][]*v1alpha3.WorkloadEntry {
+	out := make(map[string][]*v1alpha3.WorkloadEntry, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package control
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+func TestDamper_apply(t *testing.T) {
+	changedWorkloadEntries := []*v1alpha3.WorkloadEntry{
+		{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}},
+	}
+	changedHosts := map[string][]*v1alpha3.WorkloadEntry{defaultHost: changedWorkloadEntries}
+	empty := map[string][]*v1alpha3.WorkloadEntry{}
+
+	tests := []struct {
+		name   string
+		cycles []map[string][]*v1alpha3.WorkloadEntry
+		want   map[string][]*v1alpha3.WorkloadEntry
+	}{
+		{
+			name:   "first observation is propagated immediately",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{defaultHosts},
+			want:   defaultHosts,
+		},
+		{
+			name:   "change is held until it persists",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{defaultHosts, changedHosts, changedHosts},
+			want:   defaultHosts,
+		},
+		{
+			name:   "change is propagated once it persists",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{defaultHosts, changedHosts, changedHosts, changedHosts},
+			want:   changedHosts,
+		},
+		{
+			name:   "flapping host keeps its stable state",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{defaultHosts, changedHosts, defaultHosts, changedHosts, changedHosts},
+			want:   defaultHosts,
+		},
+		{
+			name:   "removal is held until it persists",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{defaultHosts, empty, empty},
+			want:   defaultHosts,
+		},
+		{
+			name:   "removal is propagated once it persists",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{defaultHosts, empty, empty, empty},
+			want:   empty,
+		},
+		{
+			name:   "host appearing briefly is never propagated",
+			cycles: []map[string][]*v1alpha3.WorkloadEntry{empty, defaultHosts, empty, defaultHosts},
+			want:   empty,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDamper(3, "cloudmap-")
+			var got map[string][]*v1alpha3.WorkloadEntry
+			for _, hosts := range tt.cycles {
+				got = d.apply(hosts)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("damper.apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 // SEStore is a mock for stubbing out serviceentry store
 type SEStore struct {
 	Result map[string]*v1alpha3.ServiceEntry
+	Rev    uint64
 }
 
 // Classify is not implemented
@@ -17,6 +18,14 @@ func (s *SEStore) Classify(_ string) serviceentry.Owner {
 	return 0
 }
 
+// Lookup returns the entry for host in s.Result, as ours
+func (s *SEStore) Lookup(host string) (*v1alpha3.ServiceEntry, serviceentry.Owner) {
+	if se, ok := s.Result[host]; ok {
+		return se, serviceentry.Us
+	}
+	return nil, serviceentry.None
+}
+
 // Ours return s.Result
 func (s *SEStore) Ours() map[string]*v1alpha3.ServiceEntry {
 	return s.Result
@@ -45,3 +54,13 @@ func (s *SEStore) Delete(se *v1alpha3.ServiceEntry) error {
 func (s *SEStore) OwnerReference() v1.OwnerReference {
 	return v1.OwnerReference{}
 }
+
+// Revision returns s.Rev
+func (s *SEStore) Revision() uint64 {
+	return s.Rev
+}
+
+// Changes is not implemented, forcing full syncs
+func (s *SEStore) Changes(uint64) (map[string]struct{}, bool) {
+	return nil, false
+}
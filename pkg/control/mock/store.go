@@ -1,10 +1,20 @@
 package mock
 
-import "istio.io/api/networking/v1alpha3"
+import (
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
 
 // Store is a mock store
 type Store struct {
-	Result map[string][]*v1alpha3.WorkloadEntry
+	Result    map[string][]*v1alpha3.WorkloadEntry
+	Annotated map[string]map[string]string
+	LastSet   time.Time
+	Rev       uint64
+	Held      map[string]struct{}
 }
 
 // Hosts return s.Result
@@ -15,3 +25,37 @@ func (s *Store) Hosts() map[string][]*v1alpha3.WorkloadEntry {
 func (s *Store) Set(map[string][]*v1alpha3.WorkloadEntry) {
 	return
 }
+
+// Apply is not implemented
+func (s *Store) Apply(provider.Delta) {}
+
+// Annotations return s.Annotated
+func (s *Store) Annotations() map[string]map[string]string {
+	return s.Annotated
+}
+
+// Annotate is not implemented
+func (s *Store) Annotate(map[string]map[string]string) {}
+
+// Changes is not implemented, forcing full syncs
+func (s *Store) Changes(uint64) (map[string]struct{}, bool) {
+	return nil, false
+}
+
+// Revision returns s.Rev
+func (s *Store) Revision() uint64 {
+	return s.Rev
+}
+
+// Synced is not implemented
+func (s *Store) Synced() {}
+
+// LastSync returns s.LastSet
+func (s *Store) LastSync() time.Time {
+	return s.LastSet
+}
+
+// HeldBack returns s.Held
+func (s *Store) HeldBack() map[string]struct{} {
+	return s.Held
+}
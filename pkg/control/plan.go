@@ -0,0 +1,142 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+)
+
+// Action is the kind of write the synchronizer would make for a host
+type Action string
+
+const (
+	// Create means a new Service Entry would be created
+	Create Action = "create"
+	// Update means an existing Service Entry would be replaced
+	Update Action = "update"
+	// Delete means an existing Service Entry would be removed
+	Delete Action = "delete"
+)
+
+// Change describes a single Service Entry write
+type Change struct {
+	Action Action
+	Host   string
+	Name   string
+	// Old is the existing Service Entry; nil for creates
+	Old *ic.ServiceEntry
+	// New is the desired Service Entry; nil for deletes
+	New *ic.ServiceEntry
+}
+
+// Plan computes the changes the synchronizer would make to bring the Service Entries we own (ours) in line
+// with the provider's hosts. Hosts claimed by Service Entries owned by someone else (theirs) are left alone.
+func Plan(owner v1.OwnerReference, prefix string, hosts map[string][]*v1alpha3.WorkloadEntry,
+	ours, theirs map[string]*ic.ServiceEntry) []Change {
+	var changes []Change
+	for host, workloadEntries := range hosts {
+		if _, ok := theirs[host]; ok {
+			continue
+		}
+		desired := infer.ServiceEntry(owner, prefix, host, workloadEntries)
+		existing, ok := ours[host]
+		if !ok {
+			changes = append(changes, Change{Action: Create, Host: host, Name: desired.Name, New: desired})
+			continue
+		}
+		if reflect.DeepEqual(existing.Spec.Endpoints, workloadEntries) {
+			continue
+		}
+		changes = append(changes, Change{Action: Update, Host: host, Name: desired.Name, Old: existing, New: desired})
+	}
+	for host, existing := range ours {
+		if _, ok := hosts[host]; !ok {
+			changes = append(changes, Change{Action: Delete, Host: host, Name: existing.Name, Old: existing})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Host < changes[j].Host
+	})
+	return changes
+}
+
+// WritePlan prints changes as a human readable diff, one block per host followed by a summary line
+func WritePlan(w io.Writer, changes []Change) error {
+	counts := map[Action]int{}
+	var b strings.Builder
+	for _, c := range changes {
+		counts[c.Action]++
+		var old, desired []*v1alpha3.WorkloadEntry
+		if c.Old != nil {
+			old = c.Old.Spec.Endpoints
+		}
+		if c.New != nil {
+			desired = c.New.Spec.Endpoints
+		}
+		fmt.Fprintf(&b, "%s %s (host %q)\n", symbol(c.Action), c.Name, c.Host)
+		for _, line := range endpointDiff(old, desired) {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+	}
+	if len(changes) == 0 {
+		b.WriteString("No changes. Service Entries match the registry.\n")
+	} else {
+		fmt.Fprintf(&b, "\nPlan: %d to create, %d to update, %d to delete.\n", counts[Create], counts[Update], counts[Delete])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func symbol(a Action) string {
+	switch a {
+	case Create:
+		return "+"
+	case Delete:
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+// endpointDiff lists the endpoints removed from old and added in desired, sorted by endpoint
+func endpointDiff(old, desired []*v1alpha3.WorkloadEntry) []string {
+	before, after := map[string]bool{}, map[string]bool{}
+	for _, we := range old {
+		before[endpointString(we)] = true
+	}
+	for _, we := range desired {
+		after[endpointString(we)] = true
+	}
+	var lines []string
+	for e := range before {
+		if !after[e] {
+			lines = append(lines, "- "+e)
+		}
+	}
+	for e := range after {
+		if !before[e] {
+			lines = append(lines, "+ "+e)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i][2:] < lines[j][2:] || (lines[i][2:] == lines[j][2:] && lines[i] < lines[j])
+	})
+	return lines
+}
+
+func endpointString(we *v1alpha3.WorkloadEntry) string {
+	ports := make([]string, 0, len(we.Ports))
+	for name, port := range we.Ports {
+		ports = append(ports, fmt.Sprintf("%s:%d", name, port))
+	}
+	sort.Strings(ports)
+	return fmt.Sprintf("%s [%s]", we.Address, strings.Join(ports, " "))
+}
@@ -0,0 +1,102 @@
+package control
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPlan(t *testing.T) {
+	changedWorkloadEntries := []*v1alpha3.WorkloadEntry{
+		{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80, "https": 443}},
+	}
+	tests := []struct {
+		name           string
+		hosts          map[string][]*v1alpha3.WorkloadEntry
+		ours, theirs   map[string]*icapi.ServiceEntry
+		wantActions    []Action
+		wantHostsOrder []string
+	}{
+		{
+			name:  "No changes if identical service entry exists",
+			hosts: defaultHosts,
+			ours:  defaultServiceEntries,
+		},
+		{
+			name:           "Creates missing service entries",
+			hosts:          defaultHosts,
+			wantActions:    []Action{Create},
+			wantHostsOrder: []string{defaultHost},
+		},
+		{
+			name:           "Updates service entries whose endpoints changed",
+			hosts:          map[string][]*v1alpha3.WorkloadEntry{defaultHost: changedWorkloadEntries},
+			ours:           defaultServiceEntries,
+			wantActions:    []Action{Update},
+			wantHostsOrder: []string{defaultHost},
+		},
+		{
+			name:           "Deletes service entries for hosts no longer in the registry",
+			hosts:          map[string][]*v1alpha3.WorkloadEntry{"a.tetrate.io": defaultWorkloadEntries},
+			ours:           defaultServiceEntries,
+			wantActions:    []Action{Create, Delete},
+			wantHostsOrder: []string{"a.tetrate.io", defaultHost},
+		},
+		{
+			name:   "Leaves hosts owned by someone else alone",
+			hosts:  defaultHosts,
+			theirs: defaultServiceEntries,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := Plan(v1.OwnerReference{}, "cloudmap-", tt.hosts, tt.ours, tt.theirs)
+			var actions []Action
+			var hosts []string
+			for _, c := range changes {
+				actions = append(actions, c.Action)
+				hosts = append(hosts, c.Host)
+			}
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("Plan() actions = %v, want %v", actions, tt.wantActions)
+			}
+			if !reflect.DeepEqual(hosts, tt.wantHostsOrder) {
+				t.Errorf("Plan() hosts = %v, want %v", hosts, tt.wantHostsOrder)
+			}
+		})
+	}
+}
+
+func TestWritePlan(t *testing.T) {
+	changes := Plan(v1.OwnerReference{}, "cloudmap-",
+		map[string][]*v1alpha3.WorkloadEntry{defaultHost: {
+			{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}},
+		}},
+		defaultServiceEntries, nil)
+
+	var out bytes.Buffer
+	if err := WritePlan(&out, changes); err != nil {
+		t.Fatal(err)
+	}
+	want := `~ cloudmap-tetrate.io (host "tetrate.io")
+    + 1.1.1.1 [http:80]
+    - 8.8.8.8 [http:80 https:443]
+
+Plan: 0 to create, 1 to update, 0 to delete.
+`
+	if out.String() != want {
+		t.Errorf("WritePlan() =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := WritePlan(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "No changes. Service Entries match the registry.\n"; out.String() != want {
+		t.Errorf("WritePlan() = %q, want %q", out.String(), want)
+	}
+}
@@ -3,16 +3,18 @@ package control
 import (
 	"context"
 	"reflect"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
 	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
 	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
-	"github.com/tetratelabs/log"
 )
 
 type synchronizer struct {
@@ -22,11 +24,60 @@ type synchronizer struct {
 	serviceEntryPrefix string
 	client             icapi.ServiceEntryInterface
 	interval           time.Duration
+	damper             *damper
+	stalenessThreshold time.Duration
+	debounce, maxDelay time.Duration
+	m                  sync.Mutex // serializes syncs triggered by the ticker and on demand
+
+	// the provider store revision the ticker last observed, when it did, and when the first change it hasn't
+	// synced yet was observed; only used by Run
+	observed                 uint64
+	observedAt, pendingSince time.Time
+
+	// revisions of the provider and Service Entry stores at the last sync that left nothing to do, so the
+	// next sync only needs to reconcile the hosts either store changed since
+	settled                        bool
+	revision, serviceEntryRevision uint64
+
+	audit auditLog
+}
+
+// Option configures optional behaviour of the synchronizer
+type Option func(*synchronizer)
+
+// WithFlapDamping only propagates a change to a host's endpoints once it has been observed for the given
+// number of consecutive cycles. Values below 2 disable damping.
+func WithFlapDamping(cycles int) Option {
+	return func(s *synchronizer) {
+		if cycles > 1 {
+			s.damper = newDamper(cycles, s.serviceEntryPrefix)
+		}
+	}
+}
+
+// WithStalenessThreshold marks the synchronizer unready and suspends garbage collection while the provider
+// hasn't synced successfully for longer than threshold, so a dead watcher can't delete every Service Entry.
+// A zero threshold disables the check.
+func WithStalenessThreshold(threshold time.Duration) Option {
+	return func(s *synchronizer) {
+		s.stalenessThreshold = threshold
+	}
+}
+
+// WithDebounce holds periodic syncs back while the provider's store keeps changing, until it has been quiet for
+// window, so a burst of changes such as a rolling deploy re-registering its instances is published in one
+// reconcile. Changes are never held back longer than maxDelay, unless it is zero. Syncs requested with Sync
+// aren't held back, and a zero window disables debouncing.
+func WithDebounce(window, maxDelay time.Duration) Option {
+	return func(s *synchronizer) {
+		s.debounce, s.maxDelay = window, maxDelay
+	}
 }
 
 func NewSynchronizer(owner v1.OwnerReference,
-	serviceEntry serviceentry.Store, store provider.Store, serviceEntryPrefix string, client icapi.ServiceEntryInterface) *synchronizer {
-	return &synchronizer{
+	serviceEntry serviceentry.Store, store provider.Store, serviceEntryPrefix string, client icapi.ServiceEntryInterface,
+	opts ...Option) *synchronizer {
+	s := &synchronizer{
 		owner:              owner,
 		serviceEntry:       serviceEntry,
 		store:              store,
@@ -34,6 +85,10 @@ func NewSynchronizer(owner v1.OwnerReference,
 		client:             client,
 		interval:           time.Second * 5,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Run the synchronizer until the context is cancelled
@@ -44,69 +99,265 @@ func (s *synchronizer) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			s.sync(ctx)
+			if s.debounced(time.Now()) {
+				continue
+			}
+			s.Sync(ctx)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (s *synchronizer) sync(ctx context.Context) {
+// debounced returns whether the provider's store changed within the debounce window at now, and the periodic
+// sync should wait for it to settle
+func (s *synchronizer) debounced(now time.Time) bool {
+	if s.debounce <= 0 {
+		return false
+	}
+	if revision := s.store.Revision(); revision != s.observed {
+		s.observed, s.observedAt = revision, now
+		if s.pendingSince.IsZero() {
+			s.pendingSince = now
+		}
+	}
+	if s.pendingSince.IsZero() {
+		return false
+	}
+	if now.Sub(s.observedAt) < s.debounce && (s.maxDelay <= 0 || now.Sub(s.pendingSince) < s.maxDelay) {
+		log.Debugf("holding back the sync of %q while its provider keeps changing", s.serviceEntryPrefix)
+		return true
+	}
+	s.pendingSince = time.Time{}
+	return false
+}
+
+// Result summarizes the changes a sync applied to the Service Entries, by name
+type Result struct {
+	Created, Updated, Deleted []string
+	Errors                    []error
+
+	audit []AuditEntry
+}
+
+// Changed returns whether the sync changed any Service Entry
+func (r Result) Changed() bool {
+	return len(r.Created)+len(r.Updated)+len(r.Deleted) > 0
+}
+
+func (r *Result) record(action Action, name string, err error) {
+	entry := AuditEntry{Time: time.Now(), Action: action, Name: name}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	r.audit = append(r.audit, entry)
+	if err != nil {
+		r.Errors = append(r.Errors, err)
+		return
+	}
+	switch action {
+	case Create:
+		r.Created = append(r.Created, name)
+	case Update:
+		r.Updated = append(r.Updated, name)
+	case Delete:
+		r.Deleted = append(r.Deleted, name)
+	}
+}
+
+// Sync reconciles the Service Entries with the provider's hosts immediately
+func (s *synchronizer) Sync(ctx context.Context) Result {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.sync(ctx)
+}
+
+func (s *synchronizer) sync(ctx context.Context) Result {
+	revision, serviceEntryRevision := s.store.Revision(), s.serviceEntry.Revision()
+	// The damper has to observe every host every cycle, so it always needs a full sync
+	if s.settled && s.damper == nil {
+		if changed, ok := s.changes(); ok {
+			res, collected := s.reconcile(ctx, changed)
+			s.settle(res, collected, revision, serviceEntryRevision)
+			return res
+		}
+	}
+
 	// Entries are generated per host; entirely from information in the slice of workload entries;
 	// so we only actually need to compare the current workload entries with the new workload entries.
-	for host, workloadEntries := range s.store.Hosts() {
+	var res Result
+	hosts := s.store.Hosts()
+	if s.damper != nil {
+		hosts = s.damper.apply(hosts)
+	}
+	annotations := s.store.Annotations()
+	ours, theirs := s.serviceEntry.Ours(), s.serviceEntry.Theirs()
+	for host, workloadEntries := range hosts {
 		// If a service entry with the same host has been created by someone else, continue.
-		if _, ok := s.serviceEntry.Theirs()[host]; ok {
+		if _, ok := theirs[host]; ok {
 			continue
 		}
-		s.createOrUpdate(ctx, host, workloadEntries)
+		s.createOrUpdate(ctx, host, workloadEntries, annotations[host], ours[host], &res)
 	}
-	s.garbageCollect(ctx)
+	collected := s.garbageCollect(ctx, hosts, ours, &res)
+	s.settle(res, collected, revision, serviceEntryRevision)
+	return res
 }
 
-func (s *synchronizer) createOrUpdate(ctx context.Context, host string, workloadEntries []*v1alpha3.WorkloadEntry) {
-	newServiceEntry := infer.ServiceEntry(s.owner, s.serviceEntryPrefix, host, workloadEntries)
+// changes returns the hosts either store changed since the last settled sync, or false if they don't know
+func (s *synchronizer) changes() (map[string]struct{}, bool) {
+	changed, ok := s.store.Changes(s.revision)
+	if !ok {
+		return nil, false
+	}
+	// our own writes come back as Service Entry changes, and are cheap to confirm
+	entries, ok := s.serviceEntry.Changes(s.serviceEntryRevision)
+	if !ok {
+		return nil, false
+	}
+	for host := range entries {
+		changed[host] = struct{}{}
+	}
+	return changed, true
+}
+
+// reconcile brings the Service Entries of just the changed hosts in line with the provider, returning false
+// if garbage collection was suspended
+func (s *synchronizer) reconcile(ctx context.Context, changed map[string]struct{}) (Result, bool) {
+	var res Result
+	if len(changed) == 0 {
+		log.Debugf("nothing changed for %q since revision %d", s.serviceEntryPrefix, s.revision)
+		return res, true
+	}
+	log.Debugf("reconciling %d changed hosts for %q", len(changed), s.serviceEntryPrefix)
+	hosts, annotations := s.store.Hosts(), s.store.Annotations()
+	ready, held := s.Ready(), s.store.HeldBack()
+	for host := range changed {
+		existing, owner := s.serviceEntry.Lookup(host)
+		if owner == serviceentry.Them {
+			continue
+		}
+		if owner != serviceentry.Us {
+			existing = nil
+		}
+		if workloadEntries, ok := hosts[host]; ok {
+			s.createOrUpdate(ctx, host, workloadEntries, annotations[host], existing, &res)
+			continue
+		}
+		if _, ok := held[host]; existing == nil || ok {
+			continue
+		}
+		if ready != nil {
+			log.Warnf("suspending garbage collection: %v", ready)
+			return res, false
+		}
+		s.delete(ctx, host, &res)
+	}
+	return res, true
+}
+
+// settle records the store revisions a sync brought the Service Entries up to, if it left nothing to retry
+func (s *synchronizer) settle(res Result, collected bool, revision, serviceEntryRevision uint64) {
+	s.audit.add(res.audit)
+	// Failed calls, suspended garbage collection and pending damped changes all need another full sync
+	s.settled = collected && len(res.Errors) == 0 && (s.damper == nil || len(s.damper.pending) == 0)
+	s.revision, s.serviceEntryRevision = revision, serviceEntryRevision
+}
+
+// createOrUpdate makes the Service Entry for host match workloadEntries and annotations; existing is our current entry,
+// if any
+func (s *synchronizer) createOrUpdate(ctx context.Context, host string, workloadEntries []*v1alpha3.WorkloadEntry,
+	annotations map[string]string, existing *ic.ServiceEntry, res *Result) {
 	name := infer.ServiceEntryName(s.serviceEntryPrefix, host)
-	if _, ok := s.serviceEntry.Ours()[host]; ok {
+	if existing != nil {
 		// If we have already created an identical service entry, return.
-		if reflect.DeepEqual(s.serviceEntry.Ours()[host].Spec.Endpoints, workloadEntries) {
+		if reflect.DeepEqual(existing.Spec.Endpoints, workloadEntries) &&
+			infer.SameAnnotations(existing.Annotations, annotations) {
 			return
 		}
 		// Otherwise, workloadEntries have changed so update existing Service Entry
-		n := infer.ServiceEntryName(s.serviceEntryPrefix, host)
-		oldServiceEntry, err := s.client.Get(ctx, n, v1.GetOptions{})
+		oldServiceEntry, err := s.client.Get(ctx, name, v1.GetOptions{})
 		if err != nil {
-			log.Errorf("failed to get existing service entry %q for host %q", n, host)
+			log.Errorf("failed to get existing service entry %q for host %q", name, host)
+			res.record(Update, name, errors.Wrapf(err, "failed to get Service Entry %q", name))
 			return
 		}
+		newServiceEntry := infer.ServiceEntry(s.owner, s.serviceEntryPrefix, host, workloadEntries)
+		infer.Annotate(newServiceEntry, annotations)
 		newServiceEntry.ResourceVersion = oldServiceEntry.ResourceVersion
 		rv, err := s.client.Update(ctx, newServiceEntry, v1.UpdateOptions{})
 		if err != nil {
 			log.Errorf("error updating Service Entry %q: %v", name, err)
+			res.record(Update, name, errors.Wrapf(err, "failed to update Service Entry %q", name))
 			return
 		}
 		log.Infof("updated Service Entry %q, ResourceVersion is now %q", name, rv.ResourceVersion)
+		res.record(Update, name, nil)
 		return
 	}
 	// Otherwise, create a new Service Entry
+	newServiceEntry := infer.ServiceEntry(s.owner, s.serviceEntryPrefix, host, workloadEntries)
+	infer.Annotate(newServiceEntry, annotations)
 	rv, err := s.client.Create(ctx, newServiceEntry, v1.CreateOptions{})
 	if err != nil {
 		log.Errorf("error creating Service Entry %q: %v\n%v", name, err, newServiceEntry)
+		res.record(Create, name, errors.Wrapf(err, "failed to create Service Entry %q", name))
+		return
 	}
 	log.Infof("created Service Entry %q, ResourceVersion is %q", name, rv.ResourceVersion)
+	res.record(Create, name, nil)
+}
+
+// Audit returns the most recent writes to the Service Entries, oldest first
+func (s *synchronizer) Audit() []AuditEntry {
+	return s.audit.list()
 }
 
-func (s *synchronizer) garbageCollect(ctx context.Context) {
-	for host := range s.serviceEntry.Ours() {
-		// If host no longer exists, delete service entry
-		if _, ok := s.store.Hosts()[host]; !ok {
-			// TODO: namespaces!
-			// TODO: Don't attempt to delete no owners
-			name := infer.ServiceEntryName(s.serviceEntryPrefix, host)
-			if err := s.client.Delete(ctx, name, v1.DeleteOptions{}); err != nil {
-				log.Errorf("error deleting Service Entry %q: %v", name, err)
+// Ready returns an error if the provider's data is too stale to be trusted
+func (s *synchronizer) Ready() error {
+	if s.stalenessThreshold <= 0 {
+		return nil
+	}
+	last := s.store.LastSync()
+	if last.IsZero() {
+		return errors.Errorf("provider %q has not synced yet", s.serviceEntryPrefix)
+	}
+	if since := time.Since(last); since > s.stalenessThreshold {
+		return errors.Errorf("provider %q last synced %v ago, exceeding the staleness threshold of %v",
+			s.serviceEntryPrefix, since.Round(time.Second), s.stalenessThreshold)
+	}
+	return nil
+}
+
+// garbageCollect deletes our Service Entries for hosts that no longer exist, returning false if it was suspended
+func (s *synchronizer) garbageCollect(ctx context.Context, hosts map[string][]*v1alpha3.WorkloadEntry,
+	ours map[string]*ic.ServiceEntry, res *Result) bool {
+	if err := s.Ready(); err != nil {
+		log.Warnf("suspending garbage collection: %v", err)
+		return false
+	}
+	held := s.store.HeldBack()
+	for host := range ours {
+		// If host no longer exists, delete service entry; hosts the budget holds back still exist
+		if _, ok := hosts[host]; !ok {
+			if _, ok := held[host]; ok {
+				continue
 			}
-			log.Infof("successfully deleted Service Entry %q", name)
+			s.delete(ctx, host, res)
 		}
 	}
+	return true
+}
+
+func (s *synchronizer) delete(ctx context.Context, host string, res *Result) {
+	// TODO: namespaces!
+	// TODO: Don't attempt to delete no owners
+	name := infer.ServiceEntryName(s.serviceEntryPrefix, host)
+	if err := s.client.Delete(ctx, name, v1.DeleteOptions{}); err != nil {
+		log.Errorf("error deleting Service Entry %q: %v", name, err)
+		res.record(Delete, name, errors.Wrapf(err, "failed to delete Service Entry %q", name))
+		return
+	}
+	log.Infof("successfully deleted Service Entry %q", name)
+	res.record(Delete, name, nil)
 }
@@ -2,7 +2,9 @@ package control
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"istio.io/api/meta/v1alpha1"
 	"istio.io/api/networking/v1alpha3"
@@ -12,6 +14,8 @@ import (
 
 	"github.com/tetratelabs/istio-registry-sync/pkg/control/mock"
 	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
 )
 
 var defaultHost = "tetrate.io"
@@ -53,6 +57,8 @@ func TestSynchronizer_garbageCollect(t *testing.T) {
 		wantNamespace  string
 		cloudMapHosts  map[string][]*v1alpha3.WorkloadEntry
 		serviceEntries map[string]*icapi.ServiceEntry
+		threshold      time.Duration
+		lastSync       time.Time
 	}{
 		{
 			name:           "Deletes Service Entry if host is no longer in Cloud Map",
@@ -68,18 +74,117 @@ func TestSynchronizer_garbageCollect(t *testing.T) {
 			serviceEntries: defaultServiceEntries,
 			cloudMapHosts:  defaultHosts,
 		},
+		{
+			name:           "Keeps Service Entry if the provider is stale",
+			deleteCall:     false,
+			serviceEntries: defaultServiceEntries,
+			cloudMapHosts:  map[string][]*v1alpha3.WorkloadEntry{},
+			threshold:      time.Minute,
+			lastSync:       time.Now().Add(-time.Hour),
+		},
+		{
+			name:           "Deletes Service Entry if the provider is fresh",
+			deleteCall:     true,
+			serviceEntries: defaultServiceEntries,
+			cloudMapHosts:  map[string][]*v1alpha3.WorkloadEntry{},
+			threshold:      time.Minute,
+			lastSync:       time.Now(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &synchronizer{
-				store:        &mock.Store{Result: tt.cloudMapHosts},
-				serviceEntry: &mock.SEStore{Result: tt.serviceEntries},
-				client:       &mockIstio{store: make(map[string]*icapi.ServiceEntry)},
+				store:              &mock.Store{Result: tt.cloudMapHosts, LastSet: tt.lastSync},
+				serviceEntry:       &mock.SEStore{Result: tt.serviceEntries},
+				client:             &mockIstio{store: make(map[string]*icapi.ServiceEntry)},
+				stalenessThreshold: tt.threshold,
 			}
-			s.garbageCollect(context.Background())
+			var res Result
+			s.garbageCollect(context.Background(), tt.cloudMapHosts, tt.serviceEntries, &res)
 			if s.client.(*mockIstio).DeleteCall != tt.deleteCall {
 				t.Errorf("Delete called = %v, want %v", s.client.(*mockIstio).DeleteCall, tt.deleteCall)
 			}
+			if res.Changed() != tt.deleteCall {
+				t.Errorf("Result.Changed() = %v, want %v", res.Changed(), tt.deleteCall)
+			}
+		})
+	}
+}
+
+func TestSynchronizer_Ready(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		lastSync  time.Time
+		wantErr   bool
+	}{
+		{name: "ready without a threshold", lastSync: time.Time{}},
+		{name: "not ready before the first sync", threshold: time.Minute, lastSync: time.Time{}, wantErr: true},
+		{name: "not ready when stale", threshold: time.Minute, lastSync: time.Now().Add(-time.Hour), wantErr: true},
+		{name: "ready when fresh", threshold: time.Minute, lastSync: time.Now()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &synchronizer{store: &mock.Store{LastSet: tt.lastSync}, stalenessThreshold: tt.threshold}
+			if err := s.Ready(); (err != nil) != tt.wantErr {
+				t.Errorf("Ready() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSynchronizer_debounced(t *testing.T) {
+	type tick struct {
+		at      time.Duration // since the start
+		change  bool          // whether the store changed since the last tick
+		holding bool
+	}
+	tests := []struct {
+		name     string
+		window   time.Duration
+		maxDelay time.Duration
+		ticks    []tick
+	}{
+		{
+			name:  "disabled",
+			ticks: []tick{{at: 0, change: true}, {at: 5 * time.Second, change: true}},
+		},
+		{
+			name:   "holds back a burst until it settles",
+			window: 10 * time.Second, maxDelay: time.Minute,
+			ticks: []tick{
+				{at: 0, change: true, holding: true},
+				{at: 5 * time.Second, change: true, holding: true},
+				{at: 10 * time.Second, holding: true},
+				{at: 15 * time.Second},
+				{at: 20 * time.Second},
+			},
+		},
+		{
+			name:   "publishes a burst lasting longer than the maximum delay",
+			window: 10 * time.Second, maxDelay: 15 * time.Second,
+			ticks: []tick{
+				{at: 0, change: true, holding: true},
+				{at: 5 * time.Second, change: true, holding: true},
+				{at: 10 * time.Second, change: true, holding: true},
+				{at: 15 * time.Second, change: true},
+				{at: 20 * time.Second, change: true, holding: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			s := &synchronizer{store: store, debounce: tt.window, maxDelay: tt.maxDelay}
+			start := time.Now()
+			for i, tick := range tt.ticks {
+				if tick.change {
+					store.Set(map[string][]*v1alpha3.WorkloadEntry{defaultHost: {infer.WorkloadEntry(fmt.Sprintf("10.0.0.%d", i), 80)}})
+				}
+				if got := s.debounced(start.Add(tick.at)); got != tick.holding {
+					t.Errorf("debounced() at %v = %v, want %v", tick.at, got, tick.holding)
+				}
+			}
 		})
 	}
 }
@@ -92,6 +197,7 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 		cloudMapHosts                   map[string][]*v1alpha3.WorkloadEntry
 		serviceEntries                  map[string]*icapi.ServiceEntry
 		workloadEntries                 []*v1alpha3.WorkloadEntry
+		annotations                     map[string]string
 	}{
 		{
 			name:            "Does nothing if identical service entry exists",
@@ -127,6 +233,16 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 			serviceEntries:  defaultServiceEntries,
 			workloadEntries: []*v1alpha3.WorkloadEntry{},
 		},
+		{
+			name:            "Updates Service Entry if the provider annotates it",
+			getCall:         true,
+			updateCall:      true,
+			host:            defaultHost,
+			cloudMapHosts:   defaultHosts,
+			serviceEntries:  defaultServiceEntries,
+			workloadEntries: defaultWorkloadEntries,
+			annotations:     map[string]string{"cloudmap.istio-registry-sync.tetrate.io/description": "web"},
+		},
 		{
 			name:            "Creates a new Service Entry if on doesn't exist",
 			createCall:      true,
@@ -144,7 +260,11 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 				serviceEntry: &mock.SEStore{Result: tt.serviceEntries},
 				client:       &mockIstio{store: make(map[string]*icapi.ServiceEntry)},
 			}
-			s.createOrUpdate(ctx, tt.host, tt.workloadEntries)
+			var res Result
+			s.createOrUpdate(ctx, tt.host, tt.workloadEntries, tt.annotations, tt.serviceEntries[tt.host], &res)
+			if len(res.Created) > 0 != tt.createCall || len(res.Updated) > 0 != tt.updateCall {
+				t.Errorf("Result = %+v, want created %v and updated %v", res, tt.createCall, tt.updateCall)
+			}
 			if s.client.(*mockIstio).UpdateCall != tt.updateCall {
 				t.Errorf("Update called = %v, want %v", s.client.(*mockIstio).UpdateCall, tt.createCall)
 			}
@@ -158,6 +278,85 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 	}
 }
 
+func TestSynchronizer_reconcilesChanges(t *testing.T) {
+	store := provider.NewStore()
+	store.Set(defaultHosts)
+	serviceEntries := serviceentry.New(v1.OwnerReference{})
+	istio := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{store: store, serviceEntry: serviceEntries, client: istio}
+	changedHost := &v1alpha3.WorkloadEntry{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}}
+
+	steps := []struct {
+		name                   string
+		change                 func()
+		wantCreate, wantUpdate bool
+	}{
+		{name: "first sync", change: func() {}, wantCreate: true},
+		{name: "nothing changed", change: func() {}},
+		{
+			name: "provider added a host",
+			change: func() {
+				store.Apply(provider.Delta{Updated: map[string][]*v1alpha3.WorkloadEntry{"istio.io": {changedHost}}})
+			},
+			wantCreate: true,
+		},
+		{
+			name:       "Service Entry changed",
+			change:     func() { _ = serviceEntries.Insert(defaultServiceEntries[defaultHost]) },
+			wantUpdate: false,
+		},
+		{
+			name: "provider changed an existing host",
+			change: func() {
+				store.Apply(provider.Delta{Updated: map[string][]*v1alpha3.WorkloadEntry{defaultHost: {changedHost}}})
+			},
+			wantUpdate: true,
+		},
+	}
+	for _, step := range steps {
+		istio.CreateCall, istio.UpdateCall = false, false
+		step.change()
+		s.Sync(context.TODO())
+		if istio.CreateCall != step.wantCreate || istio.UpdateCall != step.wantUpdate {
+			t.Errorf("%s: Create called = %v, Update called = %v, want %v and %v",
+				step.name, istio.CreateCall, istio.UpdateCall, step.wantCreate, step.wantUpdate)
+		}
+	}
+}
+
+func TestSynchronizer_keepsHostsHeldBackAfterRestart(t *testing.T) {
+	// before the restart both hosts fit; after it, the store is empty and the budget only admits a.example
+	store := provider.NewStore(provider.WithBudget(provider.NewBudget("test", 1)))
+	store.Set(map[string][]*v1alpha3.WorkloadEntry{"a.example": defaultWorkloadEntries[:1], defaultHost: defaultWorkloadEntries})
+	if held := store.HeldBack(); len(held) != 1 {
+		t.Fatalf("HeldBack() = %v, want %s", held, defaultHost)
+	}
+	// every run gets a new UID
+	previous := v1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "istio-registry-sync", UID: "previous"}
+	ref := previous
+	ref.UID = "restarted"
+	serviceEntries := serviceentry.New(ref)
+	published := defaultServiceEntries[defaultHost].DeepCopy()
+	published.OwnerReferences = []v1.OwnerReference{previous}
+	_ = serviceEntries.Insert(published)
+	istio := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{store: store, serviceEntry: serviceEntries, client: istio, owner: ref}
+
+	s.Sync(context.TODO())
+	if !istio.CreateCall {
+		t.Errorf("Create called = false, want a.example created")
+	}
+	if istio.DeleteCall {
+		t.Errorf("Delete called = true, want the Service Entry of %s kept while the budget holds it back", defaultHost)
+	}
+
+	store.Apply(provider.Delta{Updated: map[string][]*v1alpha3.WorkloadEntry{defaultHost: defaultWorkloadEntries}})
+	s.Sync(context.TODO())
+	if istio.DeleteCall {
+		t.Errorf("Delete called = true after a change, want the Service Entry of %s kept", defaultHost)
+	}
+}
+
 type mockIstio struct {
 	ic.ServiceEntryInterface
 
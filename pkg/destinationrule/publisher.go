@@ -0,0 +1,128 @@
+// Package destinationrule publishes the TLS settings providers advertise for their hosts as DestinationRules, so
+// that upstreams speaking TLS or mutual TLS don't need hand-written ones
+package destinationrule
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+// Option configures optional behaviour of the publisher
+type Option func(*publisher)
+
+// WithStalenessThreshold suspends deleting DestinationRules while the store hasn't synced successfully for longer
+// than d
+func WithStalenessThreshold(d time.Duration) Option {
+	return func(p *publisher) {
+		p.StalenessThreshold = d
+	}
+}
+
+type publisher struct {
+	*publish.Publisher[*ic.DestinationRule]
+}
+
+// NewPublisher returns a publisher keeping a DestinationRule, named and owned like its ServiceEntry, for every host
+// in store whose endpoints carry TLS settings. client must be scoped to the namespace ServiceEntries are published to.
+func NewPublisher(owner v1.OwnerReference, store provider.Store, prefix string, client icapi.DestinationRuleInterface,
+	opts ...Option) *publisher {
+	p := &publisher{&publish.Publisher[*ic.DestinationRule]{
+		Resources: publish.Resources[*ic.DestinationRule]{
+			Kind:   "DestinationRule",
+			Plural: "DestinationRules",
+			List: func(ctx context.Context) ([]*ic.DestinationRule, error) {
+				list, err := client.List(ctx, v1.ListOptions{})
+				if err != nil {
+					return nil, err
+				}
+				return list.Items, nil
+			},
+			Get: func(ctx context.Context, desired *ic.DestinationRule) (*ic.DestinationRule, error) {
+				return client.Get(ctx, desired.Name, v1.GetOptions{})
+			},
+			Equal: func(existing, desired *ic.DestinationRule) bool {
+				return existing.Spec.Host == desired.Spec.Host && existing.Spec.TrafficPolicy != nil &&
+					proto.Equal(existing.Spec.TrafficPolicy.Tls, desired.Spec.TrafficPolicy.Tls)
+			},
+			Create: func(ctx context.Context, desired *ic.DestinationRule) error {
+				_, err := client.Create(ctx, desired, v1.CreateOptions{})
+				return err
+			},
+			Update: func(ctx context.Context, existing, desired *ic.DestinationRule) error {
+				updated := existing.DeepCopy()
+				updated.Spec.Host = desired.Spec.Host
+				if updated.Spec.TrafficPolicy == nil {
+					updated.Spec.TrafficPolicy = &v1alpha3.TrafficPolicy{}
+				}
+				updated.Spec.TrafficPolicy.Tls = desired.Spec.TrafficPolicy.Tls
+				_, err := client.Update(ctx, updated, v1.UpdateOptions{})
+				return err
+			},
+			Delete: func(ctx context.Context, existing *ic.DestinationRule) error {
+				return client.Delete(ctx, existing.Name, v1.DeleteOptions{})
+			},
+		},
+		Owner:  owner,
+		Store:  store,
+		Prefix: prefix,
+		// hosts without TLS settings have none
+		Render: func(host string, wes []*v1alpha3.WorkloadEntry) (*ic.DestinationRule, bool, error) {
+			tls := Settings(host, wes)
+			if tls == nil {
+				return nil, false, nil
+			}
+			return destinationRule(owner, infer.ServiceEntryName(prefix, host), host, tls), true, nil
+		},
+		Interval: 5 * time.Second,
+		Log:      log,
+	}}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func destinationRule(owner v1.OwnerReference, name, host string, tls *v1alpha3.ClientTLSSettings) *ic.DestinationRule {
+	return &ic.DestinationRule{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: []v1.OwnerReference{owner},
+		},
+		Spec: v1alpha3.DestinationRule{
+			Host:          host,
+			TrafficPolicy: &v1alpha3.TrafficPolicy{Tls: tls},
+		},
+	}
+}
+
+// Settings returns the TLS settings of the host's endpoints, or nil if none has any. A DestinationRule applies to
+// every endpoint of its host, so if endpoints disagree those of the lowest address win.
+func Settings(host string, wes []*v1alpha3.WorkloadEntry) *v1alpha3.ClientTLSSettings {
+	var tls *v1alpha3.ClientTLSSettings
+	var address string
+	for _, we := range wes {
+		if s := infer.TLSSettings(we.Labels); s != nil && (tls == nil || we.Address < address) {
+			tls, address = s, we.Address
+		}
+	}
+	if tls == nil {
+		return nil
+	}
+	for _, we := range wes {
+		if !proto.Equal(infer.TLSSettings(we.Labels), tls) {
+			log.Warnf("endpoints of host %q disagree on TLS, publishing the settings of %s: %v", host, address, tls)
+			break
+		}
+	}
+	return tls
+}
@@ -0,0 +1,120 @@
+package destinationrule
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+var owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: "us"}
+
+func endpoint(address string, labels map[string]string) *v1alpha3.WorkloadEntry {
+	we := infer.WorkloadEntry(address, 443)
+	we.Labels = labels
+	return we
+}
+
+var (
+	simple = map[string]string{infer.TLSModeLabel: "SIMPLE", infer.TLSSNILabel: "a.tetrate.io"}
+	mutual = map[string]string{infer.TLSModeLabel: "MUTUAL", infer.TLSCredentialNameLabel: "client"}
+)
+
+func TestSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		wes  []*v1alpha3.WorkloadEntry
+		want *v1alpha3.ClientTLSSettings
+	}{
+		{name: "no endpoints"},
+		{name: "no TLS", wes: []*v1alpha3.WorkloadEntry{endpoint("10.0.0.1", nil)}},
+		{
+			name: "TLS",
+			wes:  []*v1alpha3.WorkloadEntry{endpoint("10.0.0.1", simple), endpoint("10.0.0.2", simple)},
+			want: &v1alpha3.ClientTLSSettings{Mode: v1alpha3.ClientTLSSettings_SIMPLE, Sni: "a.tetrate.io"},
+		},
+		{
+			name: "the lowest address with TLS wins disagreements",
+			wes:  []*v1alpha3.WorkloadEntry{endpoint("10.0.0.3", simple), endpoint("10.0.0.1", nil), endpoint("10.0.0.2", mutual)},
+			want: &v1alpha3.ClientTLSSettings{Mode: v1alpha3.ClientTLSSettings_MUTUAL, CredentialName: "client"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Settings("a.tetrate.io", tt.wes); !proto.Equal(got, tt.want) {
+				t.Errorf("Settings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisher_Sync(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	destinationRules := client.NetworkingV1alpha3().DestinationRules("default")
+	store := provider.NewStore()
+	p := NewPublisher(owner, store, "cloudmap-", destinationRules)
+
+	steps := []struct {
+		name    string
+		restart bool // with a new UID, as every run gets
+		hosts   map[string][]*v1alpha3.WorkloadEntry
+		want    map[string]string // TLS mode by DestinationRule name
+	}{
+		{
+			name: "creates DestinationRules for TLS hosts only",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {endpoint("10.0.0.1", simple)},
+				"b.tetrate.io": {endpoint("10.0.0.2", mutual)},
+				"c.tetrate.io": {endpoint("10.0.0.3", nil)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "SIMPLE", "cloudmap-b.tetrate.io": "MUTUAL"},
+		},
+		{
+			name: "updates changed settings and deletes those of hosts without TLS",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {endpoint("10.0.0.1", mutual)},
+				"b.tetrate.io": {endpoint("10.0.0.2", nil)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "MUTUAL"},
+		},
+		{
+			name:    "takes over the DestinationRules of the previous run after a restart",
+			restart: true,
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {endpoint("10.0.0.1", simple)},
+				"c.tetrate.io": {endpoint("10.0.0.3", mutual)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "SIMPLE", "cloudmap-c.tetrate.io": "MUTUAL"},
+		},
+	}
+	for _, step := range steps {
+		if step.restart {
+			restarted := owner
+			restarted.UID = "us, restarted"
+			store = provider.NewStore()
+			p = NewPublisher(restarted, store, "cloudmap-", destinationRules)
+		}
+		store.Set(step.hosts)
+		if err := p.Sync(context.TODO()); err != nil {
+			t.Fatalf("%s: Sync() error = %v", step.name, err)
+		}
+		list, err := destinationRules.List(context.TODO(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, dr := range list.Items {
+			got[dr.Name] = dr.Spec.TrafficPolicy.Tls.Mode.String()
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+}
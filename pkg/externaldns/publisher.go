@@ -0,0 +1,157 @@
+// Package externaldns publishes a provider's hosts as ExternalDNS DNSEndpoint resources, so ExternalDNS can make
+// them resolvable from cluster or corporate DNS alongside the ServiceEntries that route them in the mesh.
+package externaldns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+// Resource is the DNSEndpoint resource of ExternalDNS's CRD source
+var Resource = schema.GroupVersionResource{Group: "externaldns.k8s.io", Version: "v1alpha1", Resource: "dnsendpoints"}
+
+const kind = "DNSEndpoint"
+
+// Option configures optional behaviour of the publisher
+type Option func(*publisher)
+
+// WithTTL sets the TTL of the published records, in seconds. Zero leaves it to the DNS provider's default.
+func WithTTL(seconds int64) Option {
+	return func(p *publisher) {
+		p.ttl = seconds
+	}
+}
+
+// WithStalenessThreshold suspends deleting DNSEndpoints while the store hasn't synced successfully for longer than d
+func WithStalenessThreshold(d time.Duration) Option {
+	return func(p *publisher) {
+		p.StalenessThreshold = d
+	}
+}
+
+type publisher struct {
+	*publish.Publisher[*unstructured.Unstructured]
+	ttl int64
+}
+
+// NewPublisher returns a publisher keeping a DNSEndpoint, named and owned like its ServiceEntry, for every host
+// in store. client must be scoped to the namespace the DNSEndpoints are published to.
+func NewPublisher(owner v1.OwnerReference, store provider.Store, prefix string, client dynamic.ResourceInterface,
+	opts ...Option) *publisher {
+	p := &publisher{}
+	p.Publisher = &publish.Publisher[*unstructured.Unstructured]{
+		Resources: publish.Resources[*unstructured.Unstructured]{
+			Kind:   kind,
+			Plural: "DNSEndpoints",
+			List: func(ctx context.Context) ([]*unstructured.Unstructured, error) {
+				list, err := client.List(ctx, v1.ListOptions{})
+				if err != nil {
+					return nil, err
+				}
+				out := make([]*unstructured.Unstructured, 0, len(list.Items))
+				for i := range list.Items {
+					out = append(out, &list.Items[i])
+				}
+				return out, nil
+			},
+			Get: func(ctx context.Context, desired *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+				return client.Get(ctx, desired.GetName(), v1.GetOptions{})
+			},
+			Equal: func(existing, desired *unstructured.Unstructured) bool {
+				return reflect.DeepEqual(existing.Object["spec"], desired.Object["spec"])
+			},
+			Create: func(ctx context.Context, desired *unstructured.Unstructured) error {
+				_, err := client.Create(ctx, desired, v1.CreateOptions{})
+				return err
+			},
+			Update: func(ctx context.Context, existing, desired *unstructured.Unstructured) error {
+				updated := desired.DeepCopy()
+				updated.SetResourceVersion(existing.GetResourceVersion())
+				_, err := client.Update(ctx, updated, v1.UpdateOptions{})
+				return err
+			},
+			Delete: func(ctx context.Context, existing *unstructured.Unstructured) error {
+				return client.Delete(ctx, existing.GetName(), v1.DeleteOptions{})
+			},
+		},
+		Owner:  owner,
+		Store:  store,
+		Prefix: prefix,
+		Render: func(host string, wes []*v1alpha3.WorkloadEntry) (*unstructured.Unstructured, bool, error) {
+			return p.dnsEndpoint(infer.ServiceEntryName(prefix, host), host, wes), true, nil
+		},
+		Interval: 5 * time.Second,
+		Log:      log,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// dnsEndpoint returns the DNSEndpoint resolving host to its endpoints: A and AAAA records for IP addresses, or a
+// CNAME record if the endpoints are only hostnames, which can have but one target
+func (p *publisher) dnsEndpoint(name, host string, wes []*v1alpha3.WorkloadEntry) *unstructured.Unstructured {
+	var v4, v6, names []string
+	for _, we := range wes {
+		ip := net.ParseIP(we.Address)
+		switch {
+		case ip == nil:
+			names = append(names, we.Address)
+		case ip.To4() != nil:
+			v4 = append(v4, we.Address)
+		default:
+			v6 = append(v6, we.Address)
+		}
+	}
+	var endpoints []interface{}
+	add := func(recordType string, targets []string) {
+		if len(targets) == 0 {
+			return
+		}
+		sort.Strings(targets)
+		ts := make([]interface{}, len(targets))
+		for i, t := range targets {
+			ts[i] = t
+		}
+		e := map[string]interface{}{"dnsName": host, "recordType": recordType, "targets": ts}
+		if p.ttl > 0 {
+			e["recordTTL"] = p.ttl
+		}
+		endpoints = append(endpoints, e)
+	}
+	add("A", v4)
+	add("AAAA", v6)
+	if len(v4)+len(v6) == 0 && len(names) > 0 {
+		sort.Strings(names)
+		if len(names) > 1 {
+			log.Debugf("host %q has %d hostname endpoints, publishing a CNAME to %q only", host, len(names), names[0])
+		}
+		add("CNAME", names[:1])
+	}
+	if endpoints == nil {
+		endpoints = []interface{}{}
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"endpoints": endpoints},
+	}}
+	obj.SetAPIVersion(Resource.GroupVersion().String())
+	obj.SetKind(kind)
+	obj.SetName(name)
+	obj.SetOwnerReferences([]v1.OwnerReference{p.Owner})
+	return obj
+}
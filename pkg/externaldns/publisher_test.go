@@ -0,0 +1,114 @@
+package externaldns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+var owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: "us"}
+
+func TestPublisher_Sync(t *testing.T) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{Resource: kind + "List"})
+	dnsEndpoints := client.Resource(Resource).Namespace("default")
+	store := provider.NewStore()
+	p := NewPublisher(owner, store, "cloudmap-", dnsEndpoints, WithTTL(60))
+
+	theirs := p.dnsEndpoint("cloudmap-theirs.tetrate.io", "theirs.tetrate.io", nil)
+	theirs.SetOwnerReferences([]v1.OwnerReference{{Kind: "ServiceController", Name: "other", UID: "them"}})
+	if _, err := dnsEndpoints.Create(context.TODO(), theirs, v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		restart bool // with a new UID, as every run gets
+		hosts   map[string][]*v1alpha3.WorkloadEntry
+		want    map[string][]interface{} // endpoints by DNSEndpoint name
+	}{
+		{
+			name: "creates a DNSEndpoint per host",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.2", 80), infer.WorkloadEntry("10.0.0.1", 80), infer.WorkloadEntry("2001:db8::1", 80)},
+				"b.tetrate.io": {infer.WorkloadEntry("b2.example.com", 80), infer.WorkloadEntry("b1.example.com", 80)},
+			},
+			want: map[string][]interface{}{
+				"cloudmap-a.tetrate.io": {
+					map[string]interface{}{"dnsName": "a.tetrate.io", "recordType": "A", "recordTTL": int64(60), "targets": []interface{}{"10.0.0.1", "10.0.0.2"}},
+					map[string]interface{}{"dnsName": "a.tetrate.io", "recordType": "AAAA", "recordTTL": int64(60), "targets": []interface{}{"2001:db8::1"}},
+				},
+				"cloudmap-b.tetrate.io": {
+					map[string]interface{}{"dnsName": "b.tetrate.io", "recordType": "CNAME", "recordTTL": int64(60), "targets": []interface{}{"b1.example.com"}},
+				},
+			},
+		},
+		{
+			name: "updates changed hosts and deletes removed ones, leaving others' alone",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.3", 80)},
+			},
+			want: map[string][]interface{}{
+				"cloudmap-a.tetrate.io": {
+					map[string]interface{}{"dnsName": "a.tetrate.io", "recordType": "A", "recordTTL": int64(60), "targets": []interface{}{"10.0.0.3"}},
+				},
+			},
+		},
+		{
+			name:    "takes over the DNSEndpoints of the previous run after a restart",
+			restart: true,
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.5", 80)},
+				"c.tetrate.io": {infer.WorkloadEntry("10.0.0.4", 80)},
+			},
+			want: map[string][]interface{}{
+				"cloudmap-a.tetrate.io": {
+					map[string]interface{}{"dnsName": "a.tetrate.io", "recordType": "A", "recordTTL": int64(60), "targets": []interface{}{"10.0.0.5"}},
+				},
+				"cloudmap-c.tetrate.io": {
+					map[string]interface{}{"dnsName": "c.tetrate.io", "recordType": "A", "recordTTL": int64(60), "targets": []interface{}{"10.0.0.4"}},
+				},
+			},
+		},
+	}
+	for _, step := range steps {
+		if step.restart {
+			restarted := owner
+			restarted.UID = "us, restarted"
+			store = provider.NewStore()
+			p = NewPublisher(restarted, store, "cloudmap-", dnsEndpoints, WithTTL(60))
+		}
+		store.Set(step.hosts)
+		if err := p.Sync(context.TODO()); err != nil {
+			t.Fatalf("%s: Sync() error = %v", step.name, err)
+		}
+		list, err := dnsEndpoints.List(context.TODO(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string][]interface{}{}
+		for _, item := range list.Items {
+			if item.GetName() == theirs.GetName() {
+				continue
+			}
+			endpoints, _, _ := unstructured.NestedSlice(item.Object, "spec", "endpoints")
+			got[item.GetName()] = endpoints
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: DNSEndpoints = %v, want %v", step.name, got, step.want)
+		}
+		if len(list.Items) != len(step.want)+1 {
+			t.Errorf("%s: %d DNSEndpoints, want theirs kept alongside ours", step.name, len(list.Items))
+		}
+	}
+}
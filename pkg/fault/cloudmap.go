@@ -0,0 +1,99 @@
+package fault
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+)
+
+// CloudMapClient returns client with faults injected into every call, and listings truncated at the partial page rate
+func CloudMapClient(client cloudmap.ServiceDiscoveryClient, i *Injector) cloudmap.ServiceDiscoveryClient {
+	return &cloudMapClient{client: client, i: i}
+}
+
+type cloudMapClient struct {
+	client cloudmap.ServiceDiscoveryClient
+	i      *Injector
+}
+
+func (c *cloudMapClient) ListNamespaces(ctx context.Context, in *servicediscovery.ListNamespacesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListNamespacesOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	out, err := c.client.ListNamespaces(ctx, in, opts...)
+	if err == nil {
+		out.Namespaces = out.Namespaces[:c.i.Truncate(len(out.Namespaces))]
+	}
+	return out, err
+}
+
+func (c *cloudMapClient) ListServices(ctx context.Context, in *servicediscovery.ListServicesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListServicesOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	out, err := c.client.ListServices(ctx, in, opts...)
+	if err == nil {
+		out.Services = out.Services[:c.i.Truncate(len(out.Services))]
+	}
+	return out, err
+}
+
+func (c *cloudMapClient) ListTagsForResource(ctx context.Context, in *servicediscovery.ListTagsForResourceInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListTagsForResourceOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.ListTagsForResource(ctx, in, opts...)
+}
+
+func (c *cloudMapClient) ListInstances(ctx context.Context, in *servicediscovery.ListInstancesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.ListInstancesOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	out, err := c.client.ListInstances(ctx, in, opts...)
+	if err == nil {
+		out.Instances = out.Instances[:c.i.Truncate(len(out.Instances))]
+	}
+	return out, err
+}
+
+func (c *cloudMapClient) GetInstancesHealthStatus(ctx context.Context, in *servicediscovery.GetInstancesHealthStatusInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.GetInstancesHealthStatusOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.GetInstancesHealthStatus(ctx, in, opts...)
+}
+
+func (c *cloudMapClient) GetNamespace(ctx context.Context, in *servicediscovery.GetNamespaceInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.GetNamespaceOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.GetNamespace(ctx, in, opts...)
+}
+
+func (c *cloudMapClient) GetService(ctx context.Context, in *servicediscovery.GetServiceInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.GetServiceOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.GetService(ctx, in, opts...)
+}
+
+func (c *cloudMapClient) DiscoverInstances(ctx context.Context, in *servicediscovery.DiscoverInstancesInput,
+	opts ...func(*servicediscovery.Options)) (*servicediscovery.DiscoverInstancesOutput, error) {
+	if err := c.i.Call(ctx); err != nil {
+		return nil, err
+	}
+	out, err := c.client.DiscoverInstances(ctx, in, opts...)
+	if err == nil {
+		out.Instances = out.Instances[:c.i.Truncate(len(out.Instances))]
+	}
+	return out, err
+}
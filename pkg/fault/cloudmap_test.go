@@ -0,0 +1,51 @@
+package fault
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdTypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/cloudmap"
+)
+
+type fakeCloudMap struct {
+	cloudmap.ServiceDiscoveryClient
+}
+
+func (fakeCloudMap) ListServices(context.Context, *servicediscovery.ListServicesInput, ...func(*servicediscovery.Options)) (
+	*servicediscovery.ListServicesOutput, error) {
+	return &servicediscovery.ListServicesOutput{Services: make([]sdTypes.ServiceSummary, 10)}, nil
+}
+
+func TestCloudMapClient(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		wantErr   error
+		wantFewer bool
+	}{
+		{name: "passes through", config: Config{Seed: 1}},
+		{name: "fails", config: Config{ErrorRate: 1, Seed: 1}, wantErr: ErrInjected},
+		{name: "partial page", config: Config{PartialRate: 1, Seed: 1}, wantFewer: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := New(tt.config, "cloudmap-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := CloudMapClient(fakeCloudMap{}, i).ListServices(context.Background(), &servicediscovery.ListServicesInput{})
+			if err != tt.wantErr {
+				t.Fatalf("ListServices() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := len(out.Services); (got < 10) != tt.wantFewer {
+				t.Errorf("ListServices() returned %d services, want fewer than 10: %v", got, tt.wantFewer)
+			}
+		})
+	}
+}
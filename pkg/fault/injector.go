@@ -0,0 +1,105 @@
+// Package fault injects failures into providers: random API errors, slow responses and partial pages, so the
+// pipeline's resilience can be verified in integration tests and staging. Never enable it in production.
+package fault
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+// ErrInjected is returned by calls failed on purpose
+var ErrInjected = errors.New("injected fault")
+
+// Config sets how often, and how badly, calls fail
+type Config struct {
+	// ErrorRate is the probability, between 0 and 1, that a call fails with ErrInjected
+	ErrorRate float64
+	// Latency is the maximum delay added to every call; each delay is uniformly distributed up to it
+	Latency time.Duration
+	// PartialRate is the probability, between 0 and 1, that a listing returns only part of its page
+	PartialRate float64
+	// Seed makes the faults reproducible; zero seeds from the clock
+	Seed int64
+}
+
+// Enabled returns whether c injects any fault
+func (c Config) Enabled() bool {
+	return c.ErrorRate > 0 || c.Latency > 0 || c.PartialRate > 0
+}
+
+// Injector decides which calls fail, for a provider identified by its prefix in metrics
+type Injector struct {
+	c      Config
+	prefix string
+
+	m    sync.Mutex // guards rand, which isn't safe for concurrent use
+	rand *rand.Rand
+}
+
+// New returns an injector failing calls as configured by c
+func New(c Config, prefix string) (*Injector, error) {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return nil, errors.Errorf("fault error rate %v must be between 0 and 1", c.ErrorRate)
+	}
+	if c.PartialRate < 0 || c.PartialRate > 1 {
+		return nil, errors.Errorf("fault partial page rate %v must be between 0 and 1", c.PartialRate)
+	}
+	if c.Latency < 0 {
+		return nil, errors.Errorf("fault latency %v must not be negative", c.Latency)
+	}
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Warnf("injecting faults into %q: error rate %v, latency up to %v, partial page rate %v, seed %d",
+		prefix, c.ErrorRate, c.Latency, c.PartialRate, seed)
+	return &Injector{c: c, prefix: prefix, rand: rand.New(rand.NewSource(seed))}, nil
+}
+
+// Call delays the caller by a random latency, then fails it at the configured error rate. The delay ends early,
+// returning the context's error, if ctx is done first.
+func (i *Injector) Call(ctx context.Context) error {
+	i.m.Lock()
+	var delay time.Duration
+	if i.c.Latency > 0 {
+		delay = time.Duration(i.rand.Int63n(int64(i.c.Latency)))
+	}
+	fail := i.rand.Float64() < i.c.ErrorRate
+	i.m.Unlock()
+
+	if delay > 0 {
+		metrics.InjectedFaults.WithLabelValues(i.prefix, "latency").Inc()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	if fail {
+		metrics.InjectedFaults.WithLabelValues(i.prefix, "error").Inc()
+		return ErrInjected
+	}
+	return nil
+}
+
+// Truncate returns how many of a page's n items to return: n, or at the partial page rate a random smaller number
+func (i *Injector) Truncate(n int) int {
+	if n == 0 {
+		return 0
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	if i.rand.Float64() >= i.c.PartialRate {
+		return n
+	}
+	metrics.InjectedFaults.WithLabelValues(i.prefix, "partial").Inc()
+	return i.rand.Intn(n)
+}
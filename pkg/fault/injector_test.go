@@ -0,0 +1,81 @@
+package fault
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "valid", config: Config{ErrorRate: 0.1, Latency: time.Second, PartialRate: 1}},
+		{name: "error rate above 1", config: Config{ErrorRate: 1.5}, wantErr: true},
+		{name: "negative partial rate", config: Config{PartialRate: -0.1}, wantErr: true},
+		{name: "negative latency", config: Config{Latency: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config, "test-"); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInjector_Call(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		timeout time.Duration
+		want    error
+	}{
+		{name: "no faults", config: Config{Seed: 1}},
+		{name: "always fails", config: Config{ErrorRate: 1, Seed: 1}, want: ErrInjected},
+		{name: "slow call cut short by its context", config: Config{Latency: time.Hour, Seed: 1}, timeout: time.Millisecond, want: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := New(tt.config, "test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			for n := 0; n < 10; n++ {
+				if err := i.Call(ctx); err != tt.want {
+					t.Fatalf("Call() error = %v, want %v", err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInjector_Truncate(t *testing.T) {
+	whole, err := New(Config{Seed: 1}, "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, err := New(Config{PartialRate: 1, Seed: 1}, "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 10; n++ {
+		if got := whole.Truncate(5); got != 5 {
+			t.Errorf("Truncate(5) without partial pages = %d, want 5", got)
+		}
+		if got := partial.Truncate(5); got < 0 || got >= 5 {
+			t.Errorf("Truncate(5) with partial pages = %d, want fewer than 5", got)
+		}
+	}
+	if got := partial.Truncate(0); got != 0 {
+		t.Errorf("Truncate(0) = %d, want 0", got)
+	}
+}
@@ -0,0 +1,94 @@
+package fault
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Transport returns an HTTP transport with faults injected into every request, for HTTP based registries such as
+// Consul. Injected errors are returned as 503 responses, and JSON array or object responses are truncated at the
+// partial page rate.
+func Transport(rt http.RoundTripper, i *Injector) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{rt: rt, i: i}
+}
+
+type transport struct {
+	rt http.RoundTripper
+	i  *Injector
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.i.Call(req.Context()); err != nil {
+		if err != ErrInjected {
+			return nil, err
+		}
+		return response(req, http.StatusServiceUnavailable, []byte(err.Error())), nil
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(t.truncate(body)))
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// truncate drops trailing items of a JSON array, or keys of a JSON object, if the page is to be partial
+func (t *transport) truncate(body []byte) []byte {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err == nil {
+		if n := t.i.Truncate(len(items)); n < len(items) {
+			if out, err := json.Marshal(items[:n]); err == nil {
+				return out
+			}
+		}
+		return body
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil {
+		n := t.i.Truncate(len(fields))
+		if n == len(fields) {
+			return body
+		}
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		// drop keys deterministically for a given seed
+		sort.Strings(keys)
+		for _, k := range keys[n:] {
+			delete(fields, k)
+		}
+		if out, err := json.Marshal(fields); err == nil {
+			return out
+		}
+	}
+	return body
+}
+
+func response(req *http.Request, code int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,75 @@
+package fault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/array":
+			_, _ = w.Write([]byte(`[1,2,3,4]`))
+		case "/object":
+			_, _ = w.Write([]byte(`{"a":[],"b":[],"c":[]}`))
+		default:
+			_, _ = w.Write([]byte(`"scalar"`))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		config   Config
+		path     string
+		wantCode int
+		// wantItems is the most items expected in the response; -1 skips the check
+		wantItems int
+	}{
+		{name: "passes through", config: Config{Seed: 1}, path: "/array", wantCode: http.StatusOK, wantItems: 4},
+		{name: "injected errors are unavailable", config: Config{ErrorRate: 1, Seed: 1}, path: "/array", wantCode: http.StatusServiceUnavailable, wantItems: -1},
+		{name: "partial array", config: Config{PartialRate: 1, Seed: 1}, path: "/array", wantCode: http.StatusOK, wantItems: 3},
+		{name: "partial object", config: Config{PartialRate: 1, Seed: 1}, path: "/object", wantCode: http.StatusOK, wantItems: 2},
+		{name: "scalars untouched", config: Config{PartialRate: 1, Seed: 1}, path: "/scalar", wantCode: http.StatusOK, wantItems: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := New(tt.config, "test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: Transport(nil, i)}
+			resp, err := client.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s error = %v", tt.path, err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("GET %s code = %d, want %d", tt.path, resp.StatusCode, tt.wantCode)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantItems < 0 {
+				return
+			}
+			var items []interface{}
+			var fields map[string]interface{}
+			n := 0
+			if json.Unmarshal(body, &items) == nil {
+				n = len(items)
+			} else if err := json.Unmarshal(body, &fields); err == nil {
+				n = len(fields)
+			} else {
+				t.Fatalf("GET %s returned invalid JSON %q", tt.path, body)
+			}
+			if n > tt.wantItems {
+				t.Errorf("GET %s returned %d items, want at most %d", tt.path, n, tt.wantItems)
+			}
+		})
+	}
+}
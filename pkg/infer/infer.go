@@ -11,12 +11,50 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// AnnotationDomain ends the prefix of the keys of every annotation providers put on Service Entries, e.g.
+// cloudmap.istio-registry-sync.tetrate.io/description, telling them apart from annotations others put
+const AnnotationDomain = "istio-registry-sync.tetrate.io/"
+
+// ExportToAnnotation lists the namespaces, comma-separated, a provider exports the Service Entry of a host to, as its
+// exportTo: "." for the Service Entry's own namespace and "*" for every namespace
+const ExportToAnnotation = AnnotationDomain + "export-to"
+
+// Annotate sets the annotations of se, and the fields of its spec they configure
+func Annotate(se *ic.ServiceEntry, annotations map[string]string) {
+	se.Annotations = annotations
+	if exportTo, ok := annotations[ExportToAnnotation]; ok {
+		se.Spec.ExportTo = strings.Split(exportTo, ",")
+	}
+}
+
+// SameAnnotations returns whether the annotations of existing under AnnotationDomain are exactly annotations
+func SameAnnotations(existing, annotations map[string]string) bool {
+	n := 0
+	for key, value := range existing {
+		if !strings.Contains(key, AnnotationDomain) {
+			continue
+		}
+		if want, ok := annotations[key]; !ok || want != value {
+			return false
+		}
+		n++
+	}
+	return n == len(annotations)
+}
+
 // ServiceEntry infers an Istio service entry based on provided information
 func ServiceEntry(owner v1.OwnerReference, prefix, host string, workloadEntries []*v1alpha3.WorkloadEntry) *ic.ServiceEntry {
 	addresses := []string{}
 	if len(workloadEntries) > 0 {
 		if ip := net.ParseIP(workloadEntries[0].Address); ip != nil {
 			addresses = []string{workloadEntries[0].Address}
+			// dual-stack hosts get an address of each family
+			for _, we := range workloadEntries[1:] {
+				if other := net.ParseIP(we.Address); other != nil && (other.To4() == nil) != (ip.To4() == nil) {
+					addresses = append(addresses, we.Address)
+					break
+				}
+			}
 		}
 	}
 
@@ -59,16 +97,30 @@ func Proto(port uint32) string {
 	}
 }
 
+// protocols are the protocols Istio tells from a port's name, as <protocol> or <protocol>-<suffix>, longest first
+var protocols = []string{"grpc-web", "http2", "https", "http", "grpc", "mongo", "mysql", "redis", "tcp", "tls", "udp"}
+
+// Protocol returns the Istio protocol of a port named name, e.g. GRPC of grpc-api, or TCP if the name tells none
+func Protocol(name string) string {
+	name = strings.ToLower(name)
+	for _, p := range protocols {
+		if name == p || strings.HasPrefix(name, p+"-") {
+			return strings.ToUpper(p)
+		}
+	}
+	return "TCP"
+}
+
 // Ports uses a slice of Service Entry workload entries to create a de-duped slice of Istio Ports
-// Infering name and protocol from the port number
+// Taking name and protocol from the name of the workload entries' ports
 func Ports(workloadEntries []*v1alpha3.WorkloadEntry) []*v1alpha3.ServicePort {
 	dedup := map[uint32]*v1alpha3.ServicePort{}
 	for _, we := range workloadEntries {
-		for _, port := range we.Ports {
+		for name, port := range we.Ports {
 			dedup[port] = &v1alpha3.ServicePort{
-				Name:     Proto(port),
+				Name:     name,
 				Number:   uint32(port),
-				Protocol: strings.ToUpper(Proto(port)),
+				Protocol: Protocol(name),
 			}
 		}
 	}
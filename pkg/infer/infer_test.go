@@ -6,10 +6,12 @@ import (
 	"testing"
 
 	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var ipWorkloadEntry = &v1alpha3.WorkloadEntry{Address: "8.8.8.8"}
 var hostnameWorkloadEntry = &v1alpha3.WorkloadEntry{Address: "demo.tetrate.io"}
+var ipv6WorkloadEntry = &v1alpha3.WorkloadEntry{Address: "2001:db8::1"}
 
 func TestResolution(t *testing.T) {
 	tests := []struct {
@@ -27,6 +29,11 @@ func TestResolution(t *testing.T) {
 			workloadEntries: []*v1alpha3.WorkloadEntry{ipWorkloadEntry},
 			want:            v1alpha3.ServiceEntry_STATIC,
 		},
+		{
+			name:            "dual-stack workload entries infer STATIC",
+			workloadEntries: []*v1alpha3.WorkloadEntry{ipWorkloadEntry, ipv6WorkloadEntry},
+			want:            v1alpha3.ServiceEntry_STATIC,
+		},
 		{
 			name:            "Mixed workload entries infer DNS",
 			workloadEntries: []*v1alpha3.WorkloadEntry{ipWorkloadEntry, hostnameWorkloadEntry},
@@ -47,6 +54,33 @@ func TestResolution(t *testing.T) {
 	}
 }
 
+func TestServiceEntry_addresses(t *testing.T) {
+	ipWorkloadEntry2 := &v1alpha3.WorkloadEntry{Address: "9.9.9.9"}
+	tests := []struct {
+		name            string
+		workloadEntries []*v1alpha3.WorkloadEntry
+		want            []string
+	}{
+		{name: "first IP", workloadEntries: []*v1alpha3.WorkloadEntry{ipWorkloadEntry, ipWorkloadEntry2}, want: []string{"8.8.8.8"}},
+		{name: "IPv6", workloadEntries: []*v1alpha3.WorkloadEntry{ipv6WorkloadEntry}, want: []string{"2001:db8::1"}},
+		{
+			name:            "one of each family for dual-stack hosts",
+			workloadEntries: []*v1alpha3.WorkloadEntry{ipWorkloadEntry, ipWorkloadEntry2, ipv6WorkloadEntry},
+			want:            []string{"8.8.8.8", "2001:db8::1"},
+		},
+		{name: "none for hostnames", workloadEntries: []*v1alpha3.WorkloadEntry{hostnameWorkloadEntry}, want: []string{}},
+		{name: "none without workload entries", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := ServiceEntry(v1.OwnerReference{}, "test-", "demo.tetrate.io", tt.workloadEntries)
+			if !reflect.DeepEqual(se.Spec.Addresses, tt.want) {
+				t.Errorf("ServiceEntry() addresses = %v, want %v", se.Spec.Addresses, tt.want)
+			}
+		})
+	}
+}
+
 func TestPorts(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -72,6 +106,17 @@ func TestPorts(t *testing.T) {
 			},
 			want: []*v1alpha3.ServicePort{{Number: 80, Name: "http", Protocol: "HTTP"}},
 		},
+		{
+			name: "Named ports keep their name and protocol",
+			workloadEntries: []*v1alpha3.WorkloadEntry{
+				{Address: "1.1.1.1", Ports: map[string]uint32{"grpc": 8080}},
+				{Address: "8.8.8.8", Ports: map[string]uint32{"http2-admin": 9090}},
+			},
+			want: []*v1alpha3.ServicePort{
+				{Number: 8080, Name: "grpc", Protocol: "GRPC"},
+				{Number: 9090, Name: "http2-admin", Protocol: "HTTP2"},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -126,3 +171,98 @@ func TestProto(t *testing.T) {
 		})
 	}
 }
+
+func TestProtocol(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "http", want: "HTTP"},
+		{name: "HTTP2", want: "HTTP2"},
+		{name: "grpc-web", want: "GRPC-WEB"},
+		{name: "grpc-api", want: "GRPC"},
+		{name: "httpbin", want: "TCP"},
+		{name: "", want: "TCP"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v is %v", tt.name, tt.want), func(t *testing.T) {
+			if got := Protocol(tt.name); got != tt.want {
+				t.Errorf("Protocol() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     map[string]string
+	}{
+		{name: "no TLS", metadata: map[string]string{"team": "billing"}},
+		{name: "TLS disabled", metadata: map[string]string{"tls": "false"}},
+		{name: "TLS", metadata: map[string]string{"tls": "true"}, want: map[string]string{TLSModeLabel: "SIMPLE"}},
+		{
+			name:     "mutual TLS with SNI and credentials",
+			metadata: map[string]string{"tls": "Mutual", "tls-sni": "billing.tetrate.io", "tls-credential-name": "billing-client"},
+			want: map[string]string{
+				TLSModeLabel:           "MUTUAL",
+				TLSSNILabel:            "billing.tetrate.io",
+				TLSCredentialNameLabel: "billing-client",
+			},
+		},
+		{
+			name:     "drops invalid values",
+			metadata: map[string]string{"tls": "simple", "tls-sni": "not a name"},
+			want:     map[string]string{TLSModeLabel: "SIMPLE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TLSLabels(tt.metadata)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TLSLabels() = %v, want %v", got, tt.want)
+			}
+			if tt.want != nil && TLSSettings(got).Mode.String() != tt.want[TLSModeLabel] {
+				t.Errorf("TLSSettings() = %v, want mode %s", TLSSettings(got), tt.want[TLSModeLabel])
+			}
+		})
+	}
+}
+
+func TestSameAnnotations(t *testing.T) {
+	ours := "cloudmap." + AnnotationDomain + "description"
+	tests := []struct {
+		name        string
+		existing    map[string]string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "none", want: true},
+		{name: "equal", existing: map[string]string{ours: "web"}, annotations: map[string]string{ours: "web"}, want: true},
+		{name: "others' ignored", existing: map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"}, want: true},
+		{name: "changed", existing: map[string]string{ours: "web"}, annotations: map[string]string{ours: "api"}},
+		{name: "added", annotations: map[string]string{ours: "web"}},
+		{name: "removed", existing: map[string]string{ours: "web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SameAnnotations(tt.existing, tt.annotations); got != tt.want {
+				t.Errorf("SameAnnotations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	se := ServiceEntry(v1.OwnerReference{}, "consul-", "web", []*v1alpha3.WorkloadEntry{ipWorkloadEntry})
+	Annotate(se, map[string]string{ExportToAnnotation: ".,istio-system"})
+	if want := []string{".", "istio-system"}; !reflect.DeepEqual(se.Spec.ExportTo, want) {
+		t.Errorf("ExportTo = %v, want %v", se.Spec.ExportTo, want)
+	}
+	se = ServiceEntry(v1.OwnerReference{}, "consul-", "web", []*v1alpha3.WorkloadEntry{ipWorkloadEntry})
+	Annotate(se, map[string]string{AnnotationDomain + "other": "x"})
+	if se.Spec.ExportTo != nil || se.Annotations[AnnotationDomain+"other"] != "x" {
+		t.Errorf("Annotate() = %v, %v, want no exportTo", se.Annotations, se.Spec.ExportTo)
+	}
+}
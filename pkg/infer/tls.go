@@ -0,0 +1,51 @@
+package infer
+
+import (
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Labels of Workload Entries carrying the TLS settings their provider's metadata asks for
+const (
+	TLSModeLabel           = "tls.istio-registry-sync.tetrate.io/mode"
+	TLSSNILabel            = "tls.istio-registry-sync.tetrate.io/sni"
+	TLSCredentialNameLabel = "tls.istio-registry-sync.tetrate.io/credential-name"
+)
+
+// TLSLabels returns the labels describing the TLS settings found in a provider's metadata, or nil if there are none.
+// The metadata key `tls` is true or simple if the endpoint speaks TLS, and mutual if it wants a client certificate;
+// `tls-sni` is the server name to present, and `tls-credential-name` the Secret holding the client certificate and
+// the CA to verify the endpoint with. Values that can't be label values are dropped.
+func TLSLabels(metadata map[string]string) map[string]string {
+	var mode string
+	switch strings.ToLower(metadata["tls"]) {
+	case "true", "simple":
+		mode = v1alpha3.ClientTLSSettings_SIMPLE.String()
+	case "mutual":
+		mode = v1alpha3.ClientTLSSettings_MUTUAL.String()
+	default:
+		return nil
+	}
+	labels := map[string]string{TLSModeLabel: mode}
+	for key, label := range map[string]string{"tls-sni": TLSSNILabel, "tls-credential-name": TLSCredentialNameLabel} {
+		if v := metadata[key]; v != "" && len(validation.IsValidLabelValue(v)) == 0 {
+			labels[label] = v
+		}
+	}
+	return labels
+}
+
+// TLSSettings returns the Destination Rule TLS settings described by a Workload Entry's labels, or nil if it has none
+func TLSSettings(labels map[string]string) *v1alpha3.ClientTLSSettings {
+	mode, ok := v1alpha3.ClientTLSSettings_TLSmode_value[labels[TLSModeLabel]]
+	if !ok {
+		return nil
+	}
+	return &v1alpha3.ClientTLSSettings{
+		Mode:           v1alpha3.ClientTLSSettings_TLSmode(mode),
+		Sni:            labels[TLSSNILabel],
+		CredentialName: labels[TLSCredentialNameLabel],
+	}
+}
@@ -0,0 +1,461 @@
+// Package kubeservice publishes a provider's hosts as headless Kubernetes Services and EndpointSlices instead of
+// ServiceEntries, so clients outside the mesh, resolving through cluster DNS or kube-proxy, can reach them too.
+package kubeservice
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+const (
+	// HostAnnotation holds the registry host a Service was published for, since Service names can't hold dots
+	HostAnnotation = "istio-registry-sync.tetrate.io/host"
+	// ManagedBy is the endpointslice.kubernetes.io/managed-by label of the EndpointSlices we publish
+	ManagedBy = "istio-registry-sync.tetrate.io"
+
+	// maxEndpoints is the most endpoints Kubernetes accepts in one EndpointSlice
+	maxEndpoints = 1000
+	// maxNameLength is the length limit of Service names, which are DNS labels
+	maxNameLength = 63
+)
+
+// Option configures optional behaviour of the publisher
+type Option func(*publisher)
+
+// WithStalenessThreshold makes the publisher report not ready, and suspend deleting Services, while the store
+// hasn't synced successfully for longer than d
+func WithStalenessThreshold(d time.Duration) Option {
+	return func(p *publisher) {
+		p.StalenessThreshold = d
+	}
+}
+
+// service is a Service we publish and its EndpointSlices, which are written together
+type service struct {
+	*corev1.Service
+	slices []*discoveryv1.EndpointSlice
+	// orphan marks EndpointSlices of ours left without their Service, under a stand-in
+	orphan bool
+}
+
+type publisher struct {
+	*publish.Publisher[*service]
+	client    kubernetes.Interface
+	namespace string
+}
+
+// NewPublisher returns a publisher keeping a Service, named after its ServiceEntry would be, and its EndpointSlices
+// in namespace for every host in store
+func NewPublisher(owner v1.OwnerReference, store provider.Store, prefix string, client kubernetes.Interface,
+	namespace string, opts ...Option) *publisher {
+	p := &publisher{client: client, namespace: namespace}
+	p.Publisher = &publish.Publisher[*service]{
+		Resources: publish.Resources[*service]{
+			Kind:   "Service",
+			Plural: "Services",
+			List:   p.list,
+			Get: func(ctx context.Context, desired *service) (*service, error) {
+				s, err := client.CoreV1().Services(namespace).Get(ctx, desired.Name, v1.GetOptions{})
+				if err != nil {
+					return nil, err
+				}
+				slices, err := client.DiscoveryV1().EndpointSlices(namespace).List(ctx, v1.ListOptions{
+					LabelSelector: discoveryv1.LabelServiceName + "=" + desired.Name + "," +
+						discoveryv1.LabelManagedBy + "=" + ManagedBy,
+				})
+				if err != nil {
+					return nil, err
+				}
+				existing := &service{Service: s}
+				for i := range slices.Items {
+					existing.slices = append(existing.slices, &slices.Items[i])
+				}
+				return existing, nil
+			},
+			Equal:  equal,
+			Create: p.create,
+			Update: p.update,
+			Delete: p.delete,
+		},
+		Owner:  owner,
+		Store:  store,
+		Prefix: prefix,
+		Render: func(host string, wes []*v1alpha3.WorkloadEntry) (*service, bool, error) {
+			s, slices := p.desired(ServiceName(prefix, host), host, wes)
+			return &service{Service: s, slices: slices}, true, nil
+		},
+		// Service names are made DNS labels, so the host is recorded in an annotation
+		Host: func(s *service) (string, bool) {
+			if s.orphan {
+				return "", strings.HasPrefix(s.Name, label(prefix))
+			}
+			host, ok := s.Annotations[HostAnnotation]
+			return host, ok && ServiceName(prefix, host) == s.Name
+		},
+		Interval: 5 * time.Second,
+		Log:      log,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// list returns the Services and the EndpointSlices we may have published
+func (p *publisher) list(ctx context.Context) ([]*service, error) {
+	services, err := p.client.CoreV1().Services(p.namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	slices, err := p.client.DiscoveryV1().EndpointSlices(p.namespace).List(ctx,
+		v1.ListOptions{LabelSelector: discoveryv1.LabelManagedBy + "=" + ManagedBy})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list EndpointSlices")
+	}
+	byName := make(map[string]*service, len(services.Items))
+	out := make([]*service, 0, len(services.Items))
+	for i := range services.Items {
+		s := &service{Service: &services.Items[i]}
+		byName[s.Name] = s
+		out = append(out, s)
+	}
+	for i := range slices.Items {
+		slice := &slices.Items[i]
+		if !publish.Owns(p.Owner, slice.OwnerReferences) {
+			continue
+		}
+		name := slice.Labels[discoveryv1.LabelServiceName]
+		s, ok := byName[name]
+		if !ok {
+			s = &service{Service: &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: name,
+				OwnerReferences: slice.OwnerReferences}}, orphan: true}
+			byName[name] = s
+			out = append(out, s)
+		}
+		s.slices = append(s.slices, slice)
+	}
+	return out, nil
+}
+
+func (p *publisher) create(ctx context.Context, desired *service) error {
+	if _, err := p.client.CoreV1().Services(p.namespace).Create(ctx, desired.Service, v1.CreateOptions{}); err != nil {
+		return err
+	}
+	return p.writeSlices(ctx, desired.slices, nil)
+}
+
+func (p *publisher) update(ctx context.Context, existing, desired *service) error {
+	current := existing.Service
+	if existing.orphan {
+		current = nil
+	}
+	if err := p.writeService(ctx, desired.Service, current); err != nil {
+		return err
+	}
+	return p.writeSlices(ctx, desired.slices, existing.slices)
+}
+
+func (p *publisher) delete(ctx context.Context, existing *service) error {
+	if err := p.writeSlices(ctx, nil, existing.slices); err != nil {
+		return err
+	}
+	if existing.orphan {
+		return nil
+	}
+	return p.client.CoreV1().Services(p.namespace).Delete(ctx, existing.Name, v1.DeleteOptions{})
+}
+
+func equal(existing, desired *service) bool {
+	if existing.orphan || existing.Spec.Type != desired.Spec.Type ||
+		existing.Annotations[HostAnnotation] != desired.Annotations[HostAnnotation] ||
+		existing.Spec.ExternalName != desired.Spec.ExternalName || !samePorts(existing.Spec.Ports, desired.Spec.Ports) ||
+		len(existing.slices) != len(desired.slices) {
+		return false
+	}
+	slices := make(map[string]*discoveryv1.EndpointSlice, len(existing.slices))
+	for _, slice := range existing.slices {
+		slices[slice.Name] = slice
+	}
+	for _, slice := range desired.slices {
+		e, ok := slices[slice.Name]
+		if !ok || !sameSlice(e, slice) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeService creates or updates the Service, replacing it if its type changed since a ClusterIP can't be removed
+func (p *publisher) writeService(ctx context.Context, desired, existing *corev1.Service) error {
+	services := p.client.CoreV1().Services(p.namespace)
+	if existing != nil && existing.Spec.Type != desired.Spec.Type {
+		if err := services.Delete(ctx, existing.Name, v1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		existing = nil
+	}
+	if existing == nil {
+		_, err := services.Create(ctx, desired, v1.CreateOptions{})
+		return err
+	}
+	if existing.Annotations[HostAnnotation] == desired.Annotations[HostAnnotation] &&
+		existing.Spec.ExternalName == desired.Spec.ExternalName && samePorts(existing.Spec.Ports, desired.Spec.Ports) {
+		return nil
+	}
+	updated := existing.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	updated.Annotations[HostAnnotation] = desired.Annotations[HostAnnotation]
+	updated.Spec.ExternalName = desired.Spec.ExternalName
+	updated.Spec.Ports = desired.Spec.Ports
+	_, err := services.Update(ctx, updated, v1.UpdateOptions{})
+	return err
+}
+
+// writeSlices creates or updates the desired EndpointSlices and deletes the rest of existing
+func (p *publisher) writeSlices(ctx context.Context, desired, existing []*discoveryv1.EndpointSlice) error {
+	slices := p.client.DiscoveryV1().EndpointSlices(p.namespace)
+	leftover := make(map[string]*discoveryv1.EndpointSlice, len(existing))
+	for _, slice := range existing {
+		leftover[slice.Name] = slice
+	}
+	var failures int
+	for _, slice := range desired {
+		e, ok := leftover[slice.Name]
+		delete(leftover, slice.Name)
+		if !ok {
+			if _, err := slices.Create(ctx, slice, v1.CreateOptions{}); err != nil {
+				log.Errorf("error creating EndpointSlice %q: %v", slice.Name, err)
+				failures++
+			}
+			continue
+		}
+		if sameSlice(e, slice) {
+			continue
+		}
+		updated := e.DeepCopy()
+		updated.Endpoints, updated.Ports = slice.Endpoints, slice.Ports
+		if _, err := slices.Update(ctx, updated, v1.UpdateOptions{}); err != nil {
+			log.Errorf("error updating EndpointSlice %q: %v", slice.Name, err)
+			failures++
+		}
+	}
+	for name := range leftover {
+		if err := slices.Delete(ctx, name, v1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			log.Errorf("error deleting EndpointSlice %q: %v", name, err)
+			failures++
+		}
+	}
+	if failures > 0 {
+		return errors.Errorf("failed to write %d EndpointSlices", failures)
+	}
+	return nil
+}
+
+func sameSlice(a, b *discoveryv1.EndpointSlice) bool {
+	return apiequality.Semantic.DeepEqual(a.Endpoints, b.Endpoints) && apiequality.Semantic.DeepEqual(a.Ports, b.Ports)
+}
+
+// desired returns the Service publishing host and its EndpointSlices. Hosts with IP endpoints get a headless
+// Service with a slice per address type and set of ports; hosts whose endpoints are only hostnames get an
+// ExternalName Service to the first of them, since it can have but one target.
+func (p *publisher) desired(name, host string, wes []*v1alpha3.WorkloadEntry) (*corev1.Service, []*discoveryv1.EndpointSlice) {
+	var ips, names []*v1alpha3.WorkloadEntry
+	for _, we := range wes {
+		if net.ParseIP(we.Address) == nil {
+			names = append(names, we)
+		} else {
+			ips = append(ips, we)
+		}
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            name,
+			Annotations:     map[string]string{HostAnnotation: host},
+			OwnerReferences: []v1.OwnerReference{p.Owner},
+		},
+	}
+	if len(ips) == 0 && len(names) > 0 {
+		sort.Slice(names, func(i, j int) bool { return names[i].Address < names[j].Address })
+		if len(names) > 1 {
+			log.Debugf("host %q has %d hostname endpoints, publishing an ExternalName to %q only", host, len(names), names[0].Address)
+		}
+		service.Spec = corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: names[0].Address,
+			Ports:        servicePorts(names),
+		}
+		return service, nil
+	}
+	if len(names) > 0 {
+		log.Debugf("host %q mixes IP and hostname endpoints, publishing its %d IPs only", host, len(ips))
+	}
+	service.Spec = corev1.ServiceSpec{
+		Type:      corev1.ServiceTypeClusterIP,
+		ClusterIP: corev1.ClusterIPNone,
+		Ports:     servicePorts(ips),
+	}
+
+	// a slice holds a single address type and set of ports
+	groups := make(map[string][]*v1alpha3.WorkloadEntry)
+	for _, we := range ips {
+		key := string(addressType(we.Address)) + "/" + portsKey(we.Ports)
+		groups[key] = append(groups[key], we)
+	}
+	var slices []*discoveryv1.EndpointSlice
+	for key, group := range groups {
+		sort.Slice(group, func(i, j int) bool { return group[i].Address < group[j].Address })
+		for i := 0; i*maxEndpoints < len(group); i++ {
+			end := (i + 1) * maxEndpoints
+			if end > len(group) {
+				end = len(group)
+			}
+			slices = append(slices, p.endpointSlice(fmt.Sprintf("%s-%s-%d", name, hash(key), i), name, group[i*maxEndpoints:end]))
+		}
+	}
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Name < slices[j].Name })
+	return service, slices
+}
+
+func (p *publisher) endpointSlice(name, service string, wes []*v1alpha3.WorkloadEntry) *discoveryv1.EndpointSlice {
+	ready := true
+	endpoints := make([]discoveryv1.Endpoint, 0, len(wes))
+	for _, we := range wes {
+		endpoints = append(endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{we.Address},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	var ports []discoveryv1.EndpointPort
+	for _, portName := range sortedNames(wes[0].Ports) {
+		name, number, protocol := label(portName), int32(wes[0].Ports[portName]), corev1.ProtocolTCP
+		ports = append(ports, discoveryv1.EndpointPort{Name: &name, Port: &number, Protocol: &protocol})
+	}
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: service,
+				discoveryv1.LabelManagedBy:   ManagedBy,
+			},
+			OwnerReferences: []v1.OwnerReference{p.Owner},
+		},
+		AddressType: addressType(wes[0].Address),
+		Endpoints:   endpoints,
+		Ports:       ports,
+	}
+}
+
+// servicePorts returns a port for every port name of the endpoints, numbered after the lowest number it has;
+// EndpointSlices carry the actual numbers
+func servicePorts(wes []*v1alpha3.WorkloadEntry) []corev1.ServicePort {
+	numbers := make(map[string]uint32)
+	for _, we := range wes {
+		for portName, number := range we.Ports {
+			name := label(portName)
+			if n, ok := numbers[name]; !ok || number < n {
+				numbers[name] = number
+			}
+		}
+	}
+	var ports []corev1.ServicePort
+	for _, name := range sortedNames(numbers) {
+		ports = append(ports, corev1.ServicePort{
+			Name:       name,
+			Protocol:   corev1.ProtocolTCP,
+			Port:       int32(numbers[name]),
+			TargetPort: intstr.FromInt(int(numbers[name])),
+		})
+	}
+	return ports
+}
+
+func samePorts(a, b []corev1.ServicePort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Port != b[i].Port || a[i].Protocol != b[i].Protocol {
+			return false
+		}
+	}
+	return true
+}
+
+func addressType(address string) discoveryv1.AddressType {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return discoveryv1.AddressTypeIPv6
+	}
+	return discoveryv1.AddressTypeIPv4
+}
+
+func portsKey(ports map[string]uint32) string {
+	parts := make([]string, 0, len(ports))
+	for _, name := range sortedNames(ports) {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, ports[name]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedNames(ports map[string]uint32) []string {
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServiceName returns the name of the Service publishing host: its ServiceEntry name made a DNS label, with dots
+// and other invalid characters replaced by dashes, and names too long truncated and suffixed with a hash of the host
+func ServiceName(prefix, host string) string {
+	name := label(prefix + host)
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "h-" + name
+	}
+	if len(name) > maxNameLength {
+		suffix := "-" + hash(prefix+host)
+		name = strings.TrimRight(name[:maxNameLength-len(suffix)], "-") + suffix
+	}
+	return name
+}
+
+// label lowercases s and replaces the characters a DNS label can't hold with dashes
+func label(s string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, s), "-")
+}
+
+func hash(s string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
@@ -0,0 +1,164 @@
+package kubeservice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+var owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: "us"}
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		host   string
+		want   string
+	}{
+		{name: "replaces dots", prefix: "cloudmap-", host: "a.tetrate.io", want: "cloudmap-a-tetrate-io"},
+		{name: "lowercases", prefix: "consul-", host: "Billing_API.service", want: "consul-billing-api-service"},
+		{name: "starts with a letter", host: "1.tetrate.io", want: "h-1-tetrate-io"},
+		{
+			name:   "truncates long names",
+			prefix: "cloudmap-",
+			host:   strings.Repeat("a", 60) + ".tetrate.io",
+			want:   "cloudmap-" + strings.Repeat("a", 45) + "-" + hash("cloudmap-"+strings.Repeat("a", 60)+".tetrate.io"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ServiceName(tt.prefix, tt.host)
+			if got != tt.want {
+				t.Errorf("ServiceName(%q, %q) = %q, want %q", tt.prefix, tt.host, got, tt.want)
+			}
+			if len(got) > maxNameLength {
+				t.Errorf("ServiceName(%q, %q) is %d characters long", tt.prefix, tt.host, len(got))
+			}
+		})
+	}
+}
+
+func TestPublisher_Sync(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Service{ObjectMeta: v1.ObjectMeta{
+		Name:            "cloudmap-theirs-tetrate-io",
+		Namespace:       "default",
+		OwnerReferences: []v1.OwnerReference{{Kind: "ServiceController", Name: "other", UID: "them"}},
+	}})
+	store := provider.NewStore()
+	p := NewPublisher(owner, store, "cloudmap-", client, "default")
+
+	type service struct {
+		spec   string
+		slices []string
+	}
+	steps := []struct {
+		name    string
+		restart bool // with a new UID, as every run gets
+		hosts   map[string][]*v1alpha3.WorkloadEntry
+		want    map[string]service // by Service name
+	}{
+		{
+			name: "creates a Service and its EndpointSlices per host",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {
+					infer.WorkloadEntry("10.0.0.2", 80), infer.WorkloadEntry("10.0.0.1", 80),
+					infer.WorkloadEntry("10.0.0.3", 8080), infer.WorkloadEntry("2001:db8::1", 80),
+				},
+				"b.tetrate.io":      {infer.WorkloadEntry("b2.example.com", 443), infer.WorkloadEntry("b1.example.com", 443)},
+				"theirs.tetrate.io": {infer.WorkloadEntry("10.0.0.4", 80)},
+			},
+			want: map[string]service{
+				"cloudmap-a-tetrate-io": {
+					spec:   "ClusterIP None http:80 tcp:8080",
+					slices: []string{"IPv4 10.0.0.1,10.0.0.2 http:80", "IPv4 10.0.0.3 tcp:8080", "IPv6 2001:db8::1 http:80"},
+				},
+				"cloudmap-b-tetrate-io": {spec: "ExternalName b1.example.com https:443"},
+			},
+		},
+		{
+			name: "updates changed hosts and deletes removed ones, leaving others' alone",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.1", 80), infer.WorkloadEntry("10.0.0.5", 80)},
+				"b.tetrate.io": {infer.WorkloadEntry("10.0.0.6", 443)},
+			},
+			want: map[string]service{
+				"cloudmap-a-tetrate-io": {spec: "ClusterIP None http:80", slices: []string{"IPv4 10.0.0.1,10.0.0.5 http:80"}},
+				"cloudmap-b-tetrate-io": {spec: "ClusterIP None https:443", slices: []string{"IPv4 10.0.0.6 https:443"}},
+			},
+		},
+		{
+			name:    "takes over the Services and EndpointSlices of the previous run after a restart",
+			restart: true,
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.1", 80)},
+			},
+			want: map[string]service{
+				"cloudmap-a-tetrate-io": {spec: "ClusterIP None http:80", slices: []string{"IPv4 10.0.0.1 http:80"}},
+			},
+		},
+		{
+			name: "deletes the Services and EndpointSlices of removed hosts",
+			want: map[string]service{},
+		},
+	}
+	for _, step := range steps {
+		if step.restart {
+			restarted := owner
+			restarted.UID = "us, restarted"
+			store = provider.NewStore()
+			p = NewPublisher(restarted, store, "cloudmap-", client, "default")
+		}
+		store.Set(step.hosts)
+		if err := p.Sync(context.TODO()); err != nil {
+			t.Fatalf("%s: Sync() error = %v", step.name, err)
+		}
+		services, err := client.CoreV1().Services("default").List(context.TODO(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]service{}
+		for _, s := range services.Items {
+			if !publish.Owns(owner, s.OwnerReferences) {
+				continue
+			}
+			spec := string(s.Spec.Type) + " " + s.Spec.ClusterIP + s.Spec.ExternalName
+			for _, port := range s.Spec.Ports {
+				spec += " " + port.Name + ":" + port.TargetPort.String()
+			}
+			got[s.Name] = service{spec: spec}
+		}
+		slices, err := client.DiscoveryV1().EndpointSlices("default").List(context.TODO(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range slices.Items {
+			var addresses []string
+			for _, e := range s.Endpoints {
+				addresses = append(addresses, e.Addresses...)
+			}
+			slice := string(s.AddressType) + " " + strings.Join(addresses, ",")
+			for _, port := range s.Ports {
+				slice += fmt.Sprintf(" %s:%d", *port.Name, *port.Port)
+			}
+			service := got[s.Labels["kubernetes.io/service-name"]]
+			service.slices = append(service.slices, slice)
+			sort.Strings(service.slices)
+			got[s.Labels["kubernetes.io/service-name"]] = service
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+}
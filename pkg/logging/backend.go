@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/go-logr/logr"
+	tlog "github.com/tetratelabs/log"
+	"go.uber.org/zap"
+)
+
+// tetrateBackend writes through github.com/tetratelabs/log, with a tetratelabs scope per scope so lines carry
+// the scope name. Filtering is left to our scopes, so the tetratelabs scopes emit everything they are given.
+type tetrateBackend struct{}
+
+var tetrateScopes sync.Map // scope name -> *tlog.Scope
+
+// LogToStderr sends the default backend's output to stderr, keeping stdout free for command output
+func LogToStderr() error {
+	o := tlog.DefaultOptions()
+	o.OutputPaths = []string{"stderr"}
+	return tlog.Configure(o)
+}
+
+func (tetrateBackend) Log(level Level, scope, msg string) {
+	s, ok := tetrateScopes.Load(scope)
+	if !ok {
+		ts := tlog.RegisterScope(scope, "", 0)
+		ts.SetOutputLevel(tlog.DebugLevel)
+		s, _ = tetrateScopes.LoadOrStore(scope, ts)
+	}
+	ts := s.(*tlog.Scope)
+	switch level {
+	case DebugLevel:
+		ts.Debug(msg)
+	case InfoLevel:
+		ts.Info(msg)
+	case WarnLevel:
+		ts.Warn(msg)
+	case ErrorLevel:
+		ts.Error(msg)
+	}
+}
+
+// NewLogrBackend returns a backend writing to l, naming loggers after scopes. Debug messages are written at
+// verbosity 1; warnings are written as info with a severity key since logr has no warning level.
+func NewLogrBackend(l logr.Logger) Backend {
+	return logrBackend{l}
+}
+
+type logrBackend struct {
+	l logr.Logger
+}
+
+func (b logrBackend) Log(level Level, scope, msg string) {
+	l := b.l.WithName(scope)
+	switch level {
+	case DebugLevel:
+		l.V(1).Info(msg)
+	case InfoLevel:
+		l.Info(msg)
+	case WarnLevel:
+		l.Info(msg, "severity", "warning")
+	case ErrorLevel:
+		l.Error(nil, msg)
+	}
+}
+
+// NewZapBackend returns a backend writing to l, naming loggers after scopes
+func NewZapBackend(l *zap.Logger) Backend {
+	return zapBackend{l}
+}
+
+type zapBackend struct {
+	l *zap.Logger
+}
+
+func (b zapBackend) Log(level Level, scope, msg string) {
+	l := b.l.Named(scope)
+	switch level {
+	case DebugLevel:
+		l.Debug(msg)
+	case InfoLevel:
+		l.Info(msg)
+	case WarnLevel:
+		l.Warn(msg)
+	case ErrorLevel:
+		l.Error(msg)
+	}
+}
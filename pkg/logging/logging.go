@@ -0,0 +1,245 @@
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the minimum severity a scope emits
+type Level int32
+
+const (
+	// NoneLevel disables logging
+	NoneLevel Level = iota
+	// ErrorLevel only emits errors
+	ErrorLevel
+	// WarnLevel emits warnings and errors
+	WarnLevel
+	// InfoLevel emits informational messages, warnings and errors
+	InfoLevel
+	// DebugLevel emits everything
+	DebugLevel
+)
+
+var levelNames = map[Level]string{
+	NoneLevel:  "none",
+	ErrorLevel: "error",
+	WarnLevel:  "warn",
+	InfoLevel:  "info",
+	DebugLevel: "debug",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return l, nil
+		}
+	}
+	return NoneLevel, errors.Errorf("unknown log level %q", name)
+}
+
+// Backend writes log messages that passed their scope's level
+type Backend interface {
+	Log(level Level, scope, msg string)
+}
+
+// Scope logs for one module of the operator at its own, runtime adjustable, level
+type Scope struct {
+	name  string
+	level int32 // Level, accessed atomically
+}
+
+var (
+	m       sync.RWMutex
+	scopes          = map[string]*Scope{}
+	backend Backend = tetrateBackend{}
+)
+
+// RegisterScope returns the scope with the given name, creating it at InfoLevel if needed
+func RegisterScope(name string) *Scope {
+	m.Lock()
+	defer m.Unlock()
+	if s, ok := scopes[name]; ok {
+		return s
+	}
+	s := &Scope{name: name, level: int32(InfoLevel)}
+	scopes[name] = s
+	return s
+}
+
+// SetBackend replaces the backend every scope writes to
+func SetBackend(b Backend) {
+	m.Lock()
+	defer m.Unlock()
+	backend = b
+}
+
+// SetLevel sets the level of the named scope
+func SetLevel(scope string, level Level) error {
+	m.RLock()
+	s, ok := scopes[scope]
+	m.RUnlock()
+	if !ok {
+		return errors.Errorf("unknown log scope %q", scope)
+	}
+	s.SetLevel(level)
+	return nil
+}
+
+// SetAllLevels sets the level of every registered scope
+func SetAllLevels(level Level) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, s := range scopes {
+		s.SetLevel(level)
+	}
+}
+
+// Levels returns the level of every registered scope
+func Levels() map[string]Level {
+	m.RLock()
+	defer m.RUnlock()
+	out := make(map[string]Level, len(scopes))
+	for name, s := range scopes {
+		out[name] = s.Level()
+	}
+	return out
+}
+
+// Configure applies a level specification: either a single level applied to every scope, or a comma separated
+// list of scope:level pairs, e.g. "info,cloudmap:debug,consul:warn". An invalid specification changes no level.
+func Configure(spec string) error {
+	type setting struct {
+		scope string // empty for every scope
+		level Level
+	}
+	var settings []setting
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		scope, name := "", part
+		if i := strings.Index(part, ":"); i >= 0 {
+			scope, name = part[:i], part[i+1:]
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		if scope != "" {
+			m.RLock()
+			_, ok := scopes[scope]
+			m.RUnlock()
+			if !ok {
+				return errors.Errorf("unknown log scope %q", scope)
+			}
+		}
+		settings = append(settings, setting{scope: scope, level: level})
+	}
+	for _, s := range settings {
+		if s.scope == "" {
+			SetAllLevels(s.level)
+			continue
+		}
+		if err := SetLevel(s.scope, s.level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScopeNames returns the names of all registered scopes, sorted
+func ScopeNames() []string {
+	m.RLock()
+	defer m.RUnlock()
+	names := make([]string, 0, len(scopes))
+	for name := range scopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name of the scope
+func (s *Scope) Name() string {
+	return s.name
+}
+
+// Level the scope currently emits at
+func (s *Scope) Level() Level {
+	return Level(atomic.LoadInt32(&s.level))
+}
+
+// SetLevel changes the level the scope emits at
+func (s *Scope) SetLevel(level Level) {
+	atomic.StoreInt32(&s.level, int32(level))
+}
+
+// Enabled returns whether messages at level are emitted
+func (s *Scope) Enabled(level Level) bool {
+	return level != NoneLevel && s.Level() >= level
+}
+
+func (s *Scope) log(level Level, msg string) {
+	if !s.Enabled(level) {
+		return
+	}
+	m.RLock()
+	b := backend
+	m.RUnlock()
+	b.Log(level, s.name, Redact(msg))
+}
+
+// Debug logs msg at debug level
+func (s *Scope) Debug(msg string) { s.log(DebugLevel, msg) }
+
+// Debugf logs a formatted message at debug level
+func (s *Scope) Debugf(format string, args ...interface{}) {
+	if s.Enabled(DebugLevel) {
+		s.log(DebugLevel, fmt.Sprintf(format, args...))
+	}
+}
+
+// Info logs msg at info level
+func (s *Scope) Info(msg string) { s.log(InfoLevel, msg) }
+
+// Infof logs a formatted message at info level
+func (s *Scope) Infof(format string, args ...interface{}) {
+	if s.Enabled(InfoLevel) {
+		s.log(InfoLevel, fmt.Sprintf(format, args...))
+	}
+}
+
+// Warn logs msg at warn level
+func (s *Scope) Warn(msg string) { s.log(WarnLevel, msg) }
+
+// Warnf logs a formatted message at warn level
+func (s *Scope) Warnf(format string, args ...interface{}) {
+	if s.Enabled(WarnLevel) {
+		s.log(WarnLevel, fmt.Sprintf(format, args...))
+	}
+}
+
+// Error logs msg at error level
+func (s *Scope) Error(msg string) { s.log(ErrorLevel, msg) }
+
+// Errorf logs a formatted message at error level
+func (s *Scope) Errorf(format string, args ...interface{}) {
+	if s.Enabled(ErrorLevel) {
+		s.log(ErrorLevel, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"reflect"
+	"testing"
+)
+
+type recorder struct {
+	lines []string
+}
+
+func (r *recorder) Log(level Level, scope, msg string) {
+	r.lines = append(r.lines, level.String()+" "+scope+" "+msg)
+}
+
+func TestScope_levels(t *testing.T) {
+	tests := []struct {
+		name  string
+		level Level
+		want  []string
+	}{
+		{name: "debug", level: DebugLevel, want: []string{"debug test d 1", "info test i 2", "warn test w 3", "error test e 4"}},
+		{name: "info", level: InfoLevel, want: []string{"info test i 2", "warn test w 3", "error test e 4"}},
+		{name: "error", level: ErrorLevel, want: []string{"error test e 4"}},
+		{name: "none", level: NoneLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			SetBackend(r)
+			defer SetBackend(tetrateBackend{})
+
+			s := RegisterScope("test")
+			s.SetLevel(tt.level)
+			s.Debugf("d %d", 1)
+			s.Infof("i %d", 2)
+			s.Warnf("w %d", 3)
+			s.Errorf("e %d", 4)
+			if !reflect.DeepEqual(r.lines, tt.want) {
+				t.Errorf("logged %q, want %q", r.lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	RegisterScope("a")
+	RegisterScope("b")
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string]Level
+		wantErr bool
+	}{
+		{name: "global level", spec: "warn", want: map[string]Level{"a": WarnLevel, "b": WarnLevel}},
+		{name: "per scope overrides", spec: "info, b:debug", want: map[string]Level{"a": InfoLevel, "b": DebugLevel}},
+		{name: "case insensitive", spec: "ERROR,a:None", want: map[string]Level{"a": NoneLevel, "b": ErrorLevel}},
+		// an invalid specification leaves every level as it was
+		{name: "unknown level", spec: "loud", want: map[string]Level{"a": InfoLevel, "b": InfoLevel}, wantErr: true},
+		{name: "unknown scope", spec: "c:info", want: map[string]Level{"a": InfoLevel, "b": InfoLevel}, wantErr: true},
+		{
+			name:    "unknown scope after a valid part",
+			spec:    "debug,bogus:info",
+			want:    map[string]Level{"a": InfoLevel, "b": InfoLevel},
+			wantErr: true,
+		},
+		{
+			name:    "unknown level after a valid part",
+			spec:    "a:debug,b:loud",
+			want:    map[string]Level{"a": InfoLevel, "b": InfoLevel},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetAllLevels(InfoLevel)
+			err := Configure(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Configure(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			levels := Levels()
+			for scope, want := range tt.want {
+				if levels[scope] != want {
+					t.Errorf("scope %q at %s, want %s", scope, levels[scope], want)
+				}
+			}
+		})
+	}
+}
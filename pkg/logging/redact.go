@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Redaction selects how IP addresses and hostnames are removed from log messages and command output
+type Redaction int32
+
+const (
+	// RedactNone leaves messages untouched
+	RedactNone Redaction = iota
+	// RedactMask replaces addresses and hostnames with a fixed placeholder
+	RedactMask
+	// RedactHash replaces addresses and hostnames with a keyed hash, so the same value can be correlated across
+	// messages without being revealed
+	RedactHash
+)
+
+var redactionNames = map[Redaction]string{
+	RedactNone: "none",
+	RedactMask: "mask",
+	RedactHash: "hash",
+}
+
+func (r Redaction) String() string {
+	return redactionNames[r]
+}
+
+// ParseRedaction returns the redaction mode with the given name
+func ParseRedaction(name string) (Redaction, error) {
+	for r, n := range redactionNames {
+		if strings.EqualFold(n, name) {
+			return r, nil
+		}
+	}
+	return RedactNone, errors.Errorf("unknown redaction mode %q", name)
+}
+
+var (
+	redaction  int32 // Redaction, accessed atomically
+	redactKeyM sync.RWMutex
+	redactKey  []byte
+
+	// ipv4 and ipv6 find candidates, which are only redacted if they parse as addresses
+	ipv4 = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+	ipv6 = regexp.MustCompile(`[0-9A-Fa-f]*:[0-9A-Fa-f:.]*:[0-9A-Fa-f.]*`)
+	// hostname matches dotted names ending in a label starting with a letter, which excludes IPv4 addresses
+	hostname = regexp.MustCompile(`\b(?:[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)+[A-Za-z][A-Za-z0-9-]{0,62}\b`)
+)
+
+// SetRedaction redacts every message logged from now on, and the output passed through Redact. key keys the hashes
+// of RedactHash: hashes only correlate between runs sharing a key.
+func SetRedaction(r Redaction, key []byte) {
+	redactKeyM.Lock()
+	redactKey = append([]byte(nil), key...)
+	redactKeyM.Unlock()
+	atomic.StoreInt32(&redaction, int32(r))
+}
+
+// Redact returns s with IP addresses and hostnames redacted as configured by SetRedaction. Hostnames are found by
+// shape, so other dotted names, e.g. API groups and file names, are redacted as well.
+func Redact(s string) string {
+	r := Redaction(atomic.LoadInt32(&redaction))
+	if r == RedactNone {
+		return s
+	}
+	s = ipv4.ReplaceAllStringFunc(s, func(m string) string {
+		if net.ParseIP(m) == nil {
+			return m
+		}
+		return redactValue(r, "ip", m)
+	})
+	s = ipv6.ReplaceAllStringFunc(s, func(m string) string {
+		if net.ParseIP(m) == nil {
+			return m
+		}
+		return redactValue(r, "ip", m)
+	})
+	return hostname.ReplaceAllStringFunc(s, func(m string) string {
+		return redactValue(r, "host", strings.ToLower(m))
+	})
+}
+
+func redactValue(r Redaction, kind, value string) string {
+	if r == RedactMask {
+		return "<" + kind + ">"
+	}
+	redactKeyM.RLock()
+	mac := hmac.New(sha256.New, redactKey)
+	redactKeyM.RUnlock()
+	mac.Write([]byte(value))
+	// the placeholder must not look like a hostname itself, or the hostname pass would hash it again
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name      string
+		redaction Redaction
+		in        string
+		want      string
+	}{
+		{name: "none", redaction: RedactNone, in: "created svc.ns at 10.0.0.1", want: "created svc.ns at 10.0.0.1"},
+		{name: "mask IPv4 and hostname", redaction: RedactMask, in: "created svc.ns at 10.0.0.1", want: "created <host> at <ip>"},
+		{name: "mask IPv6", redaction: RedactMask, in: "no port found for address 2001:db8::1, assuming", want: "no port found for address <ip>, assuming"},
+		{name: "keeps times and durations", redaction: RedactMask, in: "synced at 12:52:09 after 1.5s", want: "synced at 12:52:09 after 1.5s"},
+		{name: "keeps out of range numbers", redaction: RedactMask, in: "version 1.2.3.400", want: "version 1.2.3.400"},
+		{
+			name:      "hash",
+			redaction: RedactHash,
+			in:        "10.0.0.1 svc.ns SVC.NS",
+			want:      "ip-27d9fca0cead host-c431d447a1d8 host-c431d447a1d8",
+		},
+	}
+	defer SetRedaction(RedactNone, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetRedaction(tt.redaction, []byte("key"))
+			if got := Redact(tt.in); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedact_key(t *testing.T) {
+	defer SetRedaction(RedactNone, nil)
+	SetRedaction(RedactHash, []byte("a"))
+	a := Redact("svc.ns")
+	SetRedaction(RedactHash, []byte("b"))
+	if b := Redact("svc.ns"); a == b || !strings.HasPrefix(b, "host-") {
+		t.Errorf("hashes with different keys are %q and %q, want distinct host hashes", a, b)
+	}
+}
+
+func TestScope_redacts(t *testing.T) {
+	r := &recorder{}
+	SetBackend(r)
+	defer SetBackend(tetrateBackend{})
+	SetRedaction(RedactMask, nil)
+	defer SetRedaction(RedactNone, nil)
+
+	s := RegisterScope("redact-test")
+	s.Infof("created %s for %s", "cloudmap-svc.ns", "10.0.0.1")
+	if want := "info redact-test created <host> for <ip>"; len(r.lines) != 1 || r.lines[0] != want {
+		t.Errorf("logged %q, want %q", r.lines, want)
+	}
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric exported by the operator
+const namespace = "istio_registry_sync"
+
+var (
+	// HostFlaps counts hosts whose endpoints changed and then reverted before the change was propagated
+	HostFlaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "host_flaps_total",
+		Help:      "Number of times a host's endpoints oscillated back to their last stable state before the change persisted.",
+	}, []string{"prefix"})
+
+	// DampedHosts is the number of hosts currently holding their last stable state while a change is pending
+	DampedHosts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "damped_hosts",
+		Help:      "Number of hosts with a pending endpoint change that has not yet persisted long enough to be propagated.",
+	}, []string{"prefix"})
+
+	// EndpointBudget is the maximum number of endpoints ingested by the providers sharing a budget
+	EndpointBudget = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "endpoint_budget",
+		Help:      "Maximum number of endpoints ingested by the providers sharing the budget.",
+	}, []string{"budget"})
+
+	// EndpointBudgetUsed is the number of endpoints currently counted against a budget
+	EndpointBudgetUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "endpoint_budget_used",
+		Help:      "Number of endpoints currently held by the providers sharing the budget.",
+	}, []string{"budget"})
+
+	// BudgetRejectedHosts is the number of new hosts currently not ingested because their budget is spent
+	BudgetRejectedHosts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "budget_rejected_hosts",
+		Help:      "Number of hosts present in a registry but not ingested because the endpoint budget is spent.",
+	}, []string{"budget"})
+
+	// InjectedFaults counts the faults injected into a provider's calls, by kind: error, latency or partial
+	InjectedFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "injected_faults_total",
+		Help:      "Number of faults injected into the provider's calls for resilience testing, by kind.",
+	}, []string{"prefix", "kind"})
+
+	// DroppedInstances counts the instances a provider started dropping, by reason: unsupported or invalid_port
+	DroppedInstances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_instances_total",
+		Help:      "Number of times an instance started being dropped, or synced with assumed settings, by reason.",
+	}, []string{"prefix", "reason"})
+
+	// CurrentlyDroppedInstances is the number of instances a provider currently drops
+	CurrentlyDroppedInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dropped_instances",
+		Help:      "Number of instances present in a registry but currently dropped, or synced with assumed settings.",
+	}, []string{"prefix"})
+
+	// CloudMapCalls counts the Cloud Map API calls of a watcher, by operation, each counted once however often retried
+	CloudMapCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_api_calls_total",
+		Help:      "Number of Cloud Map API calls, by operation.",
+	}, []string{"prefix", "operation"})
+
+	// CloudMapCallErrors counts the Cloud Map API calls that failed, after any retries
+	CloudMapCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_api_errors_total",
+		Help:      "Number of Cloud Map API calls that failed after any retries, by operation.",
+	}, []string{"prefix", "operation"})
+
+	// CloudMapThrottles counts the attempts of Cloud Map API calls that were throttled, whether retried or not
+	CloudMapThrottles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_api_throttles_total",
+		Help:      "Number of attempts of Cloud Map API calls throttled by AWS, retried or not, by operation.",
+	}, []string{"prefix", "operation"})
+
+	// CloudMapInstanceLimitHits counts the discoveries of services with more instances than DiscoverInstances returns
+	CloudMapInstanceLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_instance_limit_hits_total",
+		Help:      "Number of times a Cloud Map service had more instances than DiscoverInstances returns, so they were listed page by page instead.",
+	}, []string{"prefix"})
+
+	// CloudMapCircuitOpen is 1 while a Cloud Map watcher's circuit breaker is open, and 0 otherwise
+	CloudMapCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_circuit_open",
+		Help:      "Whether the Cloud Map watcher's circuit breaker is open after too many failed refreshes in a row, so it only probes Cloud Map.",
+	}, []string{"prefix"})
+
+	// CloudMapNoopSyncs counts the refreshes of a Cloud Map watcher that found the registry as last synced
+	CloudMapNoopSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_noop_syncs_total",
+		Help:      "Number of Cloud Map refreshes that found every host as last synced, so the store was left as is.",
+	}, []string{"prefix"})
+
+	// CloudMapPartialRefreshes counts the refreshes of a Cloud Map watcher that kept the hosts of failing namespaces
+	CloudMapPartialRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_partial_refreshes_total",
+		Help:      "Number of Cloud Map refreshes that kept the hosts of the namespaces they failed to refresh as last synced.",
+	}, []string{"prefix"})
+
+	// CloudMapCallDuration is the latency of Cloud Map API calls, retries included
+	CloudMapCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cloudmap_api_call_duration_seconds",
+		Help:      "Duration of Cloud Map API calls, retries included, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"prefix", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(HostFlaps, DampedHosts, EndpointBudget, EndpointBudgetUsed, BudgetRejectedHosts, InjectedFaults,
+		DroppedInstances, CurrentlyDroppedInstances, CloudMapCalls, CloudMapCallErrors, CloudMapThrottles,
+		CloudMapCallDuration, CloudMapInstanceLimitHits, CloudMapCircuitOpen,
+		CloudMapNoopSyncs, CloudMapPartialRefreshes)
+}
+
+// RegisterStaleness exports the time since the provider identified by prefix last synced successfully.
+// Providers that have never synced report +Inf.
+func RegisterStaleness(prefix string, lastSync func() time.Time) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "seconds_since_last_successful_sync",
+		Help:        "Seconds since the provider last refreshed its store successfully.",
+		ConstLabels: prometheus.Labels{"prefix": prefix},
+	}, func() float64 {
+		last := lastSync()
+		if last.IsZero() {
+			return math.Inf(1)
+		}
+		return time.Since(last).Seconds()
+	}))
+}
+
+// Handler returns an http.Handler serving all registered metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
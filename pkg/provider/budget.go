@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"sort"
+	"sync"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+// maxLoggedHosts limits how many rejected hosts are named in the log
+const maxLoggedHosts = 10
+
+// Budget caps the number of endpoints held across every store sharing it. Endpoints are what the operator's memory
+// use, and the size of the ServiceEntries it writes, grow with. Once the budget is spent, stores keep updating
+// the hosts they already hold but stop ingesting new ones, so a registry growing out of bounds degrades to a
+// stable mesh rather than an OOM-killed pod.
+type Budget struct {
+	name string // identifies the budget in metrics and logs
+	max  int
+
+	m        sync.Mutex
+	used     map[*store]int      // endpoints held by each store
+	rejected map[*store][]string // new hosts each store couldn't ingest on its last Set
+}
+
+// NewBudget returns a budget of max endpoints, named in metrics and logs
+func NewBudget(name string, max int) *Budget {
+	metrics.EndpointBudget.WithLabelValues(name).Set(float64(max))
+	return &Budget{name: name, max: max, used: make(map[*store]int), rejected: make(map[*store][]string)}
+}
+
+// admit returns the subset of desired hosts the store may hold: every host it already holds, then new hosts in
+// name order while they fit within the budget
+func (b *Budget) admit(s *store, current, desired map[string][]*v1alpha3.WorkloadEntry) map[string][]*v1alpha3.WorkloadEntry {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	others := 0
+	for other, n := range b.used {
+		if other != s {
+			others += n
+		}
+	}
+	used := others
+	admitted := make(map[string][]*v1alpha3.WorkloadEntry, len(desired))
+	var added []string
+	for host, wes := range desired {
+		if _, ok := current[host]; ok {
+			admitted[host] = wes
+			used += len(wes)
+			continue
+		}
+		added = append(added, host)
+	}
+	sort.Strings(added)
+	var rejected []string
+	for _, host := range added {
+		if used+len(desired[host]) > b.max {
+			rejected = append(rejected, host)
+			continue
+		}
+		admitted[host] = desired[host]
+		used += len(desired[host])
+	}
+
+	if len(rejected) != len(b.rejected[s]) {
+		if len(rejected) > 0 {
+			sample := rejected
+			if len(sample) > maxLoggedHosts {
+				sample = sample[:maxLoggedHosts]
+			}
+			log.Warnf("endpoint budget %q of %d is spent, not ingesting %d new hosts, including %v",
+				b.name, b.max, len(rejected), sample)
+		} else {
+			log.Infof("endpoint budget %q of %d has room again, all hosts ingested", b.name, b.max)
+		}
+	}
+	b.used[s] = used - others
+	b.rejected[s] = rejected
+	b.updateMetrics()
+	return admitted
+}
+
+func (b *Budget) updateMetrics() {
+	used, rejected := 0, 0
+	for s, n := range b.used {
+		used += n
+		rejected += len(b.rejected[s])
+	}
+	metrics.EndpointBudgetUsed.WithLabelValues(b.name).Set(float64(used))
+	metrics.BudgetRejectedHosts.WithLabelValues(b.name).Set(float64(rejected))
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+func endpoints(n int) []*v1alpha3.WorkloadEntry {
+	wes := make([]*v1alpha3.WorkloadEntry, n)
+	for i := range wes {
+		wes[i] = &v1alpha3.WorkloadEntry{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}}
+	}
+	return wes
+}
+
+func hostNames(hosts map[string][]*v1alpha3.WorkloadEntry) []string {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		initial map[string][]*v1alpha3.WorkloadEntry
+		other   map[string][]*v1alpha3.WorkloadEntry // held by another store sharing the budget
+		desired map[string][]*v1alpha3.WorkloadEntry
+		want    []string
+	}{
+		{
+			name:    "everything fits",
+			max:     10,
+			desired: map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(3), "b": endpoints(3)},
+			want:    []string{"a", "b"},
+		},
+		{
+			name:    "new hosts admitted in name order until spent",
+			max:     5,
+			desired: map[string][]*v1alpha3.WorkloadEntry{"c": endpoints(2), "a": endpoints(2), "b": endpoints(2)},
+			want:    []string{"a", "b"},
+		},
+		{
+			name:    "smaller new hosts still fit after a rejection",
+			max:     5,
+			desired: map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(2), "b": endpoints(4), "c": endpoints(3)},
+			want:    []string{"a", "c"},
+		},
+		{
+			name:    "existing hosts keep updating past the budget",
+			max:     4,
+			initial: map[string][]*v1alpha3.WorkloadEntry{"b": endpoints(2)},
+			desired: map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(1), "b": endpoints(5)},
+			want:    []string{"b"},
+		},
+		{
+			name:    "budget is shared across stores",
+			max:     5,
+			other:   map[string][]*v1alpha3.WorkloadEntry{"x": endpoints(4)},
+			desired: map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(2), "b": endpoints(1)},
+			want:    []string{"b"},
+		},
+		{
+			name:    "removed hosts free the budget",
+			max:     4,
+			initial: map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(4)},
+			desired: map[string][]*v1alpha3.WorkloadEntry{"b": endpoints(4)},
+			want:    []string{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBudget("test", tt.max)
+			NewStore(WithBudget(b)).Set(tt.other)
+			st := NewStore(WithBudget(b))
+			st.Set(tt.initial)
+			st.Set(tt.desired)
+			if got := hostNames(st.Hosts()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBudget_synced(t *testing.T) {
+	b := NewBudget("test", 4)
+	other := NewStore(WithBudget(b))
+	other.Set(map[string][]*v1alpha3.WorkloadEntry{"x": endpoints(3)})
+	st := NewStore(WithBudget(b))
+	st.Set(map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(2)})
+	if got := hostNames(st.Hosts()); len(got) != 0 {
+		t.Fatalf("Hosts() = %v, want none while the budget is spent", got)
+	}
+	other.Set(nil)
+	st.Synced()
+	if got, want := hostNames(st.Hosts()), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Hosts() after Synced() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/metrics"
+)
+
+// Reasons an instance isn't synced as its registry describes it
+const (
+	// DroppedUnsupported instances have no address the mesh can route to, e.g. Cloud Map alias records
+	DroppedUnsupported = "unsupported"
+	// DroppedInvalidPort instances have a port that isn't a number; they're synced with http (80) and https (443)
+	DroppedInvalidPort = "invalid_port"
+	// DroppedInvalidWeight instances have a weight that isn't a whole number; they're synced without one
+	DroppedInvalidWeight = "invalid_weight"
+)
+
+// Dropped is an instance of a host that isn't synced as its registry describes it, and why
+type Dropped struct {
+	Host   string `json:"host"`
+	ID     string `json:"id,omitempty"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// DroppedLister is implemented by watchers that keep track of the instances they drop
+type DroppedLister interface {
+	Dropped() []Dropped
+}
+
+// Drops holds the instances a watcher currently drops, counting newly dropped ones in metrics
+type Drops struct {
+	prefix string
+	m      sync.RWMutex
+	byKey  map[Dropped]struct{}
+}
+
+// NewDrops returns the drops of the watcher identified by prefix
+func NewDrops(prefix string) *Drops {
+	return &Drops{prefix: prefix, byKey: make(map[Dropped]struct{})}
+}
+
+// Set replaces the dropped instances with dropped
+func (d *Drops) Set(dropped []Dropped) {
+	byKey := make(map[Dropped]struct{}, len(dropped))
+	d.m.Lock()
+	defer d.m.Unlock()
+	for _, drop := range dropped {
+		if _, ok := d.byKey[drop]; !ok {
+			metrics.DroppedInstances.WithLabelValues(d.prefix, drop.Reason).Inc()
+		}
+		byKey[drop] = struct{}{}
+	}
+	d.byKey = byKey
+	metrics.CurrentlyDroppedInstances.WithLabelValues(d.prefix).Set(float64(len(byKey)))
+}
+
+// List returns the dropped instances sorted by host and ID
+func (d *Drops) List() []Dropped {
+	d.m.RLock()
+	dropped := make([]Dropped, 0, len(d.byKey))
+	for drop := range d.byKey {
+		dropped = append(dropped, drop)
+	}
+	d.m.RUnlock()
+	sort.Slice(dropped, func(i, j int) bool {
+		if dropped[i].Host != dropped[j].Host {
+			return dropped[i].Host < dropped[j].Host
+		}
+		if dropped[i].ID != dropped[j].ID {
+			return dropped[i].ID < dropped[j].ID
+		}
+		return dropped[i].Reason < dropped[j].Reason
+	})
+	return dropped
+}
+
+// DroppedHandler serves the instances dropped by each of watchers, by prefix, as JSON. Watchers that don't keep
+// track of them are left out. Hosts, IDs and details are redacted as logs are.
+func DroppedHandler(watchers map[string]Watcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		dropped := make(map[string][]Dropped, len(watchers))
+		for prefix, watcher := range watchers {
+			l, ok := watcher.(DroppedLister)
+			if !ok {
+				continue
+			}
+			list := l.Dropped()
+			redacted := make([]Dropped, 0, len(list))
+			for _, drop := range list {
+				drop.Host, drop.ID = logging.Redact(drop.Host), logging.Redact(drop.ID)
+				drop.Detail = logging.Redact(drop.Detail)
+				redacted = append(redacted, drop)
+			}
+			dropped[prefix] = redacted
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dropped); err != nil {
+			log.Errorf("error writing dropped instances: %v", err)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+)
+
+var (
+	alias    = Dropped{Host: "b.tetrate.io", ID: "b-1", Reason: DroppedUnsupported, Detail: "alias records are not supported"}
+	badPort  = Dropped{Host: "a.tetrate.io", ID: "a-2", Reason: DroppedInvalidPort}
+	noSource = Dropped{Host: "a.tetrate.io", ID: "a-1", Reason: DroppedUnsupported}
+)
+
+func TestDrops(t *testing.T) {
+	d := NewDrops("test-")
+	if got := d.List(); len(got) != 0 {
+		t.Errorf("List() = %v before any Set, want none", got)
+	}
+	d.Set([]Dropped{alias, badPort, noSource})
+	if got, want := d.List(), []Dropped{noSource, badPort, alias}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	d.Set([]Dropped{alias})
+	if got, want := d.List(), []Dropped{alias}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+// droppingWatcher is a watcher that keeps track of the instances it drops
+type droppingWatcher struct {
+	Watcher
+	dropped []Dropped
+}
+
+func (w droppingWatcher) Dropped() []Dropped {
+	return w.dropped
+}
+
+type plainWatcher struct {
+	Watcher
+}
+
+func TestDroppedHandler(t *testing.T) {
+	h := DroppedHandler(map[string]Watcher{
+		"tenant-cloudmap-": droppingWatcher{dropped: []Dropped{alias}},
+		"tenant-consul-":   droppingWatcher{dropped: []Dropped{}},
+		"synthetic-":       plainWatcher{},
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/dropped", nil))
+	var got map[string][]Dropped
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	want := map[string][]Dropped{"tenant-cloudmap-": {alias}, "tenant-consul-": {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDroppedHandler_redaction(t *testing.T) {
+	logging.SetRedaction(logging.RedactMask, nil)
+	defer logging.SetRedaction(logging.RedactNone, nil)
+	h := DroppedHandler(map[string]Watcher{
+		"consul-": droppingWatcher{dropped: []Dropped{
+			{Host: "a.tetrate.io", ID: "10.0.0.1:80", Reason: DroppedInvalidPort, Detail: `port "http" of 10.0.0.1`},
+		}},
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/dropped", nil))
+	var got map[string][]Dropped
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	want := map[string][]Dropped{"consul-": {
+		{Host: "<host>", ID: "<ip>:80", Reason: DroppedInvalidPort, Detail: `port "http" of <ip>`},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
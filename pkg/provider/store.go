@@ -1,52 +1,260 @@
 package provider
 
 import (
+	"reflect"
 	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/changelog"
 )
 
 type (
 	// Store describes a set of Istio workload entry objects from Cloud Map/Consul stored by the hostnames that own them.
 	// It is asynchronously accessed by a provider and the synchronizer
 	Store interface {
-		// Hosts are all hosts Cloud Map/Consul has told us about
+		// Hosts are all hosts Cloud Map/Consul has told us about. The map is shared with other readers and
+		// replaced rather than modified by Set, so it must not be modified.
 		Hosts() map[string][]*v1alpha3.WorkloadEntry
+		// Set replaces every host
 		Set(hosts map[string][]*v1alpha3.WorkloadEntry)
+		// Apply changes only the hosts in the delta, for providers that know what changed
+		Apply(d Delta)
+		// Annotations are those of the Service Entries of the hosts, by host. Like Hosts, the map is replaced rather
+		// than modified by Annotate, so it must not be modified.
+		Annotations() map[string]map[string]string
+		// Annotate replaces the annotations of every host, recording the hosts whose annotations changed
+		Annotate(annotations map[string]map[string]string)
+		// Revision changes whenever Set or Apply changes the hosts, so readers can skip work when it hasn't
+		Revision() uint64
+		// Changes returns the hosts changed after revision since, or false if the store no longer knows and the
+		// reader has to compare every host
+		Changes(since uint64) (map[string]struct{}, bool)
+		// Synced records a successful refresh that didn't change any hosts, admitting those the budget held back if
+		// it now can
+		Synced()
+		// LastSync is when the provider last refreshed the store successfully; zero if it never has
+		LastSync() time.Time
+		// HeldBack are the hosts the provider reported that the budget keeps out of Hosts. They may have been
+		// published before a restart emptied the store, so their resources must be kept rather than collected.
+		HeldBack() map[string]struct{}
 	}
 
 	store struct {
-		m     *sync.RWMutex
-		hosts map[string][]*v1alpha3.WorkloadEntry // maps host->workloadEntry
+		m        *sync.RWMutex
+		hosts    map[string][]*v1alpha3.WorkloadEntry // maps host->workloadEntry; replaced, never modified
+		desired  map[string][]*v1alpha3.WorkloadEntry // hosts last reported by the provider, if the budget held some back
+		changes  *changelog.Log
+		lastSync time.Time
+		budget   *Budget // limits the hosts Set ingests, if not nil
+
+		// the annotations of the hosts' Service Entries by host; replaced, never modified
+		annotations map[string]map[string]string
+	}
+
+	// StoreOption configures a store
+	StoreOption func(*store)
+
+	// Delta is a change to some of a store's hosts
+	Delta struct {
+		// Updated are hosts that were added or whose endpoints changed
+		Updated map[string][]*v1alpha3.WorkloadEntry
+		// Removed are hosts that no longer exist
+		Removed []string
 	}
 )
 
+// WithBudget counts the store's endpoints against the budget, which may be shared with other stores
+func WithBudget(b *Budget) StoreOption {
+	return func(s *store) {
+		s.budget = b
+	}
+}
+
 // NewStore returns a store
-func NewStore() Store {
-	return &store{
-		hosts: make(map[string][]*v1alpha3.WorkloadEntry),
-		m:     &sync.RWMutex{},
+func NewStore(opts ...StoreOption) Store {
+	s := &store{
+		hosts:   make(map[string][]*v1alpha3.WorkloadEntry),
+		changes: changelog.New(),
+		m:       &sync.RWMutex{},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *store) Hosts() map[string][]*v1alpha3.WorkloadEntry {
 	s.m.RLock()
 	defer s.m.RUnlock()
-	return copyMap(s.hosts)
+	return s.hosts
 }
 
 func (s *store) Set(hosts map[string][]*v1alpha3.WorkloadEntry) {
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.hosts = copyMap(hosts)
+	s.set(hosts)
+}
+
+func (s *store) Apply(d Delta) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	// deltas apply to what the provider reported, so hosts the budget held back are admitted once it allows
+	current := s.hosts
+	if s.desired != nil {
+		current = s.desired
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, len(current)+len(d.Updated))
+	for host, wes := range current {
+		hosts[host] = wes
+	}
+	for host, wes := range d.Updated {
+		hosts[host] = wes
+	}
+	for _, host := range d.Removed {
+		delete(hosts, host)
+	}
+	s.set(hosts)
+}
+
+func (s *store) set(hosts map[string][]*v1alpha3.WorkloadEntry) {
+	if s.budget != nil {
+		admitted := s.budget.admit(s, s.hosts, hosts)
+		s.desired = nil
+		if len(admitted) < len(hosts) {
+			s.desired = make(map[string][]*v1alpha3.WorkloadEntry, len(hosts))
+			for host, wes := range hosts {
+				s.desired[host] = wes
+			}
+		}
+		hosts = admitted
+	}
+	s.lastSync = time.Now()
+	changed := diff(s.hosts, hosts)
+	if len(changed) == 0 {
+		log.Debugf("store unchanged with %d hosts", len(hosts))
+		return
+	}
+	s.hosts = merge(s.hosts, hosts)
+	s.changes.Record(changed...)
+	log.Debugf("store updated with %d hosts, %d of them changed", len(hosts), len(changed))
+}
+
+func (s *store) Annotations() map[string]map[string]string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.annotations
 }
 
-func copyMap(m map[string][]*v1alpha3.WorkloadEntry) map[string][]*v1alpha3.WorkloadEntry {
-	out := make(map[string][]*v1alpha3.WorkloadEntry, len(m))
-	for k, v := range m {
-		wes := make([]*v1alpha3.WorkloadEntry, len(v))
-		copy(wes, v)
-		out[k] = wes
+func (s *store) Annotate(annotations map[string]map[string]string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var changed []string
+	for host, a := range annotations {
+		if !reflect.DeepEqual(s.annotations[host], a) {
+			changed = append(changed, host)
+		}
+	}
+	for host := range s.annotations {
+		if _, ok := annotations[host]; !ok {
+			changed = append(changed, host)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	s.annotations = annotations
+	s.changes.Record(changed...)
+	log.Debugf("store annotations updated, %d hosts changed", len(changed))
+}
+
+func (s *store) Revision() uint64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.changes.Revision()
+}
+
+func (s *store) Changes(since uint64) (map[string]struct{}, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.changes.Since(since)
+}
+
+func (s *store) Synced() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.desired != nil {
+		// other stores sharing the budget may have made room for the hosts it held back since
+		s.set(s.desired)
+		return
+	}
+	s.lastSync = time.Now()
+}
+
+func (s *store) LastSync() time.Time {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.lastSync
+}
+
+func (s *store) HeldBack() map[string]struct{} {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.desired == nil {
+		return nil
+	}
+	held := make(map[string]struct{}, len(s.desired)-len(s.hosts))
+	for host := range s.desired {
+		if _, ok := s.hosts[host]; !ok {
+			held[host] = struct{}{}
+		}
+	}
+	return held
+}
+
+// diff returns the hosts added, changed or removed by hosts, without allocating if there are none
+func diff(current, hosts map[string][]*v1alpha3.WorkloadEntry) []string {
+	var changed []string
+	for host, wes := range hosts {
+		if old, ok := current[host]; !ok || !equalEndpoints(old, wes) {
+			changed = append(changed, host)
+		}
+	}
+	for host := range current {
+		if _, ok := hosts[host]; !ok {
+			changed = append(changed, host)
+		}
+	}
+	return changed
+}
+
+// merge copies hosts into a new map, sharing current's slices for hosts whose endpoints are unchanged so
+// unchanged hosts cost no allocations
+func merge(current, hosts map[string][]*v1alpha3.WorkloadEntry) map[string][]*v1alpha3.WorkloadEntry {
+	out := make(map[string][]*v1alpha3.WorkloadEntry, len(hosts))
+	for host, wes := range hosts {
+		if old, ok := current[host]; ok && equalEndpoints(old, wes) {
+			out[host] = old
+			continue
+		}
+		cp := make([]*v1alpha3.WorkloadEntry, len(wes))
+		copy(cp, wes)
+		out[host] = cp
 	}
 	return out
 }
+
+func equalEndpoints(a, b []*v1alpha3.WorkloadEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// providers reuse unchanged entries, making the pointer comparison the common case
+		if a[i] != b[i] && !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
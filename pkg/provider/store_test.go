@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"reflect"
 	"testing"
 
 	"istio.io/api/networking/v1alpha3"
@@ -21,3 +22,125 @@ func Test_store(t *testing.T) {
 		}
 	})
 }
+
+func Test_storeLastSync(t *testing.T) {
+	st := NewStore()
+	if !st.LastSync().IsZero() {
+		t.Errorf("LastSync() = %v before any sync, want zero", st.LastSync())
+	}
+	st.Set(map[string][]*v1alpha3.WorkloadEntry{})
+	set := st.LastSync()
+	if set.IsZero() {
+		t.Fatal("LastSync() is zero after Set")
+	}
+	st.Synced()
+	if st.LastSync().Before(set) {
+		t.Errorf("LastSync() = %v after Synced, want at or after %v", st.LastSync(), set)
+	}
+}
+
+func Test_storeRevision(t *testing.T) {
+	we := &v1alpha3.WorkloadEntry{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}}
+	st := NewStore()
+	st.Set(map[string][]*v1alpha3.WorkloadEntry{"tetrate.io": {we}})
+	rev, hosts := st.Revision(), st.Hosts()
+
+	// an equal, but newly built, entry is no change
+	st.Set(map[string][]*v1alpha3.WorkloadEntry{"tetrate.io": {
+		{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}},
+	}})
+	if st.Revision() != rev {
+		t.Errorf("Revision() = %d after an unchanged Set, want %d", st.Revision(), rev)
+	}
+	if st.Hosts()["tetrate.io"][0] != we {
+		t.Errorf("unchanged Set replaced the stored Workload Entries")
+	}
+
+	st.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"tetrate.io": {we},
+		"istio.io":   {{Address: "8.8.8.8", Ports: map[string]uint32{"http": 80}}},
+	})
+	if st.Revision() == rev {
+		t.Errorf("Revision() unchanged after adding a host")
+	}
+	if len(hosts) != 1 {
+		t.Errorf("Set modified the hosts returned before it: %v", hosts)
+	}
+}
+
+func Test_storeApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		budget      int
+		initial     map[string][]*v1alpha3.WorkloadEntry
+		delta       Delta
+		want        []string
+		wantChanged map[string]struct{}
+	}{
+		{
+			name:        "updates and removes only the hosts in the delta",
+			initial:     map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(1), "b": endpoints(1), "c": endpoints(1)},
+			delta:       Delta{Updated: map[string][]*v1alpha3.WorkloadEntry{"b": endpoints(2), "d": endpoints(1)}, Removed: []string{"c"}},
+			want:        []string{"a", "b", "d"},
+			wantChanged: map[string]struct{}{"b": {}, "c": {}, "d": {}},
+		},
+		{
+			name:        "an unchanged host is no change",
+			initial:     map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(1)},
+			delta:       Delta{Updated: map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(1)}},
+			want:        []string{"a"},
+			wantChanged: map[string]struct{}{},
+		},
+		{
+			name:        "hosts held back by the budget are admitted once it allows",
+			budget:      2,
+			initial:     map[string][]*v1alpha3.WorkloadEntry{"a": endpoints(2), "b": endpoints(2)},
+			delta:       Delta{Removed: []string{"a"}},
+			want:        []string{"b"},
+			wantChanged: map[string]struct{}{"a": {}, "b": {}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []StoreOption
+			if tt.budget > 0 {
+				opts = append(opts, WithBudget(NewBudget("test", tt.budget)))
+			}
+			st := NewStore(opts...)
+			st.Set(tt.initial)
+			revision := st.Revision()
+			st.Apply(tt.delta)
+			if got := hostNames(st.Hosts()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+			if got, ok := st.Changes(revision); !ok || !reflect.DeepEqual(got, tt.wantChanged) {
+				t.Errorf("Changes(%d) = %v, %v, want %v", revision, got, ok, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func Test_storeAnnotate(t *testing.T) {
+	st := NewStore()
+	revision := st.Revision()
+	st.Annotate(map[string]map[string]string{"a": {"description": "web"}, "b": {"description": "api"}})
+	if got, ok := st.Changes(revision); !ok || len(got) != 2 {
+		t.Errorf("Changes(%d) = %v, %v after annotating two hosts", revision, got, ok)
+	}
+
+	revision = st.Revision()
+	st.Annotate(map[string]map[string]string{"a": {"description": "web"}, "c": {"description": "db"}})
+	want := map[string]struct{}{"b": {}, "c": {}}
+	if got, ok := st.Changes(revision); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("Changes(%d) = %v, %v, want %v", revision, got, ok, want)
+	}
+	if got := st.Annotations()["c"]["description"]; got != "db" {
+		t.Errorf("Annotations() of c = %q, want db", got)
+	}
+
+	revision = st.Revision()
+	st.Annotate(map[string]map[string]string{"a": {"description": "web"}, "c": {"description": "db"}})
+	if st.Revision() != revision {
+		t.Errorf("Revision() = %d after unchanged annotations, want %d", st.Revision(), revision)
+	}
+}
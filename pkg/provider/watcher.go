@@ -5,6 +5,19 @@ import "context"
 // Watcher is the interface of each provider
 type Watcher interface {
 	Run(ctx context.Context)
+	// Refresh performs a single sync of the provider into its store
+	Refresh(ctx context.Context) error
 	Store() Store
 	Prefix() string
 }
+
+// Checker is implemented by watchers that can verify they reach their registry with the permissions they need,
+// without reading it in full
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Readier is implemented by watchers that can tell their registry has been failing them for too long to be trusted
+type Readier interface {
+	Ready() error
+}
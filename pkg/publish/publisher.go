@@ -0,0 +1,135 @@
+package publish
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// Publisher keeps a resource published for every host of a store that has one
+type Publisher[T v1.Object] struct {
+	Resources[T]
+	Owner  v1.OwnerReference
+	Store  provider.Store
+	Prefix string
+	// Render returns the resource publishing host, or false if the host has none
+	Render func(host string, wes []*v1alpha3.WorkloadEntry) (T, bool, error)
+	// Host returns the host a resource of the owner's was published for, or false if it wasn't published for our
+	// prefix; nil recovers the host from names made by infer.ServiceEntryName
+	Host func(T) (string, bool)
+	// Key identifies a resource among the existing and the desired ones; nil keys them by name
+	Key func(T) string
+	// StalenessThreshold suspends deleting resources while the store hasn't synced successfully for longer; zero
+	// never does
+	StalenessThreshold time.Duration
+	Interval           time.Duration
+	Log                *logging.Scope
+
+	// the store revision at the last sync that left nothing to retry
+	settled  bool
+	revision uint64
+}
+
+// Run the publisher until the context is cancelled
+func (p *Publisher[T]) Run(ctx context.Context) {
+	Run(ctx, p.Interval, p.Sync, func(err error) {
+		p.Log.Errorf("error publishing %s for %q: %v", p.Plural, p.Prefix, err)
+	})
+}
+
+// Ready returns an error if the store hasn't synced successfully within the staleness threshold
+func (p *Publisher[T]) Ready() error {
+	if p.StalenessThreshold <= 0 {
+		return nil
+	}
+	last := p.Store.LastSync()
+	if last.IsZero() {
+		return errors.Errorf("provider %q has not synced yet", p.Prefix)
+	}
+	if since := time.Since(last); since > p.StalenessThreshold {
+		return errors.Errorf("provider %q last synced %v ago, exceeding the staleness threshold of %v",
+			p.Prefix, since.Round(time.Second), p.StalenessThreshold)
+	}
+	return nil
+}
+
+// Sync creates, updates and deletes resources to match the store's hosts. The resources of hosts the budget holds
+// back, or that fail to render, are kept as last published.
+func (p *Publisher[T]) Sync(ctx context.Context) error {
+	revision := p.Store.Revision()
+	if p.settled && revision == p.revision {
+		return nil
+	}
+	p.settled = false
+	r := &Reconciler[T]{Resources: p.Resources, Owner: p.Owner, Key: p.Key, Ready: p.Ready, Log: p.Log,
+		Ours: func(obj T) bool {
+			_, ok := p.host(obj)
+			return ok
+		}}
+
+	hosts := p.Store.Hosts()
+	sorted := make([]string, 0, len(hosts))
+	for host := range hosts {
+		sorted = append(sorted, host)
+	}
+	// sorted so that which of two hosts sharing a resource wins doesn't change between syncs
+	sort.Strings(sorted)
+	// hosts the budget holds back may still be served with what was published before a restart
+	kept := make(map[string]struct{})
+	for host := range p.Store.HeldBack() {
+		kept[host] = struct{}{}
+	}
+	var failures int
+	var desired []T
+	published := make(map[string]string, len(hosts)) // host by resource key
+	for _, host := range sorted {
+		obj, ok, err := p.Render(host, hosts[host])
+		if err != nil {
+			p.Log.Errorf("error rendering the %s of %q, keeping it as published: %v", p.Kind, host, err)
+			kept[host] = struct{}{}
+			failures++
+			continue
+		}
+		if !ok {
+			continue
+		}
+		key := r.key(obj)
+		if other, ok := published[key]; ok {
+			p.Log.Errorf("hosts %q and %q both map to %s %q, skipping %q", other, host, p.Kind, key, host)
+			continue
+		}
+		published[key] = host
+		desired = append(desired, obj)
+	}
+
+	n, collected, err := r.Reconcile(ctx, desired, func(obj T) bool {
+		host, _ := p.host(obj)
+		_, ok := kept[host]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+	if failures += n; failures > 0 {
+		return errors.Errorf("failed to write %d %s", failures, p.Plural)
+	}
+	// retry garbage collection once the store is fresh again, even if its hosts haven't changed
+	p.settled, p.revision = collected, revision
+	return nil
+}
+
+func (p *Publisher[T]) host(obj T) (string, bool) {
+	if p.Host != nil {
+		return p.Host(obj)
+	}
+	// infer.ServiceEntryName prefixes the host
+	return strings.CutPrefix(obj.GetName(), p.Prefix)
+}
@@ -0,0 +1,218 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+var (
+	owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: "us"}
+	log   = logging.RegisterScope("publish")
+)
+
+func TestOwns(t *testing.T) {
+	restarted := owner
+	restarted.UID = "us, restarted"
+	other := owner
+	other.Name = "other"
+	tests := []struct {
+		name string
+		refs []v1.OwnerReference
+		want bool
+	}{
+		{name: "no owner"},
+		{name: "us", refs: []v1.OwnerReference{owner}, want: true},
+		{name: "a previous run of us", refs: []v1.OwnerReference{restarted}, want: true},
+		{name: "another instance", refs: []v1.OwnerReference{other}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Owns(owner, tt.refs); got != tt.want {
+				t.Errorf("Owns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newPublisher returns a publisher of a ConfigMap per host, holding its first endpoint's address. Hosts whose
+// address is "invalid" fail to render.
+func newPublisher(owner v1.OwnerReference, store provider.Store,
+	client typedcorev1.ConfigMapInterface) *Publisher[*corev1.ConfigMap] {
+	return &Publisher[*corev1.ConfigMap]{
+		Resources: Resources[*corev1.ConfigMap]{
+			Kind:   "ConfigMap",
+			Plural: "ConfigMaps",
+			List: func(ctx context.Context) ([]*corev1.ConfigMap, error) {
+				list, err := client.List(ctx, v1.ListOptions{})
+				if err != nil {
+					return nil, err
+				}
+				var out []*corev1.ConfigMap
+				for i := range list.Items {
+					out = append(out, &list.Items[i])
+				}
+				return out, nil
+			},
+			Get: func(ctx context.Context, desired *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+				return client.Get(ctx, desired.Name, v1.GetOptions{})
+			},
+			Equal: func(existing, desired *corev1.ConfigMap) bool {
+				return reflect.DeepEqual(existing.Data, desired.Data)
+			},
+			Create: func(ctx context.Context, desired *corev1.ConfigMap) error {
+				_, err := client.Create(ctx, desired, v1.CreateOptions{})
+				return err
+			},
+			Update: func(ctx context.Context, existing, desired *corev1.ConfigMap) error {
+				updated := existing.DeepCopy()
+				updated.Data = desired.Data
+				_, err := client.Update(ctx, updated, v1.UpdateOptions{})
+				return err
+			},
+			Delete: func(ctx context.Context, existing *corev1.ConfigMap) error {
+				return client.Delete(ctx, existing.Name, v1.DeleteOptions{})
+			},
+		},
+		Owner:  owner,
+		Store:  store,
+		Prefix: "cloudmap-",
+		Render: func(host string, wes []*v1alpha3.WorkloadEntry) (*corev1.ConfigMap, bool, error) {
+			if len(wes) == 0 {
+				return nil, false, nil
+			}
+			if wes[0].Address == "invalid" {
+				return nil, false, errors.New("invalid address")
+			}
+			return &corev1.ConfigMap{
+				ObjectMeta: v1.ObjectMeta{
+					Name:            infer.ServiceEntryName("cloudmap-", host),
+					OwnerReferences: []v1.OwnerReference{owner},
+				},
+				Data: map[string]string{"address": wes[0].Address},
+			}, true, nil
+		},
+		StalenessThreshold: time.Minute,
+		Interval:           time.Second,
+		Log:                log,
+	}
+}
+
+// stale is a store that last synced an hour ago
+type stale struct {
+	provider.Store
+}
+
+func (stale) LastSync() time.Time {
+	return time.Now().Add(-time.Hour)
+}
+
+func TestPublisher_Sync(t *testing.T) {
+	other := owner
+	other.Name = "other"
+	client := fake.NewSimpleClientset(
+		// another instance's, and another prefix's of ours
+		&corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "cloudmap-theirs.tetrate.io", Namespace: "default",
+			OwnerReferences: []v1.OwnerReference{other}}},
+		&corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "consul-a.tetrate.io", Namespace: "default",
+			OwnerReferences: []v1.OwnerReference{owner}}},
+	)
+	configMaps := client.CoreV1().ConfigMaps("default")
+	store := provider.NewStore()
+	p := newPublisher(owner, store, configMaps)
+
+	steps := []struct {
+		name    string
+		restart bool // with a new UID, as every run gets
+		stale   bool
+		hosts   map[string][]*v1alpha3.WorkloadEntry
+		want    map[string]string // address by ConfigMap name
+		wantErr bool
+	}{
+		{
+			name: "creates a ConfigMap per host, leaving others' alone",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io":      {infer.WorkloadEntry("10.0.0.1", 80)},
+				"b.tetrate.io":      {infer.WorkloadEntry("10.0.0.2", 80)},
+				"theirs.tetrate.io": {infer.WorkloadEntry("10.0.0.3", 80)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "10.0.0.1", "cloudmap-b.tetrate.io": "10.0.0.2",
+				"cloudmap-theirs.tetrate.io": "", "consul-a.tetrate.io": ""},
+		},
+		{
+			name: "keeps the ConfigMaps of hosts that fail to render",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("invalid", 80)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "10.0.0.1", "cloudmap-theirs.tetrate.io": "",
+				"consul-a.tetrate.io": ""},
+			wantErr: true,
+		},
+		{
+			name:    "takes over the ConfigMaps of the previous run after a restart",
+			restart: true,
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.4", 80)},
+				"c.tetrate.io": {infer.WorkloadEntry("10.0.0.5", 80)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "10.0.0.4", "cloudmap-c.tetrate.io": "10.0.0.5",
+				"cloudmap-theirs.tetrate.io": "", "consul-a.tetrate.io": ""},
+		},
+		{
+			name:  "doesn't delete while the store is stale",
+			stale: true,
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.6", 80)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "10.0.0.6", "cloudmap-c.tetrate.io": "10.0.0.5",
+				"cloudmap-theirs.tetrate.io": "", "consul-a.tetrate.io": ""},
+		},
+		{
+			name: "deletes once the store is fresh again",
+			hosts: map[string][]*v1alpha3.WorkloadEntry{
+				"a.tetrate.io": {infer.WorkloadEntry("10.0.0.6", 80)},
+			},
+			want: map[string]string{"cloudmap-a.tetrate.io": "10.0.0.6", "cloudmap-theirs.tetrate.io": "",
+				"consul-a.tetrate.io": ""},
+		},
+	}
+	for _, step := range steps {
+		if step.restart {
+			restarted := owner
+			restarted.UID = "us, restarted"
+			store = provider.NewStore()
+			p = newPublisher(restarted, store, configMaps)
+		}
+		store.Set(step.hosts)
+		p.Store = store
+		if step.stale {
+			p.Store = stale{store}
+		}
+		if err := p.Sync(context.TODO()); (err != nil) != step.wantErr {
+			t.Fatalf("%s: Sync() error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		list, err := configMaps.List(context.TODO(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, cm := range list.Items {
+			got[cm.Name] = cm.Data["address"]
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Package publish keeps the resources publishers derive from the registry in line with it: it creates and updates
+// what is desired, and deletes what we published before that no longer is, the same way for every kind of resource.
+package publish
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/logging"
+)
+
+// Owns returns whether refs name owner. It matches the owner's API version, kind and name but not its UID, which
+// every run mints anew, so that a restarted instance takes over what it published before. Instances sharing a name,
+// like the pipelines of several regions, tell their resources apart by name prefix.
+func Owns(owner v1.OwnerReference, refs []v1.OwnerReference) bool {
+	for _, ref := range refs {
+		if ref.APIVersion == owner.APIVersion && ref.Kind == owner.Kind && ref.Name == owner.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Resources are the operations a Reconciler needs on the kind of resource it publishes
+type Resources[T v1.Object] struct {
+	// Kind and Plural name the resources in logs and errors, e.g. DNSEndpoint and DNSEndpoints
+	Kind, Plural string
+	// List returns the existing resources, ours among others
+	List func(ctx context.Context) ([]T, error)
+	// Get returns the existing resource of desired's name
+	Get func(ctx context.Context, desired T) (T, error)
+	// Equal returns whether existing already matches desired
+	Equal func(existing, desired T) bool
+	// Create creates desired, returning an AlreadyExists error if its name is taken
+	Create func(ctx context.Context, desired T) error
+	// Update makes existing match desired
+	Update func(ctx context.Context, existing, desired T) error
+	// Delete deletes existing
+	Delete func(ctx context.Context, existing T) error
+}
+
+// Reconciler creates and updates the resources desired, and deletes those of ours that no longer are
+type Reconciler[T v1.Object] struct {
+	Resources[T]
+	// Owner marks the resources we publish
+	Owner v1.OwnerReference
+	// Ours returns whether a resource the owner owns is one this reconciler published; nil takes them all
+	Ours func(T) bool
+	// Key identifies a resource among the existing and the desired ones; nil keys them by name
+	Key func(T) string
+	// Ready suspends deleting resources while it returns an error; nil never does
+	Ready func() error
+	Log   *logging.Scope
+}
+
+// Reconcile creates or updates every desired resource, and deletes the rest of ours but those keep returns true for.
+// It returns the number of writes that failed, and false if deletions were suspended.
+func (r *Reconciler[T]) Reconcile(ctx context.Context, desired []T, keep func(T) bool) (int, bool, error) {
+	list, err := r.List(ctx)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "failed to list %s", r.Plural)
+	}
+	ours := make(map[string]T)
+	for _, obj := range list {
+		if r.owns(obj) {
+			ours[r.key(obj)] = obj
+		}
+	}
+
+	var failures int
+	for _, obj := range desired {
+		key := r.key(obj)
+		existing, ok := ours[key]
+		delete(ours, key)
+		if err := r.write(ctx, key, existing, ok, obj); err != nil {
+			r.Log.Errorf("error writing %s %q: %v", r.Kind, key, err)
+			failures++
+		}
+	}
+
+	for key, obj := range ours {
+		if keep != nil && keep(obj) {
+			delete(ours, key)
+		}
+	}
+	// what's left of ours is no longer desired
+	if len(ours) > 0 && r.Ready != nil {
+		if err := r.Ready(); err != nil {
+			r.Log.Warnf("suspending garbage collection: %v", err)
+			return failures, false, nil
+		}
+	}
+	for key, obj := range ours {
+		if err := r.Delete(ctx, obj); err != nil && !k8serrors.IsNotFound(err) {
+			r.Log.Errorf("error deleting %s %q: %v", r.Kind, key, err)
+			failures++
+			continue
+		}
+		r.Log.Infof("deleted %s %q", r.Kind, key)
+	}
+	return failures, true, nil
+}
+
+// write creates desired, or updates existing to match it. A resource created since it was listed, or that we
+// published before it was, is adopted if ours, and left alone otherwise.
+func (r *Reconciler[T]) write(ctx context.Context, key string, existing T, exists bool, desired T) error {
+	if !exists {
+		err := r.Create(ctx, desired)
+		if err == nil {
+			r.Log.Infof("created %s %q", r.Kind, key)
+			return nil
+		}
+		if !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+		if existing, err = r.Get(ctx, desired); err != nil {
+			return err
+		}
+		if !r.owns(existing) {
+			r.Log.Warnf("%s %q is not ours, leaving it alone", r.Kind, key)
+			return nil
+		}
+	}
+	if r.Equal(existing, desired) {
+		return nil
+	}
+	if err := r.Update(ctx, existing, desired); err != nil {
+		return err
+	}
+	r.Log.Infof("updated %s %q", r.Kind, key)
+	return nil
+}
+
+func (r *Reconciler[T]) owns(obj T) bool {
+	return Owns(r.Owner, obj.GetOwnerReferences()) && (r.Ours == nil || r.Ours(obj))
+}
+
+func (r *Reconciler[T]) key(obj T) string {
+	if r.Key == nil {
+		return obj.GetName()
+	}
+	return r.Key(obj)
+}
+
+// Run calls sync every interval until the context is cancelled, passing the errors it returns to onError
+func Run(ctx context.Context, interval time.Duration, sync func(context.Context) error, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := sync(ctx); err != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package registrysync embeds the operator's pipeline in other controllers: providers watch service registries into
+// their stores, and sinks publish the stores' hosts, e.g. as ServiceEntries. It's the same pipeline
+// istio-registry-sync serve runs, without the flags, admin server and optional extras.
+//
+//	err := registrysync.New(registrysync.Config{
+//		ID:        "my-controller",
+//		Providers: []registrysync.Provider{watcher},
+//		Sinks:     []registrysync.Sink{registrysync.ServiceEntries(ic, "istio-system", time.Minute)},
+//	}).Run(ctx)
+package registrysync
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// The kind of the owner references of everything published, shared with istio-registry-sync serve so that instances
+// embedded elsewhere recognize their objects the same way
+const (
+	OwnerAPIVersion = "cloudmap.istio.io"
+	OwnerKind       = "ServiceController"
+)
+
+// Provider watches a service registry into its store, e.g. the watchers of the cloudmap and consul packages
+type Provider = provider.Watcher
+
+// Config configures a Syncer
+type Config struct {
+	// ID names the owner of everything published; instances sharing a cluster need distinct IDs
+	ID string
+	// Providers are the registries to sync, whose hosts are published with their prefixes
+	Providers []Provider
+	// Sinks publish the hosts of every provider
+	Sinks []Sink
+}
+
+// Syncer runs the providers and sinks of a Config
+type Syncer struct {
+	config Config
+
+	m         sync.Mutex // guards pipelines
+	pipelines []pipeline // nil until Run
+}
+
+// pipeline is a provider and the publishers of its store, one per sink
+type pipeline struct {
+	provider   Provider
+	publishers []Publisher
+}
+
+// New returns a Syncer of config; nothing runs until Run
+func New(config Config) *Syncer {
+	return &Syncer{config: config}
+}
+
+// OwnerReference returns the owner of what an instance with id publishes. Each call returns a distinct UID, so
+// providers owned by different references don't garbage collect each other's objects.
+func OwnerReference(id string) v1.OwnerReference {
+	t := true
+	return v1.OwnerReference{
+		APIVersion: OwnerAPIVersion,
+		Kind:       OwnerKind,
+		Name:       id,
+		Controller: &t,
+		UID:        uuid.NewUUID(),
+	}
+}
+
+// Run runs every provider and publisher until the context is cancelled. It fails right away if the config is
+// invalid or a sink can't publish a provider.
+func (s *Syncer) Run(ctx context.Context) error {
+	pipelines, err := s.build()
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	s.pipelines = pipelines
+	s.m.Unlock()
+
+	for _, sink := range s.config.Sinks {
+		go sink.Run(ctx)
+	}
+	for _, p := range pipelines {
+		log.Infof("Syncing %q", p.provider.Prefix())
+		go p.provider.Run(ctx)
+		for _, publisher := range p.publishers {
+			go publisher.Run(ctx)
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// build validates the config and returns a pipeline per provider
+func (s *Syncer) build() ([]pipeline, error) {
+	if s.config.ID == "" {
+		return nil, errors.New("an ID is required")
+	}
+	if len(s.config.Providers) == 0 {
+		return nil, errors.New("at least one provider is required")
+	}
+	if len(s.config.Sinks) == 0 {
+		return nil, errors.New("at least one sink is required")
+	}
+	prefixes := make(map[string]struct{}, len(s.config.Providers))
+	pipelines := make([]pipeline, 0, len(s.config.Providers))
+	for _, p := range s.config.Providers {
+		prefix := p.Prefix()
+		if _, ok := prefixes[prefix]; ok {
+			return nil, errors.Errorf("providers must have distinct prefixes, %q is used twice", prefix)
+		}
+		prefixes[prefix] = struct{}{}
+
+		// a distinct owner per provider keeps each provider's objects out of the others' reach
+		owner := OwnerReference(s.config.ID)
+		publishers := make([]Publisher, 0, len(s.config.Sinks))
+		for _, sink := range s.config.Sinks {
+			publisher, err := sink.Publisher(owner, p.Store(), prefix)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to publish %q", prefix)
+			}
+			publishers = append(publishers, publisher)
+		}
+		pipelines = append(pipelines, pipeline{provider: p, publishers: publishers})
+	}
+	return pipelines, nil
+}
+
+// Refresh syncs every provider once and publishes the result immediately, instead of waiting for their next tick
+func (s *Syncer) Refresh(ctx context.Context) error {
+	s.m.Lock()
+	pipelines := s.pipelines
+	s.m.Unlock()
+	if pipelines == nil {
+		return errors.New("the syncer isn't running")
+	}
+	var failures []string
+	for _, p := range pipelines {
+		if err := p.provider.Refresh(ctx); err != nil {
+			failures = append(failures, errors.Wrapf(err, "failed to refresh %q", p.provider.Prefix()).Error())
+			continue
+		}
+		for _, publisher := range p.publishers {
+			if err := publisher.Sync(ctx); err != nil {
+				failures = append(failures, errors.Wrapf(err, "failed to publish %q", p.provider.Prefix()).Error())
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Ready returns an error if the syncer isn't running, or a publisher finds its provider's data too stale to trust
+func (s *Syncer) Ready() error {
+	s.m.Lock()
+	pipelines := s.pipelines
+	s.m.Unlock()
+	if pipelines == nil {
+		return errors.New("the syncer isn't running")
+	}
+	for _, p := range pipelines {
+		for _, publisher := range p.publishers {
+			if r, ok := publisher.(Readier); ok {
+				if err := r.Ready(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package registrysync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+	icfake "istio.io/client-go/pkg/clientset/versioned/fake"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/kubeservice"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// staticProvider syncs fixed hosts into its store on every refresh
+type staticProvider struct {
+	prefix string
+	store  provider.Store
+	hosts  map[string][]*v1alpha3.WorkloadEntry
+}
+
+func (p *staticProvider) Run(ctx context.Context) {
+	_ = p.Refresh(ctx)
+	<-ctx.Done()
+}
+
+func (p *staticProvider) Refresh(context.Context) error {
+	p.store.Set(p.hosts)
+	return nil
+}
+
+func (p *staticProvider) Store() provider.Store {
+	return p.store
+}
+
+func (p *staticProvider) Prefix() string {
+	return p.prefix
+}
+
+func newProvider(prefix string, hosts ...string) *staticProvider {
+	p := &staticProvider{prefix: prefix, store: provider.NewStore(), hosts: map[string][]*v1alpha3.WorkloadEntry{}}
+	for _, host := range hosts {
+		p.hosts[host] = []*v1alpha3.WorkloadEntry{infer.WorkloadEntry("10.0.0.1", 80)}
+	}
+	return p
+}
+
+func TestSyncer_Run_invalid(t *testing.T) {
+	sink := Services(fake.NewSimpleClientset(), "default")
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no ID", config: Config{Providers: []Provider{newProvider("a-")}, Sinks: []Sink{sink}}},
+		{name: "no provider", config: Config{ID: "test", Sinks: []Sink{sink}}},
+		{name: "no sink", config: Config{ID: "test", Providers: []Provider{newProvider("a-")}}},
+		{
+			name:   "duplicate prefixes",
+			config: Config{ID: "test", Providers: []Provider{newProvider("a-"), newProvider("a-")}, Sinks: []Sink{sink}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := New(tt.config).Run(context.TODO()); err == nil {
+				t.Error("Run() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestSyncer_Refresh(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	ic := icfake.NewSimpleClientset()
+	s := New(Config{
+		ID:        "test",
+		Providers: []Provider{newProvider("a-", "a.tetrate.io"), newProvider("b-", "b.tetrate.io")},
+		Sinks: []Sink{
+			Services(kc, "default", kubeservice.WithStalenessThreshold(time.Hour)),
+			ServiceEntries(ic, "istio-system", 0),
+		},
+	})
+	if err := s.Refresh(context.TODO()); err == nil {
+		t.Error("Refresh() succeeded before Run, want an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := s.Run(ctx); err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	}()
+	// the providers are ready once they synced
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Ready() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("not ready in time: %v", s.Ready())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+
+	for _, name := range []string{kubeservice.ServiceName("a-", "a.tetrate.io"), kubeservice.ServiceName("b-", "b.tetrate.io")} {
+		if _, err := kc.CoreV1().Services("default").Get(ctx, name, v1.GetOptions{}); err != nil {
+			t.Errorf("Service %q: %v", name, err)
+		}
+	}
+	for _, name := range []string{infer.ServiceEntryName("a-", "a.tetrate.io"), infer.ServiceEntryName("b-", "b.tetrate.io")} {
+		se, err := ic.NetworkingV1alpha3().ServiceEntries("istio-system").Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			t.Errorf("ServiceEntry %q: %v", name, err)
+			continue
+		}
+		if ref := se.OwnerReferences[0]; ref.Name != "test" || ref.Kind != OwnerKind {
+			t.Errorf("ServiceEntry %q is owned by %v", name, ref)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package registrysync
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	icversioned "istio.io/client-go/pkg/clientset/versioned"
+	icinformer "istio.io/client-go/pkg/informers/externalversions/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/kubeservice"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+// Publisher publishes the hosts of a single provider's store, e.g. as ServiceEntries
+type Publisher interface {
+	// Run publishes the store periodically until the context is cancelled
+	Run(ctx context.Context)
+	// Sync publishes the store once
+	Sync(ctx context.Context) error
+}
+
+// Sink publishes the hosts of every provider, through a publisher per provider
+type Sink interface {
+	// Publisher returns the publisher of store, naming what it publishes with prefix and owning it as owner
+	Publisher(owner v1.OwnerReference, store provider.Store, prefix string) (Publisher, error)
+	// Run runs what the sink's publishers share, e.g. an informer, until the context is cancelled
+	Run(ctx context.Context)
+}
+
+// SinkFunc is a Sink whose publishers share nothing, e.g. one wrapping destinationrule.NewPublisher
+type SinkFunc func(owner v1.OwnerReference, store provider.Store, prefix string) (Publisher, error)
+
+// Publisher returns f(owner, store, prefix)
+func (f SinkFunc) Publisher(owner v1.OwnerReference, store provider.Store, prefix string) (Publisher, error) {
+	return f(owner, store, prefix)
+}
+
+// Run does nothing, as there's nothing to share
+func (f SinkFunc) Run(context.Context) {}
+
+// Readier is implemented by publishers that can tell whether their provider's data is fresh enough to publish
+type Readier interface {
+	Ready() error
+}
+
+type serviceEntries struct {
+	client    icversioned.Interface
+	namespace string
+	informer  cache.SharedIndexInformer
+	opts      []control.Option
+}
+
+// ServiceEntries returns a sink publishing every host as a ServiceEntry in namespace. ServiceEntries are watched
+// across all namespaces, resynced every resync period, so hosts already defined elsewhere are left alone.
+func ServiceEntries(client icversioned.Interface, namespace string, resync time.Duration, opts ...control.Option) Sink {
+	return &serviceEntries{
+		client:    client,
+		namespace: namespace,
+		informer: icinformer.NewServiceEntryInformer(client, v1.NamespaceAll, resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		opts: opts,
+	}
+}
+
+func (s *serviceEntries) Publisher(owner v1.OwnerReference, store provider.Store, prefix string) (Publisher, error) {
+	istio := serviceentry.New(owner, serviceentry.WithPrefix(prefix))
+	serviceentry.AttachHandler(istio, s.informer)
+	synchronizer := control.NewSynchronizer(owner, istio, store, prefix,
+		s.client.NetworkingV1alpha3().ServiceEntries(s.namespace), s.opts...)
+	return synchronizerPublisher{synchronizer}, nil
+}
+
+func (s *serviceEntries) Run(ctx context.Context) {
+	s.informer.Run(ctx.Done())
+}
+
+// synchronizer is what synchronizerPublisher needs of control's synchronizer
+type synchronizer interface {
+	Run(ctx context.Context)
+	Sync(ctx context.Context) control.Result
+	Ready() error
+}
+
+// synchronizerPublisher reports the failed writes of a synchronizer's syncs as errors
+type synchronizerPublisher struct {
+	synchronizer
+}
+
+func (p synchronizerPublisher) Sync(ctx context.Context) error {
+	res := p.synchronizer.Sync(ctx)
+	if len(res.Errors) > 0 {
+		return errors.Errorf("failed to write %d Service Entries, the first: %v", len(res.Errors), res.Errors[0])
+	}
+	return nil
+}
+
+// Services returns a sink publishing every host as a Kubernetes Service, with EndpointSlices if it has addresses,
+// in namespace, for clients outside the mesh
+func Services(client kubernetes.Interface, namespace string, opts ...kubeservice.Option) Sink {
+	return SinkFunc(func(owner v1.OwnerReference, store provider.Store, prefix string) (Publisher, error) {
+		return kubeservice.NewPublisher(owner, store, prefix, client, namespace, opts...), nil
+	})
+}
@@ -0,0 +1,153 @@
+// Package secret reads credentials from files, typically a mounted Kubernetes Secret, and reloads them when the
+// files change so credentials can be rotated without restarting the operator.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// watched are the files being watched, all of which ReloadAll re-reads
+var watched = struct {
+	sync.Mutex
+	files map[*File]struct{}
+}{files: map[*File]struct{}{}}
+
+// File holds the contents of a file, with surrounding whitespace trimmed, reloaded whenever the file changes
+type File struct {
+	path string
+
+	m         sync.RWMutex
+	value     []byte
+	listeners []func()
+}
+
+// Watch reads the file at path and reloads it on every change until ctx is cancelled. The file's directory is
+// watched rather than the file itself, so the atomic symlink swap Kubernetes uses to update mounted Secrets is seen.
+func Watch(ctx context.Context, path string) (*File, error) {
+	f := &File{path: filepath.Clean(path)}
+	value, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	f.value = value
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create a file watcher")
+	}
+	if err := w.Add(filepath.Dir(f.path)); err != nil {
+		_ = w.Close()
+		return nil, errors.Wrapf(err, "failed to watch %q", f.path)
+	}
+	watched.Lock()
+	watched.files[f] = struct{}{}
+	watched.Unlock()
+	go f.run(ctx, w)
+	return f, nil
+}
+
+// ReloadAll re-reads every file being watched now, e.g. on SIGHUP, for the changes the file watcher missed, as it may
+// on network file systems
+func ReloadAll() {
+	watched.Lock()
+	files := make([]*File, 0, len(watched.files))
+	for f := range watched.files {
+		files = append(files, f)
+	}
+	watched.Unlock()
+	for _, f := range files {
+		f.reload()
+	}
+}
+
+// Path of the file
+func (f *File) Path() string {
+	return f.path
+}
+
+// Value returns the file's latest contents
+func (f *File) Value() string {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return string(f.value)
+}
+
+// Reload re-reads the file now rather than when it's next seen changing, calling the listeners if its contents changed
+func (f *File) Reload() {
+	f.reload()
+}
+
+// OnChange registers fn to be called after the file's contents changed
+func (f *File) OnChange(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.listeners = append(f.listeners, fn)
+}
+
+func (f *File) run(ctx context.Context, w *fsnotify.Watcher) {
+	defer w.Close()
+	defer func() {
+		watched.Lock()
+		delete(watched.files, f)
+		watched.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// any event in the directory may be the swap of a symlink the file resolves through, so re-read it and
+			// compare rather than filter on the event's name
+			f.reload()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("error watching %q: %v", f.path, err)
+		}
+	}
+}
+
+// reload re-reads the file, keeping the previous value if it can't be read, e.g. mid-update
+func (f *File) reload() {
+	value, err := f.read()
+	if err != nil {
+		log.Warnf("keeping the previous contents of %q: %v", f.path, err)
+		return
+	}
+	f.m.Lock()
+	if bytes.Equal(value, f.value) {
+		f.m.Unlock()
+		return
+	}
+	f.value = value
+	listeners := append([]func(){}, f.listeners...)
+	f.m.Unlock()
+
+	log.Infof("reloaded %q", f.path)
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+func (f *File) read() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", f.path)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.Errorf("%q is empty", f.path)
+	}
+	return data, nil
+}
@@ -0,0 +1,163 @@
+package secret
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// mount lays out the file holding the secret in dir
+		mount func(t *testing.T, dir, token string)
+		// update rewrites the secret in dir, which was mounted at path
+		update func(t *testing.T, dir, path string)
+	}{
+		{
+			name: "file rewritten in place",
+			mount: func(t *testing.T, dir, token string) {
+				write(t, filepath.Join(dir, "token"), token)
+			},
+			update: func(t *testing.T, dir, path string) {
+				write(t, path, "rotated\n")
+			},
+		},
+		{
+			name:  "kubernetes symlink swap",
+			mount: mountSecret,
+			update: func(t *testing.T, dir, path string) {
+				write(t, filepath.Join(dir, "..2", "token"), "rotated")
+				if err := os.Symlink("..2", filepath.Join(dir, "..data_tmp")); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.mount(t, dir, "initial")
+			path := filepath.Join(dir, "token")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			f, err := Watch(ctx, path)
+			if err != nil {
+				t.Fatalf("Watch() error = %v", err)
+			}
+			if got := f.Value(); got != "initial" {
+				t.Fatalf("Value() = %q, want %q", got, "initial")
+			}
+			changed := make(chan struct{}, 1)
+			f.OnChange(func() { changed <- struct{}{} })
+
+			tt.update(t, dir, path)
+			select {
+			case <-changed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the change")
+			}
+			if got := f.Value(); got != "rotated" {
+				t.Errorf("Value() = %q, want %q", got, "rotated")
+			}
+		})
+	}
+}
+
+func TestWatch_errors(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "empty"), " \n")
+	for _, name := range []string{"missing", "empty"} {
+		if _, err := Watch(context.Background(), filepath.Join(dir, name)); err == nil {
+			t.Errorf("Watch(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestFile_Reload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	write(t, path, "initial")
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := Watch(ctx, path)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	// stop watching, as happens to changes the file watcher misses
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for isWatched(f) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the watch to stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	changes := 0
+	f.OnChange(func() { changes++ })
+
+	write(t, path, "rotated")
+	ReloadAll()
+	if got := f.Value(); got != "initial" {
+		t.Errorf("Value() after ReloadAll() = %q, want %q as the file isn't watched anymore", got, "initial")
+	}
+	f.Reload()
+	if got := f.Value(); got != "rotated" || changes != 1 {
+		t.Errorf("Value() after Reload() = %q with %d changes, want %q with 1", got, changes, "rotated")
+	}
+	f.Reload()
+	if changes != 1 {
+		t.Errorf("Reload() of unchanged contents called the listeners")
+	}
+}
+
+func TestReloadAll(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	write(t, path, "initial")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := Watch(ctx, path)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	write(t, path, "rotated")
+	// the file watcher may or may not have caught up, but ReloadAll doesn't wait for it
+	ReloadAll()
+	if got := f.Value(); got != "rotated" {
+		t.Errorf("Value() = %q, want %q", got, "rotated")
+	}
+}
+
+func isWatched(f *File) bool {
+	watched.Lock()
+	defer watched.Unlock()
+	_, ok := watched.files[f]
+	return ok
+}
+
+// mountSecret lays out a secret holding token the way kubelet does: token -> ..data/token, ..data -> ..1
+func mountSecret(t *testing.T, dir, token string) {
+	write(t, filepath.Join(dir, "..1", "token"), token)
+	if err := os.Symlink("..1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "token"), filepath.Join(dir, "token")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+package servicedirectory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultEndpoint serves Service Directory's REST API
+	defaultEndpoint = "https://servicedirectory.googleapis.com"
+	// pageSize is the most resources a single list call returns
+	pageSize = "1000"
+)
+
+// Namespace is a Service Directory namespace, of which Name is the full resource name, e.g.
+// projects/my-project/locations/us-central1/namespaces/prod
+type Namespace struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Service is a Service Directory service, of which Name is the full resource name, e.g.
+// projects/my-project/locations/us-central1/namespaces/prod/services/web
+type Service struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Endpoint is an endpoint of a Service Directory service
+type Endpoint struct {
+	Name        string            `json:"name"`
+	Address     string            `json:"address,omitempty"`
+	Port        int32             `json:"port,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Network     string            `json:"network,omitempty"`
+}
+
+// apiError is the error Google APIs answer a failed call with
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// StatusError is a call Service Directory answered with an error
+type StatusError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// client calls Service Directory's REST API at endpoint through http, which authenticates the calls
+type client struct {
+	endpoint string
+	http     *http.Client
+}
+
+// list gets the collection under parent, e.g. the namespaces of a location, limit resources a page, passing every
+// page to page, which decodes it and returns the token of the next one. Only the first page is read with a limit
+// lower than pageSize.
+func (c *client) list(ctx context.Context, parent, collection, limit string, page func([]byte) (string, error)) error {
+	token := ""
+	for {
+		query := url.Values{"pageSize": {limit}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		body, err := c.get(ctx, "/v1/"+parent+"/"+collection+"?"+query.Encode())
+		if err != nil {
+			return err
+		}
+		if token, err = page(body); err != nil {
+			return errors.Wrapf(err, "failed to decode the %s of %s", collection, parent)
+		}
+		if token == "" || limit != pageSize {
+			return nil
+		}
+	}
+}
+
+func (c *client) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.Unmarshal(body, &e) != nil || e.Error.Code == 0 {
+			return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status, Message: string(body)}
+		}
+		return nil, &StatusError{Code: e.Error.Code, Status: e.Error.Status, Message: e.Error.Message}
+	}
+	return body, nil
+}
+
+// namespaces lists the namespaces of location, e.g. projects/my-project/locations/us-central1, or only the first with
+// one
+func (c *client) namespaces(ctx context.Context, location string, one bool) ([]Namespace, error) {
+	limit := pageSize
+	if one {
+		limit = "1"
+	}
+	var namespaces []Namespace
+	err := c.list(ctx, location, "namespaces", limit, func(body []byte) (string, error) {
+		var page struct {
+			Namespaces    []Namespace `json:"namespaces"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err := json.Unmarshal(body, &page)
+		namespaces = append(namespaces, page.Namespaces...)
+		return page.NextPageToken, err
+	})
+	return namespaces, err
+}
+
+// services lists the services of namespace
+func (c *client) services(ctx context.Context, namespace string) ([]Service, error) {
+	var services []Service
+	err := c.list(ctx, namespace, "services", pageSize, func(body []byte) (string, error) {
+		var page struct {
+			Services      []Service `json:"services"`
+			NextPageToken string    `json:"nextPageToken"`
+		}
+		err := json.Unmarshal(body, &page)
+		services = append(services, page.Services...)
+		return page.NextPageToken, err
+	})
+	return services, err
+}
+
+// endpoints lists the endpoints of service
+func (c *client) endpoints(ctx context.Context, service string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	err := c.list(ctx, service, "endpoints", pageSize, func(body []byte) (string, error) {
+		var page struct {
+			Endpoints     []Endpoint `json:"endpoints"`
+			NextPageToken string     `json:"nextPageToken"`
+		}
+		err := json.Unmarshal(body, &page)
+		endpoints = append(endpoints, page.Endpoints...)
+		return page.NextPageToken, err
+	})
+	return endpoints, err
+}
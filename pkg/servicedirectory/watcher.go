@@ -0,0 +1,364 @@
+package servicedirectory
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+const (
+	defaultInterval    = 10 * time.Second
+	defaultCallTimeout = 15 * time.Second
+	// cloudPlatformScope is the OAuth scope of the credentials reading Service Directory
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// ProtocolAnnotation is the key of the endpoint annotation naming the protocol of the endpoint's port, e.g. grpc or
+// http2; ports of endpoints without it are named after their number
+const ProtocolAnnotation = "protocol"
+
+// settings are the annotation keys configuring the sync of an endpoint, rather than copied into its labels
+var settings = map[string]bool{ProtocolAnnotation: true, "tls": true, "tls-sni": true, "tls-credential-name": true}
+
+// watcher syncs the services of the Service Directory namespaces of a project and region into its store
+type watcher struct {
+	store           provider.Store
+	prefix          string
+	project, region string
+	endpoint        string
+	httpClient      *http.Client
+	credentialsFile string
+	namespaces      map[string]bool // namespaces synced, by ID; every namespace if empty
+	interval        time.Duration
+	callTimeout     time.Duration
+	drops           *provider.Drops
+
+	m      sync.Mutex // serializes refreshes triggered by the ticker and on demand
+	client *client
+}
+
+var _ provider.Watcher = &watcher{}
+var _ provider.Checker = &watcher{}
+var _ provider.DroppedLister = &watcher{}
+
+// Option configures a Service Directory watcher
+type Option func(*watcher)
+
+// WithPrefix names the watcher's ServiceEntries, and labels its metrics, with prefix instead of the default
+// "servicedirectory-"
+func WithPrefix(prefix string) Option {
+	return func(w *watcher) {
+		w.prefix = prefix
+	}
+}
+
+// WithNamespaces syncs only the namespaces of the IDs given, e.g. prod, rather than every namespace of the region
+func WithNamespaces(namespaces []string) Option {
+	return func(w *watcher) {
+		w.namespaces = make(map[string]bool, len(namespaces))
+		for _, ns := range namespaces {
+			w.namespaces[ns] = true
+		}
+	}
+}
+
+// WithInterval refreshes the store every interval rather than the default 10 seconds
+func WithInterval(interval time.Duration) Option {
+	return func(w *watcher) {
+		w.interval = interval
+	}
+}
+
+// WithCallTimeout bounds every call to Service Directory by timeout rather than the default 15 seconds; zero disables
+// the limit
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(w *watcher) {
+		w.callTimeout = timeout
+	}
+}
+
+// WithCredentialsFile authenticates with the credentials in the JSON file at path, a service account key or the
+// credential configuration of workload identity federation, rather than the application default credentials
+func WithCredentialsFile(path string) Option {
+	return func(w *watcher) {
+		w.credentialsFile = path
+	}
+}
+
+// WithEndpoint calls Service Directory's API at endpoint, e.g. a private endpoint, rather than at
+// https://servicedirectory.googleapis.com
+func WithEndpoint(endpoint string) Option {
+	return func(w *watcher) {
+		w.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// WithHTTPClient calls Service Directory through c, which authenticates the calls, rather than with credentials
+func WithHTTPClient(c *http.Client) Option {
+	return func(w *watcher) {
+		w.httpClient = c
+	}
+}
+
+// NewWatcher returns a watcher of the Service Directory namespaces of project in region, authenticating with the
+// application default credentials, e.g. those of GKE's workload identity or the credential configuration of workload
+// identity federation GOOGLE_APPLICATION_CREDENTIALS names, unless configured otherwise
+func NewWatcher(ctx context.Context, store provider.Store, project, region string, opts ...Option) (provider.Watcher, error) {
+	if project == "" {
+		return nil, errors.New("Google Cloud project not specified")
+	}
+	if region == "" {
+		return nil, errors.New("Google Cloud region not specified")
+	}
+	w := &watcher{
+		store:       store,
+		prefix:      "servicedirectory-",
+		project:     project,
+		region:      region,
+		endpoint:    defaultEndpoint,
+		interval:    defaultInterval,
+		callTimeout: defaultCallTimeout,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.interval <= 0 {
+		return nil, errors.Errorf("Service Directory refresh interval %v must be positive", w.interval)
+	}
+	w.drops = provider.NewDrops(w.prefix)
+	httpClient := w.httpClient
+	if httpClient == nil {
+		creds, err := w.credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// the token source renews tokens for as long as the watcher runs, past ctx
+		httpClient = oauth2.NewClient(context.Background(), creds.TokenSource)
+	}
+	w.client = &client{endpoint: w.endpoint, http: httpClient}
+	return w, nil
+}
+
+// credentials returns the credentials of the credentials file, or else the application default credentials
+func (w *watcher) credentials(ctx context.Context) (*google.Credentials, error) {
+	if w.credentialsFile == "" {
+		creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		return creds, errors.Wrap(err, "failed to find the Google Cloud application default credentials")
+	}
+	data, err := ioutil.ReadFile(w.credentialsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the Google Cloud credentials file")
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	return creds, errors.Wrapf(err, "invalid Google Cloud credentials in %q", w.credentialsFile)
+}
+
+func (w *watcher) Store() provider.Store {
+	return w.store
+}
+
+func (w *watcher) Prefix() string {
+	return w.prefix
+}
+
+// Dropped lists the endpoints of the last successful sync that aren't synced as Service Directory describes them
+func (w *watcher) Dropped() []provider.Dropped {
+	return w.drops.List()
+}
+
+// Run the watcher until the context is cancelled
+func (w *watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// Initial sync on startup
+	if err := w.refreshStore(ctx); err != nil {
+		log.Errorf("failed to refresh the Service Directory store: %v", err)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.refreshStore(ctx); err != nil {
+				log.Errorf("failed to refresh the Service Directory store: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh syncs Service Directory into the store once
+func (w *watcher) Refresh(ctx context.Context) error {
+	return w.refreshStore(ctx)
+}
+
+// Check lists a single namespace to verify the project, region and credentials can read Service Directory
+func (w *watcher) Check(ctx context.Context) error {
+	callCtx, cancel := w.callContext(ctx)
+	defer cancel()
+	_, err := w.client.namespaces(callCtx, w.location(), true)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.Code {
+		case http.StatusForbidden:
+			return errors.Wrap(err, "the Google Cloud credentials are not allowed to read Service Directory; grant "+
+				"them roles/servicedirectory.viewer")
+		case http.StatusUnauthorized:
+			return errors.Wrap(err, "the Google Cloud credentials were rejected")
+		case http.StatusNotFound:
+			return errors.Wrapf(err, "no Service Directory in project %q and region %q", w.project, w.region)
+		}
+	}
+	return errors.Wrap(err, "failed to list Service Directory namespaces")
+}
+
+// location is the resource name of the project and region synced
+func (w *watcher) location() string {
+	return "projects/" + w.project + "/locations/" + w.region
+}
+
+// callContext returns ctx bounded by the call timeout, if any
+func (w *watcher) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if w.callTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, w.callTimeout)
+}
+
+// refreshStore reads every service of the namespaces synced and replaces the store's hosts with them, keeping the
+// store as last synced if any call fails
+func (w *watcher) refreshStore(ctx context.Context) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	log.Info("Syncing Service Directory store")
+	callCtx, cancel := w.callContext(ctx)
+	namespaces, err := w.client.namespaces(callCtx, w.location(), false)
+	cancel()
+	if err != nil {
+		return errors.Wrap(err, "error listing Service Directory namespaces")
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry)
+	var dropped []provider.Dropped
+	for _, ns := range namespaces {
+		nsID := id(ns.Name)
+		if len(w.namespaces) > 0 && !w.namespaces[nsID] {
+			continue
+		}
+		callCtx, cancel := w.callContext(ctx)
+		services, err := w.client.services(callCtx, ns.Name)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "error listing the services of Service Directory namespace %s", nsID)
+		}
+		for _, svc := range services {
+			callCtx, cancel := w.callContext(ctx)
+			endpoints, err := w.client.endpoints(callCtx, svc.Name)
+			cancel()
+			if err != nil {
+				return errors.Wrapf(err, "error listing the endpoints of Service Directory service %s", svc.Name)
+			}
+			host := id(svc.Name) + "." + nsID
+			wes, drops := w.endpointsToWorkloadEntries(host, endpoints)
+			dropped = append(dropped, drops...)
+			if len(wes) > 0 {
+				hosts[host] = wes
+			}
+		}
+	}
+	log.Infof("Service Directory store sync successful with %d hosts", len(hosts))
+	w.drops.Set(dropped)
+	w.store.Set(hosts)
+	w.store.Synced()
+	return nil
+}
+
+// id returns the ID a resource name ends with, e.g. web of projects/p/locations/r/namespaces/prod/services/web
+func id(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// endpointsToWorkloadEntries converts the endpoints of host, returning those it dropped alongside
+func (w *watcher) endpointsToWorkloadEntries(host string, endpoints []Endpoint) ([]*v1alpha3.WorkloadEntry,
+	[]provider.Dropped) {
+	// listed in no particular order
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Name < endpoints[j].Name
+	})
+	wes := make([]*v1alpha3.WorkloadEntry, 0, len(endpoints))
+	var dropped []provider.Dropped
+	for i := range endpoints {
+		e := &endpoints[i]
+		if e.Address == "" {
+			log.Infof("endpoint %s of %s has no address", id(e.Name), host)
+			dropped = append(dropped, provider.Dropped{Host: host, ID: id(e.Name), Reason: provider.DroppedUnsupported,
+				Detail: "no address"})
+			continue
+		}
+		wes = append(wes, w.endpointToWorkloadEntry(e))
+	}
+	return wes, dropped
+}
+
+// endpointToWorkloadEntry converts e, labelled with its annotations, in the watcher's region
+func (w *watcher) endpointToWorkloadEntry(e *Endpoint) *v1alpha3.WorkloadEntry {
+	var we *v1alpha3.WorkloadEntry
+	if e.Port > 0 {
+		we = infer.WorkloadEntry(e.Address, uint32(e.Port))
+		if name := portName(e); name != "" {
+			we.Ports = map[string]uint32{name: uint32(e.Port)}
+		}
+	} else {
+		log.Infof("no port found for address %v, assuming http (80) and https (443)", e.Address)
+		we = &v1alpha3.WorkloadEntry{Address: e.Address, Ports: map[string]uint32{"http": 80, "https": 443}}
+	}
+	we.Labels = labels(e.Annotations)
+	we.Locality = w.region
+	return we
+}
+
+// portName returns the name of the port of e as its protocol annotation says, or an empty string if it says none
+// Istio knows of
+func portName(e *Endpoint) string {
+	protocol, ok := e.Annotations[ProtocolAnnotation]
+	if !ok {
+		return ""
+	}
+	if name := strings.ToLower(protocol); infer.Protocol(name) == strings.ToUpper(name) {
+		return name
+	}
+	log.Infof("endpoint %s has unknown protocol %q, inferring it from its port", e.Name, protocol)
+	return ""
+}
+
+// labels returns the TLS labels of annotations along with the rest of them, leaving out keys and values that aren't
+// valid as labels
+func labels(annotations map[string]string) map[string]string {
+	l := infer.TLSLabels(annotations)
+	for key, value := range annotations {
+		if settings[key] || len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+		if _, ok := l[key]; ok {
+			continue
+		}
+		if l == nil {
+			l = make(map[string]string, len(annotations))
+		}
+		l[key] = value
+	}
+	return l
+}
@@ -0,0 +1,147 @@
+package servicedirectory
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+const location = "projects/p/locations/us-central1"
+
+// registry serves the namespaces, services and endpoints of a Service Directory, listed by their parent, a page of a
+// single resource at a time
+func registry(t *testing.T, resources map[string][]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		collection := path[strings.LastIndex(path, "/")+1:]
+		list, ok := resources[strings.TrimSuffix(path, "/"+collection)]
+		if !ok {
+			http.NotFound(rw, r)
+			return
+		}
+		page := map[string]interface{}{collection: []interface{}{}}
+		if len(list) > 0 {
+			// the page token is the index of the page's resource
+			i := 0
+			if token := r.URL.Query().Get("pageToken"); token != "" {
+				i = int(token[0] - '0')
+			}
+			page[collection] = list[i : i+1]
+			if i+1 < len(list) {
+				page["nextPageToken"] = string(rune('0' + i + 1))
+			}
+		}
+		if err := json.NewEncoder(rw).Encode(page); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestWatcher_Refresh(t *testing.T) {
+	resources := map[string][]interface{}{
+		location: {Namespace{Name: location + "/namespaces/prod"}, Namespace{Name: location + "/namespaces/dev"}},
+		location + "/namespaces/prod": {Service{Name: location + "/namespaces/prod/services/web"},
+			Service{Name: location + "/namespaces/prod/services/empty"}},
+		location + "/namespaces/dev": {Service{Name: location + "/namespaces/dev/services/web"}},
+		location + "/namespaces/prod/services/web": {
+			Endpoint{Name: location + "/namespaces/prod/services/web/endpoints/b", Address: "10.0.0.2", Port: 8080,
+				Annotations: map[string]string{"version": "v2", ProtocolAnnotation: "grpc", "tls": "true",
+					"invalid label": "x"}},
+			Endpoint{Name: location + "/namespaces/prod/services/web/endpoints/a", Address: "10.0.0.1", Port: 8080},
+			Endpoint{Name: location + "/namespaces/prod/services/web/endpoints/c"},
+		},
+		location + "/namespaces/prod/services/empty": {},
+		location + "/namespaces/dev/services/web": {
+			Endpoint{Name: location + "/namespaces/dev/services/web/endpoints/a", Address: "10.1.0.1"},
+		},
+	}
+	server := registry(t, resources)
+	defer server.Close()
+
+	prod := map[string][]*v1alpha3.WorkloadEntry{
+		"web.prod": {
+			{Address: "10.0.0.1", Ports: map[string]uint32{"tcp": 8080}, Locality: "us-central1"},
+			{Address: "10.0.0.2", Ports: map[string]uint32{"grpc": 8080}, Locality: "us-central1",
+				Labels: map[string]string{"version": "v2", infer.TLSModeLabel: "SIMPLE"}},
+		},
+	}
+	tests := []struct {
+		name        string
+		opts        []Option
+		want        map[string][]*v1alpha3.WorkloadEntry
+		wantDropped []provider.Dropped
+	}{
+		{name: "every namespace", want: map[string][]*v1alpha3.WorkloadEntry{
+			"web.prod": prod["web.prod"],
+			"web.dev": {{Address: "10.1.0.1", Ports: map[string]uint32{"http": 80, "https": 443},
+				Locality: "us-central1"}},
+		}, wantDropped: []provider.Dropped{{Host: "web.prod", ID: "c", Reason: provider.DroppedUnsupported,
+			Detail: "no address"}}},
+		{name: "namespace", opts: []Option{WithNamespaces([]string{"dev"})}, want: map[string][]*v1alpha3.WorkloadEntry{
+			"web.dev": {{Address: "10.1.0.1", Ports: map[string]uint32{"http": 80, "https": 443},
+				Locality: "us-central1"}},
+		}, wantDropped: []provider.Dropped{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := NewWatcher(context.Background(), store, "p", "us-central1",
+				append(tt.opts, WithEndpoint(server.URL), WithHTTPClient(server.Client()))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(provider.Checker).Check(context.Background()); err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if got := store.Hosts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+			if got := w.(provider.DroppedLister).Dropped(); !reflect.DeepEqual(got, tt.wantDropped) {
+				t.Errorf("Dropped() = %v, want %v", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestWatcher_errors(t *testing.T) {
+	if _, err := NewWatcher(context.Background(), provider.NewStore(), "", "us-central1"); err == nil {
+		t.Error("NewWatcher() without a project succeeded, want an error")
+	}
+	if _, err := NewWatcher(context.Background(), provider.NewStore(), "p", ""); err == nil {
+		t.Error("NewWatcher() without a region succeeded, want an error")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+		_, _ = rw.Write([]byte(`{"error": {"code": 403, "status": "PERMISSION_DENIED", "message": "denied"}}`))
+	}))
+	defer server.Close()
+	store := provider.NewStore()
+	store.Set(map[string][]*v1alpha3.WorkloadEntry{"web.prod": {infer.WorkloadEntry("10.0.0.1", 8080)}})
+	w, err := NewWatcher(context.Background(), store, "p", "us-central1", WithEndpoint(server.URL),
+		WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(provider.Checker).Check(context.Background()); err == nil ||
+		!strings.Contains(err.Error(), "roles/servicedirectory.viewer") {
+		t.Errorf("Check() error = %v, want the role to grant", err)
+	}
+	if err := w.Refresh(context.Background()); err == nil {
+		t.Error("Refresh() succeeded, want an error")
+	}
+	if got := len(store.Hosts()); got != 1 {
+		t.Errorf("%d hosts after a failed refresh, want the one last synced", got)
+	}
+}
@@ -15,14 +15,15 @@
 package serviceentry
 
 import (
-	"reflect"
 	"sync"
 
 	"github.com/golang/protobuf/proto"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	"github.com/tetratelabs/log"
+	"github.com/tetratelabs/istio-registry-sync/pkg/changelog"
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
 )
 
 type (
@@ -34,6 +35,9 @@ type (
 		// Based on the data in the store, classify the host as belonging to us, them, or no one.
 		Classify(host string) Owner
 
+		// Lookup returns the ServiceEntry claiming host and who owns it; nil and None if there is none
+		Lookup(host string) (*v1alpha3.ServiceEntry, Owner)
+
 		// Ours are ServiceEntries managed by us
 		Ours() map[string]*v1alpha3.ServiceEntry
 
@@ -51,12 +55,23 @@ type (
 
 		// OwnerReference is used to label new entries as owned by this store
 		OwnerReference() v1.OwnerReference
+
+		// Revision changes whenever Insert, Update or Delete changes the store
+		Revision() uint64
+
+		// Changes returns the hosts changed after revision since, or false if the store no longer knows
+		Changes(since uint64) (map[string]struct{}, bool)
 	}
 
+	// Option configures a store
+	Option func(*store)
+
 	store struct {
 		ref          v1.OwnerReference
+		prefix       string
 		m            sync.RWMutex                      // guards both maps
 		ours, theirs map[string]*v1alpha3.ServiceEntry // maps host->Entry; a single Entry can be referenced by many hosts
+		changes      *changelog.Log
 	}
 )
 
@@ -69,13 +84,27 @@ const (
 	None Owner = iota
 )
 
+// WithPrefix only counts the ServiceEntries we own as ours if they're named after their host with prefix, the way
+// the synchronizer of that prefix names them. The others are theirs, so watchers with different prefixes never
+// manage each other's ServiceEntries, even if they share an owner reference.
+func WithPrefix(prefix string) Option {
+	return func(s *store) {
+		s.prefix = prefix
+	}
+}
+
 // New returns a new store which manages resources marked by the provided ID
-func New(ownerRef v1.OwnerReference) Store {
-	return &store{
-		ref:    ownerRef,
-		ours:   make(map[string]*v1alpha3.ServiceEntry),
-		theirs: make(map[string]*v1alpha3.ServiceEntry),
+func New(ownerRef v1.OwnerReference, opts ...Option) Store {
+	s := &store{
+		ref:     ownerRef,
+		ours:    make(map[string]*v1alpha3.ServiceEntry),
+		theirs:  make(map[string]*v1alpha3.ServiceEntry),
+		changes: changelog.New(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Classify the host as belonging to us, them, or no one
@@ -92,6 +121,19 @@ func (s *store) Classify(host string) Owner {
 	return None
 }
 
+func (s *store) Lookup(host string) (*v1alpha3.ServiceEntry, Owner) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if se, found := s.ours[host]; found {
+		return se, Us
+	}
+	if se, found := s.theirs[host]; found {
+		return se, Them
+	}
+	return nil, None
+}
+
 func (s *store) Ours() map[string]*v1alpha3.ServiceEntry {
 	s.m.RLock()
 	defer s.m.RUnlock()
@@ -108,11 +150,24 @@ func (s *store) Theirs() map[string]*v1alpha3.ServiceEntry {
 	return copyMap(s.theirs)
 }
 
+func (s *store) Revision() uint64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.changes.Revision()
+}
+
+func (s *store) Changes(since uint64) (map[string]struct{}, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.changes.Since(since)
+}
+
 func (s *store) Insert(se *v1alpha3.ServiceEntry) error {
-	owner := owner(s.ref, se.GetOwnerReferences())
+	owner := s.owner(se)
 	// as a single update, we insert all hosts owned by the ServiceEntry
 	s.m.Lock()
 	s.add(owner, se)
+	s.changes.Record(se.Spec.Hosts...)
 	s.m.Unlock()
 	return nil
 }
@@ -123,21 +178,23 @@ func (s *store) Update(old, se *v1alpha3.ServiceEntry) error {
 		return nil
 	}
 
-	oldOwner := owner(s.ref, old.GetOwnerReferences())
-	owner := owner(s.ref, se.GetOwnerReferences())
+	oldOwner := s.owner(old)
+	owner := s.owner(se)
 
 	s.m.Lock()
 	s.delete(oldOwner, old)
 	s.add(owner, se)
+	s.changes.Record(append(append([]string{}, old.Spec.Hosts...), se.Spec.Hosts...)...)
 	s.m.Unlock()
 	return nil
 }
 
 func (s *store) Delete(se *v1alpha3.ServiceEntry) error {
-	owner := owner(s.ref, se.GetObjectMeta().GetOwnerReferences())
+	owner := s.owner(se)
 	// as a single update, we delete all hosts owned by the ServiceEntry
 	s.m.Lock()
 	s.delete(owner, se)
+	s.changes.Record(se.Spec.Hosts...)
 	s.m.Unlock()
 	return nil
 }
@@ -176,14 +233,27 @@ func (s *store) delete(owner Owner, se *v1alpha3.ServiceEntry) {
 	}
 }
 
+// owner classifies se, taking our prefix into account
+func (s *store) owner(se *v1alpha3.ServiceEntry) Owner {
+	o := owner(s.ref, se.GetOwnerReferences())
+	if o == Us && s.prefix != "" && !Named(se, s.prefix) {
+		return Them
+	}
+	return o
+}
+
+// Named returns whether se is named after its only host with prefix, as the synchronizer of prefix names them
+func Named(se *v1alpha3.ServiceEntry, prefix string) bool {
+	return len(se.Spec.Hosts) == 1 && se.Name == infer.ServiceEntryName(prefix, se.Spec.Hosts[0])
+}
+
 func owner(self v1.OwnerReference, refs []v1.OwnerReference) Owner {
 	if len(refs) == 0 {
 		return None
 	}
-	for _, ref := range refs {
-		if reflect.DeepEqual(ref, self) {
-			return Us
-		}
+	// whatever the UID, so that a restarted instance takes over what it published before
+	if publish.Owns(self, refs) {
+		return Us
 	}
 	// there's some owner reference but it wasn't ours
 	return Them
@@ -234,6 +304,23 @@ func (l LoggingStore) Theirs() map[string]*v1alpha3.ServiceEntry {
 	return theirs
 }
 
+// Lookup returns the ServiceEntry claiming host and who owns it
+func (l LoggingStore) Lookup(host string) (*v1alpha3.ServiceEntry, Owner) {
+	se, o := l.s.Lookup(host)
+	l.log("looked up %q, owned by %d", host, o)
+	return se, o
+}
+
+// Revision changes whenever the store changes
+func (l LoggingStore) Revision() uint64 {
+	return l.s.Revision()
+}
+
+// Changes returns the hosts changed after revision since
+func (l LoggingStore) Changes(since uint64) (map[string]struct{}, bool) {
+	return l.s.Changes(since)
+}
+
 // Insert adds a ServiceEntry to the store (detecting who it belongs to)
 func (l LoggingStore) Insert(se *v1alpha3.ServiceEntry) error {
 	err := l.s.Insert(se)
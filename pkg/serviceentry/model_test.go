@@ -293,3 +293,38 @@ func TestClassify(t *testing.T) {
 		})
 	}
 }
+
+func TestClassify_withPrefix(t *testing.T) {
+	named := func(name, host string) *ic.ServiceEntry {
+		return &ic.ServiceEntry{
+			ObjectMeta: v1.ObjectMeta{Name: name, OwnerReferences: []v1.OwnerReference{baseOwner}},
+			Spec:       v1alpha3.ServiceEntry{Hosts: []string{host}},
+		}
+	}
+	// every run gets a new UID
+	restarted := named("cloudmap-east-b.tetrate.io", "b.tetrate.io")
+	restarted.OwnerReferences[0].UID = "previous"
+	tests := []struct {
+		name string
+		se   *ic.ServiceEntry
+		want Owner
+	}{
+		{name: "named with our prefix", se: named("cloudmap-east-a.tetrate.io", "a.tetrate.io"), want: Us},
+		{name: "published by a previous run", se: restarted, want: Us},
+		{name: "named with another prefix", se: named("cloudmap-west-a.tetrate.io", "a.tetrate.io"), want: Them},
+		{name: "named with a prefix starting with ours", se: named("cloudmap-east-b-a.tetrate.io", "a.tetrate.io"), want: Them},
+		{name: "several hosts", se: us, want: Them},
+		{name: "no owners", se: noOwners, want: Us},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			underTest := New(baseOwner, WithPrefix("cloudmap-east-"))
+			if err := underTest.Insert(tt.se); err != nil {
+				t.Fatal(err)
+			}
+			if actual := underTest.Classify(tt.se.Spec.Hosts[0]); actual != tt.want {
+				t.Errorf("underTest.Classify(%q) = %d, want %d", tt.se.Spec.Hosts[0], actual, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Package sidecar scopes the registry hosts workloads can reach: it keeps a namespace-wide Sidecar in each
+// configured namespace whose egress only lists the synced hosts allowed there, so enabling registry sync doesn't
+// silently open the whole registry to every workload.
+package sidecar
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/publish"
+)
+
+// DefaultBaseHosts are the egress hosts every Sidecar keeps besides registry hosts: the workload's own namespace
+// and the control plane's
+var DefaultBaseHosts = []string{"./*", "istio-system/*"}
+
+// Source is a pipeline whose hosts can be granted, and the namespace its ServiceEntries are published to
+type Source struct {
+	Namespace string
+	Store     provider.Store
+}
+
+// Option configures optional behaviour of the publisher
+type Option func(*publisher)
+
+// WithBaseHosts replaces DefaultBaseHosts
+func WithBaseHosts(hosts []string) Option {
+	return func(p *publisher) {
+		p.baseHosts = hosts
+	}
+}
+
+type publisher struct {
+	owner     v1.OwnerReference
+	sources   []Source
+	egress    map[string][]string // host patterns allowed by namespace
+	client    icapi.NetworkingV1alpha3Interface
+	baseHosts []string
+	interval  time.Duration
+
+	// the sources' revisions at the last sync that left nothing to retry
+	settled   bool
+	revisions []uint64
+}
+
+// NewPublisher returns a publisher keeping, in every namespace of egress, a Sidecar named after the owner whose
+// egress lists the sources' hosts matching that namespace's patterns
+func NewPublisher(owner v1.OwnerReference, sources []Source, egress map[string][]string,
+	client icapi.NetworkingV1alpha3Interface, opts ...Option) *publisher {
+	p := &publisher{owner: owner, sources: sources, egress: egress, client: client, baseHosts: DefaultBaseHosts,
+		interval: 5 * time.Second}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// ParseEgress parses specs of the form <namespace>=<host pattern> into the host patterns allowed by namespace.
+// Patterns are matched with path.Match, so "*" allows every registry host.
+func ParseEgress(specs []string) (map[string][]string, error) {
+	egress := make(map[string][]string)
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 || i == len(spec)-1 {
+			return nil, errors.Errorf("invalid egress %q, must be <namespace>=<host pattern>", spec)
+		}
+		namespace, pattern := spec[:i], spec[i+1:]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid host pattern %q", pattern)
+		}
+		egress[namespace] = append(egress[namespace], pattern)
+	}
+	return egress, nil
+}
+
+// Run the publisher until the context is cancelled
+func (p *publisher) Run(ctx context.Context) {
+	publish.Run(ctx, p.interval, p.Sync, func(err error) {
+		log.Errorf("error publishing Sidecars: %v", err)
+	})
+}
+
+// Sync creates or updates our Sidecar in every configured namespace, and deletes it from the others
+func (p *publisher) Sync(ctx context.Context) error {
+	revisions := make([]uint64, len(p.sources))
+	for i, s := range p.sources {
+		revisions[i] = s.Store.Revision()
+	}
+	if p.settled && reflect.DeepEqual(revisions, p.revisions) {
+		return nil
+	}
+	p.settled = false
+
+	desired := make([]*ic.Sidecar, 0, len(p.egress))
+	for namespace, patterns := range p.egress {
+		desired = append(desired, p.sidecar(namespace, p.hosts(patterns)))
+	}
+	r := &publish.Reconciler[*ic.Sidecar]{
+		Resources: publish.Resources[*ic.Sidecar]{
+			Kind:   "Sidecar",
+			Plural: "Sidecars",
+			List: func(ctx context.Context) ([]*ic.Sidecar, error) {
+				list, err := p.client.Sidecars(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+				if err != nil {
+					return nil, err
+				}
+				return list.Items, nil
+			},
+			Get: func(ctx context.Context, desired *ic.Sidecar) (*ic.Sidecar, error) {
+				return p.client.Sidecars(desired.Namespace).Get(ctx, desired.Name, v1.GetOptions{})
+			},
+			Equal: func(existing, desired *ic.Sidecar) bool {
+				return len(existing.Spec.Egress) == 1 &&
+					reflect.DeepEqual(existing.Spec.Egress[0].Hosts, desired.Spec.Egress[0].Hosts)
+			},
+			Create: func(ctx context.Context, desired *ic.Sidecar) error {
+				if err := p.checkConflicts(ctx, desired.Namespace); err != nil {
+					return err
+				}
+				_, err := p.client.Sidecars(desired.Namespace).Create(ctx, desired, v1.CreateOptions{})
+				return err
+			},
+			Update: func(ctx context.Context, existing, desired *ic.Sidecar) error {
+				if err := p.checkConflicts(ctx, desired.Namespace); err != nil {
+					return err
+				}
+				updated := existing.DeepCopy()
+				updated.Spec.Egress = desired.Spec.Egress
+				_, err := p.client.Sidecars(desired.Namespace).Update(ctx, updated, v1.UpdateOptions{})
+				return err
+			},
+			Delete: func(ctx context.Context, existing *ic.Sidecar) error {
+				return p.client.Sidecars(existing.Namespace).Delete(ctx, existing.Name, v1.DeleteOptions{})
+			},
+		},
+		Owner: p.owner,
+		// there is a single Sidecar per instance and namespace
+		Ours: func(s *ic.Sidecar) bool { return s.Name == p.owner.Name },
+		Key:  func(s *ic.Sidecar) string { return s.Namespace + "/" + s.Name },
+		Log:  log,
+	}
+	// namespaces dropped from the configuration lose their Sidecar
+	failures, _, err := r.Reconcile(ctx, desired, nil)
+	if err != nil {
+		return err
+	}
+	if failures > 0 {
+		return errors.Errorf("failed to write %d Sidecars", failures)
+	}
+	p.settled, p.revisions = true, revisions
+	return nil
+}
+
+// hosts returns the egress hosts allowed by patterns: the base hosts, then every matching host of the sources as
+// <ServiceEntry namespace>/<host>, sorted
+func (p *publisher) hosts(patterns []string) []string {
+	var matched []string
+	for _, s := range p.sources {
+		for host := range s.Store.Hosts() {
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, host); ok {
+					matched = append(matched, s.Namespace+"/"+host)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(matched)
+	return append(append([]string{}, p.baseHosts...), matched...)
+}
+
+// checkConflicts returns an error if a namespace-wide Sidecar other than ours exists in namespace, since Istio only
+// honours one
+func (p *publisher) checkConflicts(ctx context.Context, namespace string) error {
+	list, err := p.client.Sidecars(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list Sidecars")
+	}
+	for _, s := range list.Items {
+		if s.Spec.WorkloadSelector == nil && !(s.Name == p.owner.Name && publish.Owns(p.owner, s.OwnerReferences)) {
+			return errors.Errorf("Sidecar %q already applies to the whole namespace", s.Name)
+		}
+	}
+	return nil
+}
+
+func (p *publisher) sidecar(namespace string, hosts []string) *ic.Sidecar {
+	return &ic.Sidecar{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            p.owner.Name,
+			Namespace:       namespace,
+			OwnerReferences: []v1.OwnerReference{p.owner},
+		},
+		Spec: v1alpha3.Sidecar{
+			Egress: []*v1alpha3.IstioEgressListener{{Hosts: hosts}},
+		},
+	}
+}
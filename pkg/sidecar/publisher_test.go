@@ -0,0 +1,113 @@
+package sidecar
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+var owner = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: "us"}
+
+func TestParseEgress(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:  "groups patterns by namespace",
+			specs: []string{"payments=*.billing.tetrate.io", "web=*", "payments=ledger.tetrate.io"},
+			want:  map[string][]string{"payments": {"*.billing.tetrate.io", "ledger.tetrate.io"}, "web": {"*"}},
+		},
+		{name: "missing namespace", specs: []string{"=*"}, wantErr: true},
+		{name: "missing pattern", specs: []string{"web="}, wantErr: true},
+		{name: "invalid pattern", specs: []string{"web=[a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEgress(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEgress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEgress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisher_Sync(t *testing.T) {
+	client := fake.NewSimpleClientset(&ic.Sidecar{ObjectMeta: v1.ObjectMeta{Name: "default", Namespace: "legacy"}})
+	cloudmap, consul := provider.NewStore(), provider.NewStore()
+	cloudmap.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"a.billing.tetrate.io": {infer.WorkloadEntry("10.0.0.1", 80)},
+		"b.billing.tetrate.io": {infer.WorkloadEntry("10.0.0.2", 80)},
+		"catalog.tetrate.io":   {infer.WorkloadEntry("10.0.0.3", 80)},
+	})
+	consul.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"ledger.service.consul": {infer.WorkloadEntry("10.0.0.4", 80)},
+	})
+	sources := []Source{{Namespace: "istio-system", Store: cloudmap}, {Namespace: "registry", Store: consul}}
+	networking := client.NetworkingV1alpha3()
+
+	p := NewPublisher(owner, sources, map[string][]string{
+		"payments": {"*.billing.tetrate.io", "ledger.*"},
+		"web":      {"*"},
+		"legacy":   {"*"},
+	}, networking)
+	if err := p.Sync(context.TODO()); err == nil {
+		t.Error("Sync() overwrote the namespace-wide Sidecar of legacy")
+	}
+	want := map[string][]string{
+		"payments": {"./*", "istio-system/*", "istio-system/a.billing.tetrate.io", "istio-system/b.billing.tetrate.io",
+			"registry/ledger.service.consul"},
+		"web": {"./*", "istio-system/*", "istio-system/a.billing.tetrate.io", "istio-system/b.billing.tetrate.io",
+			"istio-system/catalog.tetrate.io", "registry/ledger.service.consul"},
+	}
+	if got := egress(t, networking); !reflect.DeepEqual(got, want) {
+		t.Errorf("egress = %v, want %v", got, want)
+	}
+
+	cloudmap.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"a.billing.tetrate.io": {infer.WorkloadEntry("10.0.0.1", 80)},
+	})
+	restarted := owner
+	restarted.UID = "us, restarted"
+	p = NewPublisher(restarted, sources, map[string][]string{"payments": {"*.billing.tetrate.io"}}, networking,
+		WithBaseHosts([]string{"./*"}))
+	if err := p.Sync(context.TODO()); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	want = map[string][]string{"payments": {"./*", "istio-system/a.billing.tetrate.io"}}
+	if got := egress(t, networking); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reconfiguring, egress = %v, want %v", got, want)
+	}
+}
+
+// egress returns the egress hosts of our Sidecars by namespace
+func egress(t *testing.T, client icapi.NetworkingV1alpha3Interface) map[string][]string {
+	list, err := client.Sidecars(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, s := range list.Items {
+		if s.Name != owner.Name {
+			continue
+		}
+		for _, e := range s.Spec.Egress {
+			got[s.Namespace] = append(got[s.Namespace], e.Hosts...)
+		}
+	}
+	return got
+}
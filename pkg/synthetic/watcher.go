@@ -0,0 +1,183 @@
+package synthetic
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/fault"
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+const (
+	defaultInterval = 5 * time.Second
+	// port every synthetic endpoint listens on
+	endpointPort = 8080
+	// the number of addresses available in 10.0.0.0/8
+	maxAddresses = 1 << 24
+)
+
+// watcher generates a fixed set of synthetic hosts and mutates some of their endpoints every refresh, so the
+// rest of the pipeline can be demoed and load tested without access to a real registry
+type watcher struct {
+	store     provider.Store
+	prefix    string
+	interval  time.Duration
+	rand      *rand.Rand
+	mutations int // hosts changed per refresh
+	faults    *fault.Injector
+
+	m           sync.Mutex // guards the fields below
+	hosts       map[string][]*v1alpha3.WorkloadEntry
+	names       []string // host names, in creation order, for picking hosts to mutate
+	nextAddress uint32
+}
+
+var _ provider.Watcher = &watcher{}
+
+// Option configures a synthetic watcher
+type Option func(*watcher)
+
+// WithFaults fails and slows down refreshes, and publishes partial sets of hosts, as decided by i
+func WithFaults(i *fault.Injector) Option {
+	return func(w *watcher) {
+		w.faults = i
+	}
+}
+
+// WithPrefix names the watcher's ServiceEntries, and labels its metrics, with prefix instead of the default
+// "synthetic-"
+func WithPrefix(prefix string) Option {
+	return func(w *watcher) {
+		w.prefix = prefix
+	}
+}
+
+// NewWatcher returns a watcher for hosts synthetic hosts with endpoints endpoints each, changing the endpoints of
+// mutations randomly chosen hosts every interval. A zero interval uses the default of 5 seconds.
+func NewWatcher(store provider.Store, hosts, endpoints, mutations int, interval time.Duration, opts ...Option) (
+	provider.Watcher, error) {
+	if hosts <= 0 {
+		return nil, errors.New("number of synthetic hosts must be positive")
+	}
+	if endpoints <= 0 {
+		return nil, errors.New("number of synthetic endpoints per host must be positive")
+	}
+	if mutations < 0 || mutations > hosts {
+		return nil, errors.Errorf("number of synthetic mutations must be between 0 and the number of hosts (%d)", hosts)
+	}
+	if hosts*endpoints+mutations >= maxAddresses {
+		return nil, errors.Errorf("%d hosts with %d endpoints each exceed the synthetic address space", hosts, endpoints)
+	}
+	w := newWatcher(store, hosts, endpoints, mutations, time.Now().UnixNano())
+	if interval > 0 {
+		w.interval = interval
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w, nil
+}
+
+func newWatcher(store provider.Store, hosts, endpoints, mutations int, seed int64) *watcher {
+	w := &watcher{
+		store:     store,
+		prefix:    "synthetic-",
+		interval:  defaultInterval,
+		rand:      rand.New(rand.NewSource(seed)),
+		mutations: mutations,
+		hosts:     make(map[string][]*v1alpha3.WorkloadEntry, hosts),
+		names:     make([]string, 0, hosts),
+	}
+	for i := 0; i < hosts; i++ {
+		name := fmt.Sprintf("svc-%d.synthetic.local", i)
+		wes := make([]*v1alpha3.WorkloadEntry, 0, endpoints)
+		for j := 0; j < endpoints; j++ {
+			wes = append(wes, infer.WorkloadEntry(w.address(), endpointPort))
+		}
+		w.hosts[name] = wes
+		w.names = append(w.names, name)
+	}
+	return w
+}
+
+func (w *watcher) Store() provider.Store {
+	return w.store
+}
+
+func (w *watcher) Prefix() string {
+	return w.prefix
+}
+
+// Run the watcher until the context is cancelled
+func (w *watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	w.m.Lock()
+	w.store.Set(w.hosts)
+	w.m.Unlock()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.refreshStore(ctx); err != nil {
+				log.Errorf("failed to refresh synthetic hosts: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh mutates the synthetic hosts once and publishes them
+func (w *watcher) Refresh(ctx context.Context) error {
+	return w.refreshStore(ctx)
+}
+
+func (w *watcher) refreshStore(ctx context.Context) error {
+	if w.faults != nil {
+		if err := w.faults.Call(ctx); err != nil {
+			return err
+		}
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for _, i := range w.rand.Perm(len(w.names))[:w.mutations] {
+		w.mutate(w.names[i])
+	}
+	hosts := w.hosts
+	if w.faults != nil {
+		if n := w.faults.Truncate(len(w.names)); n < len(w.names) {
+			hosts = make(map[string][]*v1alpha3.WorkloadEntry, n)
+			for _, name := range w.names[:n] {
+				hosts[name] = w.hosts[name]
+			}
+		}
+	}
+	log.Infof("Synthetic store refreshed with %d hosts, %d mutated", len(hosts), w.mutations)
+	w.store.Set(hosts)
+	return nil
+}
+
+// mutate replaces one of the host's endpoints with a new address
+func (w *watcher) mutate(host string) {
+	old := w.hosts[host]
+	wes := make([]*v1alpha3.WorkloadEntry, len(old))
+	copy(wes, old)
+	wes[w.rand.Intn(len(wes))] = infer.WorkloadEntry(w.address(), endpointPort)
+	w.hosts[host] = wes
+}
+
+// address hands out the next unused address in 10.0.0.0/8, wrapping around once exhausted
+func (w *watcher) address() string {
+	n := w.nextAddress % maxAddresses
+	w.nextAddress++
+	return fmt.Sprintf("10.%d.%d.%d", n>>16&0xff, n>>8&0xff, n&0xff)
+}
@@ -0,0 +1,119 @@
+package synthetic
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/fault"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+func TestNewWatcher(t *testing.T) {
+	tests := []struct {
+		name                        string
+		hosts, endpoints, mutations int
+		wantErr                     bool
+	}{
+		{name: "valid", hosts: 10, endpoints: 2, mutations: 3},
+		{name: "no hosts", hosts: 0, endpoints: 2, wantErr: true},
+		{name: "no endpoints", hosts: 10, endpoints: 0, wantErr: true},
+		{name: "more mutations than hosts", hosts: 10, endpoints: 2, mutations: 11, wantErr: true},
+		{name: "address space exhausted", hosts: 1 << 20, endpoints: 16, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWatcher(provider.NewStore(), tt.hosts, tt.endpoints, tt.mutations, 0)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewWatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatcher_refreshStore(t *testing.T) {
+	w := newWatcher(provider.NewStore(), 20, 3, 4, 1)
+	if len(w.hosts) != 20 {
+		t.Fatalf("got %d hosts, want 20", len(w.hosts))
+	}
+	w.store.Set(w.hosts)
+	before := w.store.Hosts()
+
+	if err := w.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	after := w.store.Hosts()
+	if len(after) != 20 {
+		t.Fatalf("got %d hosts after refresh, want 20", len(after))
+	}
+
+	changed := 0
+	for host, wes := range after {
+		if len(wes) != 3 {
+			t.Errorf("host %q has %d endpoints, want 3", host, len(wes))
+		}
+		if !reflect.DeepEqual(wes, before[host]) {
+			changed++
+		}
+	}
+	if changed != 4 {
+		t.Errorf("%d hosts changed, want 4", changed)
+	}
+
+	addresses := map[string]bool{}
+	for _, wes := range after {
+		for _, we := range wes {
+			if addresses[we.Address] {
+				t.Errorf("address %s is used by more than one endpoint", we.Address)
+			}
+			addresses[we.Address] = true
+			if !reflect.DeepEqual(we.Ports, map[string]uint32{"tcp": endpointPort}) {
+				t.Errorf("endpoint %s has ports %v", we.Address, we.Ports)
+			}
+		}
+	}
+}
+
+func TestWatcher_address(t *testing.T) {
+	w := &watcher{nextAddress: 256*256 + 256 + 1, hosts: map[string][]*v1alpha3.WorkloadEntry{}}
+	if got := w.address(); got != "10.1.1.1" {
+		t.Errorf("address() = %q, want %q", got, "10.1.1.1")
+	}
+	w.nextAddress = maxAddresses
+	if got := w.address(); got != "10.0.0.0" {
+		t.Errorf("address() = %q, want %q", got, "10.0.0.0")
+	}
+}
+
+func TestWatcher_faults(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    fault.Config
+		wantErr   bool
+		wantFewer bool
+	}{
+		{name: "failing refresh", config: fault.Config{ErrorRate: 1, Seed: 1}, wantErr: true},
+		{name: "partial hosts", config: fault.Config{PartialRate: 1, Seed: 1}, wantFewer: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := fault.New(tt.config, "synthetic-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := NewWatcher(provider.NewStore(), 20, 1, 0, 0, WithFaults(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Refresh(context.TODO())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := len(w.Store().Hosts()); tt.wantFewer && got >= 20 {
+				t.Errorf("store holds %d hosts, want fewer than 20", got)
+			}
+		})
+	}
+}
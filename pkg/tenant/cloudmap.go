@@ -0,0 +1,58 @@
+package tenant
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// CloudMapConfig lists Cloud Map watchers configured each on their own, as a tenant's Cloud Map provider is, to be
+	// served side by side outside of multi-tenant mode
+	CloudMapConfig struct {
+		Watchers []CloudMapWatcher `json:"watchers"`
+	}
+
+	// CloudMapWatcher is a Cloud Map registry, or one per account, read with settings of its own. Its ServiceEntries
+	// are prefixed with "cloudmap-<name>-".
+	CloudMapWatcher struct {
+		Name string `json:"name"`
+		CloudMap
+	}
+)
+
+// LoadCloudMap reads and validates the Cloud Map watchers in the YAML file at path
+func LoadCloudMap(path string) (*CloudMapConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read Cloud Map config %q", path)
+	}
+	return ParseCloudMap(data)
+}
+
+// ParseCloudMap validates the YAML Cloud Map watchers in data
+func ParseCloudMap(data []byte) (*CloudMapConfig, error) {
+	var c CloudMapConfig
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Cloud Map config")
+	}
+	if len(c.Watchers) == 0 {
+		return nil, errors.New("Cloud Map config lists no watchers")
+	}
+	names := make(map[string]bool, len(c.Watchers))
+	for i := range c.Watchers {
+		w := &c.Watchers[i]
+		if !validName.MatchString(w.Name) {
+			return nil, errors.Errorf("watcher %d: name %q must consist of lower case alphanumerics and '-'", i, w.Name)
+		}
+		if names[w.Name] {
+			return nil, errors.Errorf("watcher %q is listed more than once", w.Name)
+		}
+		names[w.Name] = true
+		if err := w.CloudMap.validate(); err != nil {
+			return nil, errors.Wrapf(err, "watcher %q", w.Name)
+		}
+	}
+	return &c, nil
+}
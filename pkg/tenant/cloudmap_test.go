@@ -0,0 +1,74 @@
+package tenant
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCloudMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []CloudMapWatcher
+		wantErr string
+	}{
+		{
+			name: "watchers",
+			config: `
+watchers:
+- name: prod
+  region: us-east-1
+  roleARN: arn:aws:iam::111111111111:role/cloudmap-reader
+  namespaces: [apps.local]
+  syncInterval: 30s
+  healthStatus: HEALTHY_OR_ELSE_ALL
+- name: staging
+  region: eu-west-1
+  endpointURL: http://localhost:4566
+`,
+			want: []CloudMapWatcher{
+				{Name: "prod", CloudMap: CloudMap{
+					AWS:          AWS{Region: "us-east-1", RoleARN: "arn:aws:iam::111111111111:role/cloudmap-reader"},
+					Namespaces:   []string{"apps.local"},
+					SyncInterval: v1.Duration{Duration: 30 * time.Second},
+					HealthStatus: "HEALTHY_OR_ELSE_ALL",
+				}},
+				{Name: "staging", CloudMap: CloudMap{AWS: AWS{Region: "eu-west-1"}, EndpointURL: "http://localhost:4566"}},
+			},
+		},
+		{name: "no watchers", config: "watchers: []", wantErr: "no watchers"},
+		{name: "invalid name", config: "watchers:\n- {name: Prod, region: us-east-1}", wantErr: "lower case"},
+		{
+			name:    "duplicate names",
+			config:  "watchers:\n- {name: prod, region: us-east-1}\n- {name: prod, region: eu-west-1}",
+			wantErr: "more than once",
+		},
+		{name: "unknown field", config: "watchers:\n- {name: prod, regoin: us-east-1}", wantErr: "regoin"},
+		{
+			name:    "invalid accounts",
+			config:  "watchers:\n- {name: prod, roleARN: 'arn:aws:iam::1:role/r', accounts: [{name: a}]}",
+			wantErr: "set them per account",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCloudMap([]byte(tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseCloudMap() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCloudMap() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Watchers, tt.want) {
+				t.Errorf("ParseCloudMap() = %+v, want %+v", got.Watchers, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package tenant
+
+import (
+	"io/ioutil"
+	"regexp"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// Config lists the tenants served by a single operator
+	Config struct {
+		Tenants []Tenant `json:"tenants"`
+	}
+
+	// Tenant is a logically isolated set of providers, publishing ServiceEntries with their own prefix, into their
+	// own namespace, under their own owner reference
+	Tenant struct {
+		Name string `json:"name"`
+		// Namespace ServiceEntries are published to
+		Namespace string `json:"namespace"`
+		// Prefix of the tenant's ServiceEntry names and metric labels, ahead of the provider's; defaults to "<name>-"
+		Prefix string `json:"prefix,omitempty"`
+		// MaxEndpoints is the tenant's endpoint budget, shared by its providers; zero means unlimited
+		MaxEndpoints int `json:"maxEndpoints,omitempty"`
+
+		CloudMap         *CloudMap         `json:"cloudmap,omitempty"`
+		Consul           *Consul           `json:"consul,omitempty"`
+		ServiceDirectory *ServiceDirectory `json:"serviceDirectory,omitempty"`
+		Synthetic        *Synthetic        `json:"synthetic,omitempty"`
+		ZooKeeper        *ZooKeeper        `json:"zookeeper,omitempty"`
+	}
+
+	// CloudMap configures a tenant's Cloud Map provider
+	CloudMap struct {
+		AWS
+		CallTimeout v1.Duration `json:"callTimeout,omitempty"`
+		// EndpointURL receives the API calls instead of the region's endpoint, as --cloudmap-endpoint-url
+		EndpointURL string `json:"endpointURL,omitempty"`
+		// FIPS and CABundleFile configure how AWS endpoints are called, as --aws-use-fips-endpoint and --aws-ca-bundle
+		FIPS         bool   `json:"fips,omitempty"`
+		CABundleFile string `json:"caBundleFile,omitempty"`
+		// ProxyURL, DialTimeout and TLSHandshakeTimeout configure the connections to AWS endpoints, as --aws-proxy-url,
+		// --aws-dial-timeout and --aws-tls-handshake-timeout
+		ProxyURL            string      `json:"proxyURL,omitempty"`
+		DialTimeout         v1.Duration `json:"dialTimeout,omitempty"`
+		TLSHandshakeTimeout v1.Duration `json:"tlsHandshakeTimeout,omitempty"`
+		// SyncInterval is how often the registry is read, as --cloudmap-sync-interval
+		SyncInterval v1.Duration `json:"syncInterval,omitempty"`
+		// FullSyncInterval is how often every service is discovered, as --cloudmap-full-sync-interval
+		FullSyncInterval v1.Duration `json:"fullSyncInterval,omitempty"`
+		// InstancesTTL is how long discovered instances are reused, as --cloudmap-instances-ttl
+		InstancesTTL v1.Duration `json:"instancesTTL,omitempty"`
+		// Concurrency is how many services' instances are discovered at once, as --cloudmap-concurrency
+		Concurrency int `json:"concurrency,omitempty"`
+		// BreakerFailures and BreakerProbeInterval configure the circuit breaker, as --cloudmap-breaker-failures and
+		// --cloudmap-breaker-probe-interval; BreakerFailures defaults to 5, and a negative number disables it
+		BreakerFailures      int         `json:"breakerFailures,omitempty"`
+		BreakerProbeInterval v1.Duration `json:"breakerProbeInterval,omitempty"`
+		// PartialRefresh keeps the hosts of namespaces failing a refresh, as --cloudmap-partial-refresh
+		PartialRefresh bool `json:"partialRefresh,omitempty"`
+		// ServiceAnnotations annotates ServiceEntries with their Cloud Map service, as --cloudmap-service-annotations
+		ServiceAnnotations bool `json:"serviceAnnotations,omitempty"`
+		// RequestsPerSecond and RequestBurst limit the API calls of each watcher, as --aws-requests-per-second and
+		// --aws-request-burst
+		RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+		RequestBurst      int     `json:"requestBurst,omitempty"`
+		// RetryMode, RetryMaxAttempts and RetryMaxBackoff configure retries of failed calls, as --aws-retry-mode,
+		// --aws-retry-max-attempts and --aws-retry-max-backoff
+		RetryMode        string      `json:"retryMode,omitempty"`
+		RetryMaxAttempts int         `json:"retryMaxAttempts,omitempty"`
+		RetryMaxBackoff  v1.Duration `json:"retryMaxBackoff,omitempty"`
+		// EventsQueueURL and ResyncInterval drive refreshes by events, as --aws-events-queue-url and
+		// --aws-events-resync-interval
+		EventsQueueURL string      `json:"eventsQueueURL,omitempty"`
+		ResyncInterval v1.Duration `json:"resyncInterval,omitempty"`
+		// Namespaces, by name or ID, are the only Cloud Map namespaces synced unless empty; ExcludeNamespaces never are
+		Namespaces        []string `json:"namespaces,omitempty"`
+		ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+		// NamespaceLookup looks up Namespaces rather than listing every namespace, as --aws-namespace-lookup
+		NamespaceLookup bool `json:"namespaceLookup,omitempty"`
+		// IncludeServices and ExcludeServices are regular expressions matching the names of the Cloud Map services
+		// synced and never synced, as --cloudmap-include-services and --cloudmap-exclude-services
+		IncludeServices string `json:"includeServices,omitempty"`
+		ExcludeServices string `json:"excludeServices,omitempty"`
+		// QueryParameters narrow the instances discovered of the services they're keyed by, by host in Cloud Map or *
+		// for every other service, as --cloudmap-query-parameters-file
+		QueryParameters map[string]CloudMapQuery `json:"queryParameters,omitempty"`
+		// HostSuffixes end the hosts of the namespaces they're keyed by, by name or ID, as --cloudmap-host-suffixes
+		HostSuffixes map[string]string `json:"hostSuffixes,omitempty"`
+		// Tag, as key=value or key, is carried by the services synced or their namespaces, as --cloudmap-tag
+		Tag string `json:"tag,omitempty"`
+		// HealthStatus of the instances synced, as --aws-health-status; defaults to HEALTHY
+		HealthStatus string `json:"healthStatus,omitempty"`
+		// PortAttributes are probed for the port of instances ahead of AWS_INSTANCE_PORT, as --cloudmap-port-attributes
+		PortAttributes []string `json:"portAttributes,omitempty"`
+		// WeightAttribute holds the weight of instances, as --cloudmap-weight-attribute
+		WeightAttribute string `json:"weightAttribute,omitempty"`
+		// LabelAttributes label the entries of instances by attribute, as --cloudmap-label-attributes
+		LabelAttributes map[string]string `json:"labelAttributes,omitempty"`
+		// HealthAttribute and UnhealthyValues leave out instances, as --cloudmap-health-attribute and
+		// --cloudmap-unhealthy-values; UnhealthyValues defaults to UNHEALTHY
+		HealthAttribute string   `json:"healthAttribute,omitempty"`
+		UnhealthyValues []string `json:"unhealthyValues,omitempty"`
+		// ResolveDNSNamespaces resolves the hosts of DNS namespaces through Route 53, as --cloudmap-resolve-dns-namespaces
+		ResolveDNSNamespaces bool `json:"resolveDNSNamespaces,omitempty"`
+		// Accounts are read instead of a single registry, each by a watcher of its own with the settings above
+		Accounts []CloudMapAccount `json:"accounts,omitempty"`
+	}
+
+	// CloudMapQuery are the attributes the instances of a Cloud Map service discovered have: all of Query, and all of
+	// Optional if any instance does
+	CloudMapQuery struct {
+		Query    map[string]string `json:"query,omitempty"`
+		Optional map[string]string `json:"optional,omitempty"`
+	}
+
+	// CloudMapAccount is a Cloud Map registry read alongside the tenant's others, with its own region, defaulting to
+	// the tenant's, and its own credentials. Its ServiceEntries are prefixed with "cloudmap-<name>-".
+	CloudMapAccount struct {
+		Name string `json:"name"`
+		AWS
+	}
+
+	// AWS configures the region Cloud Map is read in and the credentials it's read with
+	AWS struct {
+		Region          string `json:"region"`
+		AccessKeyID     string `json:"accessKeyID,omitempty"`
+		SecretAccessKey string `json:"secretAccessKey,omitempty"`
+		// Files holding the credentials, reloaded when rotated; they take precedence over the inline credentials
+		AccessKeyIDFile     string `json:"accessKeyIDFile,omitempty"`
+		SecretAccessKeyFile string `json:"secretAccessKeyFile,omitempty"`
+		SessionTokenFile    string `json:"sessionTokenFile,omitempty"`
+		// Vault generates the credentials instead
+		Vault *Vault `json:"vault,omitempty"`
+		// RoleARN is a role assumed with the credentials to read Cloud Map, as --aws-role-arn
+		RoleARN         string `json:"roleARN,omitempty"`
+		ExternalID      string `json:"externalID,omitempty"`
+		RoleSessionName string `json:"roleSessionName,omitempty"`
+		// WebIdentityTokenFile and WebIdentityRoleARN replace the default credential chain with IAM Roles for Service
+		// Accounts, as --aws-web-identity-token-file and --aws-web-identity-role-arn
+		WebIdentityTokenFile string `json:"webIdentityTokenFile,omitempty"`
+		WebIdentityRoleARN   string `json:"webIdentityRoleARN,omitempty"`
+	}
+
+	// Vault configures reading AWS credentials generated by Vault's AWS secrets engine
+	Vault struct {
+		Address         string `json:"address"`
+		CAFile          string `json:"caFile,omitempty"`
+		TokenFile       string `json:"tokenFile,omitempty"`
+		KubernetesRole  string `json:"kubernetesRole,omitempty"`
+		KubernetesMount string `json:"kubernetesMount,omitempty"`
+		AWSMount        string `json:"awsMount,omitempty"`
+		AWSRole         string `json:"awsRole"`
+	}
+
+	// Consul configures a tenant's Consul provider
+	Consul struct {
+		// Endpoint is the Consul API to read, or several comma-separated ones failed over between, as --consul-endpoint
+		Endpoint    string      `json:"endpoint"`
+		Namespace   string      `json:"namespace,omitempty"`
+		CallTimeout v1.Duration `json:"callTimeout,omitempty"`
+		// Concurrency is how many services are described at once, as --consul-concurrency
+		Concurrency int `json:"concurrency,omitempty"`
+		// MaxBackoff caps the wait between attempts while Consul keeps failing, as --consul-max-backoff
+		MaxBackoff v1.Duration `json:"maxBackoff,omitempty"`
+		// AllNamespaces syncs every namespace rather than Namespace, as --consul-all-namespaces
+		AllNamespaces bool `json:"allNamespaces,omitempty"`
+		// Peers also syncs the services cluster peers export, as --consul-peers
+		Peers bool `json:"peers,omitempty"`
+		// Partition is the admin partition to read, as --consul-partition
+		Partition string `json:"partition,omitempty"`
+		// HealthStatus is the worst check status of the instances synced, as --consul-health-status
+		HealthStatus string `json:"healthStatus,omitempty"`
+		// Filter is the expression the instances synced match, as --consul-filter
+		Filter string `json:"filter,omitempty"`
+		// ExcludeServices is a regular expression matching the names of the services never synced, and ExcludeTags
+		// the tags of those never synced, as --consul-exclude-services and --consul-exclude-tags
+		ExcludeServices string   `json:"excludeServices,omitempty"`
+		ExcludeTags     []string `json:"excludeTags,omitempty"`
+		// Connect syncs the Connect sidecar proxies of services rather than their instances, as --consul-connect
+		Connect bool `json:"connect,omitempty"`
+		// AgentServices syncs the services registered with the agent at Endpoint rather than the catalog's, as
+		// --consul-agent-services
+		AgentServices bool `json:"agentServices,omitempty"`
+		// ServiceAnnotations annotates ServiceEntries with their Consul service, as --consul-service-annotations
+		ServiceAnnotations bool `json:"serviceAnnotations,omitempty"`
+		// HostTemplate renders the hosts services are published as, as --consul-host-template
+		HostTemplate string `json:"hostTemplate,omitempty"`
+		// OverridesPrefix prefixes the KV keys overriding how services are synced, as --consul-overrides-prefix
+		OverridesPrefix string `json:"overridesPrefix,omitempty"`
+		// TaggedAddress names the tagged address to reach instances at, as --consul-tagged-address
+		TaggedAddress string `json:"taggedAddress,omitempty"`
+		// PortTags is a regular expression matching the tags naming further ports, as --consul-port-tags
+		PortTags string `json:"portTags,omitempty"`
+		// Consistency and MaxStale are the consistency mode of reads, as --consul-consistency and --consul-max-stale
+		Consistency string      `json:"consistency,omitempty"`
+		MaxStale    v1.Duration `json:"maxStale,omitempty"`
+		// ServiceWatches keeps a blocking query open on every service, as --consul-service-watches
+		ServiceWatches bool `json:"serviceWatches,omitempty"`
+		// HealthWatch keeps a blocking query open on every check, as --consul-health-watch
+		HealthWatch bool `json:"healthWatch,omitempty"`
+		// Token is a static ACL token, as --consul-token
+		Token string `json:"token,omitempty"`
+		// TokenFile holds the ACL token, reloaded when rotated, and takes precedence over Token
+		TokenFile string `json:"tokenFile,omitempty"`
+		// AuthMethod and AuthBearerTokenFile log in for the ACL token instead, as --consul-auth-method and
+		// --consul-auth-bearer-token-file
+		AuthMethod          string `json:"authMethod,omitempty"`
+		AuthBearerTokenFile string `json:"authBearerTokenFile,omitempty"`
+	}
+
+	// ServiceDirectory configures a tenant's Google Cloud Service Directory provider, as --gcp-project, --gcp-region,
+	// --gcp-credentials-file, --servicedirectory-namespaces, --servicedirectory-sync-interval and
+	// --servicedirectory-call-timeout
+	ServiceDirectory struct {
+		Project         string      `json:"project"`
+		Region          string      `json:"region"`
+		CredentialsFile string      `json:"credentialsFile,omitempty"`
+		Namespaces      []string    `json:"namespaces,omitempty"`
+		SyncInterval    v1.Duration `json:"syncInterval,omitempty"`
+		CallTimeout     v1.Duration `json:"callTimeout,omitempty"`
+	}
+
+	// ZooKeeper configures a tenant's ZooKeeper provider, as --zookeeper-servers, --zookeeper-layout, --zookeeper-root
+	// and --zookeeper-session-timeout
+	ZooKeeper struct {
+		Servers        []string    `json:"servers"`
+		Layout         string      `json:"layout,omitempty"`
+		Root           string      `json:"root,omitempty"`
+		SessionTimeout v1.Duration `json:"sessionTimeout,omitempty"`
+	}
+
+	// Synthetic configures a tenant's synthetic provider
+	Synthetic struct {
+		Hosts     int         `json:"hosts"`
+		Endpoints int         `json:"endpoints"`
+		Mutations int         `json:"mutations,omitempty"`
+		Interval  v1.Duration `json:"interval,omitempty"`
+	}
+)
+
+// names must be usable in ServiceEntry names and owner references
+var validName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Load reads and validates the tenant configuration in the YAML file at path
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read tenant config %q", path)
+	}
+	return Parse(data)
+}
+
+// Parse validates the YAML tenant configuration in data, defaulting tenants' prefixes
+func Parse(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse tenant config")
+	}
+	if len(c.Tenants) == 0 {
+		return nil, errors.New("tenant config lists no tenants")
+	}
+	names := make(map[string]bool, len(c.Tenants))
+	prefixes := make(map[string]string, len(c.Tenants))
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if !validName.MatchString(t.Name) {
+			return nil, errors.Errorf("tenant %d: name %q must consist of lower case alphanumerics and '-'", i, t.Name)
+		}
+		if names[t.Name] {
+			return nil, errors.Errorf("tenant %q is listed more than once", t.Name)
+		}
+		names[t.Name] = true
+		if t.Namespace == "" {
+			return nil, errors.Errorf("tenant %q: namespace is required", t.Name)
+		}
+		if t.Prefix == "" {
+			t.Prefix = t.Name + "-"
+		}
+		if other, ok := prefixes[t.Prefix]; ok {
+			return nil, errors.Errorf("tenants %q and %q share the prefix %q", other, t.Name, t.Prefix)
+		}
+		prefixes[t.Prefix] = t.Name
+		if t.CloudMap == nil && t.Consul == nil && t.ServiceDirectory == nil && t.Synthetic == nil &&
+			t.ZooKeeper == nil {
+			return nil, errors.Errorf("tenant %q: at least one of cloudmap, consul, serviceDirectory, synthetic or "+
+				"zookeeper is required", t.Name)
+		}
+		if zk := t.ZooKeeper; zk != nil && len(zk.Servers) == 0 {
+			return nil, errors.Errorf("tenant %q: zookeeper servers are required", t.Name)
+		}
+		if sd := t.ServiceDirectory; sd != nil && (sd.Project == "" || sd.Region == "") {
+			return nil, errors.Errorf("tenant %q: serviceDirectory project and region are required", t.Name)
+		}
+		if t.CloudMap != nil {
+			if err := t.CloudMap.validate(); err != nil {
+				return nil, errors.Wrapf(err, "tenant %q", t.Name)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// validate checks the credentials of c and its accounts, which are read with their own rather than c's
+func (c *CloudMap) validate() error {
+	if len(c.Accounts) == 0 {
+		return c.AWS.validate("cloudmap")
+	}
+	if c.AWS.credentials() {
+		return errors.New("cloudmap credentials and roles apply to a single registry, set them per account instead")
+	}
+	if c.EventsQueueURL != "" {
+		return errors.New("cloudmap eventsQueueURL receives the events of a single registry, it can't be combined with accounts")
+	}
+	names := make(map[string]bool, len(c.Accounts))
+	for i, a := range c.Accounts {
+		if !validName.MatchString(a.Name) {
+			return errors.Errorf("cloudmap account %d: name %q must consist of lower case alphanumerics and '-'", i, a.Name)
+		}
+		if names[a.Name] {
+			return errors.Errorf("cloudmap account %q is listed more than once", a.Name)
+		}
+		names[a.Name] = true
+		if err := a.AWS.validate("cloudmap account " + a.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AWS) validate(field string) error {
+	if a.Vault != nil && a.Vault.AWSRole == "" {
+		return errors.Errorf("%s: vault.awsRole is required", field)
+	}
+	return nil
+}
+
+// credentials returns whether a sets any credentials or role, rather than only a region
+func (a *AWS) credentials() bool {
+	return a.AccessKeyID != "" || a.SecretAccessKey != "" || a.AccessKeyIDFile != "" || a.SecretAccessKeyFile != "" ||
+		a.SessionTokenFile != "" || a.Vault != nil || a.RoleARN != "" || a.ExternalID != "" || a.RoleSessionName != "" ||
+		a.WebIdentityTokenFile != "" || a.WebIdentityRoleARN != ""
+}
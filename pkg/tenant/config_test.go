@@ -0,0 +1,160 @@
+package tenant
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []Tenant
+		wantErr string
+	}{
+		{
+			name: "defaults prefixes",
+			config: `
+tenants:
+- name: team-a
+  namespace: a
+  cloudmap:
+    region: us-east-1
+    callTimeout: 5s
+- name: team-b
+  namespace: b
+  prefix: b-
+  maxEndpoints: 100
+  consul:
+    endpoint: http://consul:8500
+`,
+			want: []Tenant{{Name: "team-a", Namespace: "a", Prefix: "team-a-"}, {Name: "team-b", Namespace: "b", Prefix: "b-", MaxEndpoints: 100}},
+		},
+		{name: "no tenants", config: "tenants: []", wantErr: "no tenants"},
+		{name: "unknown field", config: "tenants:\n- name: a\n  namespaces: a", wantErr: "unknown field"},
+		{name: "invalid name", config: "tenants:\n- name: Team_A\n  namespace: a", wantErr: "lower case"},
+		{name: "missing namespace", config: "tenants:\n- name: a\n  synthetic: {hosts: 1}", wantErr: "namespace is required"},
+		{name: "missing provider", config: "tenants:\n- name: a\n  namespace: a", wantErr: "at least one of"},
+		{
+			name:    "zookeeper without servers",
+			config:  "tenants:\n- {name: a, namespace: a, zookeeper: {layout: dubbo}}",
+			wantErr: "zookeeper servers are required",
+		},
+		{
+			name:    "vault without role",
+			config:  "tenants:\n- {name: a, namespace: a, cloudmap: {region: us-east-1, vault: {address: 'http://vault:8200'}}}",
+			wantErr: "awsRole is required",
+		},
+		{
+			name:    "duplicate names",
+			config:  "tenants:\n- {name: a, namespace: a, synthetic: {hosts: 1}}\n- {name: a, namespace: b, synthetic: {hosts: 1}}",
+			wantErr: "more than once",
+		},
+		{
+			name:    "shared prefix",
+			config:  "tenants:\n- {name: a, namespace: a, synthetic: {hosts: 1}}\n- {name: b, namespace: b, prefix: a-, synthetic: {hosts: 1}}",
+			wantErr: "share the prefix",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if len(got.Tenants) != len(tt.want) {
+				t.Fatalf("Parse() returned %d tenants, want %d", len(got.Tenants), len(tt.want))
+			}
+			for i, want := range tt.want {
+				g := got.Tenants[i]
+				if g.Name != want.Name || g.Namespace != want.Namespace || g.Prefix != want.Prefix || g.MaxEndpoints != want.MaxEndpoints {
+					t.Errorf("tenant %d = %+v, want %+v", i, g, want)
+				}
+			}
+			if timeout := got.Tenants[0].CloudMap.CallTimeout.Duration; timeout != 5*time.Second {
+				t.Errorf("cloudmap call timeout = %v, want 5s", timeout)
+			}
+		})
+	}
+}
+
+func TestParse_cloudMapAccounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []CloudMapAccount
+		wantErr string
+	}{
+		{
+			name: "accounts",
+			config: `
+tenants:
+- name: a
+  namespace: a
+  cloudmap:
+    region: us-east-1
+    accounts:
+    - name: prod
+      roleARN: arn:aws:iam::111111111111:role/cloudmap-reader
+    - name: staging
+      region: eu-west-1
+      accessKeyIDFile: /etc/aws/id
+      secretAccessKeyFile: /etc/aws/key
+`,
+			want: []CloudMapAccount{
+				{Name: "prod", AWS: AWS{RoleARN: "arn:aws:iam::111111111111:role/cloudmap-reader"}},
+				{Name: "staging", AWS: AWS{Region: "eu-west-1", AccessKeyIDFile: "/etc/aws/id", SecretAccessKeyFile: "/etc/aws/key"}},
+			},
+		},
+		{
+			name:    "invalid name",
+			config:  "tenants:\n- {name: a, namespace: a, cloudmap: {region: us-east-1, accounts: [{name: Prod}]}}",
+			wantErr: "lower case",
+		},
+		{
+			name:    "duplicate names",
+			config:  "tenants:\n- {name: a, namespace: a, cloudmap: {region: us-east-1, accounts: [{name: prod}, {name: prod}]}}",
+			wantErr: "more than once",
+		},
+		{
+			name:    "shared credentials",
+			config:  "tenants:\n- {name: a, namespace: a, cloudmap: {region: us-east-1, roleARN: 'arn:aws:iam::1:role/r', accounts: [{name: prod}]}}",
+			wantErr: "set them per account",
+		},
+		{
+			name:    "events",
+			config:  "tenants:\n- {name: a, namespace: a, cloudmap: {eventsQueueURL: 'https://sqs.us-east-1.amazonaws.com/1/q', accounts: [{name: prod}]}}",
+			wantErr: "single registry",
+		},
+		{
+			name:    "vault without role",
+			config:  "tenants:\n- {name: a, namespace: a, cloudmap: {accounts: [{name: prod, vault: {address: 'http://vault:8200'}}]}}",
+			wantErr: "awsRole is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if accounts := got.Tenants[0].CloudMap.Accounts; !reflect.DeepEqual(accounts, tt.want) {
+				t.Errorf("cloudmap accounts = %+v, want %+v", accounts, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package testing
+
+import (
+	"context"
+	"sort"
+	"sync"
+	stdtesting "testing"
+
+	"github.com/pkg/errors"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icfake "istio.io/client-go/pkg/clientset/versioned/fake"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+	"github.com/tetratelabs/istio-registry-sync/pkg/registrysync"
+	"github.com/tetratelabs/istio-registry-sync/pkg/serviceentry"
+)
+
+var serviceEntryResource = schema.GroupVersionResource{
+	Group:    "networking.istio.io",
+	Version:  "v1alpha3",
+	Resource: "serviceentries",
+}
+
+// Cluster is an in-memory Kubernetes cluster with Istio's resources, backed by client-go's fake clientsets
+type Cluster struct {
+	Istio *icfake.Clientset
+	Kube  *fake.Clientset
+
+	m      sync.Mutex
+	stores []serviceentry.Store // told about every ServiceEntry written, as an informer would
+}
+
+// NewCluster returns an empty cluster
+func NewCluster() *Cluster {
+	c := &Cluster{Istio: icfake.NewSimpleClientset(), Kube: fake.NewSimpleClientset()}
+	for _, verb := range []string{"create", "update", "delete"} {
+		c.Istio.PrependReactor(verb, serviceEntryResource.Resource, c.write)
+	}
+	return c
+}
+
+// write applies a write to a ServiceEntry, then tells the stores of the cluster's sinks before returning, so a
+// sync always sees the writes of the previous one
+func (c *Cluster) write(action k8stesting.Action) (bool, runtime.Object, error) {
+	var name string
+	switch a := action.(type) {
+	case k8stesting.UpdateAction:
+		name = a.GetObject().(*v1alpha3.ServiceEntry).Name
+	case k8stesting.DeleteAction:
+		name = a.GetName()
+	}
+	var old *v1alpha3.ServiceEntry
+	if name != "" {
+		if obj, err := c.Istio.Tracker().Get(serviceEntryResource, action.GetNamespace(), name); err == nil {
+			old = obj.(*v1alpha3.ServiceEntry)
+		}
+	}
+	_, obj, err := k8stesting.ObjectReaction(c.Istio.Tracker())(action)
+	if err != nil {
+		return true, obj, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, s := range c.stores {
+		switch {
+		case action.GetVerb() == "delete":
+			_ = s.Delete(old)
+		case old == nil:
+			_ = s.Insert(obj.(*v1alpha3.ServiceEntry))
+		default:
+			_ = s.Update(old, obj.(*v1alpha3.ServiceEntry))
+		}
+	}
+	return true, obj, nil
+}
+
+// watch tells store about the cluster's ServiceEntries, and about every one written from now on
+func (c *Cluster) watch(store serviceentry.Store) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	list, err := c.Istio.Tracker().List(serviceEntryResource,
+		v1alpha3.SchemeGroupVersion.WithKind("ServiceEntry"), v1.NamespaceAll)
+	if err != nil {
+		return err
+	}
+	for _, se := range list.(*v1alpha3.ServiceEntryList).Items {
+		_ = store.Insert(se)
+	}
+	c.stores = append(c.stores, store)
+	return nil
+}
+
+// ServiceEntrySink returns a sink publishing every host as a ServiceEntry in namespace, like
+// registrysync.ServiceEntries, except that its publishers learn about ServiceEntries as they're written rather than
+// through an informer, and only sync when asked to
+func (c *Cluster) ServiceEntrySink(namespace string, opts ...control.Option) registrysync.Sink {
+	return registrysync.SinkFunc(func(owner v1.OwnerReference, store provider.Store, prefix string) (registrysync.Publisher, error) {
+		istio := serviceentry.New(owner, serviceentry.WithPrefix(prefix))
+		if err := c.watch(istio); err != nil {
+			return nil, err
+		}
+		synchronizer := control.NewSynchronizer(owner, istio, store, prefix,
+			c.Istio.NetworkingV1alpha3().ServiceEntries(namespace), opts...)
+		return publisher{synchronizer}, nil
+	})
+}
+
+// synchronizer is what publisher needs of control's synchronizer
+type synchronizer interface {
+	Sync(ctx context.Context) control.Result
+	Ready() error
+}
+
+// publisher syncs a synchronizer when asked to, and never on its own
+type publisher struct {
+	synchronizer
+}
+
+func (p publisher) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (p publisher) Sync(ctx context.Context) error {
+	res := p.synchronizer.Sync(ctx)
+	if len(res.Errors) > 0 {
+		return errors.Errorf("failed to write %d Service Entries, the first: %v", len(res.Errors), res.Errors[0])
+	}
+	return nil
+}
+
+// CreateServiceEntry creates se, e.g. to define a host the way someone else would
+func (c *Cluster) CreateServiceEntry(t stdtesting.TB, se *v1alpha3.ServiceEntry) {
+	t.Helper()
+	if _, err := c.Istio.NetworkingV1alpha3().ServiceEntries(se.Namespace).Create(context.TODO(), se, v1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create ServiceEntry %s/%s: %v", se.Namespace, se.Name, err)
+	}
+}
+
+// ServiceEntries returns the ServiceEntries in namespace by name
+func (c *Cluster) ServiceEntries(t stdtesting.TB, namespace string) map[string]*v1alpha3.ServiceEntry {
+	t.Helper()
+	list, err := c.Istio.NetworkingV1alpha3().ServiceEntries(namespace).List(context.TODO(), v1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list ServiceEntries in %q: %v", namespace, err)
+	}
+	entries := make(map[string]*v1alpha3.ServiceEntry, len(list.Items))
+	for _, se := range list.Items {
+		entries[se.Name] = se
+	}
+	return entries
+}
+
+// Endpoints returns the sorted addresses of the ServiceEntry named name in namespace, or nil if there's none
+func (c *Cluster) Endpoints(t stdtesting.TB, namespace, name string) []string {
+	t.Helper()
+	se, err := c.Istio.NetworkingV1alpha3().ServiceEntries(namespace).Get(context.TODO(), name, v1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("failed to get ServiceEntry %s/%s: %v", namespace, name, err)
+	}
+	addresses := make([]string, 0, len(se.Spec.Endpoints))
+	for _, we := range se.Spec.Endpoints {
+		addresses = append(addresses, we.Address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
@@ -0,0 +1,119 @@
+// Package testing runs registrysync end to end without a cluster or a registry, for tests of new providers and
+// sinks: a Cluster fakes Kubernetes and Istio in memory, a Provider is a registry the test scripts, and a Harness
+// syncs them when the test says so.
+//
+//	p := testing.NewProvider("test-")
+//	h := testing.Start(t, []registrysync.Provider{p})
+//	p.Register("a.tetrate.io", "10.0.0.1", 80)
+//	h.Sync(t)
+//	h.Endpoints(t, p, "a.tetrate.io") // [10.0.0.1]
+package testing
+
+import (
+	"context"
+	stdtesting "testing"
+	"time"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/registrysync"
+)
+
+// Namespace is where a harness publishes ServiceEntries unless it's given sinks
+const Namespace = "istio-system"
+
+// Harness runs a registrysync.Syncer against a Cluster for the duration of a test
+type Harness struct {
+	Cluster *Cluster
+	Syncer  *registrysync.Syncer
+}
+
+// Option configures a Harness
+type Option func(*options)
+
+type options struct {
+	cluster *Cluster
+	sinks   func(*Cluster) []registrysync.Sink
+}
+
+// WithCluster runs the harness against c instead of an empty cluster, e.g. one with ServiceEntries created already
+func WithCluster(c *Cluster) Option {
+	return func(o *options) {
+		o.cluster = c
+	}
+}
+
+// WithSinks publishes through the sinks returns for the harness's cluster, instead of as ServiceEntries in Namespace
+func WithSinks(sinks func(*Cluster) []registrysync.Sink) Option {
+	return func(o *options) {
+		o.sinks = sinks
+	}
+}
+
+// Start runs providers until the test ends. Nothing is published until Sync, except by sinks given WithSinks that
+// publish periodically on their own.
+func Start(t stdtesting.TB, providers []registrysync.Provider, opts ...Option) *Harness {
+	t.Helper()
+	o := options{sinks: func(c *Cluster) []registrysync.Sink {
+		return []registrysync.Sink{c.ServiceEntrySink(Namespace)}
+	}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.cluster == nil {
+		o.cluster = NewCluster()
+	}
+	h := &Harness{
+		Cluster: o.cluster,
+		Syncer:  registrysync.New(registrysync.Config{ID: "test", Providers: providers, Sinks: o.sinks(o.cluster)}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		runErr = h.Syncer.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	// Ready fails until Run has built the pipelines
+	deadline := time.Now().Add(5 * time.Second)
+	for err := h.Syncer.Ready(); err != nil; err = h.Syncer.Ready() {
+		select {
+		case <-done:
+			t.Fatalf("failed to run the syncer: %v", runErr)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the syncer isn't ready: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return h
+}
+
+// Sync refreshes every provider and publishes the result, failing the test if that fails
+func (h *Harness) Sync(t stdtesting.TB) {
+	t.Helper()
+	if err := h.Syncer.Refresh(context.TODO()); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+}
+
+// Flap flaps the instance of host at address times times, syncing after each, e.g. to check a flapping instance
+// isn't published
+func (h *Harness) Flap(t stdtesting.TB, p *Provider, host, address string, port uint32, times int) {
+	t.Helper()
+	for i := 0; i < times; i++ {
+		p.Flap(host, address, port)
+		h.Sync(t)
+	}
+}
+
+// Endpoints returns the sorted addresses p's ServiceEntry of host has in Namespace, or nil if there's none
+func (h *Harness) Endpoints(t stdtesting.TB, p registrysync.Provider, host string) []string {
+	t.Helper()
+	return h.Cluster.Endpoints(t, Namespace, infer.ServiceEntryName(p.Prefix(), host))
+}
@@ -0,0 +1,113 @@
+package testing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/control"
+	"github.com/tetratelabs/istio-registry-sync/pkg/kubeservice"
+	"github.com/tetratelabs/istio-registry-sync/pkg/registrysync"
+)
+
+func TestHarness_registerDeregister(t *testing.T) {
+	p := NewProvider("test-")
+	h := Start(t, []registrysync.Provider{p})
+
+	p.Register("a.tetrate.io", "10.0.0.1", 80)
+	p.Register("a.tetrate.io", "10.0.0.2", 80)
+	p.Register("b.tetrate.io", "10.0.0.3", 443)
+	h.Sync(t)
+	if got, want := h.Endpoints(t, p, "a.tetrate.io"), []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a.tetrate.io endpoints = %v, want %v", got, want)
+	}
+	if got, want := h.Endpoints(t, p, "b.tetrate.io"), []string{"10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("b.tetrate.io endpoints = %v, want %v", got, want)
+	}
+
+	// deregistering right after a sync must not depend on anything catching up with its writes
+	p.Deregister("a.tetrate.io", "10.0.0.1")
+	p.Deregister("b.tetrate.io", "10.0.0.3")
+	h.Sync(t)
+	if got, want := h.Endpoints(t, p, "a.tetrate.io"), []string{"10.0.0.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a.tetrate.io endpoints = %v, want %v", got, want)
+	}
+	if got := h.Endpoints(t, p, "b.tetrate.io"); got != nil {
+		t.Errorf("b.tetrate.io endpoints = %v, want its ServiceEntry deleted", got)
+	}
+}
+
+func TestHarness_theirs(t *testing.T) {
+	c := NewCluster()
+	c.CreateServiceEntry(t, &v1alpha3.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "theirs",
+			Namespace:       "default",
+			OwnerReferences: []v1.OwnerReference{registrysync.OwnerReference("someone-else")},
+		},
+		Spec: networking.ServiceEntry{Hosts: []string{"a.tetrate.io"}},
+	})
+	p := NewProvider("test-")
+	h := Start(t, []registrysync.Provider{p}, WithCluster(c))
+
+	p.Register("a.tetrate.io", "10.0.0.1", 80)
+	h.Sync(t)
+	if got := h.Endpoints(t, p, "a.tetrate.io"); got != nil {
+		t.Errorf("a.tetrate.io endpoints = %v, want it left to its ServiceEntry in default", got)
+	}
+}
+
+func TestHarness_Flap(t *testing.T) {
+	p := NewProvider("test-")
+	h := Start(t, []registrysync.Provider{p}, WithSinks(func(c *Cluster) []registrysync.Sink {
+		return []registrysync.Sink{c.ServiceEntrySink(Namespace, control.WithFlapDamping(3))}
+	}))
+
+	p.Register("a.tetrate.io", "10.0.0.1", 80)
+	h.Sync(t)
+	h.Flap(t, p, "a.tetrate.io", "10.0.0.2", 80, 5)
+	if got, want := h.Endpoints(t, p, "a.tetrate.io"), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a.tetrate.io endpoints = %v, want %v", got, want)
+	}
+}
+
+func TestHarness_Fail(t *testing.T) {
+	p := NewProvider("test-")
+	h := Start(t, []registrysync.Provider{p})
+
+	p.Register("a.tetrate.io", "10.0.0.1", 80)
+	p.Fail(errors.New("registry unreachable"))
+	if err := h.Syncer.Refresh(context.TODO()); err == nil {
+		t.Error("Refresh() succeeded, want the provider's error")
+	}
+	if got := h.Endpoints(t, p, "a.tetrate.io"); got != nil {
+		t.Errorf("a.tetrate.io endpoints = %v before a successful refresh", got)
+	}
+	p.Fail(nil)
+	h.Sync(t)
+	if got, want := h.Endpoints(t, p, "a.tetrate.io"), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a.tetrate.io endpoints = %v, want %v", got, want)
+	}
+}
+
+func TestHarness_sinks(t *testing.T) {
+	p := NewProvider("test-")
+	h := Start(t, []registrysync.Provider{p}, WithSinks(func(c *Cluster) []registrysync.Sink {
+		return []registrysync.Sink{registrysync.Services(c.Kube, "default")}
+	}))
+
+	p.Register("a.tetrate.io", "10.0.0.1", 80)
+	h.Sync(t)
+	name := kubeservice.ServiceName("test-", "a.tetrate.io")
+	if _, err := h.Cluster.Kube.CoreV1().Services("default").Get(context.TODO(), name, v1.GetOptions{}); err != nil {
+		t.Errorf("Service %q: %v", name, err)
+	}
+	if got := h.Cluster.ServiceEntries(t, Namespace); len(got) != 0 {
+		t.Errorf("got ServiceEntries %v, want none without their sink", got)
+	}
+}
@@ -0,0 +1,110 @@
+package testing
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// Provider is a provider whose hosts change only when the test registers or deregisters instances. Changes reach
+// its store on the next refresh, as they would reach a real provider's on its next poll.
+type Provider struct {
+	prefix string
+	store  provider.Store
+
+	m     sync.Mutex
+	hosts map[string]map[string]*v1alpha3.WorkloadEntry // instances by host and address
+	err   error                                         // returned by Refresh, if not nil
+}
+
+// NewProvider returns a provider with no hosts, whose ServiceEntries are named with prefix
+func NewProvider(prefix string) *Provider {
+	return &Provider{
+		prefix: prefix,
+		store:  provider.NewStore(),
+		hosts:  make(map[string]map[string]*v1alpha3.WorkloadEntry),
+	}
+}
+
+// Register adds an instance of host at address, replacing the instance already there, if any
+func (p *Provider) Register(host, address string, port uint32) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.hosts[host] == nil {
+		p.hosts[host] = make(map[string]*v1alpha3.WorkloadEntry)
+	}
+	p.hosts[host][address] = infer.WorkloadEntry(address, port)
+}
+
+// Deregister removes the instance of host at address; the host goes away with its last instance
+func (p *Provider) Deregister(host, address string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.hosts[host], address)
+	if len(p.hosts[host]) == 0 {
+		delete(p.hosts, host)
+	}
+}
+
+// Registered returns whether host has an instance at address
+func (p *Provider) Registered(host, address string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	_, ok := p.hosts[host][address]
+	return ok
+}
+
+// Flap deregisters the instance of host at address if it's registered, and registers it otherwise
+func (p *Provider) Flap(host, address string, port uint32) {
+	if p.Registered(host, address) {
+		p.Deregister(host, address)
+	} else {
+		p.Register(host, address, port)
+	}
+}
+
+// Fail makes refreshes fail with err, leaving the store as it is, until Fail is called with nil
+func (p *Provider) Fail(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.err = err
+}
+
+// Run refreshes the store once, then waits for the context to be cancelled; later changes are synced by Refresh
+func (p *Provider) Run(ctx context.Context) {
+	_ = p.Refresh(ctx)
+	<-ctx.Done()
+}
+
+// Refresh sets the store to the registered instances, sorted by address
+func (p *Provider) Refresh(context.Context) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, len(p.hosts))
+	for host, instances := range p.hosts {
+		wes := make([]*v1alpha3.WorkloadEntry, 0, len(instances))
+		for _, we := range instances {
+			wes = append(wes, we)
+		}
+		sort.Slice(wes, func(i, j int) bool { return wes[i].Address < wes[j].Address })
+		hosts[host] = wes
+	}
+	p.store.Set(hosts)
+	return nil
+}
+
+func (p *Provider) Store() provider.Store {
+	return p.store
+}
+
+func (p *Provider) Prefix() string {
+	return p.prefix
+}
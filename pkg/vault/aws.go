@@ -0,0 +1,185 @@
+// Package vault obtains short-lived AWS credentials from Vault's AWS secrets engine, so Cloud Map can be read
+// without static IAM user keys.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+)
+
+const (
+	defaultAWSMount            = "aws"
+	defaultKubernetesMount     = "kubernetes"
+	defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	requestTimeout             = 30 * time.Second
+)
+
+// Config selects the Vault server, how we authenticate to it and the AWS secrets engine role to read
+type Config struct {
+	// Address of the Vault server, e.g. https://vault.vault:8200
+	Address string
+	// CAFile is a PEM bundle to verify the server's certificate with, instead of the system roots
+	CAFile string
+	// Token authenticates to Vault; ignored if KubernetesRole is set
+	Token *secret.File
+	// KubernetesRole logs in with the pod's service account token using Vault's Kubernetes auth method
+	KubernetesRole string
+	// KubernetesMount is the path the Kubernetes auth method is mounted at; defaults to "kubernetes"
+	KubernetesMount string
+	// KubernetesTokenPath is the service account token to log in with; defaults to the one mounted into the pod
+	KubernetesTokenPath string
+	// AWSMount is the path the AWS secrets engine is mounted at; defaults to "aws"
+	AWSMount string
+	// AWSRole is the secrets engine role to generate credentials for
+	AWSRole string
+}
+
+// NewAWSCredentials returns AWS credentials generated by Vault. They're cached until two thirds of their lease
+// has passed, then replaced by a new set, so they're rotated well before Vault revokes them.
+func NewAWSCredentials(c Config) (aws.CredentialsProvider, error) {
+	if c.Address == "" {
+		return nil, errors.New("Vault address must be specified")
+	}
+	if c.AWSRole == "" {
+		return nil, errors.New("Vault AWS secrets engine role must be specified")
+	}
+	if c.Token == nil && c.KubernetesRole == "" {
+		return nil, errors.New("either a Vault token or a Kubernetes auth role must be specified")
+	}
+	if c.AWSMount == "" {
+		c.AWSMount = defaultAWSMount
+	}
+	if c.KubernetesMount == "" {
+		c.KubernetesMount = defaultKubernetesMount
+	}
+	if c.KubernetesTokenPath == "" {
+		c.KubernetesTokenPath = defaultKubernetesTokenPath
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read Vault CA bundle %q", c.CAFile)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in Vault CA bundle %q", c.CAFile)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+	return aws.NewCredentialsCache(&awsCredentials{config: c, client: client}), nil
+}
+
+type awsCredentials struct {
+	config Config
+	client *http.Client
+}
+
+// response is the envelope of Vault's API responses
+type response struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int64           `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (a *awsCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	token, err := a.token(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	resp, err := a.do(ctx, http.MethodGet, "/v1/"+a.config.AWSMount+"/creds/"+a.config.AWSRole, token, nil)
+	if err != nil {
+		return aws.Credentials{}, errors.Wrapf(err, "failed to generate AWS credentials for Vault role %q", a.config.AWSRole)
+	}
+	var data struct {
+		AccessKey     string `json:"access_key"`
+		SecretKey     string `json:"secret_key"`
+		SecurityToken string `json:"security_token"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return aws.Credentials{}, errors.Wrap(err, "failed to decode the AWS credentials from Vault")
+	}
+	if data.AccessKey == "" || data.SecretKey == "" {
+		return aws.Credentials{}, errors.Errorf("Vault role %q returned no AWS credentials", a.config.AWSRole)
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     data.AccessKey,
+		SecretAccessKey: data.SecretKey,
+		SessionToken:    data.SecurityToken,
+		Source:          "Vault",
+	}
+	if resp.LeaseDuration > 0 {
+		lease := time.Duration(resp.LeaseDuration) * time.Second
+		creds.CanExpire = true
+		creds.Expires = time.Now().Add(lease * 2 / 3)
+	}
+	log.Infof("obtained AWS credentials from Vault lease %q for %s", resp.LeaseID,
+		time.Duration(resp.LeaseDuration)*time.Second)
+	return creds, nil
+}
+
+// token returns a Vault token, logging in with the Kubernetes auth method if configured. Credentials are only
+// generated once per lease, so logging in each time saves tracking the Vault token's own expiry.
+func (a *awsCredentials) token(ctx context.Context) (string, error) {
+	if a.config.KubernetesRole == "" {
+		return a.config.Token.Value(), nil
+	}
+	jwt, err := ioutil.ReadFile(a.config.KubernetesTokenPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the service account token to log in to Vault with")
+	}
+	body, err := json.Marshal(map[string]string{"role": a.config.KubernetesRole, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.do(ctx, http.MethodPost, "/v1/auth/"+a.config.KubernetesMount+"/login", "", body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to log in to Vault as Kubernetes role %q", a.config.KubernetesRole)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", errors.Errorf("Vault login as Kubernetes role %q returned no token", a.config.KubernetesRole)
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+func (a *awsCredentials) do(ctx context.Context, method, path, token string, body []byte) (*response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.config.Address, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	r, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	var resp response
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode Vault response with status %q", r.Status)
+	}
+	if r.StatusCode != http.StatusOK {
+		if len(resp.Errors) > 0 {
+			return nil, errors.Errorf("%s: %s", r.Status, strings.Join(resp.Errors, "; "))
+		}
+		return nil, errors.New(r.Status)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,125 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/secret"
+)
+
+// fakeVault serves Kubernetes auth logins for the "sa-jwt" service account token, and credentials of the "cloudmap"
+// role of the AWS secrets engine to the "root" and logged in tokens
+func fakeVault(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var login map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["jwt"] != "sa-jwt" || login["role"] != "registry-sync" {
+				rw.WriteHeader(http.StatusForbidden)
+				_, _ = rw.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"auth":{"client_token":"logged-in"}}`))
+		case "/v1/aws/creds/cloudmap":
+			if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "logged-in" {
+				rw.WriteHeader(http.StatusForbidden)
+				_, _ = rw.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"lease_id":"aws/creds/cloudmap/1","lease_duration":900,
+				"data":{"access_key":"ASIA1","secret_key":"secret","security_token":"session"}}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			_, _ = rw.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestNewAWSCredentials(t *testing.T) {
+	server := fakeVault(t)
+	defer server.Close()
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	token := func(value string) *secret.File {
+		f, err := secret.Watch(ctx, write("token-"+value, value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	jwt := write("jwt", "sa-jwt\n")
+
+	tests := []struct {
+		name      string
+		config    Config
+		wantError bool
+	}{
+		{name: "token auth", config: Config{Address: server.URL, Token: token("root"), AWSRole: "cloudmap"}},
+		{
+			name:   "kubernetes auth",
+			config: Config{Address: server.URL, KubernetesRole: "registry-sync", KubernetesTokenPath: jwt, AWSRole: "cloudmap"},
+		},
+		{name: "denied token", config: Config{Address: server.URL, Token: token("guest"), AWSRole: "cloudmap"}, wantError: true},
+		{
+			name:      "denied login",
+			config:    Config{Address: server.URL, KubernetesRole: "other", KubernetesTokenPath: jwt, AWSRole: "cloudmap"},
+			wantError: true,
+		},
+		{name: "unknown role", config: Config{Address: server.URL, Token: token("root"), AWSRole: "ec2"}, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := NewAWSCredentials(tt.config)
+			if err != nil {
+				t.Fatalf("NewAWSCredentials() error = %v", err)
+			}
+			got, err := creds.Retrieve(ctx)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("Retrieve() error = %v, wantError %v", err, tt.wantError)
+			}
+			if tt.wantError {
+				return
+			}
+			if got.AccessKeyID != "ASIA1" || got.SecretAccessKey != "secret" || got.SessionToken != "session" {
+				t.Errorf("Retrieve() = %+v, want the credentials Vault generated", got)
+			}
+			// rotated with a third of the 15m lease left
+			if !got.CanExpire || got.Expires.After(time.Now().Add(10*time.Minute)) || got.Expires.Before(time.Now().Add(9*time.Minute)) {
+				t.Errorf("Retrieve() expires at %v, want in 10m", got.Expires)
+			}
+		})
+	}
+}
+
+func TestNewAWSCredentials_config(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no address", config: Config{KubernetesRole: "registry-sync", AWSRole: "cloudmap"}},
+		{name: "no role", config: Config{Address: "http://vault:8200", KubernetesRole: "registry-sync"}},
+		{name: "no auth", config: Config{Address: "http://vault:8200", AWSRole: "cloudmap"}},
+		{name: "missing CA", config: Config{Address: "https://vault:8200", CAFile: "/nonexistent", KubernetesRole: "registry-sync", AWSRole: "cloudmap"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAWSCredentials(tt.config); err == nil {
+				t.Error("NewAWSCredentials() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/go-zookeeper/zk"
+	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// curatorInstance is an instance registered by Curator's service discovery, as its znode holds it
+type curatorInstance struct {
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Port    *int   `json:"port"`
+	SSLPort *int   `json:"sslPort"`
+	// Enabled is only written by Curator 5 and later, so instances without it are enabled
+	Enabled *bool `json:"enabled"`
+	// Payload is up to the registering application; Spring Cloud Zookeeper and Dubbo write an object whose
+	// metadata is a map of strings
+	Payload json.RawMessage `json:"payload"`
+}
+
+// curatorPayload is the payload Spring Cloud Zookeeper and Dubbo register instances with
+type curatorPayload struct {
+	Metadata map[string]string `json:"metadata"`
+}
+
+// curatorHosts reads the services of the Curator layout, <root>/<service>/<instance id>, returning the instances it
+// dropped alongside
+func (w *watcher) curatorHosts(ctx context.Context) (map[string][]*v1alpha3.WorkloadEntry, []provider.Dropped, error) {
+	services, err := w.children(ctx, w.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, len(services))
+	var dropped []provider.Dropped
+	for _, svc := range services {
+		host := serviceHost(svc)
+		if host == "" {
+			continue
+		}
+		ids, err := w.children(ctx, w.root+"/"+svc)
+		if err != nil {
+			return nil, nil, err
+		}
+		var wes []*v1alpha3.WorkloadEntry
+		for _, id := range ids {
+			data, err := w.data(ctx, w.root+"/"+svc+"/"+id)
+			if err == zk.ErrNoNode {
+				// deregistered since its service was listed
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			we, drop := curatorWorkloadEntry(host, id, data)
+			if drop != nil {
+				dropped = append(dropped, *drop)
+			}
+			if we != nil {
+				wes = append(wes, we)
+			}
+		}
+		if len(wes) > 0 {
+			hosts[host] = wes
+		}
+	}
+	return hosts, dropped, nil
+}
+
+// curatorWorkloadEntry converts the instance of host registered as id with data, or returns why it's dropped
+func curatorWorkloadEntry(host, id string, data []byte) (*v1alpha3.WorkloadEntry, *provider.Dropped) {
+	var instance curatorInstance
+	if err := json.Unmarshal(data, &instance); err != nil {
+		log.Infof("instance %s of %s isn't a Curator instance: %v", id, host, err)
+		return nil, &provider.Dropped{Host: host, ID: id, Reason: provider.DroppedUnsupported,
+			Detail: "not a Curator instance"}
+	}
+	if instance.Enabled != nil && !*instance.Enabled {
+		log.Debugf("instance %s of %s is disabled", id, host)
+		return nil, nil
+	}
+	if instance.Address == "" {
+		log.Infof("instance %s of %s has no address", id, host)
+		return nil, &provider.Dropped{Host: host, ID: id, Reason: provider.DroppedUnsupported, Detail: "no address"}
+	}
+	we := &v1alpha3.WorkloadEntry{Address: instance.Address, Ports: make(map[string]uint32, 2)}
+	if instance.Port != nil && *instance.Port > 0 {
+		port := uint32(*instance.Port)
+		we.Ports[infer.Proto(port)] = port
+	}
+	if instance.SSLPort != nil && *instance.SSLPort > 0 {
+		port := uint32(*instance.SSLPort)
+		if _, ok := we.Ports["https"]; ok {
+			we.Ports["https-"+strconv.Itoa(*instance.SSLPort)] = port
+		} else {
+			we.Ports["https"] = port
+		}
+	}
+	if len(we.Ports) == 0 {
+		log.Infof("no port found for address %v, assuming http (80) and https (443)", instance.Address)
+		we.Ports = map[string]uint32{"http": 80, "https": 443}
+	}
+	var payload curatorPayload
+	if len(instance.Payload) > 0 && json.Unmarshal(instance.Payload, &payload) == nil {
+		we.Labels = labels(payload.Metadata)
+	}
+	return we, nil
+}
+
+// labels returns the TLS labels of metadata along with the rest of it, leaving out keys and values that aren't valid
+// as labels
+func labels(metadata map[string]string) map[string]string {
+	l := infer.TLSLabels(metadata)
+	for key, value := range metadata {
+		if key == "tls" || key == "tls-sni" || key == "tls-credential-name" ||
+			len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+		if l == nil {
+			l = make(map[string]string, len(metadata))
+		}
+		l[key] = value
+	}
+	return l
+}
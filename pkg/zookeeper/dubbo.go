@@ -0,0 +1,124 @@
+package zookeeper
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// dubboLabels are the parameters of a provider URL copied into the labels of its WorkloadEntry
+var dubboLabels = []string{"application", "group", "version", "release"}
+
+// dubboPortNames name the ports of the Dubbo protocols Istio knows of, e.g. Triple, which is compatible with gRPC;
+// ports of other protocols, e.g. dubbo itself, are synced as TCP
+var dubboPortNames = map[string]string{"tri": "grpc", "grpc": "grpc", "rest": "http", "http": "http"}
+
+// dubboHosts reads the providers of the Dubbo layout, <root>/<interface>/providers/<URL>, returning the providers it
+// dropped alongside. Interfaces are published as hosts named after them, e.g. org.example.greeter.
+func (w *watcher) dubboHosts(ctx context.Context) (map[string][]*v1alpha3.WorkloadEntry, []provider.Dropped, error) {
+	interfaces, err := w.children(ctx, w.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, len(interfaces))
+	var dropped []provider.Dropped
+	for _, iface := range interfaces {
+		categories, err := w.children(ctx, w.root+"/"+iface)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Dubbo 3 keeps its config, metadata and mapping alongside the interfaces, which have no providers
+		if !contains(categories, "providers") {
+			continue
+		}
+		host := serviceHost(iface)
+		if host == "" {
+			continue
+		}
+		providers, err := w.children(ctx, w.root+"/"+iface+"/providers")
+		if err != nil {
+			return nil, nil, err
+		}
+		var wes []*v1alpha3.WorkloadEntry
+		for _, p := range providers {
+			we, drop := dubboWorkloadEntry(host, p)
+			if drop != nil {
+				dropped = append(dropped, *drop)
+			}
+			if we != nil {
+				wes = append(wes, we)
+			}
+		}
+		if len(wes) > 0 {
+			hosts[host] = wes
+		}
+	}
+	return hosts, dropped, nil
+}
+
+// dubboWorkloadEntry converts the provider of host registered as the URL-encoded URL p, or returns why it's dropped
+func dubboWorkloadEntry(host, p string) (*v1alpha3.WorkloadEntry, *provider.Dropped) {
+	raw, err := url.QueryUnescape(p)
+	if err != nil {
+		raw = p
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		log.Infof("provider %s of %s isn't a Dubbo URL", p, host)
+		return nil, &provider.Dropped{Host: host, ID: p, Reason: provider.DroppedUnsupported,
+			Detail: "not a Dubbo URL"}
+	}
+	params := u.Query()
+	if params.Get("enabled") == "false" {
+		log.Debugf("provider %s of %s is disabled", u.Host, host)
+		return nil, nil
+	}
+	if category := params.Get("category"); category != "" && category != "providers" {
+		return nil, nil
+	}
+	we := &v1alpha3.WorkloadEntry{Address: u.Hostname()}
+	var drop *provider.Dropped
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || port == 0 {
+		log.Infof("no port found for address %v, assuming http (80) and https (443)", u.Hostname())
+		we.Ports = map[string]uint32{"http": 80, "https": 443}
+		if u.Port() != "" {
+			drop = &provider.Dropped{Host: host, ID: u.Host, Reason: provider.DroppedInvalidPort, Detail: u.Port()}
+		}
+	} else if name, ok := dubboPortNames[strings.ToLower(u.Scheme)]; ok {
+		we.Ports = map[string]uint32{name: uint32(port)}
+	} else {
+		we.Ports = map[string]uint32{"tcp": uint32(port)}
+	}
+	if weight := params.Get("weight"); weight != "" {
+		if w, err := strconv.ParseUint(weight, 10, 32); err == nil {
+			we.Weight = uint32(w)
+		} else if drop == nil {
+			drop = &provider.Dropped{Host: host, ID: u.Host, Reason: provider.DroppedInvalidWeight, Detail: weight}
+		}
+	}
+	for _, key := range dubboLabels {
+		if value := params.Get(key); value != "" && len(validation.IsValidLabelValue(value)) == 0 {
+			if we.Labels == nil {
+				we.Labels = make(map[string]string, len(dubboLabels))
+			}
+			we.Labels[key] = value
+		}
+	}
+	return we, drop
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package zookeeper
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// Layouts of the services registered in ZooKeeper
+const (
+	// LayoutCurator is the layout of Curator's service discovery, used by Spring Cloud Zookeeper and Dubbo 3's
+	// application-level discovery: <root>/<service>/<instance id> znodes holding the instance as JSON
+	LayoutCurator = "curator"
+	// LayoutDubbo is the layout of Dubbo's interface-level registry: <root>/<interface>/providers/<URL> znodes naming
+	// a provider of the interface by their URL-encoded URL
+	LayoutDubbo = "dubbo"
+)
+
+const (
+	defaultSessionTimeout = 10 * time.Second
+	// settleDelay is how long the watcher waits after a watch fires before syncing, so a burst of changes is synced
+	// at once
+	settleDelay = 200 * time.Millisecond
+	// retryInterval is how long the watcher waits before syncing again after a sync fails
+	retryInterval = 5 * time.Second
+)
+
+// defaultRoots are the znodes each layout registers services under by default
+var defaultRoots = map[string]string{LayoutCurator: "/services", LayoutDubbo: "/dubbo"}
+
+// conn is the subset of the ZooKeeper client the watcher reads with
+type conn interface {
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Close()
+}
+
+var _ conn = &zk.Conn{}
+
+// znode is what the watcher read of a znode, cached until the watch set by the read fires
+type znode struct {
+	children []string
+	data     []byte
+}
+
+// watcher syncs the services registered in a ZooKeeper ensemble into its store, reading again the znodes whose
+// watches fire
+type watcher struct {
+	store          provider.Store
+	prefix         string
+	servers        []string
+	layout         string
+	root           string
+	sessionTimeout time.Duration
+	drops          *provider.Drops
+	conn           conn
+	changes        chan struct{} // signalled when a watch fires
+
+	refreshing sync.Mutex // serializes syncs triggered by watches and on demand
+	m          sync.Mutex // guards cache
+	cache      map[string]*znode
+}
+
+var _ provider.Watcher = &watcher{}
+var _ provider.Checker = &watcher{}
+var _ provider.DroppedLister = &watcher{}
+
+// Option configures a ZooKeeper watcher
+type Option func(*watcher)
+
+// WithPrefix names the watcher's ServiceEntries, and labels its metrics, with prefix instead of the default
+// "zookeeper-"
+func WithPrefix(prefix string) Option {
+	return func(w *watcher) {
+		w.prefix = prefix
+	}
+}
+
+// WithLayout reads the services registered in layout, LayoutCurator or LayoutDubbo, rather than the default
+// LayoutCurator
+func WithLayout(layout string) Option {
+	return func(w *watcher) {
+		w.layout = layout
+	}
+}
+
+// WithRoot reads the services registered under the znode at root rather than the layout's default, /services for
+// LayoutCurator and /dubbo for LayoutDubbo
+func WithRoot(root string) Option {
+	return func(w *watcher) {
+		w.root = root
+	}
+}
+
+// WithSessionTimeout asks ZooKeeper for sessions of timeout rather than the default 10 seconds. Reads are bounded by
+// the session timeout too.
+func WithSessionTimeout(timeout time.Duration) Option {
+	return func(w *watcher) {
+		w.sessionTimeout = timeout
+	}
+}
+
+// NewWatcher returns a watcher of the services registered in the ZooKeeper ensemble of servers, given as host:port
+func NewWatcher(store provider.Store, servers []string, opts ...Option) (provider.Watcher, error) {
+	w, err := newWatcher(store, servers, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// connecting is asynchronous, reads wait for the session
+	w.conn, _, err = zk.Connect(servers, w.sessionTimeout, zk.WithLogger(zkLogger{}), zk.WithEventCallback(logSession))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to ZooKeeper")
+	}
+	return w, nil
+}
+
+// newWatcher returns a watcher configured by opts, yet to be connected
+func newWatcher(store provider.Store, servers []string, opts ...Option) (*watcher, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("ZooKeeper servers not specified")
+	}
+	w := &watcher{
+		store:          store,
+		prefix:         "zookeeper-",
+		servers:        servers,
+		layout:         LayoutCurator,
+		sessionTimeout: defaultSessionTimeout,
+		changes:        make(chan struct{}, 1),
+		cache:          make(map[string]*znode),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if _, ok := defaultRoots[w.layout]; !ok {
+		return nil, errors.Errorf("unknown ZooKeeper layout %q, want %s or %s", w.layout, LayoutCurator, LayoutDubbo)
+	}
+	if w.root == "" {
+		w.root = defaultRoots[w.layout]
+	}
+	if !strings.HasPrefix(w.root, "/") {
+		return nil, errors.Errorf("ZooKeeper root %q must be an absolute path", w.root)
+	}
+	w.root = path.Clean(w.root)
+	if w.sessionTimeout <= 0 {
+		return nil, errors.Errorf("ZooKeeper session timeout %v must be positive", w.sessionTimeout)
+	}
+	w.drops = provider.NewDrops(w.prefix)
+	return w, nil
+}
+
+// zkLogger logs the ZooKeeper client's messages, mostly about its connections, at debug level
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	log.Debugf(format, args...)
+}
+
+// logSession logs the changes of state of the ZooKeeper session
+func logSession(ev zk.Event) {
+	if ev.Type != zk.EventSession {
+		return
+	}
+	switch ev.State {
+	case zk.StateHasSession:
+		log.Infof("ZooKeeper session established with %s", ev.Server)
+	case zk.StateDisconnected:
+		log.Warnf("disconnected from ZooKeeper server %s", ev.Server)
+	case zk.StateExpired:
+		log.Warn("ZooKeeper session expired, reading every znode again in a new one")
+	}
+}
+
+func (w *watcher) Store() provider.Store {
+	return w.store
+}
+
+func (w *watcher) Prefix() string {
+	return w.prefix
+}
+
+// Dropped lists the instances of the last successful sync that aren't synced as ZooKeeper describes them
+func (w *watcher) Dropped() []provider.Dropped {
+	return w.drops.List()
+}
+
+// Run the watcher until the context is cancelled, syncing whenever the watch of a znode read fires
+func (w *watcher) Run(ctx context.Context) {
+	defer w.conn.Close()
+
+	// Initial sync on startup
+	w.changed()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.changes:
+			select {
+			case <-time.After(settleDelay):
+			case <-ctx.Done():
+				return
+			}
+			// changes while settling are synced now
+			select {
+			case <-w.changes:
+			default:
+			}
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+		retry = nil
+		if err := w.refreshStore(ctx); err != nil {
+			log.Errorf("failed to refresh the ZooKeeper store, retrying in %v: %v", retryInterval, err)
+			retry = time.After(retryInterval)
+		}
+	}
+}
+
+// Refresh syncs ZooKeeper into the store once
+func (w *watcher) Refresh(ctx context.Context) error {
+	return w.refreshStore(ctx)
+}
+
+// Check verifies a server of the ensemble can be reached and the root of the layout exists
+func (w *watcher) Check(ctx context.Context) error {
+	var exists bool
+	err := w.call(ctx, func() (err error) {
+		// the watch set is cleared by the first change, or the end of the session
+		exists, _, _, err = w.conn.ExistsW(w.root)
+		return err
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.Errorf("no ZooKeeper server of %s reached within %v", strings.Join(w.servers, ","),
+			w.sessionTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read ZooKeeper znode %s", w.root)
+	}
+	if !exists {
+		return errors.Errorf("no ZooKeeper znode %s; is the %s layout registered under another root?", w.root,
+			w.layout)
+	}
+	return nil
+}
+
+// refreshStore reads the services registered in the layout and replaces the store's hosts with them, keeping the
+// store as last synced if any read fails
+func (w *watcher) refreshStore(ctx context.Context) error {
+	w.refreshing.Lock()
+	defer w.refreshing.Unlock()
+
+	log.Info("Syncing ZooKeeper store")
+	var hosts map[string][]*v1alpha3.WorkloadEntry
+	var dropped []provider.Dropped
+	var err error
+	switch w.layout {
+	case LayoutDubbo:
+		hosts, dropped, err = w.dubboHosts(ctx)
+	default:
+		hosts, dropped, err = w.curatorHosts(ctx)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error reading the %s layout under %s", w.layout, w.root)
+	}
+	log.Infof("ZooKeeper store sync successful with %d hosts", len(hosts))
+	w.drops.Set(dropped)
+	w.store.Set(hosts)
+	w.store.Synced()
+	return nil
+}
+
+// serviceHost returns the host a service of the layout is published as, or an empty string if its name can't be one
+func serviceHost(name string) string {
+	host := strings.ToLower(name)
+	if problems := validation.IsDNS1123Subdomain(host); len(problems) > 0 {
+		log.Infof("not syncing service %q, its name isn't a valid host: %s", name, strings.Join(problems, ", "))
+		return ""
+	}
+	return host
+}
+
+// children returns the sorted children of the znode at p, or none if there's no such znode
+func (w *watcher) children(ctx context.Context, p string) ([]string, error) {
+	n, err := w.read(ctx, "children:"+p, func() (*znode, <-chan zk.Event, error) {
+		children, _, events, err := w.conn.ChildrenW(p)
+		if err != zk.ErrNoNode {
+			sort.Strings(children)
+			return &znode{children: children}, events, err
+		}
+		if p != w.root {
+			// the parent's watch fires on its deletion
+			return nil, nil, err
+		}
+		// watch for the root to be created, until then it has no children
+		exists, _, events, err := w.conn.ExistsW(p)
+		if err == nil && exists {
+			return nil, nil, errors.Errorf("znode %s created while listing its children", p)
+		}
+		return &znode{}, events, err
+	})
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the children of %s", p)
+	}
+	return n.children, nil
+}
+
+// data returns the data of the znode at p, or zk.ErrNoNode if there's no such znode
+func (w *watcher) data(ctx context.Context, p string) ([]byte, error) {
+	n, err := w.read(ctx, "data:"+p, func() (*znode, <-chan zk.Event, error) {
+		data, _, events, err := w.conn.GetW(p)
+		return &znode{data: data}, events, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n.data, nil
+}
+
+// read returns the znode cached as key, or else reads it with fetch and caches it until the watch fetch set fires
+func (w *watcher) read(ctx context.Context, key string, fetch func() (*znode, <-chan zk.Event, error)) (*znode, error) {
+	w.m.Lock()
+	n, ok := w.cache[key]
+	w.m.Unlock()
+	if ok {
+		return n, nil
+	}
+	err := w.call(ctx, func() error {
+		// caches even when the call outlives ctx, as the watch is set regardless
+		fetched, events, err := fetch()
+		if err != nil {
+			return err
+		}
+		w.m.Lock()
+		w.cache[key] = fetched
+		w.m.Unlock()
+		go w.invalidate(key, events)
+		n = fetched
+		return nil
+	})
+	if err != nil {
+		// n is only set once f returns without error
+		return nil, err
+	}
+	return n, nil
+}
+
+// invalidate drops the znode cached as key once its watch fires, be it for a change or because the session ended,
+// and has the watcher sync again
+func (w *watcher) invalidate(key string, events <-chan zk.Event) {
+	ev := <-events
+	log.Debugf("%s changed: %v", key, ev.Type)
+	w.m.Lock()
+	delete(w.cache, key)
+	w.m.Unlock()
+	w.changed()
+}
+
+// changed has the watcher sync, unless a sync is pending already
+func (w *watcher) changed() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+// call runs f, returning early if ctx is done or the session timeout passes first. Calls wait for the session to be
+// established, but f must leave nothing for its caller to clean up when it returns late.
+func (w *watcher) call(ctx context.Context, f func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, w.sessionTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
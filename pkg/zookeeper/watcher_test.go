@@ -0,0 +1,320 @@
+package zookeeper
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-registry-sync/pkg/infer"
+	"github.com/tetratelabs/istio-registry-sync/pkg/provider"
+)
+
+// fakeConn is a ZooKeeper tree of znodes by path, firing the watches set on a znode when it changes
+type fakeConn struct {
+	m       sync.Mutex
+	znodes  map[string][]byte
+	reads   int
+	watches map[string][]chan zk.Event
+}
+
+func newFakeConn(znodes map[string]string) *fakeConn {
+	c := &fakeConn{znodes: map[string][]byte{"/": nil}, watches: make(map[string][]chan zk.Event)}
+	for p, data := range znodes {
+		c.set(p, data)
+	}
+	return c
+}
+
+// set creates or updates the znode at p, and its parents
+func (c *fakeConn) set(p, data string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for parent := path.Dir(p); ; parent = path.Dir(parent) {
+		if _, ok := c.znodes[parent]; ok {
+			break
+		}
+		c.znodes[parent] = nil
+		c.fire(path.Dir(parent), zk.EventNodeChildrenChanged)
+	}
+	_, ok := c.znodes[p]
+	c.znodes[p] = []byte(data)
+	if ok {
+		c.fire(p, zk.EventNodeDataChanged)
+	} else {
+		c.fire(p, zk.EventNodeCreated)
+		c.fire(path.Dir(p), zk.EventNodeChildrenChanged)
+	}
+}
+
+// delete deletes the znode at p
+func (c *fakeConn) delete(p string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.znodes, p)
+	c.fire(p, zk.EventNodeDeleted)
+	c.fire(path.Dir(p), zk.EventNodeChildrenChanged)
+}
+
+func (c *fakeConn) fire(p string, t zk.EventType) {
+	for _, ch := range c.watches[p] {
+		ch <- zk.Event{Type: t, Path: p}
+		close(ch)
+	}
+	delete(c.watches, p)
+}
+
+func (c *fakeConn) watch(p string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	c.watches[p] = append(c.watches[p], ch)
+	return ch
+}
+
+func (c *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.reads++
+	if _, ok := c.znodes[p]; !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for child := range c.znodes {
+		if child != "/" && path.Dir(child) == p {
+			children = append(children, path.Base(child))
+		}
+	}
+	return children, &zk.Stat{}, c.watch(p), nil
+}
+
+func (c *fakeConn) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.reads++
+	data, ok := c.znodes[p]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{}, c.watch(p), nil
+}
+
+func (c *fakeConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.reads++
+	_, ok := c.znodes[p]
+	return ok, &zk.Stat{}, c.watch(p), nil
+}
+
+func (c *fakeConn) Close() {}
+
+// dubboProvider returns the znode name Dubbo registers the provider at url under
+func dubboProvider(u string) string {
+	return url.QueryEscape(u)
+}
+
+func TestWatcher_Refresh(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		znodes      map[string]string
+		want        map[string][]*v1alpha3.WorkloadEntry
+		wantDropped []provider.Dropped
+	}{
+		{
+			name: "curator",
+			znodes: map[string]string{
+				"/services/web/b": `{"name": "web", "id": "b", "address": "10.0.0.2", "port": 8080, "sslPort": 8443,
+					"payload": {"@class": "org.springframework.cloud.zookeeper.discovery.ZookeeperInstance",
+					"metadata": {"version": "v2", "tls": "true", "invalid label": "x"}}}`,
+				"/services/web/a":        `{"name": "web", "id": "a", "address": "10.0.0.1", "port": 8080}`,
+				"/services/web/c":        `{"name": "web", "id": "c", "port": 8080}`,
+				"/services/web/disabled": `{"name": "web", "id": "disabled", "address": "10.0.0.3", "enabled": false}`,
+				"/services/Billing/a":    `{"name": "Billing", "id": "a", "address": "10.1.0.1", "payload": "opaque"}`,
+				"/services/bad_name/a":   `{"name": "bad_name", "id": "a", "address": "10.2.0.1"}`,
+				"/services/garbage/a":    `not json`,
+				"/services/empty":        "",
+			},
+			want: map[string][]*v1alpha3.WorkloadEntry{
+				"web": {
+					{Address: "10.0.0.1", Ports: map[string]uint32{"tcp": 8080}},
+					{Address: "10.0.0.2", Ports: map[string]uint32{"tcp": 8080, "https": 8443},
+						Labels: map[string]string{"version": "v2", infer.TLSModeLabel: "SIMPLE"}},
+				},
+				"billing": {{Address: "10.1.0.1", Ports: map[string]uint32{"http": 80, "https": 443}}},
+			},
+			wantDropped: []provider.Dropped{
+				{Host: "garbage", ID: "a", Reason: provider.DroppedUnsupported, Detail: "not a Curator instance"},
+				{Host: "web", ID: "c", Reason: provider.DroppedUnsupported, Detail: "no address"},
+			},
+		},
+		{
+			name: "curator root",
+			opts: []Option{WithRoot("/apps/")},
+			znodes: map[string]string{
+				"/apps/web/a":     `{"name": "web", "id": "a", "address": "10.0.0.1", "port": 80}`,
+				"/services/web/b": `{"name": "web", "id": "b", "address": "10.0.0.2", "port": 80}`,
+			},
+			want: map[string][]*v1alpha3.WorkloadEntry{
+				"web": {{Address: "10.0.0.1", Ports: map[string]uint32{"http": 80}}},
+			},
+			wantDropped: []provider.Dropped{},
+		},
+		{
+			name:        "no root",
+			znodes:      map[string]string{"/dubbo/org.example.Greeter/providers": ""},
+			want:        map[string][]*v1alpha3.WorkloadEntry{},
+			wantDropped: []provider.Dropped{},
+		},
+		{
+			name: "dubbo",
+			opts: []Option{WithLayout(LayoutDubbo)},
+			znodes: map[string]string{
+				"/dubbo/org.example.Greeter/configurators": "",
+				"/dubbo/org.example.Idle/providers":        "",
+				"/dubbo/mapping/org.example.Greeter":       "greeter",
+				"/dubbo/metadata/org.example.Greeter":      "{}",
+
+				"/dubbo/org.example.Greeter/providers/" + dubboProvider("dubbo://10.0.0.1:20880/org.example.Greeter?"+
+					"application=greeter&interface=org.example.Greeter&methods=hello,bye&version=1.0.0&weight=50"): "",
+				"/dubbo/org.example.Greeter/providers/" + dubboProvider("tri://10.0.0.2:50051/org.example.Greeter?"+
+					"application=greeter&group=canary&weight=heavy"): "",
+				"/dubbo/org.example.Greeter/providers/" + dubboProvider("dubbo://10.0.0.3:20880/org.example.Greeter?"+
+					"enabled=false"): "",
+				"/dubbo/org.example.Greeter/consumers/" + dubboProvider("consumer://10.9.0.1/org.example.Greeter"): "",
+			},
+			want: map[string][]*v1alpha3.WorkloadEntry{
+				"org.example.greeter": {
+					{Address: "10.0.0.1", Ports: map[string]uint32{"tcp": 20880}, Weight: 50,
+						Labels: map[string]string{"application": "greeter", "version": "1.0.0"}},
+					{Address: "10.0.0.2", Ports: map[string]uint32{"grpc": 50051},
+						Labels: map[string]string{"application": "greeter", "group": "canary"}},
+				},
+			},
+			wantDropped: []provider.Dropped{{Host: "org.example.greeter", ID: "10.0.0.2:50051",
+				Reason: provider.DroppedInvalidWeight, Detail: "heavy"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := provider.NewStore()
+			w, err := newWatcher(store, []string{"zk:2181"}, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.conn = newFakeConn(tt.znodes)
+			if err := w.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if got := store.Hosts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+			if got := w.Dropped(); !reflect.DeepEqual(got, tt.wantDropped) {
+				t.Errorf("Dropped() = %v, want %v", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestWatcher_Run(t *testing.T) {
+	conn := newFakeConn(map[string]string{
+		"/services/web/a": `{"address": "10.0.0.1", "port": 80}`,
+	})
+	store := provider.NewStore()
+	w, err := newWatcher(store, []string{"zk:2181"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.conn = conn
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	// waitFor waits for the store to hold the addresses of want by host; comparing the WorkloadEntries themselves
+	// would race with the store comparing them
+	waitFor := func(want map[string][]string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !reflect.DeepEqual(addresses(store.Hosts()), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("addresses = %v, want %v", addresses(store.Hosts()), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(map[string][]string{"web": {"10.0.0.1"}})
+	conn.m.Lock()
+	reads := conn.reads
+	conn.m.Unlock()
+
+	conn.set("/services/web/b", `{"address": "10.0.0.2", "port": 80}`)
+	waitFor(map[string][]string{"web": {"10.0.0.1", "10.0.0.2"}})
+	conn.set("/services/web/a", `{"address": "10.0.0.3", "port": 80}`)
+	waitFor(map[string][]string{"web": {"10.0.0.3", "10.0.0.2"}})
+	conn.delete("/services/web/b")
+	conn.set("/services/api/a", `{"address": "10.1.0.1", "port": 80}`)
+	waitFor(map[string][]string{"web": {"10.0.0.3"}, "api": {"10.1.0.1"}})
+
+	// only the znodes whose watches fired are read again: web's children and the data of its instances twice each, then
+	// the root, api's children and its instance once each
+	conn.m.Lock()
+	defer conn.m.Unlock()
+	if got := conn.reads - reads; got != 7 {
+		t.Errorf("%d znodes read after the initial sync, want 7", got)
+	}
+}
+
+func addresses(hosts map[string][]*v1alpha3.WorkloadEntry) map[string][]string {
+	byHost := make(map[string][]string, len(hosts))
+	for host, wes := range hosts {
+		for _, we := range wes {
+			byHost[host] = append(byHost[host], we.Address)
+		}
+	}
+	return byHost
+}
+
+func TestNewWatcher_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []string
+		opts    []Option
+		want    string
+	}{
+		{name: "no servers", want: "servers not specified"},
+		{name: "layout", servers: []string{"zk:2181"}, opts: []Option{WithLayout("eureka")}, want: "unknown"},
+		{name: "relative root", servers: []string{"zk:2181"}, opts: []Option{WithRoot("services")}, want: "absolute"},
+		{name: "session timeout", servers: []string{"zk:2181"}, opts: []Option{WithSessionTimeout(0)},
+			want: "positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewWatcher(provider.NewStore(), tt.servers, tt.opts...); err == nil ||
+				!strings.Contains(err.Error(), tt.want) {
+				t.Errorf("NewWatcher() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_Check(t *testing.T) {
+	w, err := newWatcher(provider.NewStore(), []string{"zk:2181"}, WithLayout(LayoutDubbo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newFakeConn(map[string]string{"/services/web/a": "{}"})
+	w.conn = conn
+	if err := w.Check(context.Background()); err == nil || !strings.Contains(err.Error(), "no ZooKeeper znode /dubbo") {
+		t.Errorf("Check() error = %v, want the missing root", err)
+	}
+	conn.set("/dubbo/org.example.Greeter/providers", "")
+	if err := w.Check(context.Background()); err != nil {
+		t.Errorf("Check() error = %v", err)
+	}
+}